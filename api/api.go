@@ -1,11 +1,19 @@
 package api
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/DanielePalaia/object-storage-service/auth"
 	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/lifecycle"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/ratelimit"
+	"github.com/DanielePalaia/object-storage-service/replication"
 	"github.com/gorilla/mux"
 )
 
@@ -18,31 +26,91 @@ import (
 // @Param bucket path string true "Bucket name"
 // @Param objectID path string true "Object ID"
 // @Param data body string true "Object data"
+// @Param X-Expires header string false "Expiry time of the object (HTTP date or RFC 3339)"
+// @Param X-TTL header string false "Time to live of the object (seconds or Go duration)"
+// @Param X-Tagging header string false "Object tags, URL-encoded (k1=v1&k2=v2)"
+// @Param Content-MD5 header string false "Base64 MD5 of the object"
+// @Param X-Checksum-CRC32C header string false "Base64 CRC-32C of the object"
+// @Param X-Checksum-SHA1 header string false "Base64 SHA-1 of the object"
+// @Param X-Checksum-SHA256 header string false "Base64 SHA-256 of the object"
 // @Success 201 {object} map[string]string "Created"
-// @Failure 400 {string} string "Bad Request"
+// @Failure 400 {object} ErrorResponse "Checksum mismatch (BadDigest) or malformed (InvalidDigest)"
+// @Failure 403 {object} ErrorResponse "Tenant quota exceeded"
+// @Failure 413 {object} ErrorResponse "Object too large"
 // @Failure 500 {string} string "Internal Server Error"
+// @Failure 507 {object} ErrorResponse "Bucket quota exceeded"
 // @Router /objects/{bucket}/{objectID} [put]
-func putObjectHandler(storage domain.Storage) http.HandlerFunc {
+func putObjectHandler(storage domain.Storage, o *options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		bucket := vars["bucket"]
 		objectID := vars["objectID"]
 
-		data, err := io.ReadAll(r.Body)
+		// Only principals with the replication role upload replicas
+		replica := auth.PrincipalFrom(r.Context()).HasRole(auth.RoleReplication)
+		meta, err := objectMetadataFromHeaders(r.Header, time.Now(), replica)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		checksums, err := newUploadChecksums(r)
+		if err != nil {
+			writeDigestError(w, err)
+			return
+		}
+
+		// The size is checked before reading the body so that clients sending
+		// "Expect: 100-continue" are rejected before uploading anything
+		if o.sizeLimits != nil {
+			if max := o.sizeLimits.For(bucket); max > 0 {
+				if r.ContentLength > max {
+					writeError(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "object exceeds the maximum size of "+strconv.FormatInt(max, 10)+" bytes")
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+		}
+
+		var body io.Reader = r.Body
+		if o.bandwidth != nil {
+			transfer := o.bandwidth.Start(r.Context(), principalKey(r), ratelimit.Upload)
+			defer transfer.Done()
+			body = transfer.Reader(body)
+		}
+		body = checksums.Reader(body)
+
+		data, err := io.ReadAll(body)
 		if err != nil {
 			log.Println("Request error:", err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", "object exceeds the maximum size of "+strconv.FormatInt(maxBytesErr.Limit, 10)+" bytes")
+				return
+			}
 			http.Error(w, "unable to read request body", http.StatusBadRequest)
 			return
 		}
 		defer r.Body.Close()
 
-		_, err = storage.Put(bucket, objectID, data)
+		// Trailing checksums are only available once the body is read
+		if err := checksums.Verify(r.Trailer); err != nil {
+			log.Println("Request error:", err)
+			writeDigestError(w, err)
+			return
+		}
+		checksums.Record(meta)
+
+		_, err = domain.PutWithMetadata(storage, bucket, objectID, data, meta)
 		if err != nil {
 			log.Println("Request error:", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			writeStorageError(w, err)
 			return
 		}
 
+		if o.quotas != nil && o.quotas.SoftExceeded(bucket) {
+			w.Header().Set("X-Quota-Warning", "soft quota exceeded")
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		w.Write([]byte(`{"id":"` + objectID + `"}`))
@@ -51,30 +119,84 @@ func putObjectHandler(storage domain.Storage) http.HandlerFunc {
 
 // getObjectHandler downloads an object from a bucket.
 // @Summary Download an object
-// @Description Download an object by bucket and objectID.
+// @Description Download an object by bucket and objectID. Objects stored compressed are served with Content-Encoding when the client accepts the codec. The checksums sent on upload are returned in the Content-MD5 and X-Checksum-* headers, unless the object is served with Content-Encoding.
 // @Tags objects
 // @Produce application/octet-stream
 // @Param bucket path string true "Bucket name"
 // @Param objectID path string true "Object ID"
+// @Param Accept-Encoding header string false "Accepted content codings"
 // @Success 200 {string} string "Object data"
 // @Failure 404 {string} string "Not Found"
+// @Failure 500 {object} ErrorResponse "Object corrupt"
 // @Router /objects/{bucket}/{objectID} [get]
-func getObjectHandler(storage domain.Storage) http.HandlerFunc {
+// @Router /objects/{bucket}/{objectID} [head]
+func getObjectHandler(storage domain.Storage, o *options) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		bucket := vars["bucket"]
 		objectID := vars["objectID"]
 
-		data, err := storage.Get(bucket, objectID)
+		var (
+			data     []byte
+			meta     domain.Metadata
+			encoding persistence.Codec
+			err      error
+		)
+		if o.compression != nil {
+			accept := r.Header.Get("Accept-Encoding")
+			data, meta, encoding, err = o.compression.GetEncodedWithMetadata(bucket, objectID, func(c persistence.Codec) bool {
+				return acceptsEncoding(accept, string(c))
+			})
+		} else {
+			data, meta, err = domain.GetWithMetadata(storage, bucket, objectID)
+		}
+		if errors.Is(err, domain.ErrCorrupt) {
+			log.Println("Integrity error:", err)
+			writeError(w, http.StatusInternalServerError, "ObjectCorrupt", "the object failed its integrity check")
+			return
+		}
 		if err != nil {
 			log.Println("Request error:", err)
 			http.Error(w, "object not found", http.StatusNotFound)
 			return
 		}
+		// Objects past their TTL are gone for clients before the lifecycle scheduler removes them
+		if lifecycle.Expired(meta, time.Now()) {
+			http.Error(w, "object not found", http.StatusNotFound)
+			return
+		}
 
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", string(encoding))
+		}
+		if o.compression != nil {
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+		if o.replication != nil {
+			if status := o.replication.StatusOf(bucket, objectID, meta); status != "" {
+				w.Header().Set(replication.HeaderStatus, status)
+			}
+		}
+		// The checksums cover the decoded object, not the encoded body
+		if encoding == "" {
+			setChecksumHeaders(w.Header(), meta)
+		}
 		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		var out io.Writer = w
+		if o.bandwidth != nil {
+			transfer := o.bandwidth.Start(r.Context(), principalKey(r), ratelimit.Download)
+			defer transfer.Done()
+			out = transfer.Writer(w)
+		}
+
 		w.WriteHeader(http.StatusOK)
-		w.Write(data)
+		out.Write(data)
 	}
 }
 
@@ -103,3 +225,55 @@ func deleteObjectHandler(storage domain.Storage) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// ObjectSummary describes an object returned by a listing
+type ObjectSummary struct {
+	ID           string    `json:"id"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	// ReplicationStatus is PENDING, COMPLETED or FAILED for replicated objects and REPLICA for copies
+	ReplicationStatus string `json:"replicationStatus,omitempty"`
+}
+
+// listObjectsHandler lists the objects of a bucket.
+// @Summary List objects
+// @Description List the objects of the bucket whose ID starts with the optional prefix.
+// @Tags objects
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param prefix query string false "Object ID prefix"
+// @Success 200 {array} ObjectSummary
+// @Failure 501 {string} string "Not Implemented"
+// @Router /objects/{bucket} [get]
+func listObjectsHandler(storage domain.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lister, ok := storage.(domain.Lister)
+		if !ok {
+			http.Error(w, "listing not supported by the storage", http.StatusNotImplemented)
+			return
+		}
+
+		infos, err := lister.ListObjects(mux.Vars(r)["bucket"], r.URL.Query().Get("prefix"))
+		if err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		objects := make([]ObjectSummary, 0, len(infos))
+		for _, info := range infos {
+			// Objects past their TTL are not listed either, like on read
+			if lifecycle.Expired(info.Metadata, now) {
+				continue
+			}
+			objects = append(objects, ObjectSummary{
+				ID:                info.ID,
+				Size:              info.Size,
+				LastModified:      info.ModTime,
+				ReplicationStatus: info.Metadata[replication.MetadataStatus],
+			})
+		}
+		writeJSON(w, http.StatusOK, objects)
+	}
+}
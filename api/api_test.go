@@ -1,14 +1,40 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/cluster"
+	"github.com/DanielePalaia/object-storage-service/consensus"
 	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/events"
+	"github.com/DanielePalaia/object-storage-service/integrity"
+	"github.com/DanielePalaia/object-storage-service/lifecycle"
+	"github.com/DanielePalaia/object-storage-service/notify"
 	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/policy"
+	"github.com/DanielePalaia/object-storage-service/queue"
+	"github.com/DanielePalaia/object-storage-service/quota"
+	"github.com/DanielePalaia/object-storage-service/ratelimit"
+	"github.com/DanielePalaia/object-storage-service/replication"
+	"github.com/DanielePalaia/object-storage-service/tenant"
+	"github.com/hashicorp/raft"
 )
 
 func setupTestServer() (*Server, domain.Storage) {
@@ -182,3 +208,1105 @@ func TestPut_DeDuplicateAndOverwrite(t *testing.T) {
 		t.Fatalf("expected updated content, got: %s", data)
 	}
 }
+
+func TestGetObject_ContentEncoding(t *testing.T) {
+	storage, err := persistence.NewCompressedStorage(persistence.NewInMemoryStorage(), persistence.CodecGzip)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	server := NewServer(storage, "8080", WithCompression(storage))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	content := bytes.Repeat([]byte("compressible log line\n"), 100)
+	put, _ := http.NewRequest(http.MethodPut, ts.URL+"/objects/logs/app.log", bytes.NewReader(content))
+	if resp, err := http.DefaultClient.Do(put); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("failed to store object: %v (err %v)", resp, err)
+	}
+
+	// Client accepting gzip gets the stored bytes as-is
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/objects/logs/app.log", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send GET request: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected Content-Encoding gzip; got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if len(body) >= len(content) {
+		t.Errorf("expected compressed body, got %d bytes", len(body))
+	}
+	// The checksums cover the decoded object, they don't describe an encoded body
+	if resp.Header.Get("X-Checksum-CRC32C") != "" {
+		t.Errorf("expected no checksum with Content-Encoding, got %v", resp.Header)
+	}
+
+	// Client not accepting gzip gets decompressed data
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/objects/logs/app.log", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send GET request: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, content) {
+		t.Errorf("expected decompressed body without Content-Encoding")
+	}
+	if resp.Header.Get("X-Checksum-CRC32C") == "" {
+		t.Errorf("expected the checksum of the decoded object, got %v", resp.Header)
+	}
+}
+
+func TestPutObject_TTLAndTagging(t *testing.T) {
+	server, storage := setupTestServer()
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/objects/builds/artifact", bytes.NewReader([]byte("data")))
+	req.Header.Set("X-TTL", "3600")
+	req.Header.Set("X-Tagging", "kind=ci")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201 Created; got %d", resp.StatusCode)
+	}
+
+	_, meta, err := domain.GetWithMetadata(storage, "builds", "artifact")
+	if err != nil {
+		t.Fatalf("expected object to be stored, got error: %v", err)
+	}
+	if meta[lifecycle.MetadataExpires] == "" || meta[lifecycle.MetadataTagging] != "kind=ci" {
+		t.Errorf("expected expiry and tags in metadata, got %v", meta)
+	}
+
+	// Objects past their TTL are not served before the scheduler removes them
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	domain.PutWithMetadata(storage, "builds", "stale", []byte("data"), domain.Metadata{lifecycle.MetadataExpires: past})
+	resp, err = http.Get(ts.URL + "/objects/builds/stale")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 for an expired object; got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(ts.URL + "/objects/builds")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var listed []ObjectSummary
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	for _, obj := range listed {
+		if obj.ID == "stale" {
+			t.Errorf("expected expired objects not to be listed, got %+v", listed)
+		}
+	}
+
+	// Invalid TTL is rejected
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/builds/bad", bytes.NewReader([]byte("data")))
+	req.Header.Set("X-TTL", "never")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid TTL; got %d", resp.StatusCode)
+	}
+}
+
+func TestPutObject_QuotaExceeded(t *testing.T) {
+	quotas := quota.NewManager()
+	storage := quota.NewStorage(persistence.NewInMemoryStorage(), quotas)
+	server := NewServer(storage, "8080", WithQuotas(quotas))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/quotas/buckets/small", bytes.NewReader([]byte(`{"hardBytes":4}`)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 OK configuring quota; got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/small/obj", bytes.NewReader([]byte("too large")))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("expected status 507; got %d", resp.StatusCode)
+	}
+	var body ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != "BucketQuotaExceeded" {
+		t.Errorf("expected BucketQuotaExceeded error code, got %+v (err %v)", body, err)
+	}
+}
+
+// trackingReader records whether the request body has been read
+type trackingReader struct {
+	r    io.Reader
+	read bool
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	t.read = true
+	return t.r.Read(p)
+}
+
+func TestPutObject_SizeLimits(t *testing.T) {
+	storage := persistence.NewInMemoryStorage()
+	limits := NewSizeLimits(16)
+	server := NewServer(storage, "8080", WithSizeLimits(limits))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	// Oversized upload announced with Expect: 100-continue is rejected before the body is sent
+	body := &trackingReader{r: bytes.NewReader(bytes.Repeat([]byte("x"), 32))}
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/objects/bucket/big", body)
+	req.ContentLength = 32
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413; got %d", resp.StatusCode)
+	}
+	if body.read {
+		t.Errorf("expected body not to be sent for rejected upload")
+	}
+
+	// Oversized chunked upload without Content-Length is cut by the body limit
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/bucket/chunked", io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), 32))))
+	req.ContentLength = -1
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for chunked upload; got %d", resp.StatusCode)
+	}
+	if _, err := storage.Get("bucket", "chunked"); err == nil {
+		t.Errorf("expected oversized object not to be stored")
+	}
+
+	// Bucket limits are stricter than the global one
+	if err := limits.SetBucket("tiny", 4); err != nil {
+		t.Fatalf("SetBucket failed: %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/tiny/obj", bytes.NewReader([]byte("12345")))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for bucket limit; got %d", resp.StatusCode)
+	}
+
+	// Limits are reported by the admin endpoint, the health endpoint has no bucket names
+	resp, err = http.Get(ts.URL + "/admin/limits")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var info LimitsInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("could not decode limits response: %v", err)
+	}
+	if info.MaxObjectSize != 16 || info.BucketMaxObjectSize["tiny"] != 4 {
+		t.Errorf("unexpected limits: %+v", info)
+	}
+	health, err := http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer health.Body.Close()
+	healthBody, _ := io.ReadAll(health.Body)
+	if bytes.Contains(healthBody, []byte("tiny")) {
+		t.Errorf("expected no bucket in the health response, got %s", healthBody)
+	}
+	var status HealthResponse
+	if err := json.Unmarshal(healthBody, &status); err != nil || status.MaxObjectSize != 16 {
+		t.Errorf("expected the global limit in the health response, got %s (err %v)", healthBody, err)
+	}
+
+	// A bucket without its limit falls back to the global one
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/buckets/tiny/limits", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the bucket limit to be deleted, got %v (err %v)", resp, err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 deleting a missing bucket limit, got %v (err %v)", resp, err)
+	}
+	resp, err = http.Get(ts.URL + "/buckets/tiny/limits")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var bucketLimits BucketLimits
+	if err := json.NewDecoder(resp.Body).Decode(&bucketLimits); err != nil || bucketLimits.MaxObjectSize != 16 {
+		t.Errorf("expected the global limit after deleting the bucket limit, got %+v (err %v)", bucketLimits, err)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	storage := persistence.NewInMemoryStorage()
+	keys := auth.NewKeyStore()
+	adminToken := "admin.0123456789abcdef0123"
+	if _, err := keys.Import(adminToken, "admin", []string{auth.RoleAdmin}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	server := NewServer(storage, "8080", WithAPIKeys(keys), WithAuthorizer(policy.NewAuthorizer(true)))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	storage.Put("logs", "app.log", []byte("log line"))
+
+	doRequest := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader([]byte(body)))
+		// Only admins configure buckets without a policy granting it
+		if strings.HasPrefix(path, "/buckets/") {
+			req.Header.Set(auth.APIKeyHeader, adminToken)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Without policy object actions are allowed by default, bucket actions are not
+	if resp := doRequest(http.MethodGet, "/objects/logs/app.log", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 OK; got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/buckets/logs/acl", bytes.NewReader([]byte(`{"acl":"public-read"}`)))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected anonymous requests not to set the acl, got %v (err %v)", resp.StatusCode, err)
+	}
+
+	// Public read bucket with a policy denying deletes to everyone
+	if resp := doRequest(http.MethodPut, "/buckets/logs/acl", `{"acl":"public-read"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 OK setting acl; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/logs/app.log", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected public read to be allowed; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/logs", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected public list to be allowed; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodDelete, "/objects/logs/app.log", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected delete to be denied; got %d", resp.StatusCode)
+	}
+	if _, err := storage.Get("logs", "app.log"); err != nil {
+		t.Errorf("expected object not to be deleted")
+	}
+
+	// Dry-run explains the decision
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/buckets/other/policy/explain", bytes.NewReader([]byte(`{"action":"object:Delete","key":"x"}`)))
+	req.Header.Set(auth.APIKeyHeader, adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var decision policy.Decision
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil || !decision.Allowed {
+		t.Errorf("expected explained decision to allow, got %+v (err %v)", decision, err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	storage := persistence.NewInMemoryStorage()
+	keys := auth.NewKeyStore()
+	adminToken := "admin.0123456789abcdef0123"
+	if _, err := keys.Import(adminToken, "admin", []string{auth.RoleAdmin}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	server := NewServer(storage, "8080", WithAPIKeys(keys), WithAuthRequired(true))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	doRequest := func(method, path, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set(auth.APIKeyHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %v", err)
+		}
+		return resp
+	}
+
+	// Anonymous requests are rejected
+	if resp := doRequest(http.MethodGet, "/objects/builds/x", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without credentials; got %d", resp.StatusCode)
+	}
+
+	// Admin creates a write-only key scoped to one bucket
+	resp := doRequest(http.MethodPost, "/admin/keys", adminToken, `{"name":"ci","roles":["writer"],"scopes":[{"bucket":"builds"}]}`)
+	var created CreateKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected key to be created, got status %d (err %v)", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+
+	if resp := doRequest(http.MethodPost, "/admin/keys", created.Token, `{"name":"x","roles":["admin"]}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected non admin key not to manage keys; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPut, "/objects/builds/artifact", created.Token, "data"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected write in scope to succeed; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPut, "/objects/other/artifact", created.Token, "data"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected write out of scope to be denied; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/builds/artifact", created.Token, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected read with write-only key to be denied; got %d", resp.StatusCode)
+	}
+
+	// Revoked keys are rejected
+	if resp := doRequest(http.MethodDelete, "/admin/keys/"+created.ID, adminToken, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected key to be revoked; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPut, "/objects/builds/artifact", created.Token, "data"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected revoked key to be rejected; got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIKeys_BucketConfiguration(t *testing.T) {
+	keys := auth.NewKeyStore()
+	_, writerToken, err := keys.Create("ci", "", []string{auth.RoleWriter}, []auth.Scope{{Bucket: "builds"}}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	deliveries, _ := queue.Open("")
+	deadLetters, _ := queue.Open("")
+	tasks, _ := queue.Open("")
+	storage := replication.NewStorage(persistence.NewInMemoryStorage(), replication.NewStore(), tasks, replication.DefaultRetryPolicy)
+	server := NewServer(storage, "8080",
+		WithAPIKeys(keys),
+		WithAuthRequired(true),
+		WithAuthorizer(policy.NewAuthorizer(true)),
+		WithReplication(storage),
+		WithNotifications(notify.NewDispatcher(notify.NewStore(), deliveries, deadLetters, notify.DefaultRetryPolicy)),
+	)
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	// Writers manage objects, but never the configuration of a bucket
+	for _, path := range []string{"/buckets/prod/policy", "/buckets/prod/acl", "/buckets/prod/replication", "/buckets/prod/notifications"} {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+path, bytes.NewReader([]byte(`{}`)))
+		req.Header.Set(auth.APIKeyHeader, writerToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected PUT %s to be denied; got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	quotas := quota.NewManager()
+	storage := quota.NewStorage(persistence.NewInMemoryStorage(), quotas)
+	keys := auth.NewKeyStore()
+	adminToken := "admin.0123456789abcdef0123"
+	if _, err := keys.Import(adminToken, "admin", []string{auth.RoleAdmin}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	server := NewServer(storage, "8080", WithAPIKeys(keys), WithQuotas(quotas), WithTenants(tenant.NewRegistry()))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	doRequest := func(method, path, token, body string, headers ...string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader([]byte(body)))
+		req.Header.Set(auth.APIKeyHeader, token)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %v", err)
+		}
+		return resp
+	}
+	createKey := func(tenant string) string {
+		resp := doRequest(http.MethodPost, "/admin/keys", adminToken, `{"name":"`+tenant+`","tenant":"`+tenant+`","roles":["reader","writer"]}`)
+		defer resp.Body.Close()
+		var created CreateKeyResponse
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected key to be created, got status %d (err %v)", resp.StatusCode, err)
+		}
+		return created.Token
+	}
+
+	if resp := doRequest(http.MethodPost, "/admin/tenants", adminToken, `{"name":"acme","quota":{"hardObjects":1}}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected tenant to be created; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPost, "/admin/tenants", adminToken, `{"name":"globex"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected tenant to be created; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPost, "/admin/tenants", adminToken, `{"name":"acme"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected duplicate tenant to conflict; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPost, "/admin/keys", adminToken, `{"name":"x","tenant":"initech","roles":["reader"]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected key of unknown tenant to be rejected; got %d", resp.StatusCode)
+	}
+	acme, globex := createKey("acme"), createKey("globex")
+
+	// Both tenants use the same bucket name without colliding
+	if resp := doRequest(http.MethodPut, "/objects/shared/obj", acme, "acme data"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected acme write to succeed; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/shared/obj", globex, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected globex not to see acme objects; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPut, "/objects/shared/obj", globex, "globex data"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected globex write to succeed; got %d", resp.StatusCode)
+	}
+	if data, err := storage.Get("acme/shared", "obj"); err != nil || string(data) != "acme data" {
+		t.Errorf("expected acme object in its namespace, got %q (err %v)", data, err)
+	}
+
+	// Administrators act within a tenant namespace with X-Tenant
+	resp := doRequest(http.MethodGet, "/objects/shared/obj", adminToken, "", TenantHeader, "globex")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "globex data" {
+		t.Errorf("expected admin to read the globex object, got %q", body)
+	}
+
+	// Tenant admins cannot cross into other tenants
+	resp = doRequest(http.MethodPost, "/admin/keys", adminToken, `{"name":"acme-admin","tenant":"acme","roles":["admin"]}`)
+	var tenantAdmin CreateKeyResponse
+	json.NewDecoder(resp.Body).Decode(&tenantAdmin)
+	resp.Body.Close()
+	if resp := doRequest(http.MethodGet, "/objects/shared/obj", tenantAdmin.Token, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the tenant admin to read its tenant objects; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/shared/obj", tenantAdmin.Token, "", TenantHeader, "globex"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the tenant admin not to switch tenants; got %d", resp.StatusCode)
+	}
+	for _, req := range []struct{ method, path, body string }{
+		{http.MethodPost, "/admin/keys", `{"name":"x","tenant":"globex","roles":["admin"]}`},
+		{http.MethodPost, "/admin/keys", `{"name":"x","roles":["admin"]}`},
+		{http.MethodGet, "/admin/keys", ""},
+		{http.MethodPost, "/admin/tenants/globex/suspend", ""},
+		{http.MethodPut, "/quotas/tenants/globex", `{"hardObjects":100}`},
+	} {
+		if resp := doRequest(req.method, req.path, tenantAdmin.Token, req.body); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected the tenant admin to be denied %s %s; got %d", req.method, req.path, resp.StatusCode)
+		}
+	}
+
+	// The tenant quota counts every bucket of its namespace
+	if resp := doRequest(http.MethodPut, "/objects/other/obj", acme, "more"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected tenant quota to reject the write; got %d", resp.StatusCode)
+	}
+	if report := quotas.TenantReport("acme"); report.Usage.Objects != 1 {
+		t.Errorf("expected acme to use 1 object, got %+v", report)
+	}
+
+	// Suspended tenants are rejected until resumed
+	if resp := doRequest(http.MethodPost, "/admin/tenants/acme/suspend", adminToken, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tenant to be suspended; got %d", resp.StatusCode)
+	}
+	resp = doRequest(http.MethodGet, "/objects/shared/obj", acme, "")
+	var errResp ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || errResp.Code != "TenantSuspended" {
+		t.Errorf("expected suspended tenant to be rejected; got %d %+v", resp.StatusCode, errResp)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/shared/obj", globex, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other tenants to be unaffected; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodPost, "/admin/tenants/acme/resume", adminToken, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tenant to be resumed; got %d", resp.StatusCode)
+	}
+	if resp := doRequest(http.MethodGet, "/objects/shared/obj", acme, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected resumed tenant to be served; got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	limiter := ratelimit.NewLimiter()
+	if err := limiter.Configure("ip.read=0.1:1"); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	server := NewServer(persistence.NewInMemoryStorage(), "8080", WithRateLimits(limiter))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	if resp, err := http.Get(ts.URL + "/objects/bucket/obj"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected first read to reach the handler, got %v (err %v)", resp.StatusCode, err)
+	}
+	resp, err := http.Get(ts.URL + "/objects/bucket/obj")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" {
+		t.Errorf("expected 429 with Retry-After 10; got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Writes and unnamed routes such as /health are not limited
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/objects/bucket/obj", bytes.NewReader([]byte("data")))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected write not to be limited, got %v (err %v)", resp.StatusCode, err)
+	}
+	if resp, err := http.Get(ts.URL + "/health"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected health not to be limited, got %v (err %v)", resp.StatusCode, err)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	bandwidth, err := ratelimit.NewBandwidth(ratelimit.BandwidthConfig{})
+	if err != nil {
+		t.Fatalf("NewBandwidth failed: %v", err)
+	}
+	storage := persistence.NewInMemoryStorage()
+	storage.Put("bucket", "large", make([]byte, 64*1024))
+	server := NewServer(storage, "8080", WithBandwidth(bandwidth))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/admin/bandwidth", bytes.NewReader([]byte(`{"download":{"perConnection":131072}}`)))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected limits to be updated, got %v (err %v)", resp.StatusCode, err)
+	}
+	if cfg := bandwidth.Config(); cfg.Download.PerConnection != 131072 {
+		t.Errorf("unexpected bandwidth config %+v", cfg)
+	}
+
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/objects/bucket/large")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(data) != 64*1024 {
+		t.Errorf("expected the whole object, got %d bytes", len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected download to be throttled, took %v", elapsed)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	received := make(chan notify.Notification, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(notify.HeaderSignature) != notify.Sign("s3cr3t", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var n notify.Notification
+		json.Unmarshal(body, &n)
+		received <- n
+	}))
+	defer hook.Close()
+
+	deliveries, _ := queue.Open("")
+	deadLetters, _ := queue.Open("")
+	dispatcher := notify.NewDispatcher(notify.NewStore(), deliveries, deadLetters, notify.DefaultRetryPolicy)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+
+	storage := events.NewStorage(persistence.NewInMemoryStorage(), dispatcher)
+	server := NewServer(storage, "8080", WithNotifications(dispatcher))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	cfg := `{"webhooks":[{"id":"pipeline","url":"` + hook.URL + `","secret":"s3cr3t","events":["ObjectCreated:*"],"filter":{"suffix":".csv"}}]}`
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/buckets/reports/notifications", bytes.NewReader([]byte(cfg)))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected configuration to be accepted, got %v (err %v)", resp.StatusCode, err)
+	}
+	resp, err := http.Get(ts.URL + "/buckets/reports/notifications")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Contains(body, []byte("s3cr3t")) {
+		t.Errorf("expected the secret not to be returned: %s", body)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/reports/2024.csv", bytes.NewReader([]byte("a,b")))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %v (err %v)", resp.StatusCode, err)
+	}
+	select {
+	case n := <-received:
+		if n.Type != events.ObjectCreatedPut || n.Bucket != "reports" || n.Key != "2024.csv" {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook was not notified")
+	}
+
+	resp, err = http.Get(ts.URL + "/admin/notifications/dead-letters")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected dead letters to be listed, got %v (err %v)", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+}
+
+func TestWatch(t *testing.T) {
+	changes := events.NewChangeLog(100, time.Hour)
+	storage := events.NewStorage(persistence.NewInMemoryStorage(), changes)
+	server := NewServer(storage, "8080", WithChangeLog(changes))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	storage.Put("photos", "old.jpg", []byte("old"))
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/buckets/photos/watch?prefix=2024/", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected stream to open, got %v (err %v)", resp, err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	storage.Put("photos", "2023/a.jpg", []byte("filtered"))
+	storage.Put("other", "2024/a.jpg", []byte("other bucket"))
+	storage.Put("photos", "2024/a.jpg", []byte("v1"))
+	storage.Put("photos", "2024/a.jpg", []byte("v2"))
+	storage.Delete("photos", "2024/a.jpg")
+
+	lines := bufio.NewScanner(resp.Body)
+	var got []WatchEvent
+	var lastID string
+	for len(got) < 3 && lines.Scan() {
+		line := lines.Text()
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			lastID = id
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var e WatchEvent
+			json.Unmarshal([]byte(data), &e)
+			got = append(got, e)
+		}
+	}
+	want := []string{WatchCreate, WatchOverwrite, WatchDelete}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), got)
+	}
+	for i, e := range got {
+		if e.Type != want[i] || e.Key != "2024/a.jpg" {
+			t.Errorf("unexpected event %d: %+v", i, e)
+		}
+	}
+	if got[0].ETag != "6654c734ccab8f440ff0825eb443dc7f" || got[0].Size != 2 {
+		t.Errorf("unexpected etag or size: %+v", got[0])
+	}
+
+	// Long-polling resumes after a cursor
+	resp, err = http.Get(ts.URL + "/buckets/photos/watch?cursor=1&timeout=1s")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected long-poll to succeed, got %v (err %v)", resp, err)
+	}
+	var poll WatchResponse
+	json.NewDecoder(resp.Body).Decode(&poll)
+	resp.Body.Close()
+	if len(poll.Events) != 4 || poll.Events[0].Key != "2023/a.jpg" || strconv.FormatUint(poll.Cursor, 10) != lastID {
+		t.Errorf("unexpected long-poll response %+v", poll)
+	}
+
+	// Without changes the long-poll returns an empty batch after the timeout
+	resp, err = http.Get(ts.URL + "/buckets/photos/watch?cursor=" + lastID + "&timeout=50ms")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	poll = WatchResponse{}
+	json.NewDecoder(resp.Body).Decode(&poll)
+	resp.Body.Close()
+	if len(poll.Events) != 0 || poll.Reset {
+		t.Errorf("expected an empty batch, got %+v", poll)
+	}
+
+	// An unknown cursor asks the client to resynchronize
+	resp, err = http.Get(ts.URL + "/buckets/photos/watch?cursor=1000")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	poll = WatchResponse{}
+	json.NewDecoder(resp.Body).Decode(&poll)
+	resp.Body.Close()
+	if !poll.Reset {
+		t.Errorf("expected a reset, got %+v", poll)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	keys := auth.NewKeyStore()
+	replicaToken := "replica.0123456789abcdef0123"
+	if _, err := keys.Import(replicaToken, "primary", []string{auth.RoleReplication}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	standby := httptest.NewServer(NewServer(persistence.NewInMemoryStorage(), "8080", WithAPIKeys(keys)).router)
+	defer standby.Close()
+
+	// Only the replication role uploads replicas
+	req, _ := http.NewRequest(http.MethodPut, standby.URL+"/objects/other/forged.jpg", bytes.NewReader([]byte("forged")))
+	req.Header.Set(replication.HeaderStatus, replication.StatusReplica)
+	http.DefaultClient.Do(req)
+	if resp, err := http.Get(standby.URL + "/objects/other/forged.jpg"); err != nil || resp.Header.Get(replication.HeaderStatus) == replication.StatusReplica {
+		t.Errorf("expected an anonymous upload not to be marked as replica")
+	}
+
+	tasks, _ := queue.Open("")
+	replicated := replication.NewStorage(persistence.NewInMemoryStorage(), replication.NewStore(), tasks, replication.DefaultRetryPolicy)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go replicated.Run(ctx)
+	server := NewServer(replicated, "8080", WithReplication(replicated))
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/buckets/photos/replication/resync", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected resync without rules to fail, got %v (err %v)", resp.StatusCode, err)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/photos/before.jpg", bytes.NewReader([]byte("before")))
+	http.DefaultClient.Do(req)
+
+	cfg := `{"rules":[{"id":"standby","endpoint":"` + standby.URL + `","apiKey":"` + replicaToken + `"}]}`
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/buckets/photos/replication", bytes.NewReader([]byte(cfg)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected configuration to be accepted, got %v (err %v)", resp.StatusCode, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Contains(body, []byte(replicaToken)) {
+		t.Errorf("expected the API key not to be returned: %s", body)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/objects/photos/a.jpg", bytes.NewReader([]byte("a")))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %v (err %v)", resp.StatusCode, err)
+	}
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/buckets/photos/replication/resync", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected resync to be accepted, got %v (err %v)", resp.StatusCode, err)
+	}
+	var resync ResyncResponse
+	json.NewDecoder(resp.Body).Decode(&resync)
+	resp.Body.Close()
+	if resync.Queued != 2 {
+		t.Errorf("expected 2 objects to be queued, got %d", resync.Queued)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for replicated.Status("photos", "a.jpg") != replication.StatusCompleted || replicated.Status("photos", "before.jpg") != replication.StatusCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("objects were not replicated")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	resp, err = http.Get(ts.URL + "/objects/photos/a.jpg")
+	if err != nil || resp.Header.Get(replication.HeaderStatus) != replication.StatusCompleted {
+		t.Errorf("expected the object to report its replication, got %v (err %v)", resp.Header, err)
+	}
+
+	resp, err = http.Get(standby.URL + "/objects/photos")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var objects []ObjectSummary
+	json.NewDecoder(resp.Body).Decode(&objects)
+	resp.Body.Close()
+	if len(objects) != 2 || objects[0].ID != "a.jpg" || objects[0].ReplicationStatus != replication.StatusReplica {
+		t.Errorf("expected the standby to hold the replicas, got %+v", objects)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	servers := []*httptest.Server{httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil)}
+	var members []cluster.Node
+	for i, s := range servers {
+		members = append(members, cluster.Node{ID: "node-" + strconv.Itoa(i+1), URL: "http://" + s.Listener.Addr().String()})
+	}
+	for i, s := range servers {
+		node, err := cluster.New(persistence.NewInMemoryStorage(), cluster.Config{Self: members[i].ID, Nodes: members, ReplicationFactor: 1, Secret: "s3cr3t"})
+		if err != nil {
+			t.Fatalf("cluster.New failed: %v", err)
+		}
+		s.Config.Handler = NewServer(node, "8080", WithCluster(node)).router
+		s.Start()
+		defer s.Close()
+	}
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest(http.MethodPut, servers[0].URL+"/objects/photos/"+strconv.Itoa(i), bytes.NewReader([]byte("data")))
+		if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected upload to succeed, got %v (err %v)", resp.StatusCode, err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(servers[1].URL + "/objects/photos/" + strconv.Itoa(i))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected object %d to be served by any node, got %v (err %v)", i, resp.StatusCode, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(servers[1].URL + "/admin/cluster")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var status ClusterResponse
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Self != "node-2" || len(status.Members) != 2 || !status.Members[0].Alive {
+		t.Errorf("unexpected cluster status %+v", status)
+	}
+
+	resp, err = http.Get(servers[1].URL + "/admin/cluster/placement/photos/3")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var placement PlacementResponse
+	json.NewDecoder(resp.Body).Decode(&placement)
+	resp.Body.Close()
+	if len(placement.Owners) != 1 {
+		t.Errorf("expected a single owner, got %+v", placement)
+	}
+
+	// The internal API requires the cluster secret
+	req, _ := http.NewRequest(http.MethodGet, servers[0].URL+cluster.PathPrefix+"/ping", nil)
+	req.Header.Set(cluster.HeaderSecret, "guess")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the internal API to be protected, got %v (err %v)", resp.StatusCode, err)
+	}
+}
+
+func TestRaft(t *testing.T) {
+	data := persistence.NewInMemoryStorage()
+	servers := []*httptest.Server{httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil)}
+	var transports []*raft.InmemTransport
+	for i, s := range servers {
+		id := "node-" + strconv.Itoa(i+1)
+		config := raft.DefaultConfig()
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.LogOutput = io.Discard
+		_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+		store, err := consensus.Open(consensus.Config{ID: id, URL: "http://" + s.Listener.Addr().String(), Bootstrap: i == 0, Secret: "s3cr3t", Raft: config}, transport)
+		if err != nil {
+			t.Fatalf("consensus.Open failed: %v", err)
+		}
+		defer store.Shutdown()
+		s.Config.Handler = NewServer(consensus.NewStorage(store, data), "8080", WithRaft(store)).router
+		s.Start()
+		defer s.Close()
+		transports = append(transports, transport)
+	}
+	transports[0].Connect(transports[1].LocalAddr(), transports[1])
+	transports[1].Connect(transports[0].LocalAddr(), transports[0])
+
+	join := `{"id":"node-2","address":"node-2","url":"` + servers[1].URL + `"}`
+	resp, err := http.Post(servers[0].URL+"/admin/raft/members", "application/json", strings.NewReader(join))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected node-2 to join, got %v (err %v)", resp.StatusCode, err)
+	}
+
+	// Writes through the follower are forwarded to the leader
+	req, _ := http.NewRequest(http.MethodPut, servers[1].URL+"/objects/photos/cat.png", bytes.NewReader([]byte("meow")))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %v (err %v)", resp.StatusCode, err)
+	}
+	resp, err = http.Get(servers[0].URL + "/objects/photos/cat.png")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the object to be served by the leader, got %v (err %v)", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(servers[1].URL + "/admin/raft")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var status consensus.Status
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.ID != "node-2" || status.Leader != "node-1" || len(status.Members) != 2 {
+		t.Errorf("unexpected raft status %+v", status)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, servers[1].URL+"/admin/raft/members/node-9", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown member to be rejected, got %v (err %v)", resp.StatusCode, err)
+	}
+	resp, err = http.Post(servers[0].URL+"/admin/raft/members", "application/json", strings.NewReader(`{"id":"node-3"}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid member to be rejected, got %v (err %v)", resp.StatusCode, err)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	inner := persistence.NewInMemoryStorage()
+	checked := integrity.NewStorage(inner)
+	scrubber, err := integrity.NewScrubber(checked, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("NewScrubber failed: %v", err)
+	}
+	srv := httptest.NewServer(NewServer(checked, "8080", WithScrubber(scrubber)).router)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/objects/photos/cat.png", bytes.NewReader([]byte("meow")))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %v (err %v)", resp.StatusCode, err)
+	}
+	_, meta, _ := inner.GetWithMetadata("photos", "cat.png")
+	inner.PutWithMetadata("photos", "cat.png", []byte("woof"), meta)
+
+	resp, err := http.Get(srv.URL + "/objects/photos/cat.png")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var errResp ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || errResp.Code != "ObjectCorrupt" {
+		t.Errorf("expected corrupt data to be refused, got %d %+v", resp.StatusCode, errResp)
+	}
+
+	resp, err = http.Get(srv.URL + "/admin/scrub")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	var status integrity.ScrubStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if len(status.Quarantined) != 1 || status.Quarantined[0].ID != "cat.png" {
+		t.Errorf("expected cat.png to be quarantined, got %+v", status)
+	}
+	if resp, err := http.Post(srv.URL+"/admin/scrub", "", nil); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected a run to be triggered, got %v (err %v)", resp.StatusCode, err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	server, _ := setupTestServer()
+	srv := httptest.NewServer(server.router)
+	defer srv.Close()
+
+	data := []byte("hello checksums")
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	contentMD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	sha256Value := base64.StdEncoding.EncodeToString(sha256Sum[:])
+
+	put := func(path string, header http.Header, body io.Reader, trailer http.Header) (int, ErrorResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+path, body)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Trailer = trailer
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send request: %v", err)
+		}
+		defer resp.Body.Close()
+		var errResp ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return resp.StatusCode, errResp
+	}
+
+	header := http.Header{"Content-Md5": {contentMD5}, "X-Checksum-Sha256": {sha256Value}}
+	if status, _ := put("/objects/b/ok", header, bytes.NewReader(data), nil); status != http.StatusCreated {
+		t.Fatalf("expected matching checksums to be accepted, got %d", status)
+	}
+	header = http.Header{"Content-Md5": {contentMD5}}
+	if status, errResp := put("/objects/b/bad", header, strings.NewReader("tampered"), nil); status != http.StatusBadRequest || errResp.Code != "BadDigest" {
+		t.Errorf("expected BadDigest, got %d %+v", status, errResp)
+	}
+	header = http.Header{"X-Checksum-Sha1": {"not base64!"}}
+	if status, errResp := put("/objects/b/bad", header, bytes.NewReader(data), nil); status != http.StatusBadRequest || errResp.Code != "InvalidDigest" {
+		t.Errorf("expected InvalidDigest, got %d %+v", status, errResp)
+	}
+
+	// Chunked uploads send the checksum after the body
+	trailer := http.Header{"X-Checksum-Sha256": nil}
+	body := &trailingReader{r: bytes.NewReader(data), trailer: trailer, value: sha256Value}
+	if status, _ := put("/objects/b/chunked", nil, body, trailer); status != http.StatusCreated {
+		t.Errorf("expected a matching trailing checksum to be accepted, got %d", status)
+	}
+	trailer = http.Header{"X-Checksum-Sha256": nil}
+	body = &trailingReader{r: strings.NewReader("tampered"), trailer: trailer, value: sha256Value}
+	if status, errResp := put("/objects/b/chunked", nil, body, trailer); status != http.StatusBadRequest || errResp.Code != "BadDigest" {
+		t.Errorf("expected a mismatching trailing checksum to be rejected, got %d %+v", status, errResp)
+	}
+
+	resp, err := http.Head(srv.URL + "/objects/b/ok")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(data)) {
+		t.Errorf("unexpected HEAD response %d, length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if resp.Header.Get("Content-MD5") != contentMD5 || resp.Header.Get("X-Checksum-SHA256") != sha256Value {
+		t.Errorf("expected the checksums to be returned, got %v", resp.Header)
+	}
+
+	// Without checksums, a CRC-32C is computed for downloads to be verified
+	put("/objects/b/plain", nil, bytes.NewReader(data), nil)
+	resp, err = http.Get(srv.URL + "/objects/b/plain")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	crc := crc32.Checksum(got, crc32.MakeTable(crc32.Castagnoli))
+	want := base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+	if resp.Header.Get("X-Checksum-CRC32C") != want {
+		t.Errorf("expected CRC-32C %s, got %q", want, resp.Header.Get("X-Checksum-CRC32C"))
+	}
+}
+
+// trailingReader sets a trailer once its body is read
+type trailingReader struct {
+	r       io.Reader
+	trailer http.Header
+	value   string
+}
+
+func (r *trailingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.trailer.Set("X-Checksum-Sha256", r.value)
+	}
+	return n, err
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/policy"
+	"github.com/DanielePalaia/object-storage-service/tenant"
+	"github.com/gorilla/mux"
+)
+
+// Actions of the administration routes, only principals with the admin role can perform them
+const (
+	actionAdminKeys   = "admin:Keys"
+	actionAdminQuotas = "admin:Quotas"
+	actionAdminLimits = "admin:Limits"
+)
+
+// actionRoles lists the roles granting each action. Bucket configuration
+// actions can redirect data to other services, only admins perform them.
+// Actions missing from the table require the admin role.
+var actionRoles = map[string][]string{
+	policy.ActionGetObject:           {auth.RoleReader},
+	policy.ActionListObjects:         {auth.RoleReader},
+	policy.ActionWatchObjects:        {auth.RoleReader},
+	policy.ActionPutObject:           {auth.RoleWriter, auth.RoleReplication},
+	policy.ActionDeleteObject:        {auth.RoleWriter, auth.RoleReplication},
+	policy.ActionGetPolicy:           {auth.RoleAdmin},
+	policy.ActionPutPolicy:           {auth.RoleAdmin},
+	policy.ActionDeletePolicy:        {auth.RoleAdmin},
+	policy.ActionGetACL:              {auth.RoleAdmin},
+	policy.ActionPutACL:              {auth.RoleAdmin},
+	policy.ActionGetConfiguration:    {auth.RoleAdmin},
+	policy.ActionPutConfiguration:    {auth.RoleAdmin},
+	policy.ActionDeleteConfiguration: {auth.RoleAdmin},
+}
+
+// CreateKeyRequest is the body of an API key creation
+type CreateKeyRequest struct {
+	Name      string       `json:"name"`
+	Tenant    string       `json:"tenant,omitempty"`
+	Roles     []string     `json:"roles"`
+	Scopes    []auth.Scope `json:"scopes,omitempty"`
+	ExpiresAt *time.Time   `json:"expiresAt,omitempty"`
+	// TTL is an alternative to ExpiresAt, as a Go duration such as "720h"
+	TTL string `json:"ttl,omitempty"`
+}
+
+// CreateKeyResponse returns a new API key with its token, which is never shown again
+type CreateKeyResponse struct {
+	auth.APIKey
+	Token string `json:"token"`
+}
+
+// authenticationMiddleware identifies the principal of the request. When
+// required, requests without credentials are rejected.
+func authenticationMiddleware(authenticators []auth.Authenticator, required bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := auth.Authenticate(r, authenticators)
+			switch {
+			case errors.Is(err, auth.ErrExpiredCredentials):
+				writeError(w, http.StatusUnauthorized, "ExpiredCredentials", "credentials have expired")
+				return
+			case err != nil:
+				log.Println("Authentication error:", err)
+				writeError(w, http.StatusUnauthorized, "InvalidCredentials", "invalid credentials")
+				return
+			case required && principal.IsAnonymous() && routeAction(r) != "":
+				writeError(w, http.StatusUnauthorized, "MissingCredentials", "credentials are required")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// roleMiddleware checks authenticated principals have a role granting the
+// action of the route and that the bucket or object is within their scopes.
+// Administration routes require the admin role, and those acting beyond a
+// bucket (keys, tenants, limits, cluster...) require an admin without tenant.
+func roleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.PrincipalFrom(r.Context())
+		action := routeAction(r)
+
+		if strings.HasPrefix(action, "admin:") {
+			if !principal.HasRole(auth.RoleAdmin) {
+				writeError(w, http.StatusForbidden, "AccessDenied", "the admin role is required")
+				return
+			}
+			// Bucket routes are confined to the tenant namespace by tenantMiddleware
+			if _, bucketRoute := mux.Vars(r)["bucket"]; principal.Tenant != "" && !bucketRoute {
+				writeError(w, http.StatusForbidden, "AccessDenied", "a global admin is required")
+				return
+			}
+		}
+		if action == "" || principal.IsAnonymous() || principal.HasRole(auth.RoleAdmin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		granted := false
+		for _, role := range actionRoles[action] {
+			granted = granted || principal.HasRole(role)
+		}
+		if !granted {
+			writeError(w, http.StatusForbidden, "AccessDenied", "no role of the principal grants "+action)
+			return
+		}
+
+		vars := mux.Vars(r)
+		key := vars["objectID"]
+		if action == policy.ActionListObjects || action == policy.ActionWatchObjects {
+			key = r.URL.Query().Get("prefix")
+		}
+		if !principal.InScope(vars["bucket"], key) {
+			writeError(w, http.StatusForbidden, "AccessDenied", "object is outside the scopes of the principal")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createKeyHandler creates an API key.
+// @Summary Create an API key
+// @Description Create an API key with roles (admin, reader, writer, replication), an optional tenant, bucket/prefix scopes and an optional expiry. The token is only returned once.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param key body CreateKeyRequest true "API key"
+// @Success 201 {object} CreateKeyResponse
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/keys [post]
+func createKeyHandler(keys *auth.KeyStore, tenants *tenant.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid api key request", http.StatusBadRequest)
+			return
+		}
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+			expires := time.Now().Add(ttl).UTC()
+			req.ExpiresAt = &expires
+		}
+
+		// Tenant admins only create keys of their own tenant
+		if caller := auth.PrincipalFrom(r.Context()); caller.Tenant != "" {
+			if req.Tenant != "" && req.Tenant != caller.Tenant {
+				writeError(w, http.StatusForbidden, "AccessDenied", "keys can only be created for the tenant of the caller")
+				return
+			}
+			req.Tenant = caller.Tenant
+		}
+		if req.Tenant != "" && tenants != nil {
+			if _, ok := tenants.Get(req.Tenant); !ok {
+				http.Error(w, "unknown tenant", http.StatusBadRequest)
+				return
+			}
+		}
+
+		key, token, err := keys.Create(req.Name, req.Tenant, req.Roles, req.Scopes, req.ExpiresAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, CreateKeyResponse{APIKey: key, Token: token})
+	}
+}
+
+// listKeysHandler lists the API keys.
+// @Summary List API keys
+// @Description List the API keys with their roles, scopes, expiry and last use.
+// @Tags admin
+// @Produce json
+// @Success 200 {array} auth.APIKey
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/keys [get]
+func listKeysHandler(keys *auth.KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, keys.List())
+	}
+}
+
+// revokeKeyHandler revokes an API key.
+// @Summary Revoke an API key
+// @Description Revoke the API key, requests using it are rejected from now on.
+// @Tags admin
+// @Param id path string true "API key ID"
+// @Success 200 {string} string "Revoked"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /admin/keys/{id} [delete]
+func revokeKeyHandler(keys *auth.KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !keys.Revoke(mux.Vars(r)["id"]) {
+			http.Error(w, "api key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
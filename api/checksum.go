@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+// MetadataChecksumPrefix prefixes the metadata keys recording the checksums
+// sent with an upload, such as "content-sha256"
+const MetadataChecksumPrefix = "content-"
+
+// checksumAlgorithm is a checksum clients can send with an upload, as the
+// base64 encoding of its digest
+type checksumAlgorithm struct {
+	name    string
+	header  string
+	newHash func() hash.Hash
+}
+
+var checksumAlgorithms = []checksumAlgorithm{
+	{name: "md5", header: "Content-MD5", newHash: md5.New},
+	{name: "crc32c", header: "X-Checksum-CRC32C", newHash: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{name: "sha1", header: "X-Checksum-SHA1", newHash: sha1.New},
+	{name: "sha256", header: "X-Checksum-SHA256", newHash: sha256.New},
+}
+
+// defaultChecksum is computed when the client sends no checksum, so that
+// downloads can always be verified
+const defaultChecksum = "crc32c"
+
+// digestError rejects an upload whose checksums are malformed or do not match
+type digestError struct {
+	code    string
+	message string
+}
+
+func (e *digestError) Error() string {
+	return e.message
+}
+
+type uploadChecksum struct {
+	algorithm checksumAlgorithm
+	hash      hash.Hash
+	// expected is nil when the checksum is sent as a trailer or not at all
+	expected []byte
+	trailer  bool
+}
+
+// uploadChecksums computes the checksums of an upload while it is read and
+// verifies them against the ones sent by the client, in the headers or, for
+// chunked uploads, in the trailers
+type uploadChecksums struct {
+	sums []*uploadChecksum
+}
+
+// newUploadChecksums collects the checksums announced by r
+func newUploadChecksums(r *http.Request) (*uploadChecksums, error) {
+	c := &uploadChecksums{}
+	for _, algorithm := range checksumAlgorithms {
+		sum := &uploadChecksum{algorithm: algorithm}
+		if value := r.Header.Get(algorithm.header); value != "" {
+			expected, err := decodeChecksum(algorithm, value)
+			if err != nil {
+				return nil, err
+			}
+			sum.expected = expected
+		} else if _, ok := r.Trailer[http.CanonicalHeaderKey(algorithm.header)]; ok {
+			sum.trailer = true
+		} else if algorithm.name != defaultChecksum {
+			continue
+		}
+		sum.hash = algorithm.newHash()
+		c.sums = append(c.sums, sum)
+	}
+	return c, nil
+}
+
+func decodeChecksum(algorithm checksumAlgorithm, value string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(digest) != algorithm.newHash().Size() {
+		return nil, &digestError{code: "InvalidDigest", message: "the " + algorithm.header + " you specified is not valid"}
+	}
+	return digest, nil
+}
+
+// Reader returns body hashed while it is read
+func (c *uploadChecksums) Reader(body io.Reader) io.Reader {
+	writers := make([]io.Writer, len(c.sums))
+	for i, sum := range c.sums {
+		writers[i] = sum.hash
+	}
+	return io.TeeReader(body, io.MultiWriter(writers...))
+}
+
+// Verify compares the checksums of the body read with the expected ones,
+// trailer holding the trailing checksums once the body is fully read
+func (c *uploadChecksums) Verify(trailer http.Header) error {
+	for _, sum := range c.sums {
+		expected := sum.expected
+		if sum.trailer {
+			value := trailer.Get(sum.algorithm.header)
+			if value == "" {
+				return &digestError{code: "InvalidDigest", message: "the trailing " + sum.algorithm.header + " is missing"}
+			}
+			var err error
+			if expected, err = decodeChecksum(sum.algorithm, value); err != nil {
+				return err
+			}
+		}
+		if expected != nil && !bytes.Equal(expected, sum.hash.Sum(nil)) {
+			return &digestError{code: "BadDigest", message: "the " + sum.algorithm.header + " you specified did not match what we received"}
+		}
+	}
+	return nil
+}
+
+// Record stores the checksums in the metadata of the object
+func (c *uploadChecksums) Record(meta domain.Metadata) {
+	for _, sum := range c.sums {
+		meta[MetadataChecksumPrefix+sum.algorithm.name] = base64.StdEncoding.EncodeToString(sum.hash.Sum(nil))
+	}
+}
+
+// setChecksumHeaders returns the checksums recorded on upload so that
+// clients can verify downloads
+func setChecksumHeaders(h http.Header, meta domain.Metadata) {
+	for _, algorithm := range checksumAlgorithms {
+		if value := meta[MetadataChecksumPrefix+algorithm.name]; value != "" {
+			h.Set(algorithm.header, value)
+		}
+	}
+}
+
+// writeDigestError replies to an upload rejected by its checksums
+func writeDigestError(w http.ResponseWriter, err error) {
+	if d, ok := err.(*digestError); ok {
+		writeError(w, http.StatusBadRequest, d.code, d.message)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
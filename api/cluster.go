@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/cluster"
+	"github.com/gorilla/mux"
+)
+
+// actionAdminCluster is the action of the cluster administration routes
+const actionAdminCluster = "admin:Cluster"
+
+// ClusterResponse describes the cluster as seen by the node serving the request
+type ClusterResponse struct {
+	Self              string                 `json:"self"`
+	ReplicationFactor int                    `json:"replicationFactor"`
+	Members           []cluster.MemberStatus `json:"members"`
+}
+
+// PlacementResponse lists the nodes storing an object, its primary owner first
+type PlacementResponse struct {
+	Owners []cluster.Node `json:"owners"`
+}
+
+// getClusterHandler returns the members of the cluster.
+// @Summary Get cluster membership
+// @Description Get the members of the cluster and whether this node can reach them.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} ClusterResponse
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/cluster [get]
+func getClusterHandler(c *cluster.Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ClusterResponse{
+			Self:              c.Self().ID,
+			ReplicationFactor: c.ReplicationFactor(),
+			Members:           c.Members(),
+		})
+	}
+}
+
+// getPlacementHandler returns the nodes owning an object.
+// @Summary Get object placement
+// @Description Get the nodes storing an object according to the current membership, its primary owner first.
+// @Tags admin
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param objectID path string true "Object ID"
+// @Success 200 {object} PlacementResponse
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/cluster/placement/{bucket}/{objectID} [get]
+func getPlacementHandler(c *cluster.Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		writeJSON(w, http.StatusOK, PlacementResponse{Owners: c.Owners(vars["bucket"], vars["objectID"])})
+	}
+}
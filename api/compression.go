@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/gorilla/mux"
+)
+
+// CompressionConfig is the compression setting of a bucket
+type CompressionConfig struct {
+	Codec string `json:"codec"`
+}
+
+// putCompressionHandler configures the codec used for new objects in a bucket.
+// @Summary Configure bucket compression
+// @Description Set the codec (zstd, gzip or none) used to store new objects in the bucket.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param config body CompressionConfig true "Compression config"
+// @Success 200 {object} CompressionConfig
+// @Failure 400 {string} string "Bad Request"
+// @Router /buckets/{bucket}/compression [put]
+func putCompressionHandler(cs *persistence.CompressedStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var cfg CompressionConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid compression config", http.StatusBadRequest)
+			return
+		}
+		codec, err := persistence.ParseCodec(cfg.Codec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cs.SetBucketCodec(bucket, codec)
+
+		writeJSON(w, http.StatusOK, CompressionConfig{Codec: string(codec)})
+	}
+}
+
+// getCompressionHandler returns the codec used for new objects in a bucket.
+// @Summary Get bucket compression
+// @Description Get the codec used to store new objects in the bucket.
+// @Tags buckets
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} CompressionConfig
+// @Router /buckets/{bucket}/compression [get]
+func getCompressionHandler(cs *persistence.CompressedStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+		writeJSON(w, http.StatusOK, CompressionConfig{Codec: string(cs.BucketCodec(bucket))})
+	}
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows the given coding
+func acceptsEncoding(header, coding string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if name == coding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Response error:", err)
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/consensus"
+	"github.com/gorilla/mux"
+)
+
+// actionAdminRaft is the action of the Raft administration routes
+const actionAdminRaft = "admin:Raft"
+
+// getRaftHandler returns the state of the Raft cluster.
+// @Summary Get Raft status
+// @Description Get the Raft state of this node, the current leader and the members of the cluster replicating the metadata.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} consensus.Status
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/raft [get]
+func getRaftHandler(store *consensus.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := store.Status()
+		if err != nil {
+			log.Println("Raft error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// addRaftMemberHandler adds a node to the Raft cluster.
+// @Summary Add a Raft member
+// @Description Add a node started without bootstrapping to the cluster as a voter, it then receives the metadata from the leader. The request is forwarded to the leader.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param member body consensus.Member true "Node ID, Raft address and HTTP URL"
+// @Success 201 {object} consensus.Member
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 503 {string} string "No leader available"
+// @Router /admin/raft/members [post]
+func addRaftMemberHandler(store *consensus.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m consensus.Member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid member", http.StatusBadRequest)
+			return
+		}
+		if err := store.AddMember(m); err != nil {
+			raftError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, m)
+	}
+}
+
+// removeRaftMemberHandler removes a node from the Raft cluster.
+// @Summary Remove a Raft member
+// @Description Remove a node from the cluster, possibly the leader which then steps down. The request is forwarded to the leader.
+// @Tags admin
+// @Param id path string true "Node ID"
+// @Success 204 "Removed"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Failure 503 {string} string "No leader available"
+// @Router /admin/raft/members/{id} [delete]
+func removeRaftMemberHandler(store *consensus.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := store.RemoveMember(mux.Vars(r)["id"]); err != nil {
+			raftError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func raftError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, consensus.ErrInvalidMember):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, consensus.ErrUnknownMember):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, consensus.ErrNoLeader):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		log.Println("Raft error:", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/quota"
+	"github.com/DanielePalaia/object-storage-service/tiering"
+)
+
+// ErrorResponse is the body of errors carrying a machine readable code
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError replies with a JSON error body
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorResponse{Code: code, Message: message})
+}
+
+// writeStorageError replies to a failed write with the status and code matching err
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, quota.ErrBucketQuotaExceeded):
+		writeError(w, http.StatusInsufficientStorage, "BucketQuotaExceeded", err.Error())
+	case errors.Is(err, quota.ErrTenantQuotaExceeded):
+		writeError(w, http.StatusForbidden, "TenantQuotaExceeded", err.Error())
+	case errors.Is(err, tiering.ErrTierFull):
+		writeError(w, http.StatusInsufficientStorage, "StorageFull", err.Error())
+	case errors.Is(err, persistence.ErrObjectTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, "EntityTooLarge", err.Error())
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
@@ -12,6 +12,9 @@ type HealthResponse struct {
 	Timestamp time.Time `json:"timestamp"`
 	Service   string    `json:"service"`
 	Version   string    `json:"version,omitempty"`
+	// MaxObjectSize is the global maximum object size, the endpoint is not
+	// authenticated so the limits of buckets are only reported by /admin/limits
+	MaxObjectSize int64 `json:"maxObjectSize,omitempty"`
 }
 
 // HealthHandler handles health check requests
@@ -37,3 +40,21 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// healthHandler reports the health of the service together with its global
+// maximum object size when size limits are configured
+func healthHandler(o *options) http.HandlerFunc {
+	if o.sizeLimits == nil {
+		return HealthHandler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := HealthResponse{
+			Status:        "healthy",
+			Timestamp:     time.Now().UTC(),
+			Service:       "object-storage-service",
+			Version:       "1.0.0",
+			MaxObjectSize: o.sizeLimits.Global(),
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/integrity"
+)
+
+// actionAdminScrub is the action of the scrubber administration routes
+const actionAdminScrub = "admin:Scrub"
+
+// getScrubHandler returns the state of the scrubber.
+// @Summary Get scrubber status
+// @Description Get the report of the last scrubbing run and the objects quarantined as corrupt.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} integrity.ScrubStatus
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/scrub [get]
+func getScrubHandler(sc *integrity.Scrubber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sc.Status())
+	}
+}
+
+// triggerScrubHandler starts a scrubbing run.
+// @Summary Start scrubbing
+// @Description Verify every object as soon as possible rather than at the next scheduled run.
+// @Tags admin
+// @Success 202 {string} string "Accepted"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/scrub [post]
+func triggerScrubHandler(sc *integrity.Scrubber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc.Trigger()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/lifecycle"
+	"github.com/DanielePalaia/object-storage-service/replication"
+	"github.com/gorilla/mux"
+)
+
+// putLifecycleHandler replaces the lifecycle rules of a bucket.
+// @Summary Configure bucket lifecycle
+// @Description Set the lifecycle rules (expiration, incomplete multipart uploads, noncurrent versions) of the bucket.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param config body lifecycle.Configuration true "Lifecycle configuration"
+// @Success 200 {object} lifecycle.Configuration
+// @Failure 400 {string} string "Bad Request"
+// @Router /buckets/{bucket}/lifecycle [put]
+func putLifecycleHandler(store *lifecycle.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var cfg lifecycle.Configuration
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid lifecycle configuration", http.StatusBadRequest)
+			return
+		}
+		if err := store.Set(bucket, cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// getLifecycleHandler returns the lifecycle rules of a bucket.
+// @Summary Get bucket lifecycle
+// @Description Get the lifecycle rules of the bucket.
+// @Tags buckets
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} lifecycle.Configuration
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/lifecycle [get]
+func getLifecycleHandler(store *lifecycle.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, ok := store.Get(mux.Vars(r)["bucket"])
+		if !ok {
+			http.Error(w, "lifecycle configuration not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// deleteLifecycleHandler removes the lifecycle rules of a bucket.
+// @Summary Delete bucket lifecycle
+// @Description Remove the lifecycle rules of the bucket.
+// @Tags buckets
+// @Param bucket path string true "Bucket name"
+// @Success 200 {string} string "Deleted"
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/lifecycle [delete]
+func deleteLifecycleHandler(store *lifecycle.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !store.Delete(mux.Vars(r)["bucket"]) {
+			http.Error(w, "lifecycle configuration not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// objectMetadataFromHeaders builds the metadata of an uploaded object from
+// the X-Expires, X-TTL, X-Tagging and X-Replication-Status request headers.
+// The replication status is only honoured when replica is set.
+func objectMetadataFromHeaders(h http.Header, now time.Time, replica bool) (domain.Metadata, error) {
+	meta := domain.Metadata{}
+
+	if v := h.Get("X-Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			if expires, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, errors.New("invalid X-Expires header")
+			}
+		}
+		meta[lifecycle.MetadataExpires] = expires.UTC().Format(time.RFC3339)
+	} else if v := h.Get("X-TTL"); v != "" {
+		ttl, err := parseTTL(v)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("invalid X-TTL header")
+		}
+		meta[lifecycle.MetadataExpires] = now.Add(ttl).UTC().Format(time.RFC3339)
+	}
+
+	if v := h.Get("X-Tagging"); v != "" {
+		tags, err := url.ParseQuery(v)
+		if err != nil {
+			return nil, errors.New("invalid X-Tagging header")
+		}
+		meta[lifecycle.MetadataTagging] = tags.Encode()
+	}
+
+	// Copies made by the replication of another instance are marked as replicas
+	if replica && h.Get(replication.HeaderStatus) == replication.StatusReplica {
+		meta[replication.MetadataStatus] = replication.StatusReplica
+	}
+
+	return meta, nil
+}
+
+// parseTTL accepts a number of seconds or a Go duration such as "36h"
+func parseTTL(v string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
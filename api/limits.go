@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// SizeLimits holds the maximum object size accepted globally and per bucket. Zero means unlimited.
+type SizeLimits struct {
+	mu      sync.RWMutex
+	global  int64
+	buckets map[string]int64
+}
+
+// BucketLimits is the size limit configuration of a bucket
+type BucketLimits struct {
+	MaxObjectSize int64 `json:"maxObjectSize"`
+}
+
+// LimitsInfo describes the configured size limits
+type LimitsInfo struct {
+	MaxObjectSize       int64            `json:"maxObjectSize"`
+	BucketMaxObjectSize map[string]int64 `json:"bucketMaxObjectSize,omitempty"`
+}
+
+// NewSizeLimits creates size limits with a global maximum object size
+func NewSizeLimits(maxObjectSize int64) *SizeLimits {
+	return &SizeLimits{
+		global:  maxObjectSize,
+		buckets: make(map[string]int64),
+	}
+}
+
+// SetBucket overrides the maximum object size of a bucket, it can't exceed the global limit
+func (l *SizeLimits) SetBucket(bucket string, maxObjectSize int64) error {
+	if maxObjectSize < 0 {
+		return errors.New("maximum object size must not be negative")
+	}
+	if l.global > 0 && (maxObjectSize == 0 || maxObjectSize > l.global) {
+		return errors.New("maximum object size can't exceed the global limit")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets[bucket] = maxObjectSize
+	return nil
+}
+
+// DeleteBucket removes the override of a bucket, which falls back to the
+// global limit, and reports whether it had one
+func (l *SizeLimits) DeleteBucket(bucket string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.buckets[bucket]
+	delete(l.buckets, bucket)
+	return ok
+}
+
+// Global returns the maximum object size of the service
+func (l *SizeLimits) Global() int64 {
+	return l.global
+}
+
+// For returns the maximum object size of a bucket
+func (l *SizeLimits) For(bucket string) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if max, ok := l.buckets[bucket]; ok {
+		return max
+	}
+	return l.global
+}
+
+// Info returns a snapshot of the configured limits
+func (l *SizeLimits) Info() LimitsInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	info := LimitsInfo{MaxObjectSize: l.global}
+	if len(l.buckets) > 0 {
+		info.BucketMaxObjectSize = make(map[string]int64, len(l.buckets))
+		for bucket, max := range l.buckets {
+			info.BucketMaxObjectSize[bucket] = max
+		}
+	}
+	return info
+}
+
+// putBucketLimitsHandler configures the maximum object size of a bucket.
+// @Summary Configure bucket limits
+// @Description Set the maximum object size accepted in the bucket, it can't exceed the global limit.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param limits body BucketLimits true "Bucket limits"
+// @Success 200 {object} BucketLimits
+// @Failure 400 {string} string "Bad Request"
+// @Router /buckets/{bucket}/limits [put]
+func putBucketLimitsHandler(limits *SizeLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var cfg BucketLimits
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid bucket limits", http.StatusBadRequest)
+			return
+		}
+		if err := limits.SetBucket(bucket, cfg.MaxObjectSize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// getBucketLimitsHandler returns the maximum object size of a bucket.
+// @Summary Get bucket limits
+// @Description Get the maximum object size accepted in the bucket (0 means unlimited).
+// @Tags buckets
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} BucketLimits
+// @Router /buckets/{bucket}/limits [get]
+func getBucketLimitsHandler(limits *SizeLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, BucketLimits{MaxObjectSize: limits.For(mux.Vars(r)["bucket"])})
+	}
+}
+
+// deleteBucketLimitsHandler removes the maximum object size of a bucket.
+// @Summary Delete bucket limits
+// @Description Remove the maximum object size of the bucket, which falls back to the global limit.
+// @Tags buckets
+// @Param bucket path string true "Bucket name"
+// @Success 200 {string} string "Deleted"
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/limits [delete]
+func deleteBucketLimitsHandler(limits *SizeLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limits.DeleteBucket(mux.Vars(r)["bucket"]) {
+			http.Error(w, "bucket limits not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// getLimitsHandler returns the size limits of the service and of every bucket.
+// @Summary Get size limits
+// @Description Get the global maximum object size and the limits configured on buckets, which are tenant-qualified.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} LimitsInfo
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/limits [get]
+func getLimitsHandler(limits *SizeLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, limits.Info())
+	}
+}
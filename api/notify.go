@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/notify"
+	"github.com/DanielePalaia/object-storage-service/queue"
+	"github.com/gorilla/mux"
+)
+
+// actionAdminNotifications is the action of the dead-letter administration routes
+const actionAdminNotifications = "admin:Notifications"
+
+// ReplayResponse reports how many dead-lettered deliveries were queued again
+type ReplayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// putNotificationsHandler replaces the webhooks of a bucket.
+// @Summary Configure bucket notifications
+// @Description Set the webhooks notified about object events (ObjectCreated:Put, ObjectRemoved:Delete) of the bucket, with optional prefix/suffix filters and HMAC secrets.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param config body notify.Configuration true "Notification configuration"
+// @Success 200 {object} notify.Configuration
+// @Failure 400 {string} string "Bad Request"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /buckets/{bucket}/notifications [put]
+func putNotificationsHandler(store *notify.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var cfg notify.Configuration
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid notification configuration", http.StatusBadRequest)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.Set(bucket, cfg); err != nil {
+			log.Println("Notification error:", err)
+			http.Error(w, "unable to save the notification configuration", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, cfg.Redacted())
+	}
+}
+
+// getNotificationsHandler returns the webhooks of a bucket.
+// @Summary Get bucket notifications
+// @Description Get the webhooks of the bucket, secrets are not returned.
+// @Tags buckets
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} notify.Configuration
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/notifications [get]
+func getNotificationsHandler(store *notify.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, ok := store.Get(mux.Vars(r)["bucket"])
+		if !ok {
+			http.Error(w, "notification configuration not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, cfg.Redacted())
+	}
+}
+
+// deleteNotificationsHandler removes the webhooks of a bucket.
+// @Summary Delete bucket notifications
+// @Description Remove the webhooks of the bucket, queued deliveries to them are dropped.
+// @Tags buckets
+// @Param bucket path string true "Bucket name"
+// @Success 200 {string} string "Deleted"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /buckets/{bucket}/notifications [delete]
+func deleteNotificationsHandler(store *notify.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deleted, err := store.Delete(mux.Vars(r)["bucket"])
+		if err != nil {
+			log.Println("Notification error:", err)
+			http.Error(w, "unable to save the notification configuration", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "notification configuration not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// listDeadLettersHandler lists the deliveries which exhausted their attempts.
+// @Summary List dead letters
+// @Description List the webhook deliveries which exhausted their attempts, with their last error.
+// @Tags admin
+// @Produce json
+// @Success 200 {array} notify.DeadLetter
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/notifications/dead-letters [get]
+func listDeadLettersHandler(d *notify.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.DeadLetters())
+	}
+}
+
+// replayDeadLetterHandler queues a dead-lettered delivery again.
+// @Summary Replay a dead letter
+// @Description Queue the dead-lettered delivery again with a fresh set of attempts.
+// @Tags admin
+// @Produce json
+// @Param id path string true "Dead letter ID"
+// @Success 200 {object} ReplayResponse
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /admin/notifications/dead-letters/{id}/replay [post]
+func replayDeadLetterHandler(d *notify.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := d.Replay(mux.Vars(r)["id"])
+		if errors.Is(err, queue.ErrNotFound) {
+			http.Error(w, "dead letter not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ReplayResponse{Replayed: 1})
+	}
+}
+
+// replayDeadLettersHandler queues every dead-lettered delivery again.
+// @Summary Replay all dead letters
+// @Description Queue every dead-lettered delivery again with a fresh set of attempts.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} ReplayResponse
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/notifications/dead-letters/replay [post]
+func replayDeadLettersHandler(d *notify.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		replayed, err := d.ReplayAll()
+		if err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ReplayResponse{Replayed: replayed})
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/cluster"
+	"github.com/DanielePalaia/object-storage-service/consensus"
+	"github.com/DanielePalaia/object-storage-service/events"
+	"github.com/DanielePalaia/object-storage-service/integrity"
+	"github.com/DanielePalaia/object-storage-service/lifecycle"
+	"github.com/DanielePalaia/object-storage-service/notify"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/policy"
+	"github.com/DanielePalaia/object-storage-service/quota"
+	"github.com/DanielePalaia/object-storage-service/ratelimit"
+	"github.com/DanielePalaia/object-storage-service/replication"
+	"github.com/DanielePalaia/object-storage-service/tenant"
+)
+
+// Option configures optional subsystems wired into the router
+type Option func(*options)
+
+type options struct {
+	compression *persistence.CompressedStorage
+	lifecycle   *lifecycle.Store
+	quotas      *quota.Manager
+	sizeLimits  *SizeLimits
+	authorizer  *policy.Authorizer
+	notify      *notify.Dispatcher
+	changes     *events.ChangeLog
+	replication *replication.Storage
+	cluster     *cluster.Cluster
+	raft        *consensus.Store
+	scrubber    *integrity.Scrubber
+
+	authenticators []auth.Authenticator
+	authRequired   bool
+	keys           *auth.KeyStore
+	tenants        *tenant.Registry
+
+	rateLimits  *ratelimit.Limiter
+	concurrency *ratelimit.Concurrency
+	bandwidth   *ratelimit.Bandwidth
+}
+
+// WithCompression enables per-bucket compression settings and serving
+// compressed objects with Content-Encoding to clients accepting it
+func WithCompression(cs *persistence.CompressedStorage) Option {
+	return func(o *options) {
+		o.compression = cs
+	}
+}
+
+// WithLifecycle enables the bucket lifecycle configuration endpoints
+func WithLifecycle(store *lifecycle.Store) Option {
+	return func(o *options) {
+		o.lifecycle = store
+	}
+}
+
+// WithQuotas enables the quota configuration and usage endpoints
+func WithQuotas(m *quota.Manager) Option {
+	return func(o *options) {
+		o.quotas = m
+	}
+}
+
+// WithSizeLimits enforces maximum object sizes on uploads
+func WithSizeLimits(l *SizeLimits) Option {
+	return func(o *options) {
+		o.sizeLimits = l
+	}
+}
+
+// WithNotifications enables the bucket notification endpoints and the
+// administration of the dead-lettered deliveries of d
+func WithNotifications(d *notify.Dispatcher) Option {
+	return func(o *options) {
+		o.notify = d
+	}
+}
+
+// WithAuthorizer evaluates bucket policies and ACLs before every handler and
+// enables the policy endpoints
+func WithAuthorizer(a *policy.Authorizer) Option {
+	return func(o *options) {
+		o.authorizer = a
+	}
+}
+
+// WithAPIKeys authenticates requests carrying an API key, enforces the roles
+// and scopes of the key and enables the key administration endpoints
+func WithAPIKeys(keys *auth.KeyStore) Option {
+	return func(o *options) {
+		o.keys = keys
+		o.authenticators = append(o.authenticators, keys)
+	}
+}
+
+// WithAuthenticator identifies principals with an additional authenticator, such as JWT bearer tokens
+func WithAuthenticator(a auth.Authenticator) Option {
+	return func(o *options) {
+		o.authenticators = append(o.authenticators, a)
+	}
+}
+
+// WithTenants isolates the buckets of every tenant in its own namespace and
+// enables the tenant administration endpoints
+func WithTenants(r *tenant.Registry) Option {
+	return func(o *options) {
+		o.tenants = r
+	}
+}
+
+// WithRateLimits throttles requests per principal, client IP and bucket
+func WithRateLimits(l *ratelimit.Limiter) Option {
+	return func(o *options) {
+		o.rateLimits = l
+	}
+}
+
+// WithConcurrencyLimit bounds the number of requests served at the same time
+func WithConcurrencyLimit(c *ratelimit.Concurrency) Option {
+	return func(o *options) {
+		o.concurrency = c
+	}
+}
+
+// WithBandwidth throttles the bytes per second of uploads and downloads and
+// enables the bandwidth administration endpoint
+func WithBandwidth(b *ratelimit.Bandwidth) Option {
+	return func(o *options) {
+		o.bandwidth = b
+	}
+}
+
+// WithChangeLog enables the watch endpoint streaming the changes of a bucket
+func WithChangeLog(l *events.ChangeLog) Option {
+	return func(o *options) {
+		o.changes = l
+	}
+}
+
+// WithReplication enables the bucket replication endpoints and reports the
+// replication status of objects
+func WithReplication(s *replication.Storage) Option {
+	return func(o *options) {
+		o.replication = s
+	}
+}
+
+// WithCluster serves the internal API other nodes of the cluster use to reach
+// this node, and the cluster administration endpoints
+func WithCluster(c *cluster.Cluster) Option {
+	return func(o *options) {
+		o.cluster = c
+	}
+}
+
+// WithRaft serves the API other nodes use to forward requests to the Raft
+// leader, and the Raft membership endpoints
+func WithRaft(s *consensus.Store) Option {
+	return func(o *options) {
+		o.raft = s
+	}
+}
+
+// WithScrubber enables the scrubber administration endpoints
+func WithScrubber(sc *integrity.Scrubber) Option {
+	return func(o *options) {
+		o.scrubber = sc
+	}
+}
+
+// WithAuthRequired rejects requests without credentials
+func WithAuthRequired(required bool) Option {
+	return func(o *options) {
+		o.authRequired = required
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/policy"
+	"github.com/gorilla/mux"
+)
+
+// ACLConfig is the canned ACL of a bucket
+type ACLConfig struct {
+	ACL string `json:"acl"`
+}
+
+// ExplainRequest describes a request to evaluate without performing it
+type ExplainRequest struct {
+	Principal auth.Principal `json:"principal"`
+	Action    string         `json:"action"`
+	Key       string         `json:"key,omitempty"`
+	SourceIP  string         `json:"sourceIp,omitempty"`
+}
+
+// authorizationMiddleware evaluates the action of the matched route against
+// the policy of its bucket. Routes are named after the action they perform,
+// routes without a bucket-scoped action are not subject to bucket policies.
+func authorizationMiddleware(a *policy.Authorizer) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			action := routeAction(r)
+			bucket, hasBucket := mux.Vars(r)["bucket"]
+			if !hasBucket || !(strings.HasPrefix(action, "object:") || strings.HasPrefix(action, "bucket:")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := mux.Vars(r)["objectID"]
+			if action == policy.ActionListObjects || action == policy.ActionWatchObjects {
+				key = r.URL.Query().Get("prefix")
+			}
+			decision := a.Authorize(policy.Request{
+				Principal: auth.PrincipalFrom(r.Context()),
+				Action:    action,
+				Bucket:    bucket,
+				Key:       key,
+				SourceIP:  sourceIP(r),
+			})
+			if !decision.Allowed {
+				log.Printf("Access denied: %s on %s/%s: %s", action, bucket, key, decision.Reason)
+				writeError(w, http.StatusForbidden, "AccessDenied", decision.Reason)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeAction returns the action performed by the matched route
+func routeAction(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		return route.GetName()
+	}
+	return ""
+}
+
+// sourceIP returns the address of the client performing the request
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// putPolicyHandler replaces the policy of a bucket.
+// @Summary Set bucket policy
+// @Description Replace the JSON policy of the bucket.
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param policy body policy.Policy true "Bucket policy"
+// @Success 200 {object} policy.Policy
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /buckets/{bucket}/policy [put]
+func putPolicyHandler(a *policy.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var p policy.Policy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid policy", http.StatusBadRequest)
+			return
+		}
+		if err := a.SetPolicy(bucket, p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, p)
+	}
+}
+
+// getPolicyHandler returns the policy of a bucket.
+// @Summary Get bucket policy
+// @Description Get the JSON policy of the bucket.
+// @Tags policies
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} policy.Policy
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/policy [get]
+func getPolicyHandler(a *policy.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := a.Policy(mux.Vars(r)["bucket"])
+		if !ok {
+			http.Error(w, "policy not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	}
+}
+
+// deletePolicyHandler removes the policy of a bucket.
+// @Summary Delete bucket policy
+// @Description Remove the JSON policy of the bucket.
+// @Tags policies
+// @Param bucket path string true "Bucket name"
+// @Success 200 {string} string "Deleted"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/policy [delete]
+func deletePolicyHandler(a *policy.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.DeletePolicy(mux.Vars(r)["bucket"]) {
+			http.Error(w, "policy not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// explainPolicyHandler evaluates a request against the bucket policy without performing it.
+// @Summary Explain an authorization decision
+// @Description Dry-run the authorization of an action and report why it is allowed or denied.
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param request body ExplainRequest true "Request to evaluate"
+// @Success 200 {object} policy.Decision
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /buckets/{bucket}/policy/explain [post]
+func explainPolicyHandler(a *policy.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ExplainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Action == "" {
+			http.Error(w, "invalid explain request", http.StatusBadRequest)
+			return
+		}
+
+		principal := &req.Principal
+		if principal.Name == "" || principal.Name == auth.Anonymous.Name {
+			principal = auth.Anonymous
+		}
+		writeJSON(w, http.StatusOK, a.Authorize(policy.Request{
+			Principal: principal,
+			Action:    req.Action,
+			Bucket:    mux.Vars(r)["bucket"],
+			Key:       req.Key,
+			SourceIP:  req.SourceIP,
+		}))
+	}
+}
+
+// putACLHandler sets the canned ACL of a bucket.
+// @Summary Set bucket ACL
+// @Description Set the canned ACL (private or public-read) of the bucket.
+// @Tags policies
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param acl body ACLConfig true "Canned ACL"
+// @Success 200 {object} ACLConfig
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /buckets/{bucket}/acl [put]
+func putACLHandler(a *policy.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cfg ACLConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid acl", http.StatusBadRequest)
+			return
+		}
+		acl, err := policy.ParseACL(cfg.ACL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.SetACL(mux.Vars(r)["bucket"], acl)
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// getACLHandler returns the canned ACL of a bucket.
+// @Summary Get bucket ACL
+// @Description Get the canned ACL of the bucket.
+// @Tags policies
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} ACLConfig
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/acl [get]
+func getACLHandler(a *policy.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		acl, ok := a.ACL(mux.Vars(r)["bucket"])
+		if !ok {
+			http.Error(w, "acl not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, ACLConfig{ACL: string(acl)})
+	}
+}
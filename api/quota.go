@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/DanielePalaia/object-storage-service/quota"
+	"github.com/gorilla/mux"
+)
+
+// TenantQuota is the quota configuration of a tenant and the buckets it owns
+type TenantQuota struct {
+	quota.Limits
+	Buckets []string `json:"buckets,omitempty"`
+}
+
+// UsageResponse reports the usage of every bucket and tenant
+type UsageResponse struct {
+	Buckets []quota.Report `json:"buckets"`
+	Tenants []quota.Report `json:"tenants"`
+}
+
+// putBucketQuotaHandler configures the quotas of a bucket.
+// @Summary Configure bucket quota
+// @Description Set the hard and soft byte and object count quotas of the bucket.
+// @Tags quotas
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param limits body quota.Limits true "Quota limits"
+// @Success 200 {object} quota.Report
+// @Failure 400 {string} string "Bad Request"
+// @Router /quotas/buckets/{bucket} [put]
+func putBucketQuotaHandler(m *quota.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var limits quota.Limits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid quota limits", http.StatusBadRequest)
+			return
+		}
+		if err := m.SetBucketLimits(bucket, limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, m.BucketReport(bucket))
+	}
+}
+
+// putTenantQuotaHandler configures the quotas of a tenant and the buckets counting towards it.
+// @Summary Configure tenant quota
+// @Description Set the hard and soft quotas of the tenant and assign buckets to it.
+// @Tags quotas
+// @Accept json
+// @Produce json
+// @Param tenant path string true "Tenant name"
+// @Param quota body TenantQuota true "Tenant quota"
+// @Success 200 {object} quota.Report
+// @Failure 400 {string} string "Bad Request"
+// @Router /quotas/tenants/{tenant} [put]
+func putTenantQuotaHandler(m *quota.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := mux.Vars(r)["tenant"]
+
+		var tq TenantQuota
+		if err := json.NewDecoder(r.Body).Decode(&tq); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid tenant quota", http.StatusBadRequest)
+			return
+		}
+		if err := m.SetTenantLimits(tenant, tq.Limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, bucket := range tq.Buckets {
+			m.AssignBucket(bucket, tenant)
+		}
+
+		writeJSON(w, http.StatusOK, m.TenantReport(tenant))
+	}
+}
+
+// getUsageHandler reports the usage of every bucket and tenant.
+// @Summary Get usage
+// @Description Report the current consumption and quotas of every bucket and tenant.
+// @Tags quotas
+// @Produce json
+// @Success 200 {object} UsageResponse
+// @Router /usage [get]
+func getUsageHandler(m *quota.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buckets, tenants := m.Reports()
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+		sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+		writeJSON(w, http.StatusOK, UsageResponse{Buckets: buckets, Tenants: tenants})
+	}
+}
+
+// getBucketUsageHandler reports the usage of a bucket.
+// @Summary Get bucket usage
+// @Description Report the current consumption and quotas of the bucket.
+// @Tags quotas
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} quota.Report
+// @Router /usage/buckets/{bucket} [get]
+func getBucketUsageHandler(m *quota.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.BucketReport(mux.Vars(r)["bucket"]))
+	}
+}
+
+// getTenantUsageHandler reports the usage of a tenant.
+// @Summary Get tenant usage
+// @Description Report the current consumption and quotas of the tenant.
+// @Tags quotas
+// @Produce json
+// @Param tenant path string true "Tenant name"
+// @Success 200 {object} quota.Report
+// @Router /usage/tenants/{tenant} [get]
+func getTenantUsageHandler(m *quota.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.TenantReport(mux.Vars(r)["tenant"]))
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/policy"
+	"github.com/DanielePalaia/object-storage-service/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// actionAdminBandwidth is the action of the bandwidth administration routes
+const actionAdminBandwidth = "admin:Bandwidth"
+
+// rateLimitMiddleware throttles requests per principal, client IP and bucket.
+// It runs after the tenant middleware so that buckets of different tenants
+// have separate limits.
+func rateLimitMiddleware(l *ratelimit.Limiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if routeAction(r) == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			req := ratelimit.Request{
+				Key:    principalKey(r),
+				IP:     sourceIP(r),
+				Bucket: mux.Vars(r)["bucket"],
+				Class:  ratelimit.ClassWrite,
+			}
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				req.Class = ratelimit.ClassRead
+			}
+
+			if ok, retryAfter := l.Allow(req); !ok {
+				setRetryAfter(w, retryAfter)
+				writeError(w, http.StatusTooManyRequests, "SlowDown", "rate limit exceeded, retry later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// concurrencyMiddleware bounds the requests served at the same time, requests
+// above the limit are queued and rejected when the queue is full or they
+// waited too long. Watch streams are not counted since they stay open for as
+// long as the client follows the bucket.
+func concurrencyMiddleware(c *ratelimit.Concurrency) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if action := routeAction(r); action == "" || action == policy.ActionWatchObjects {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			release, err := c.Acquire(r.Context())
+			if errors.Is(err, ratelimit.ErrQueueFull) || errors.Is(err, ratelimit.ErrQueueTimeout) {
+				setRetryAfter(w, time.Second)
+				writeError(w, http.StatusTooManyRequests, "SlowDown", err.Error())
+				return
+			}
+			if err != nil {
+				log.Println("Request abandoned while queued:", err)
+				return
+			}
+			defer release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// principalKey identifies the principal of the request for per key limits,
+// anonymous requests have no key
+func principalKey(r *http.Request) string {
+	principal := auth.PrincipalFrom(r.Context())
+	if principal.IsAnonymous() {
+		return ""
+	}
+	return principal.Tenant + "/" + principal.Name
+}
+
+// putBandwidthHandler changes the bandwidth limits at runtime.
+// @Summary Set bandwidth limits
+// @Description Set the global, per key and per connection bytes per second limits of uploads and downloads. Running transfers are adjusted.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param limits body ratelimit.BandwidthConfig true "Bandwidth limits"
+// @Success 200 {object} ratelimit.BandwidthConfig
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/bandwidth [put]
+func putBandwidthHandler(b *ratelimit.Bandwidth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cfg ratelimit.BandwidthConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid bandwidth limits", http.StatusBadRequest)
+			return
+		}
+		if err := b.SetConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// getBandwidthHandler returns the bandwidth limits.
+// @Summary Get bandwidth limits
+// @Description Get the bytes per second limits of uploads and downloads.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} ratelimit.BandwidthConfig
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/bandwidth [get]
+func getBandwidthHandler(b *ratelimit.Bandwidth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, b.Config())
+	}
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
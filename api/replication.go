@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/replication"
+	"github.com/gorilla/mux"
+)
+
+// actionAdminReplication is the action of the replication resync route
+const actionAdminReplication = "admin:Replication"
+
+// ResyncResponse reports how many objects were queued for replication
+type ResyncResponse struct {
+	Queued int `json:"queued"`
+}
+
+// putReplicationHandler replaces the replication rules of a bucket.
+// @Summary Configure bucket replication
+// @Description Set the rules replicating the objects put and deleted in the bucket to remote instances of the service, with optional key prefixes. API keys are never returned.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Param config body replication.Configuration true "Replication configuration"
+// @Success 200 {object} replication.Configuration
+// @Failure 400 {string} string "Bad Request"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /buckets/{bucket}/replication [put]
+func putReplicationHandler(store *replication.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+
+		var cfg replication.Configuration
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid replication configuration", http.StatusBadRequest)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.Set(bucket, cfg); err != nil {
+			log.Println("Replication error:", err)
+			http.Error(w, "unable to save the replication configuration", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, cfg.Redacted())
+	}
+}
+
+// getReplicationHandler returns the replication rules of a bucket.
+// @Summary Get bucket replication
+// @Description Get the replication rules of the bucket, API keys are not returned.
+// @Tags buckets
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 200 {object} replication.Configuration
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/replication [get]
+func getReplicationHandler(store *replication.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, ok := store.Get(mux.Vars(r)["bucket"])
+		if !ok {
+			http.Error(w, "replication configuration not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, cfg.Redacted())
+	}
+}
+
+// deleteReplicationHandler removes the replication rules of a bucket.
+// @Summary Delete bucket replication
+// @Description Remove the replication rules of the bucket, queued operations for them are dropped.
+// @Tags buckets
+// @Param bucket path string true "Bucket name"
+// @Success 200 {string} string "Deleted"
+// @Failure 404 {string} string "Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /buckets/{bucket}/replication [delete]
+func deleteReplicationHandler(store *replication.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deleted, err := store.Delete(mux.Vars(r)["bucket"])
+		if err != nil {
+			log.Println("Replication error:", err)
+			http.Error(w, "unable to save the replication configuration", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "replication configuration not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// resyncReplicationHandler queues the replication of every object of a bucket.
+// @Summary Resync bucket replication
+// @Description Queue the replication of every object of the bucket, to bring a new or lagging replica up to date.
+// @Tags admin
+// @Produce json
+// @Param bucket path string true "Bucket name"
+// @Success 202 {object} ResyncResponse
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /buckets/{bucket}/replication/resync [post]
+func resyncReplicationHandler(s *replication.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queued, err := s.Resync(mux.Vars(r)["bucket"])
+		if errors.Is(err, replication.ErrNotConfigured) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, ResyncResponse{Queued: queued})
+	}
+}
@@ -6,9 +6,13 @@ import (
 
 	_ "github.com/DanielePalaia/object-storage-service/docs"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	httpSwagger "github.com/swaggo/http-swagger"
 
+	"github.com/DanielePalaia/object-storage-service/cluster"
+	"github.com/DanielePalaia/object-storage-service/consensus"
 	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/policy"
 )
 
 type Server struct {
@@ -25,17 +29,120 @@ type Server struct {
 // @host localhost:8080
 // @BasePath /
 //
-// RegisterRoutes attaches HTTP handlers to the router
-func RegisterRoutes(r *mux.Router, storage domain.Storage) {
+// RegisterRoutes attaches HTTP handlers to the router. Routes are named
+// after the action they perform, which is what authorization evaluates.
+func RegisterRoutes(r *mux.Router, storage domain.Storage, opts ...Option) {
+	o := newOptions(opts)
+
 	r.Use(loggingMiddleware)
-	r.HandleFunc("/objects/{bucket}/{objectID}", putObjectHandler(storage)).Methods("PUT")
-	r.HandleFunc("/objects/{bucket}/{objectID}", getObjectHandler(storage)).Methods("GET")
-	r.HandleFunc("/objects/{bucket}/{objectID}", deleteObjectHandler(storage)).Methods("DELETE")
-	r.HandleFunc("/health", HealthHandler).Methods("GET")
+	if o.concurrency != nil {
+		r.Use(concurrencyMiddleware(o.concurrency))
+	}
+	if len(o.authenticators) > 0 {
+		r.Use(authenticationMiddleware(o.authenticators, o.authRequired))
+		r.Use(roleMiddleware)
+	}
+	if o.tenants != nil {
+		r.Use(tenantMiddleware(o.tenants))
+	}
+	if o.rateLimits != nil {
+		r.Use(rateLimitMiddleware(o.rateLimits))
+	}
+	if o.authorizer != nil {
+		r.Use(authorizationMiddleware(o.authorizer))
+	}
+
+	r.HandleFunc("/objects/{bucket}/{objectID}", putObjectHandler(storage, o)).Methods("PUT").Name(policy.ActionPutObject)
+	r.HandleFunc("/objects/{bucket}/{objectID}", getObjectHandler(storage, o)).Methods("GET", "HEAD").Name(policy.ActionGetObject)
+	r.HandleFunc("/objects/{bucket}/{objectID}", deleteObjectHandler(storage)).Methods("DELETE").Name(policy.ActionDeleteObject)
+	r.HandleFunc("/objects/{bucket}", listObjectsHandler(storage)).Methods("GET").Name(policy.ActionListObjects)
+	r.HandleFunc("/health", healthHandler(o)).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	if o.compression != nil {
+		r.HandleFunc("/buckets/{bucket}/compression", putCompressionHandler(o.compression)).Methods("PUT").Name(policy.ActionPutConfiguration)
+		r.HandleFunc("/buckets/{bucket}/compression", getCompressionHandler(o.compression)).Methods("GET").Name(policy.ActionGetConfiguration)
+	}
+	if o.lifecycle != nil {
+		r.HandleFunc("/buckets/{bucket}/lifecycle", putLifecycleHandler(o.lifecycle)).Methods("PUT").Name(policy.ActionPutConfiguration)
+		r.HandleFunc("/buckets/{bucket}/lifecycle", getLifecycleHandler(o.lifecycle)).Methods("GET").Name(policy.ActionGetConfiguration)
+		r.HandleFunc("/buckets/{bucket}/lifecycle", deleteLifecycleHandler(o.lifecycle)).Methods("DELETE").Name(policy.ActionDeleteConfiguration)
+	}
+	if o.sizeLimits != nil {
+		r.HandleFunc("/buckets/{bucket}/limits", putBucketLimitsHandler(o.sizeLimits)).Methods("PUT").Name(policy.ActionPutConfiguration)
+		r.HandleFunc("/buckets/{bucket}/limits", getBucketLimitsHandler(o.sizeLimits)).Methods("GET").Name(policy.ActionGetConfiguration)
+		r.HandleFunc("/buckets/{bucket}/limits", deleteBucketLimitsHandler(o.sizeLimits)).Methods("DELETE").Name(policy.ActionDeleteConfiguration)
+		r.HandleFunc("/admin/limits", getLimitsHandler(o.sizeLimits)).Methods("GET").Name(actionAdminLimits)
+	}
+	if o.notify != nil {
+		r.HandleFunc("/buckets/{bucket}/notifications", putNotificationsHandler(o.notify.Store())).Methods("PUT").Name(policy.ActionPutConfiguration)
+		r.HandleFunc("/buckets/{bucket}/notifications", getNotificationsHandler(o.notify.Store())).Methods("GET").Name(policy.ActionGetConfiguration)
+		r.HandleFunc("/buckets/{bucket}/notifications", deleteNotificationsHandler(o.notify.Store())).Methods("DELETE").Name(policy.ActionDeleteConfiguration)
+		r.HandleFunc("/admin/notifications/dead-letters", listDeadLettersHandler(o.notify)).Methods("GET").Name(actionAdminNotifications)
+		r.HandleFunc("/admin/notifications/dead-letters/replay", replayDeadLettersHandler(o.notify)).Methods("POST").Name(actionAdminNotifications)
+		r.HandleFunc("/admin/notifications/dead-letters/{id}/replay", replayDeadLetterHandler(o.notify)).Methods("POST").Name(actionAdminNotifications)
+	}
+	if o.changes != nil {
+		r.HandleFunc("/buckets/{bucket}/watch", watchHandler(o.changes)).Methods("GET").Name(policy.ActionWatchObjects)
+	}
+	if o.replication != nil {
+		r.HandleFunc("/buckets/{bucket}/replication", putReplicationHandler(o.replication.Store())).Methods("PUT").Name(policy.ActionPutConfiguration)
+		r.HandleFunc("/buckets/{bucket}/replication", getReplicationHandler(o.replication.Store())).Methods("GET").Name(policy.ActionGetConfiguration)
+		r.HandleFunc("/buckets/{bucket}/replication", deleteReplicationHandler(o.replication.Store())).Methods("DELETE").Name(policy.ActionDeleteConfiguration)
+		r.HandleFunc("/buckets/{bucket}/replication/resync", resyncReplicationHandler(o.replication)).Methods("POST").Name(actionAdminReplication)
+	}
+	if o.authorizer != nil {
+		r.HandleFunc("/buckets/{bucket}/policy", putPolicyHandler(o.authorizer)).Methods("PUT").Name(policy.ActionPutPolicy)
+		r.HandleFunc("/buckets/{bucket}/policy", getPolicyHandler(o.authorizer)).Methods("GET").Name(policy.ActionGetPolicy)
+		r.HandleFunc("/buckets/{bucket}/policy", deletePolicyHandler(o.authorizer)).Methods("DELETE").Name(policy.ActionDeletePolicy)
+		r.HandleFunc("/buckets/{bucket}/policy/explain", explainPolicyHandler(o.authorizer)).Methods("POST").Name(policy.ActionGetPolicy)
+		r.HandleFunc("/buckets/{bucket}/acl", putACLHandler(o.authorizer)).Methods("PUT").Name(policy.ActionPutACL)
+		r.HandleFunc("/buckets/{bucket}/acl", getACLHandler(o.authorizer)).Methods("GET").Name(policy.ActionGetACL)
+	}
+	if o.quotas != nil {
+		r.HandleFunc("/quotas/buckets/{bucket}", putBucketQuotaHandler(o.quotas)).Methods("PUT").Name(actionAdminQuotas)
+		r.HandleFunc("/quotas/tenants/{tenant}", putTenantQuotaHandler(o.quotas)).Methods("PUT").Name(actionAdminQuotas)
+		r.HandleFunc("/usage", getUsageHandler(o.quotas)).Methods("GET").Name(actionAdminQuotas)
+		r.HandleFunc("/usage/buckets/{bucket}", getBucketUsageHandler(o.quotas)).Methods("GET").Name(actionAdminQuotas)
+		r.HandleFunc("/usage/tenants/{tenant}", getTenantUsageHandler(o.quotas)).Methods("GET").Name(actionAdminQuotas)
+	}
+	if o.keys != nil {
+		r.HandleFunc("/admin/keys", createKeyHandler(o.keys, o.tenants)).Methods("POST").Name(actionAdminKeys)
+		r.HandleFunc("/admin/keys", listKeysHandler(o.keys)).Methods("GET").Name(actionAdminKeys)
+		r.HandleFunc("/admin/keys/{id}", revokeKeyHandler(o.keys)).Methods("DELETE").Name(actionAdminKeys)
+	}
+	if o.bandwidth != nil {
+		r.HandleFunc("/admin/bandwidth", putBandwidthHandler(o.bandwidth)).Methods("PUT").Name(actionAdminBandwidth)
+		r.HandleFunc("/admin/bandwidth", getBandwidthHandler(o.bandwidth)).Methods("GET").Name(actionAdminBandwidth)
+	}
+	if o.cluster != nil {
+		// The internal API is authenticated with the cluster secret rather than client credentials
+		r.PathPrefix(cluster.PathPrefix + "/").Handler(o.cluster.Handler())
+		r.HandleFunc("/admin/cluster", getClusterHandler(o.cluster)).Methods("GET").Name(actionAdminCluster)
+		r.HandleFunc("/admin/cluster/placement/{bucket}/{objectID}", getPlacementHandler(o.cluster)).Methods("GET").Name(actionAdminCluster)
+	}
+	if o.raft != nil {
+		// Requests forwarded to the leader are authenticated with the cluster secret
+		r.PathPrefix(consensus.PathPrefix + "/").Handler(o.raft.Handler())
+		r.HandleFunc("/admin/raft", getRaftHandler(o.raft)).Methods("GET").Name(actionAdminRaft)
+		r.HandleFunc("/admin/raft/members", addRaftMemberHandler(o.raft)).Methods("POST").Name(actionAdminRaft)
+		r.HandleFunc("/admin/raft/members/{id}", removeRaftMemberHandler(o.raft)).Methods("DELETE").Name(actionAdminRaft)
+	}
+	if o.scrubber != nil {
+		r.HandleFunc("/admin/scrub", getScrubHandler(o.scrubber)).Methods("GET").Name(actionAdminScrub)
+		r.HandleFunc("/admin/scrub", triggerScrubHandler(o.scrubber)).Methods("POST").Name(actionAdminScrub)
+	}
+	if o.tenants != nil {
+		r.HandleFunc("/admin/tenants", createTenantHandler(o.tenants, o.quotas)).Methods("POST").Name(actionAdminTenants)
+		r.HandleFunc("/admin/tenants", listTenantsHandler(o.tenants)).Methods("GET").Name(actionAdminTenants)
+		r.HandleFunc("/admin/tenants/{tenant}", getTenantHandler(o.tenants)).Methods("GET").Name(actionAdminTenants)
+		r.HandleFunc("/admin/tenants/{tenant}/suspend", suspendTenantHandler(o.tenants)).Methods("POST").Name(actionAdminTenants)
+		r.HandleFunc("/admin/tenants/{tenant}/resume", resumeTenantHandler(o.tenants)).Methods("POST").Name(actionAdminTenants)
+	}
 }
 
 // NewServer creates a new server instance with storage and port config
-func NewServer(storage domain.Storage, port string) *Server {
+func NewServer(storage domain.Storage, port string, opts ...Option) *Server {
 	s := &Server{
 		router:  mux.NewRouter(),
 		storage: storage,
@@ -43,7 +150,7 @@ func NewServer(storage domain.Storage, port string) *Server {
 	}
 
 	// Register API routes
-	RegisterRoutes(s.router, s.storage)
+	RegisterRoutes(s.router, s.storage, opts...)
 
 	// Register swagger UI route
 	s.setupSwagger()
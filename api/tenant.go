@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/quota"
+	"github.com/DanielePalaia/object-storage-service/tenant"
+	"github.com/gorilla/mux"
+)
+
+// TenantHeader lets administrators act within the namespace of a tenant
+const TenantHeader = "X-Tenant"
+
+// actionAdminTenants is the action of the tenant administration routes
+const actionAdminTenants = "admin:Tenants"
+
+// CreateTenantRequest is the body of a tenant creation
+type CreateTenantRequest struct {
+	Name string `json:"name"`
+	// Quota optionally sets the quotas of the tenant
+	Quota *quota.Limits `json:"quota,omitempty"`
+}
+
+// tenantMiddleware scopes requests of a tenant principal to its namespace by
+// qualifying the bucket of the route, see domain.TenantBucket. Requests of
+// unknown or suspended tenants are rejected. Principals without a tenant use
+// the global namespace, global administrators can pick a tenant with
+// X-Tenant. Tenant principals are confined to their own tenant.
+func tenantMiddleware(registry *tenant.Registry) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := auth.PrincipalFrom(r.Context())
+			name := principal.Tenant
+			if header := r.Header.Get(TenantHeader); header != "" {
+				if name != "" {
+					writeError(w, http.StatusForbidden, "AccessDenied", "tenant principals cannot use "+TenantHeader)
+					return
+				}
+				if principal.HasRole(auth.RoleAdmin) {
+					name = header
+				}
+			}
+			if name == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err := registry.Admit(name); err != nil {
+				code := "UnknownTenant"
+				if errors.Is(err, tenant.ErrSuspended) {
+					code = "TenantSuspended"
+				}
+				writeError(w, http.StatusForbidden, code, err.Error())
+				return
+			}
+
+			vars := mux.Vars(r)
+			if bucket, ok := vars["bucket"]; ok {
+				vars["bucket"] = domain.TenantBucket(name, bucket)
+				r = mux.SetURLVars(r, vars)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// createTenantHandler creates a tenant.
+// @Summary Create a tenant
+// @Description Create a tenant with its own bucket namespace and optional quotas.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param tenant body CreateTenantRequest true "Tenant"
+// @Success 201 {object} tenant.Tenant
+// @Failure 400 {string} string "Bad Request"
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 409 {string} string "Conflict"
+// @Router /admin/tenants [post]
+func createTenantHandler(registry *tenant.Registry, quotas *quota.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateTenantRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Println("Request error:", err)
+			http.Error(w, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		if req.Quota != nil {
+			if quotas == nil {
+				http.Error(w, "quotas are not enabled", http.StatusBadRequest)
+				return
+			}
+			if err := req.Quota.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		t, err := registry.Create(req.Name)
+		if errors.Is(err, tenant.ErrAlreadyExist) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Quota != nil {
+			quotas.SetTenantLimits(t.Name, *req.Quota)
+		}
+		writeJSON(w, http.StatusCreated, t)
+	}
+}
+
+// listTenantsHandler lists the tenants.
+// @Summary List tenants
+// @Description List the tenants and their status.
+// @Tags admin
+// @Produce json
+// @Success 200 {array} tenant.Tenant
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Router /admin/tenants [get]
+func listTenantsHandler(registry *tenant.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, registry.List())
+	}
+}
+
+// getTenantHandler returns a tenant.
+// @Summary Get a tenant
+// @Description Get the status of the tenant.
+// @Tags admin
+// @Produce json
+// @Param tenant path string true "Tenant name"
+// @Success 200 {object} tenant.Tenant
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /admin/tenants/{tenant} [get]
+func getTenantHandler(registry *tenant.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := registry.Get(mux.Vars(r)["tenant"])
+		if !ok {
+			http.Error(w, "tenant not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
+
+// suspendTenantHandler suspends a tenant.
+// @Summary Suspend a tenant
+// @Description Reject every request of the tenant until it is resumed, its data is kept.
+// @Tags admin
+// @Produce json
+// @Param tenant path string true "Tenant name"
+// @Success 200 {object} tenant.Tenant
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /admin/tenants/{tenant}/suspend [post]
+func suspendTenantHandler(registry *tenant.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := registry.Suspend(mux.Vars(r)["tenant"])
+		if err != nil {
+			http.Error(w, "tenant not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
+
+// resumeTenantHandler reactivates a suspended tenant.
+// @Summary Resume a tenant
+// @Description Accept the requests of a suspended tenant again.
+// @Tags admin
+// @Produce json
+// @Param tenant path string true "Tenant name"
+// @Success 200 {object} tenant.Tenant
+// @Failure 403 {object} ErrorResponse "Access Denied"
+// @Failure 404 {string} string "Not Found"
+// @Router /admin/tenants/{tenant}/resume [post]
+func resumeTenantHandler(registry *tenant.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := registry.Resume(mux.Vars(r)["tenant"])
+		if err != nil {
+			http.Error(w, "tenant not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
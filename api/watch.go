@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/events"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// watchKeepalive is how often an idle event stream sends a comment, so
+	// that proxies don't close it
+	watchKeepalive = 15 * time.Second
+	// watchBatch bounds the changes read from the change log at once
+	watchBatch = 100
+	// Default and maximum time a long-poll waits for changes
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 2 * time.Minute
+)
+
+// Types of the changes reported by the watch endpoint
+const (
+	WatchCreate    = "create"
+	WatchOverwrite = "overwrite"
+	WatchDelete    = "delete"
+)
+
+// WatchEvent is a change of an object of the watched bucket
+type WatchEvent struct {
+	Cursor uint64    `json:"cursor"`
+	Type   string    `json:"type"`
+	Key    string    `json:"key"`
+	Size   int64     `json:"size,omitempty"`
+	ETag   string    `json:"etag,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// WatchResponse is the body of a long-poll watch. Reset is set when the
+// cursor had expired: changes were missed and the client should list the
+// bucket again before following it from Cursor.
+type WatchResponse struct {
+	Cursor uint64       `json:"cursor"`
+	Reset  bool         `json:"reset,omitempty"`
+	Events []WatchEvent `json:"events"`
+}
+
+func newWatchEvent(c events.Change) WatchEvent {
+	e := WatchEvent{Cursor: c.Seq, Key: c.Key, Size: c.Size, ETag: c.ETag, Time: c.Time}
+	switch {
+	case c.Type == events.ObjectRemovedDelete, c.Type == events.ObjectRemovedEvicted:
+		e.Type = WatchDelete
+	case c.Overwrite:
+		e.Type = WatchOverwrite
+	default:
+		e.Type = WatchCreate
+	}
+	return e
+}
+
+// watchHandler follows the changes of a bucket.
+// @Summary Watch bucket changes
+// @Description Stream the objects created, overwritten and deleted in the bucket as Server-Sent Events when the client accepts text/event-stream, or long-poll for them otherwise. Event IDs are cursors: a stream resumes after the Last-Event-ID header (or the cursor parameter), without one only new changes are reported. A "reset" event (or reset flag) reports that the cursor is older than the retained changes.
+// @Tags buckets
+// @Produce json
+// @Produce text/event-stream
+// @Param bucket path string true "Bucket name"
+// @Param prefix query string false "Only report objects with this key prefix"
+// @Param cursor query integer false "Report changes after this cursor"
+// @Param timeout query string false "How long a long-poll waits for changes, such as 30s"
+// @Success 200 {object} WatchResponse
+// @Failure 400 {string} string "Bad Request"
+// @Router /buckets/{bucket}/watch [get]
+func watchHandler(changes *events.ChangeLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket := mux.Vars(r)["bucket"]
+		prefix := r.URL.Query().Get("prefix")
+		match := func(e events.Event) bool {
+			return e.Bucket == bucket && strings.HasPrefix(e.Key, prefix)
+		}
+
+		cursor := changes.Cursor()
+		param := r.Header.Get("Last-Event-ID")
+		if param == "" {
+			param = r.URL.Query().Get("cursor")
+		}
+		if param != "" {
+			var err error
+			if cursor, err = strconv.ParseUint(param, 10, 64); err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			streamChanges(w, r, changes, cursor, match)
+			return
+		}
+
+		timeout := defaultWatchTimeout
+		if param := r.URL.Query().Get("timeout"); param != "" {
+			d, err := time.ParseDuration(param)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = min(d, maxWatchTimeout)
+		}
+		pollChanges(w, r, changes, cursor, match, timeout)
+	}
+}
+
+// streamChanges sends the changes after cursor as Server-Sent Events until the client goes away
+func streamChanges(w http.ResponseWriter, r *http.Request, changes *events.ChangeLog, cursor uint64, match func(events.Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	signal, cancel := changes.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+	for {
+		batch, next, err := changes.Read(cursor, match, watchBatch)
+		if errors.Is(err, events.ErrCursorExpired) {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {\"cursor\":%d}\n\n", next, next); err != nil {
+				return
+			}
+			flusher.Flush()
+			cursor = next
+			continue
+		}
+		for _, c := range batch {
+			e := newWatchEvent(c)
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, e.Type, data); err != nil {
+				return
+			}
+		}
+		if len(batch) > 0 {
+			flusher.Flush()
+		}
+		cursor = next
+		if len(batch) == watchBatch {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-signal:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// pollChanges responds with the changes after cursor as soon as there are
+// some, or with none once timeout elapsed
+func pollChanges(w http.ResponseWriter, r *http.Request, changes *events.ChangeLog, cursor uint64, match func(events.Event) bool, timeout time.Duration) {
+	signal, cancel := changes.Subscribe()
+	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for timedOut := false; ; {
+		batch, next, err := changes.Read(cursor, match, watchBatch)
+		if errors.Is(err, events.ErrCursorExpired) {
+			writeJSON(w, http.StatusOK, WatchResponse{Cursor: next, Reset: true, Events: []WatchEvent{}})
+			return
+		}
+		cursor = next
+		if len(batch) > 0 || timedOut {
+			resp := WatchResponse{Cursor: cursor, Events: make([]WatchEvent, 0, len(batch))}
+			for _, c := range batch {
+				resp.Events = append(resp.Events, newWatchEvent(c))
+			}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-signal:
+		case <-timer.C:
+			timedOut = true
+		}
+	}
+}
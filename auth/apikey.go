@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyHeader is the request header carrying an API key token
+const APIKeyHeader = "X-API-Key"
+
+// APIKey is a credential granting roles on a set of scopes until it expires.
+// Only the hash of the secret is kept, the secret itself is returned once on creation.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Roles     []string   `json:"roles"`
+	Scopes    []Scope    `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+
+	secretHash [sha256.Size]byte
+}
+
+// KeyStore holds the API keys and authenticates requests carrying them
+type KeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*APIKey
+	now  func() time.Time
+}
+
+// NewKeyStore creates an empty API key store
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		keys: make(map[string]*APIKey),
+		now:  time.Now,
+	}
+}
+
+// Create generates a new API key, acting within the namespace of tenant if not
+// empty, and returns it with its token ("<id>.<secret>"). The token can't be
+// retrieved later.
+func (s *KeyStore) Create(name, tenant string, roles []string, scopes []Scope, expiresAt *time.Time) (APIKey, string, error) {
+	if name == "" {
+		return APIKey{}, "", errors.New("name is required")
+	}
+	if len(roles) == 0 {
+		return APIKey{}, "", errors.New("at least one role is required")
+	}
+	for _, role := range roles {
+		if role != RoleAdmin && role != RoleReader && role != RoleWriter && role != RoleReplication {
+			return APIKey{}, "", fmt.Errorf("unknown role %q", role)
+		}
+	}
+	for _, scope := range scopes {
+		if scope.Bucket == "" {
+			return APIKey{}, "", errors.New("scope bucket is required")
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := s.add(id, secret, name, tenant, roles, scopes, expiresAt)
+	return key, id + "." + secret, nil
+}
+
+// Import registers a key with a known token, it is meant to bootstrap an admin key from configuration
+func (s *KeyStore) Import(token, name string, roles []string) (APIKey, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || len(secret) < 16 {
+		return APIKey{}, errors.New("token must be <id>.<secret> with a secret of at least 16 characters")
+	}
+	return s.add(id, secret, name, "", roles, nil, nil), nil
+}
+
+func (s *KeyStore) add(id, secret, name, tenant string, roles []string, scopes []Scope, expiresAt *time.Time) APIKey {
+	key := &APIKey{
+		ID:         id,
+		Name:       name,
+		Tenant:     tenant,
+		Roles:      roles,
+		Scopes:     scopes,
+		CreatedAt:  s.now().UTC(),
+		ExpiresAt:  expiresAt,
+		secretHash: sha256.Sum256([]byte(secret)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[id] = key
+	return *key
+}
+
+// List returns every API key, sorted by creation time
+func (s *KeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Revoke deletes an API key
+func (s *KeyStore) Revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.keys[id]
+	delete(s.keys, id)
+	return ok
+}
+
+// Authenticate identifies requests carrying an API key in the X-API-Key header
+func (s *KeyStore) Authenticate(r *http.Request) (*Principal, error) {
+	token := r.Header.Get(APIKeyHeader)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], key.secretHash[:]) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	now := s.now().UTC()
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return nil, ErrExpiredCredentials
+	}
+	key.LastUsed = &now
+
+	return &Principal{Name: key.Name, Tenant: key.Tenant, Roles: key.Roles, Scopes: key.Scopes}, nil
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
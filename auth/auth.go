@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the request carries no credentials they handle
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned when credentials are unknown, revoked or malformed
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrExpiredCredentials is returned when credentials are no longer valid
+	ErrExpiredCredentials = errors.New("expired credentials")
+)
+
+// Authenticator identifies the principal performing a request
+type Authenticator interface {
+	// Authenticate returns ErrNoCredentials when the request carries no credentials it handles
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticate tries every authenticator in turn and returns the first
+// principal identified, or Anonymous when no credentials were presented
+func Authenticate(r *http.Request, authenticators []Authenticator) (*Principal, error) {
+	for _, a := range authenticators {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return Anonymous, nil
+}
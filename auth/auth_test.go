@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyStore_CreateAuthenticateRevoke(t *testing.T) {
+	store := NewKeyStore()
+	key, token, err := store.Create("ci", "", []string{RoleWriter}, []Scope{{Bucket: "builds", Prefix: "ci/"}}, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(APIKeyHeader, token)
+	p, err := store.Authenticate(req)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if p.Name != "ci" || !p.HasRole(RoleWriter) || p.HasRole(RoleReader) {
+		t.Errorf("unexpected principal: %+v", p)
+	}
+	if !p.InScope("builds", "ci/artifact") || p.InScope("builds", "release/artifact") || p.InScope("other", "ci/x") {
+		t.Errorf("unexpected scope evaluation for %+v", p.Scopes)
+	}
+	if keys := store.List(); len(keys) != 1 || keys[0].LastUsed == nil {
+		t.Errorf("expected last used timestamp to be recorded, got %+v", keys)
+	}
+
+	// A wrong secret is rejected
+	req.Header.Set(APIKeyHeader, key.ID+".wrong")
+	if _, err := store.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+
+	// A revoked key is rejected
+	if !store.Revoke(key.ID) {
+		t.Fatalf("Revoke failed")
+	}
+	req.Header.Set(APIKeyHeader, token)
+	if _, err := store.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected revoked key to be rejected, got %v", err)
+	}
+}
+
+func TestKeyStore_Expiry(t *testing.T) {
+	store := NewKeyStore()
+	expires := time.Now().Add(time.Hour)
+	_, token, err := store.Create("dashboard", "", []string{RoleReader}, nil, &expires)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(APIKeyHeader, token)
+	if _, err := store.Authenticate(req); err != nil {
+		t.Fatalf("expected key to be valid before expiry, got %v", err)
+	}
+
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := store.Authenticate(req); !errors.Is(err, ErrExpiredCredentials) {
+		t.Errorf("expected expired credentials, got %v", err)
+	}
+}
+
+func TestKeyStore_SecretIsHashed(t *testing.T) {
+	store := NewKeyStore()
+	key, token, _ := store.Create("ci", "", []string{RoleWriter}, nil, nil)
+	secret := strings.TrimPrefix(token, key.ID+".")
+
+	if store.keys[key.ID].secretHash != sha256.Sum256([]byte(secret)) {
+		t.Errorf("expected the hash of the secret to be stored")
+	}
+	listed, err := json.Marshal(store.List())
+	if err != nil {
+		t.Fatalf("could not marshal keys: %v", err)
+	}
+	if strings.Contains(string(listed), secret) {
+		t.Errorf("expected secret not to be exposed when listing keys")
+	}
+}
+
+func TestAuthenticate_NoCredentials(t *testing.T) {
+	p, err := Authenticate(httptest.NewRequest("GET", "/", nil), []Authenticator{NewKeyStore()})
+	if err != nil || !p.IsAnonymous() {
+		t.Errorf("expected anonymous principal, got %+v (err %v)", p, err)
+	}
+}
@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig configures the validation of OIDC bearer tokens
+type JWTConfig struct {
+	// JWKS is the URL (http or https) or the file path of the JSON Web Key Set
+	JWKS string
+	// Issuer and Audience must match the iss and aud claims, they are required
+	// so that tokens issued for other services are not accepted
+	Issuer   string
+	Audience string
+	// RefreshInterval is how long the key set is cached before being fetched again
+	RefreshInterval time.Duration
+	// Leeway tolerates clock skew when checking exp, nbf and iat
+	Leeway time.Duration
+
+	// TenantClaim, BucketsClaim and RolesClaim name the claims mapped to the
+	// tenant, allowed buckets and roles of the principal
+	TenantClaim  string
+	BucketsClaim string
+	RolesClaim   string
+	// DefaultRoles are granted when the token has no roles claim
+	DefaultRoles []string
+}
+
+// signingMethods are the algorithms accepted for bearer tokens
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// minRefetchInterval rate-limits fetching the key set when a token references an unknown key
+const minRefetchInterval = 10 * time.Second
+
+// JWTAuthenticator identifies requests carrying an "Authorization: Bearer" JWT
+type JWTAuthenticator struct {
+	cfg    JWTConfig
+	keys   *JWKS
+	parser *jwt.Parser
+}
+
+// NewJWTAuthenticator creates an authenticator validating tokens against cfg
+func NewJWTAuthenticator(cfg JWTConfig) (*JWTAuthenticator, error) {
+	if cfg.JWKS == "" {
+		return nil, errors.New("a JWKS url or file is required")
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("an issuer and an audience are required")
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "tenant"
+	}
+	if cfg.BucketsClaim == "" {
+		cfg.BucketsClaim = "buckets"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	if cfg.DefaultRoles == nil {
+		cfg.DefaultRoles = []string{RoleReader, RoleWriter}
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.Audience),
+	}
+
+	return &JWTAuthenticator{
+		cfg:    cfg,
+		keys:   NewJWKS(cfg.JWKS, cfg.RefreshInterval),
+		parser: jwt.NewParser(opts...),
+	}, nil
+}
+
+// Authenticate validates the bearer token and maps its claims to a principal
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	scheme, raw, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(strings.TrimSpace(raw), claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.Key(kid)
+	})
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrExpiredCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, fmt.Errorf("%w: missing sub claim", ErrInvalidCredentials)
+	}
+	p := &Principal{Name: subject, Roles: a.cfg.DefaultRoles}
+	if tenant, ok := claims[a.cfg.TenantClaim].(string); ok {
+		p.Tenant = tenant
+	}
+	if roles, ok := stringsClaim(claims, a.cfg.RolesClaim); ok {
+		p.Roles = roles
+	}
+	if buckets, ok := stringsClaim(claims, a.cfg.BucketsClaim); ok {
+		p.Scopes = make([]Scope, 0, len(buckets))
+		for _, bucket := range buckets {
+			p.Scopes = append(p.Scopes, Scope{Bucket: bucket})
+		}
+	}
+	return p, nil
+}
+
+// stringsClaim reads a claim holding a list of strings or a space separated string
+func stringsClaim(claims jwt.MapClaims, name string) ([]string, bool) {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v), true
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// JWKS is a cached JSON Web Key Set loaded from a URL or a file. The set is
+// reloaded when it gets older than the refresh interval, or earlier when a
+// token references an unknown key so that key rotations are picked up.
+// Lookups don't wait for a reload in progress unless the set was never
+// loaded, the new set is swapped in once fetched.
+type JWKS struct {
+	source     string
+	refresh    time.Duration
+	minRefetch time.Duration
+	client     *http.Client
+
+	// loading serializes the reloads of the set
+	loading sync.Mutex
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWKS creates a key set loaded lazily from source
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{
+		source:     source,
+		refresh:    refresh,
+		minRefetch: minRefetchInterval,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key returns the public key identified by kid. An empty kid is accepted when the set holds a single key.
+func (s *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	keys, fetchedAt := s.snapshot()
+	if keys == nil || time.Since(fetchedAt) > s.refresh {
+		if err := s.load(fetchedAt); err != nil && keys == nil {
+			return nil, err
+		}
+		keys, fetchedAt = s.snapshot()
+	}
+	if key, ok := lookup(keys, kid); ok {
+		return key, nil
+	}
+	if time.Since(fetchedAt) > s.minRefetch {
+		if err := s.load(fetchedAt); err != nil {
+			return nil, err
+		}
+		keys, _ = s.snapshot()
+		if key, ok := lookup(keys, kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// snapshot returns the current key set and when it was fetched
+func (s *JWKS) snapshot() (map[string]crypto.PublicKey, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys, s.fetchedAt
+}
+
+func lookup(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// load fetches and parses the key set, then swaps it in. The set is not
+// fetched again when another lookup reloaded it since seen.
+func (s *JWKS) load(seen time.Time) error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	if _, fetchedAt := s.snapshot(); !fetchedAt.Equal(seen) {
+		return nil
+	}
+
+	data, err := s.fetch()
+	if err != nil {
+		return fmt.Errorf("loading JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parsing JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// A key of an unsupported type doesn't prevent using the others
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("JWKS: skipping key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *JWKS) fetch() ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(s.source, "file://"))
+	}
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// jsonWebKey is a public key of a JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
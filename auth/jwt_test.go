@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testJWKS serves the public part of a set of RSA keys
+type testJWKS struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+	// unsupported are published along the keys
+	unsupported []jsonWebKey
+}
+
+func (s *testJWKS) add(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+	return key
+}
+
+func (s *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for kid, key := range s.keys {
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kid: kid,
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	set.Keys = append(set.Keys, s.unsupported...)
+	json.NewEncoder(w).Encode(set)
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return signed
+}
+
+func bearer(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	jwks := &testJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	key := jwks.add(t, "k1")
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	a, err := NewJWTAuthenticator(JWTConfig{JWKS: server.URL, Issuer: "https://idp", Audience: "storage"})
+	if err != nil {
+		t.Fatalf("NewJWTAuthenticator failed: %v", err)
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://idp",
+			"aud": "storage",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	// Claims are mapped to the principal
+	claims := valid()
+	claims["tenant"] = "acme"
+	claims["roles"] = []string{RoleReader}
+	claims["buckets"] = "photos docs"
+	p, err := a.Authenticate(bearer(sign(t, key, "k1", claims)))
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if p.Name != "alice" || p.Tenant != "acme" || !p.HasRole(RoleReader) || p.HasRole(RoleWriter) {
+		t.Errorf("unexpected principal: %+v", p)
+	}
+	if !p.InScope("photos", "a.jpg") || !p.InScope("docs", "x") || p.InScope("other", "x") {
+		t.Errorf("unexpected scopes: %+v", p.Scopes)
+	}
+
+	// Without a roles claim the default roles are granted
+	p, err = a.Authenticate(bearer(sign(t, key, "k1", valid())))
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if !p.HasRole(RoleReader) || !p.HasRole(RoleWriter) || p.Scopes != nil {
+		t.Errorf("unexpected default principal: %+v", p)
+	}
+
+	// Expired tokens
+	claims = valid()
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err := a.Authenticate(bearer(sign(t, key, "k1", claims))); !errors.Is(err, ErrExpiredCredentials) {
+		t.Errorf("expected expired credentials, got %v", err)
+	}
+
+	// Wrong issuer and audience
+	claims = valid()
+	claims["iss"] = "https://other"
+	if _, err := a.Authenticate(bearer(sign(t, key, "k1", claims))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials for wrong issuer, got %v", err)
+	}
+	claims = valid()
+	claims["aud"] = "other"
+	if _, err := a.Authenticate(bearer(sign(t, key, "k1", claims))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials for wrong audience, got %v", err)
+	}
+
+	// A token signed by an unknown key
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := a.Authenticate(bearer(sign(t, other, "k1", valid()))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials for bad signature, got %v", err)
+	}
+
+	// No bearer token at all
+	if _, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+}
+
+func TestNewJWTAuthenticator_RequiresIssuerAndAudience(t *testing.T) {
+	for _, cfg := range []JWTConfig{
+		{JWKS: "jwks.json", Audience: "storage"},
+		{JWKS: "jwks.json", Issuer: "https://idp"},
+	} {
+		if _, err := NewJWTAuthenticator(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestJWKS_KeyRotation(t *testing.T) {
+	jwks := &testJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	jwks.add(t, "k1")
+	// Keys which can't be used don't prevent using the others
+	jwks.unsupported = []jsonWebKey{{Kid: "oct", Kty: "oct"}, {Kid: "bad-ec", Kty: "EC", Crv: "P-192"}}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	a, err := NewJWTAuthenticator(JWTConfig{JWKS: server.URL, Issuer: "https://idp", Audience: "storage"})
+	if err != nil {
+		t.Fatalf("NewJWTAuthenticator failed: %v", err)
+	}
+	claims := jwt.MapClaims{"sub": "bob", "iss": "https://idp", "aud": "storage", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if _, err := a.keys.Key("k1"); err != nil {
+		t.Fatalf("Key failed: %v", err)
+	}
+
+	// A new key published by the provider is picked up on first use
+	rotated := jwks.add(t, "k2")
+	a.keys.minRefetch = 0
+	if _, err := a.Authenticate(bearer(sign(t, rotated, "k2", claims))); err != nil {
+		t.Fatalf("expected rotated key to be accepted, got %v", err)
+	}
+	if jwks.fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", jwks.fetches)
+	}
+
+	// Unknown keys are not refetched more often than minRefetch
+	a.keys.minRefetch = time.Hour
+	if _, err := a.Authenticate(bearer(sign(t, rotated, "k3", claims))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected invalid credentials for unknown kid, got %v", err)
+	}
+	if jwks.fetches != 2 {
+		t.Errorf("expected no refetch within minRefetch, got %d fetches", jwks.fetches)
+	}
+}
+
+func TestJWKS_ConcurrentLookups(t *testing.T) {
+	jwks := &testJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	jwks.add(t, "k1")
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	// Lookups racing on an empty set fetch it once
+	keys := NewJWKS(server.URL, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keys.Key("k1"); err != nil {
+				t.Errorf("Key failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if jwks.fetches != 1 {
+		t.Errorf("expected a single fetch, got %d", jwks.fetches)
+	}
+}
@@ -0,0 +1,80 @@
+// Package auth carries the identity of the caller through request handling.
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	// RoleAdmin grants every permission, including the administration endpoints
+	RoleAdmin = "admin"
+	// RoleReader grants reading and listing objects
+	RoleReader = "reader"
+	// RoleWriter grants uploading and deleting objects
+	RoleWriter = "writer"
+	// RoleReplication grants uploading and deleting the replicas of another instance
+	RoleReplication = "replication"
+)
+
+// Scope restricts a principal to the objects of a bucket starting with a prefix.
+// Bucket "*" matches every bucket.
+type Scope struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// Principal is the authenticated identity performing a request
+type Principal struct {
+	Name   string   `json:"name"`
+	Tenant string   `json:"tenant,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	// Scopes restricts the objects the principal can access, nil means unrestricted
+	Scopes []Scope `json:"scopes,omitempty"`
+}
+
+// Anonymous is the principal of unauthenticated requests
+var Anonymous = &Principal{Name: "anonymous"}
+
+// HasRole reports whether the principal has the given role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// InScope reports whether the principal scopes cover the object key of bucket
+func (p *Principal) InScope(bucket, key string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if (s.Bucket == "*" || s.Bucket == bucket) && strings.HasPrefix(key, s.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAnonymous reports whether the principal is unauthenticated
+func (p *Principal) IsAnonymous() bool {
+	return p == Anonymous
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal carried by the context, Anonymous if there is none
+func PrincipalFrom(ctx context.Context) *Principal {
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok && p != nil {
+		return p
+	}
+	return Anonymous
+}
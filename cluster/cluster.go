@@ -0,0 +1,471 @@
+// Package cluster spreads objects over several nodes of the service. Objects
+// are placed by consistent hashing and stored on a configurable number of
+// nodes, requests for objects owned by other nodes are proxied to them.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	aliveNodes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cluster_alive_nodes",
+		Help: "Nodes of the cluster currently reachable, including this one.",
+	})
+	proxiedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cluster_proxied_requests_total",
+		Help: "Storage operations sent to other nodes, by operation.",
+	}, []string{"operation"})
+	rebalances = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_rebalances_total",
+		Help: "Rebalancing runs triggered by membership changes.",
+	})
+	rebalancedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cluster_rebalanced_objects_total",
+		Help: "Objects handled by rebalancing, by action (copied, dropped or deleted).",
+	}, []string{"action"})
+)
+
+// Node is a member of the cluster
+type Node struct {
+	ID string `json:"id"`
+	// URL is the base URL other nodes reach the node at, such as "http://node-1:8080"
+	URL string `json:"url"`
+}
+
+// ParsePeers parses a comma separated list of "<id>=<url>" nodes, such as
+// "node-1=http://node-1:8080,node-2=http://node-2:8080"
+func ParsePeers(peers string) ([]Node, error) {
+	var nodes []Node
+	for _, item := range strings.Split(peers, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, rawURL, ok := strings.Cut(item, "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid peer %q: expected <id>=<url>", item)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer %q: url must be an absolute http or https url", item)
+		}
+		nodes = append(nodes, Node{ID: id, URL: strings.TrimSuffix(rawURL, "/")})
+	}
+	return nodes, nil
+}
+
+// Config describes the cluster as seen by one node
+type Config struct {
+	// Self is the ID of this node, it must be one of Nodes
+	Self string
+	// Nodes is the static list of members, including this node
+	Nodes []Node
+	// ReplicationFactor is the number of nodes storing every object
+	ReplicationFactor int
+	// VirtualNodes is the number of positions of every node on the ring
+	VirtualNodes int
+	// Secret authenticates the requests between nodes, it is required
+	Secret string
+	// ProbeInterval is how often peers are checked
+	ProbeInterval time.Duration
+	// TombstoneTTL is how long deletions are remembered, so that the copies
+	// held by nodes unreachable at the time are not restored by rebalancing
+	TombstoneTTL time.Duration
+	// TombstoneFile is the file deletions are logged to so that they survive
+	// a restart, they are only kept in memory when it is empty
+	TombstoneFile string
+}
+
+// MemberStatus describes a member as seen by this node
+type MemberStatus struct {
+	Node
+	Self  bool `json:"self"`
+	Alive bool `json:"alive"`
+}
+
+// Cluster is a node of the cluster. It is a domain.Storage placing objects
+// on the nodes owning them, keeping those owned by this node in its local
+// storage.
+//
+// Membership comes from the static list of nodes: peers are probed
+// periodically and the ring only holds the reachable ones. When membership
+// changes, objects are rebalanced: every node copies the objects it holds to
+// their new owners missing them and drops those it no longer owns.
+type Cluster struct {
+	local  domain.Storage
+	lister domain.Lister
+	config Config
+	self   Node
+	client *http.Client
+
+	mu    sync.RWMutex
+	alive map[string]bool
+	ring  *Ring
+
+	// tombstones records when objects were deleted on this node, and
+	// tombstoneLog persists them when configured
+	tombstonesMu sync.Mutex
+	tombstones   map[objectRef]time.Time
+	tombstoneLog *tombstoneLog
+
+	rebalance chan struct{}
+}
+
+type objectRef struct {
+	bucket, objectID string
+}
+
+// errDeleted is returned when copying an object deleted after it was written
+var errDeleted = errors.New("object was deleted")
+
+// New creates the node config.Self of a cluster storing its objects in local
+func New(local domain.Storage, config Config) (*Cluster, error) {
+	lister, ok := local.(domain.Lister)
+	if !ok {
+		return nil, errors.New("cluster storage must support listing")
+	}
+	if config.Secret == "" {
+		return nil, errors.New("cluster secret is required")
+	}
+	if config.ReplicationFactor <= 0 {
+		config.ReplicationFactor = 1
+	}
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = 128
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = 5 * time.Second
+	}
+	if config.TombstoneTTL <= 0 {
+		config.TombstoneTTL = 24 * time.Hour
+	}
+
+	c := &Cluster{
+		local:      local,
+		lister:     lister,
+		config:     config,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		alive:      make(map[string]bool),
+		tombstones: make(map[objectRef]time.Time),
+		rebalance:  make(chan struct{}, 1),
+	}
+	ids := make(map[string]bool)
+	for _, n := range config.Nodes {
+		if ids[n.ID] {
+			return nil, fmt.Errorf("duplicate node %q", n.ID)
+		}
+		ids[n.ID] = true
+		if n.ID == config.Self {
+			c.self = n
+		}
+		// Peers are assumed to be up until probed
+		c.alive[n.ID] = true
+	}
+	if c.self.ID == "" {
+		return nil, fmt.Errorf("node %q is not a member of the cluster", config.Self)
+	}
+	if config.TombstoneFile != "" {
+		l, tombstones, err := openTombstoneLog(config.TombstoneFile, config.TombstoneTTL, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("loading tombstones: %w", err)
+		}
+		c.tombstoneLog, c.tombstones = l, tombstones
+	}
+	c.buildRing()
+	return c, nil
+}
+
+// buildRing places the alive nodes on the ring, c.mu must be held
+func (c *Cluster) buildRing() {
+	var ids []string
+	for id, alive := range c.alive {
+		if alive {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	c.ring = NewRing(ids, c.config.VirtualNodes)
+	aliveNodes.Set(float64(len(ids)))
+}
+
+// Self returns this node
+func (c *Cluster) Self() Node {
+	return c.self
+}
+
+// ReplicationFactor returns the number of nodes storing every object
+func (c *Cluster) ReplicationFactor() int {
+	return c.config.ReplicationFactor
+}
+
+// Members returns the members of the cluster and whether they are reachable
+func (c *Cluster) Members() []MemberStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	members := make([]MemberStatus, 0, len(c.config.Nodes))
+	for _, n := range c.config.Nodes {
+		members = append(members, MemberStatus{Node: n, Self: n.ID == c.self.ID, Alive: c.alive[n.ID]})
+	}
+	return members
+}
+
+// Owners returns the nodes storing an object, its primary owner first
+func (c *Cluster) Owners(bucket, objectID string) []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var owners []Node
+	for _, id := range c.ring.Owners(bucket+"/"+objectID, c.config.ReplicationFactor) {
+		owners = append(owners, c.node(id))
+	}
+	return owners
+}
+
+// reachable returns the alive nodes
+func (c *Cluster) reachable() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var nodes []Node
+	for _, n := range c.config.Nodes {
+		if c.alive[n.ID] {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (c *Cluster) node(id string) Node {
+	for _, n := range c.config.Nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return Node{ID: id}
+}
+
+// Run probes the peers and rebalances objects on membership changes until ctx is done
+func (c *Cluster) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.ProbeInterval)
+	defer ticker.Stop()
+
+	// Objects held from a previous membership are placed again on startup
+	c.triggerRebalance()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.probe(ctx)
+			c.pruneTombstones(time.Now())
+		case <-c.rebalance:
+			c.rebalanceObjects(ctx)
+		}
+	}
+}
+
+// probe checks every peer and rebuilds the ring when membership changed
+func (c *Cluster) probe(ctx context.Context) {
+	results := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, n := range c.config.Nodes {
+		if n.ID == c.self.ID {
+			continue
+		}
+		wg.Add(1)
+		go func(n Node) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, min(c.config.ProbeInterval, 2*time.Second))
+			defer cancel()
+			err := c.ping(probeCtx, n)
+			mu.Lock()
+			results[n.ID] = err == nil
+			mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	changed := false
+	for id, alive := range results {
+		if c.alive[id] != alive {
+			if alive {
+				log.Printf("Cluster: node %s is up", id)
+			} else {
+				log.Printf("Cluster: node %s is down", id)
+			}
+			c.alive[id] = alive
+			changed = true
+		}
+	}
+	if changed {
+		c.buildRing()
+	}
+	c.mu.Unlock()
+
+	if changed {
+		c.triggerRebalance()
+	}
+}
+
+// bury records the deletion of an object, it fails when the deletion can't
+// be persisted
+func (c *Cluster) bury(bucket, objectID string) error {
+	c.tombstonesMu.Lock()
+	defer c.tombstonesMu.Unlock()
+	ref, now := objectRef{bucket, objectID}, time.Now()
+	if c.tombstoneLog != nil {
+		if err := c.tombstoneLog.append(ref, now); err != nil {
+			return fmt.Errorf("recording the deletion of %s/%s: %w", bucket, objectID, err)
+		}
+	}
+	c.tombstones[ref] = now
+	return nil
+}
+
+// unbury forgets the deletion of an object written again
+func (c *Cluster) unbury(bucket, objectID string) {
+	c.tombstonesMu.Lock()
+	defer c.tombstonesMu.Unlock()
+	ref := objectRef{bucket, objectID}
+	if _, ok := c.tombstones[ref]; !ok {
+		return
+	}
+	delete(c.tombstones, ref)
+	if c.tombstoneLog != nil {
+		// A deletion left in the log only refuses copies older than it after a restart
+		if err := c.tombstoneLog.append(ref, time.Time{}); err != nil {
+			log.Printf("Cluster error: forgetting the deletion of %s/%s: %v", bucket, objectID, err)
+		}
+	}
+}
+
+// deletedSince reports whether the object was deleted after modTime
+func (c *Cluster) deletedSince(bucket, objectID string, modTime time.Time) bool {
+	c.tombstonesMu.Lock()
+	defer c.tombstonesMu.Unlock()
+	deleted, ok := c.tombstones[objectRef{bucket, objectID}]
+	return ok && !modTime.After(deleted)
+}
+
+// pruneTombstones forgets the deletions older than the TombstoneTTL
+func (c *Cluster) pruneTombstones(now time.Time) {
+	c.tombstonesMu.Lock()
+	defer c.tombstonesMu.Unlock()
+	pruned := false
+	for ref, deleted := range c.tombstones {
+		if now.Sub(deleted) > c.config.TombstoneTTL {
+			delete(c.tombstones, ref)
+			pruned = true
+		}
+	}
+	if pruned && c.tombstoneLog != nil {
+		if err := c.tombstoneLog.compact(c.tombstones); err != nil {
+			log.Printf("Cluster error: compacting the tombstones: %v", err)
+		}
+	}
+}
+
+func (c *Cluster) triggerRebalance() {
+	select {
+	case c.rebalance <- struct{}{}:
+	default:
+	}
+}
+
+// rebalanceObjects copies the local objects to their owners missing them and
+// drops the local copies of objects this node no longer owns, or which were
+// deleted while this node was unreachable
+func (c *Cluster) rebalanceObjects(ctx context.Context) {
+	rebalances.Inc()
+	buckets, err := c.lister.ListBuckets()
+	if err != nil {
+		log.Println("Cluster: rebalancing failed:", err)
+		return
+	}
+	for _, bucket := range buckets {
+		infos, err := c.lister.ListObjects(bucket, "")
+		if err != nil {
+			log.Printf("Cluster: rebalancing %s failed: %v", bucket, err)
+			continue
+		}
+		for _, info := range infos {
+			if ctx.Err() != nil {
+				return
+			}
+			c.rebalanceObject(ctx, bucket, info)
+		}
+	}
+}
+
+func (c *Cluster) rebalanceObject(ctx context.Context, bucket string, info domain.ObjectInfo) {
+	objectID := info.ID
+	if c.deletedSince(bucket, objectID, info.ModTime) {
+		c.dropDeleted(bucket, objectID)
+		return
+	}
+	owned, handedOff := false, true
+	for _, owner := range c.Owners(bucket, objectID) {
+		if owner.ID == c.self.ID {
+			owned = true
+			continue
+		}
+		exists, err := c.remoteExists(ctx, owner, bucket, objectID)
+		if err == nil && !exists {
+			var data []byte
+			var meta domain.Metadata
+			data, meta, err = domain.GetWithMetadata(c.local, bucket, objectID)
+			if errors.Is(err, domain.ErrNotFound) {
+				// Deleted meanwhile
+				return
+			}
+			if err == nil {
+				_, err = c.remotePut(ctx, owner, bucket, objectID, data, meta, info.ModTime)
+			}
+			if errors.Is(err, errDeleted) {
+				// The owner saw a deletion newer than this copy
+				c.dropDeleted(bucket, objectID)
+				return
+			}
+			if err == nil {
+				rebalancedObjects.WithLabelValues("copied").Inc()
+			}
+		}
+		if err != nil {
+			log.Printf("Cluster: handing %s/%s off to %s failed: %v", bucket, objectID, owner.ID, err)
+			handedOff = false
+		}
+	}
+	if !owned && handedOff {
+		if err := c.local.Delete(bucket, objectID); err == nil {
+			rebalancedObjects.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+// dropDeleted removes the stale local copy of a deleted object
+func (c *Cluster) dropDeleted(bucket, objectID string) {
+	if err := c.bury(bucket, objectID); err != nil {
+		log.Println("Cluster error:", err)
+		return
+	}
+	if err := c.local.Delete(bucket, objectID); err == nil {
+		rebalancedObjects.WithLabelValues("deleted").Inc()
+	}
+}
@@ -0,0 +1,301 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+)
+
+func TestRing_Owners(t *testing.T) {
+	nodes := []string{"node-1", "node-2", "node-3"}
+	ring := NewRing(nodes, 128)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owners := ring.Owners(fmt.Sprintf("bucket/key-%d", i), 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("expected 2 distinct owners, got %v", owners)
+		}
+		counts[owners[0]]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 700 || counts[node] > 1300 {
+			t.Errorf("unbalanced ring: %v", counts)
+		}
+	}
+	if owners := ring.Owners("key", 5); len(owners) != 3 {
+		t.Errorf("expected owners to be bounded by the nodes, got %v", owners)
+	}
+
+	// Only the keys of the removed node move
+	smaller := NewRing([]string{"node-1", "node-2"}, 128)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("bucket/key-%d", i)
+		before, after := ring.Owners(key, 1)[0], smaller.Owners(key, 1)[0]
+		if before != "node-3" && before != after {
+			t.Fatalf("key %s moved from %s to %s", key, before, after)
+		}
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	nodes, err := ParsePeers("node-1=http://a:8080/, node-2=https://b")
+	if err != nil || len(nodes) != 2 || nodes[0].URL != "http://a:8080" || nodes[1].ID != "node-2" {
+		t.Fatalf("unexpected peers %+v (err %v)", nodes, err)
+	}
+	for _, invalid := range []string{"node-1", "=http://a", "node-1=a:8080"} {
+		if _, err := ParsePeers(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+type testNode struct {
+	cluster *Cluster
+	local   *persistence.InMemoryStorage
+	server  *httptest.Server
+}
+
+// startCluster runs n nodes on loopback
+func startCluster(t *testing.T, n, replicationFactor int) []*testNode {
+	var members []Node
+	servers := make([]*httptest.Server, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		members = append(members, Node{ID: fmt.Sprintf("node-%d", i+1), URL: "http://" + servers[i].Listener.Addr().String()})
+	}
+
+	nodes := make([]*testNode, n)
+	for i, server := range servers {
+		local := persistence.NewInMemoryStorage()
+		c, err := New(local, Config{Self: members[i].ID, Nodes: members, ReplicationFactor: replicationFactor, Secret: "s3cr3t"})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		server.Config.Handler = c.Handler()
+		server.Start()
+		t.Cleanup(server.Close)
+		nodes[i] = &testNode{cluster: c, local: local, server: server}
+	}
+	return nodes
+}
+
+// holders returns the nodes storing an object locally
+func holders(nodes []*testNode, bucket, objectID string) map[string]bool {
+	held := make(map[string]bool)
+	for _, n := range nodes {
+		if _, err := n.local.Get(bucket, objectID); err == nil {
+			held[n.cluster.Self().ID] = true
+		}
+	}
+	return held
+}
+
+func TestCluster_PlacesAndProxies(t *testing.T) {
+	nodes := startCluster(t, 3, 2)
+	entry := nodes[0].cluster
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := entry.Put("acme/photos", key, []byte(key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		held := holders(nodes, "acme/photos", key)
+		owners := entry.Owners("acme/photos", key)
+		if len(held) != 2 || !held[owners[0].ID] || !held[owners[1].ID] {
+			t.Fatalf("expected %s on its owners %v, held by %v", key, owners, held)
+		}
+	}
+
+	// Every node serves every object
+	data, err := nodes[2].cluster.Get("acme/photos", "key-7")
+	if err != nil || string(data) != "key-7" {
+		t.Errorf("expected key-7 from another node, got %q (err %v)", data, err)
+	}
+	infos, err := nodes[1].cluster.ListObjects("acme/photos", "key-1")
+	if err != nil || len(infos) != 11 {
+		t.Errorf("expected 11 objects listed once, got %d (err %v)", len(infos), err)
+	}
+	buckets, _ := nodes[2].cluster.ListBuckets()
+	if len(buckets) != 1 || buckets[0] != "acme/photos" {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+
+	// Metadata updates reach every copy
+	if err := nodes[2].cluster.UpdateMetadata("acme/photos", "key-3", domain.Metadata{"status": "done"}); err != nil {
+		t.Fatalf("UpdateMetadata failed: %v", err)
+	}
+	for _, n := range nodes {
+		if data, meta, err := n.local.GetWithMetadata("acme/photos", "key-3"); err == nil && (string(data) != "key-3" || meta["status"] != "done") {
+			t.Errorf("%s: expected the metadata of key-3 to be updated, got %q %v", n.cluster.Self().ID, data, meta)
+		}
+	}
+	if err := entry.UpdateMetadata("acme/photos", "missing", domain.Metadata{"status": "done"}); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := nodes[1].cluster.Delete("acme/photos", "key-7"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if held := holders(nodes, "acme/photos", "key-7"); len(held) != 0 {
+		t.Errorf("expected key-7 to be deleted everywhere, held by %v", held)
+	}
+	if _, err := entry.Get("acme/photos", "key-7"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := entry.Delete("acme/photos", "key-7"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCluster_RebalancesOnMembershipChange(t *testing.T) {
+	nodes := startCluster(t, 3, 2)
+	for i := 0; i < 30; i++ {
+		nodes[0].cluster.Put("photos", fmt.Sprintf("key-%d", i), []byte("data"))
+	}
+
+	// node-3 leaves, the survivors take its objects over
+	nodes[2].server.Close()
+	ctx := context.Background()
+	for _, n := range nodes[:2] {
+		n.cluster.probe(ctx)
+		if alive := n.cluster.reachable(); len(alive) != 2 {
+			t.Fatalf("expected 2 alive nodes, got %v", alive)
+		}
+		n.cluster.rebalanceObjects(ctx)
+	}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if held := holders(nodes[:2], "photos", key); len(held) != 2 {
+			t.Errorf("expected %s to be replicated on the survivors, held by %v", key, held)
+		}
+	}
+
+	// With a single copy per object, node-1 drops the objects now owned by node-2
+	rf1, err := New(nodes[0].local, Config{Self: "node-1", Nodes: nodes[0].cluster.config.Nodes, ReplicationFactor: 1, Secret: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rf1.probe(ctx)
+	rf1.rebalanceObjects(ctx)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := rf1.Owners("photos", key)[0].ID
+		if _, err := nodes[0].local.Get("photos", key); (err == nil) != (owner == "node-1") {
+			t.Errorf("expected node-1 to hold %s only if it owns it (owner %s)", key, owner)
+		}
+	}
+}
+
+func TestCluster_DeletionsSurviveUnreachableNodes(t *testing.T) {
+	nodes := startCluster(t, 3, 2)
+	ctx := context.Background()
+	key := ""
+	for i := 0; key == ""; i++ {
+		candidate := fmt.Sprintf("key-%d", i)
+		if owners := nodes[0].cluster.Owners("photos", candidate); owners[0].ID != "node-3" && owners[1].ID != "node-3" {
+			key = candidate
+		}
+	}
+	// node-3 holds a copy from an earlier membership and is unreachable
+	// while the object is deleted
+	nodes[2].local.Put("photos", key, []byte("stale"))
+	nodes[0].cluster.Put("photos", key, []byte("stale"))
+	nodes[0].cluster.mu.Lock()
+	nodes[0].cluster.alive["node-3"] = false
+	nodes[0].cluster.mu.Unlock()
+	if err := nodes[0].cluster.Delete("photos", key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// Back, node-3 drops its copy instead of restoring it on the owners
+	nodes[2].cluster.rebalanceObjects(ctx)
+	if held := holders(nodes, "photos", key); len(held) != 0 {
+		t.Errorf("expected the deleted object not to be restored, held by %v", held)
+	}
+
+	// Writing the object again forgets the deletion
+	if _, err := nodes[0].cluster.Put("photos", key, []byte("new")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	nodes[2].local.Put("photos", key, []byte("new"))
+	nodes[2].cluster.rebalanceObjects(ctx)
+	if held := holders(nodes, "photos", key); len(held) != 2 || held["node-3"] {
+		t.Errorf("expected the object to be held by its owners only, held by %v", held)
+	}
+
+	nodes[0].cluster.bury("photos", "old")
+	nodes[0].cluster.pruneTombstones(time.Now().Add(25 * time.Hour))
+	if nodes[0].cluster.deletedSince("photos", "old", time.Time{}) {
+		t.Errorf("expected expired tombstones to be pruned")
+	}
+}
+
+func TestCluster_TombstonesSurviveRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tombstones.log")
+	config := Config{Self: "node-1", Nodes: []Node{{ID: "node-1", URL: "http://node-1"}}, Secret: "s3cr3t", TombstoneFile: path}
+	local := persistence.NewInMemoryStorage()
+	c, err := New(local, config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	c.Put("photos", "deleted", []byte("a"))
+	c.Delete("photos", "deleted")
+	c.Put("photos", "rewritten", []byte("b"))
+	c.Delete("photos", "rewritten")
+	c.Put("photos", "rewritten", []byte("c"))
+
+	restarted, err := New(local, config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if !restarted.deletedSince("photos", "deleted", time.Now().Add(-time.Minute)) {
+		t.Errorf("expected the deletion to survive a restart")
+	}
+	if restarted.deletedSince("photos", "rewritten", time.Time{}) {
+		t.Errorf("expected the deletion of an object written again to be forgotten")
+	}
+
+	// Expired deletions are dropped from the log
+	config.TombstoneTTL = time.Nanosecond
+	if _, err := New(local, config); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("expected the expired deletions to be compacted away, got %s", data)
+	}
+}
+
+func TestCluster_RejectsUnknownPeers(t *testing.T) {
+	nodes := startCluster(t, 2, 1)
+	impostor, _ := New(persistence.NewInMemoryStorage(), Config{Self: "node-1", Nodes: nodes[0].cluster.config.Nodes, Secret: "wrong"})
+	if err := impostor.ping(context.Background(), nodes[1].cluster.Self()); err == nil {
+		t.Errorf("expected a wrong secret to be rejected")
+	}
+	if _, err := New(persistence.NewInMemoryStorage(), Config{Self: "node-1", Nodes: nodes[0].cluster.config.Nodes}); err == nil {
+		t.Errorf("expected a cluster without secret to be rejected")
+	}
+}
+
+func TestCluster_RepairsFromReplicas(t *testing.T) {
+	nodes := startCluster(t, 2, 2)
+	nodes[0].cluster.Put("photos", "cat.png", []byte("meow"))
+	nodes[0].local.Delete("photos", "cat.png")
+
+	if ok, err := nodes[0].cluster.Repair("photos", "cat.png"); err != nil || !ok {
+		t.Fatalf("expected the object to be repaired, got %v (err %v)", ok, err)
+	}
+	if data, err := nodes[0].local.Get("photos", "cat.png"); err != nil || string(data) != "meow" {
+		t.Errorf("expected the local copy to be restored, got %q (err %v)", data, err)
+	}
+	if ok, _ := nodes[0].cluster.Repair("photos", "missing"); ok {
+		t.Errorf("expected no copy of a missing object")
+	}
+}
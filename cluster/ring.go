@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Ring places keys on nodes by consistent hashing. Every node owns several
+// virtual nodes spread on the ring so that keys are balanced and only about
+// 1/N of them move when a node joins or leaves.
+type Ring struct {
+	hashes []uint64          // sorted positions of the virtual nodes
+	owners map[uint64]string // virtual node position -> node ID
+	nodes  int
+}
+
+// NewRing places vnodes virtual nodes of every node on the ring
+func NewRing(nodes []string, vnodes int) *Ring {
+	r := &Ring{owners: make(map[uint64]string), nodes: len(nodes)}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			h := hash(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owners returns the n distinct nodes owning key, the first one being its
+// primary owner. Fewer are returned when the ring has less than n nodes.
+func (r *Ring) Owners(key string, n int) []string {
+	n = min(n, r.nodes)
+	if n <= 0 || len(r.hashes) == 0 {
+		return nil
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	owners := make([]string, 0, n)
+	for i := 0; i < len(r.hashes) && len(owners) < n; i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// hash is FNV-1a followed by the murmur3 finalizer, which spreads keys
+// differing only in their last characters (such as virtual node labels)
+func hash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func contains(values []string, v string) bool {
+	for _, other := range values {
+		if other == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+// Put stores the object on its owners
+func (c *Cluster) Put(bucket, objectID string, data []byte) (bool, error) {
+	return c.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object and its metadata on every owner. It
+// reports whether the primary owner created or changed the object.
+func (c *Cluster) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	ctx := context.Background()
+	created := false
+	for i, owner := range c.Owners(bucket, objectID) {
+		var changed bool
+		var err error
+		if owner.ID == c.self.ID {
+			c.unbury(bucket, objectID)
+			changed, err = domain.PutWithMetadata(c.local, bucket, objectID, data, meta)
+		} else {
+			changed, err = c.remotePut(ctx, owner, bucket, objectID, data, meta, time.Time{})
+		}
+		if err != nil {
+			return false, fmt.Errorf("storing on node %s: %w", owner.ID, err)
+		}
+		if i == 0 {
+			created = changed
+		}
+	}
+	return created, nil
+}
+
+// Get retrieves the object from its owners
+func (c *Cluster) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := c.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object and its metadata from the first owner
+// holding it. While rebalancing, objects may not have reached their new
+// owners yet, so the other nodes are asked as well.
+func (c *Cluster) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	ctx := context.Background()
+	owners := c.Owners(bucket, objectID)
+	candidates := owners
+	for _, n := range c.reachable() {
+		if !containsNode(owners, n) {
+			candidates = append(candidates, n)
+		}
+	}
+
+	var lastErr error = domain.ErrNotFound
+	for _, n := range candidates {
+		var data []byte
+		var meta domain.Metadata
+		var err error
+		if n.ID == c.self.ID {
+			data, meta, err = domain.GetWithMetadata(c.local, bucket, objectID)
+		} else {
+			data, meta, err = c.remoteGet(ctx, n, bucket, objectID)
+		}
+		if err == nil {
+			return data, meta, nil
+		}
+		if !errors.Is(err, domain.ErrNotFound) {
+			lastErr = err
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// Exists reports whether a node holds the object, asking the owners first
+// and the other nodes while rebalancing, without transferring its data
+func (c *Cluster) Exists(bucket, objectID string) (bool, error) {
+	ctx := context.Background()
+	owners := c.Owners(bucket, objectID)
+	candidates := owners
+	for _, n := range c.reachable() {
+		if !containsNode(owners, n) {
+			candidates = append(candidates, n)
+		}
+	}
+
+	var lastErr error
+	for _, n := range candidates {
+		var exists bool
+		var err error
+		if n.ID == c.self.ID {
+			exists, err = domain.Exists(c.local, bucket, objectID)
+		} else {
+			exists, err = c.remoteExists(ctx, n, bucket, objectID)
+		}
+		if exists {
+			return true, nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return false, lastErr
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object on
+// every reachable node holding it, so that copies made while rebalancing
+// carry them as well
+func (c *Cluster) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	ctx := context.Background()
+	updated := false
+	for _, n := range c.reachable() {
+		var err error
+		if n.ID == c.self.ID {
+			err = domain.UpdateMetadata(c.local, bucket, objectID, changes)
+		} else {
+			err = c.remoteUpdateMetadata(ctx, n, bucket, objectID, changes)
+		}
+		switch {
+		case err == nil:
+			updated = true
+		case !errors.Is(err, domain.ErrNotFound):
+			return fmt.Errorf("updating on node %s: %w", n.ID, err)
+		}
+	}
+	if !updated {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes the object from every node holding it. Every reachable node
+// records the deletion, so that the copies of the nodes unreachable at the
+// time are dropped instead of being copied back when they return.
+func (c *Cluster) Delete(bucket, objectID string) error {
+	ctx := context.Background()
+	deleted := false
+	for _, n := range c.reachable() {
+		var err error
+		if n.ID == c.self.ID {
+			err = c.bury(bucket, objectID)
+			if err == nil {
+				err = c.local.Delete(bucket, objectID)
+			}
+		} else {
+			err = c.remoteDelete(ctx, n, bucket, objectID)
+		}
+		switch {
+		case err == nil:
+			deleted = true
+		case !errors.Is(err, domain.ErrNotFound):
+			return fmt.Errorf("deleting on node %s: %w", n.ID, err)
+		}
+	}
+	if !deleted {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// ListBuckets lists the buckets holding objects on any node
+func (c *Cluster) ListBuckets() ([]string, error) {
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	for _, n := range c.reachable() {
+		var buckets []string
+		var err error
+		if n.ID == c.self.ID {
+			buckets, err = c.lister.ListBuckets()
+		} else {
+			buckets, err = c.remoteListBuckets(ctx, n)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing node %s: %w", n.ID, err)
+		}
+		for _, b := range buckets {
+			seen[b] = true
+		}
+	}
+
+	buckets := make([]string, 0, len(seen))
+	for b := range seen {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects lists the objects of a bucket on every node, an object stored
+// on several nodes is listed once with its most recent copy
+func (c *Cluster) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	ctx := context.Background()
+	latest := make(map[string]domain.ObjectInfo)
+	for _, n := range c.reachable() {
+		var infos []domain.ObjectInfo
+		var err error
+		if n.ID == c.self.ID {
+			infos, err = c.lister.ListObjects(bucket, prefix)
+		} else {
+			infos, err = c.remoteListObjects(ctx, n, bucket, prefix)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing node %s: %w", n.ID, err)
+		}
+		for _, info := range infos {
+			if existing, ok := latest[info.ID]; !ok || info.ModTime.After(existing.ModTime) {
+				latest[info.ID] = info
+			}
+		}
+	}
+
+	infos := make([]domain.ObjectInfo, 0, len(latest))
+	for _, info := range latest {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// Repair restores the local copy of an object from another node holding an
+// intact one, it reports whether such a copy was found
+func (c *Cluster) Repair(bucket, objectID string) (bool, error) {
+	ctx := context.Background()
+	for _, n := range c.reachable() {
+		if n.ID == c.self.ID {
+			continue
+		}
+		data, meta, err := c.remoteGet(ctx, n, bucket, objectID)
+		if errors.Is(err, domain.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Cluster: fetching %s/%s from %s failed: %v", bucket, objectID, n.ID, err)
+			continue
+		}
+		if _, err := domain.PutWithMetadata(c.local, bucket, objectID, data, meta); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func containsNode(nodes []Node, n Node) bool {
+	for _, other := range nodes {
+		if other.ID == n.ID {
+			return true
+		}
+	}
+	return false
+}
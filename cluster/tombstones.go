@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tombstoneRecord is a line of the tombstone log. A zero Deleted forgets the
+// deletion of an object written again.
+type tombstoneRecord struct {
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Deleted time.Time `json:"deleted,omitempty"`
+}
+
+// tombstoneLog appends the deletions seen by a node to a file, so that they
+// survive a restart. It is compacted when opened and when deletions expire.
+type tombstoneLog struct {
+	path string
+	file *os.File
+}
+
+// openTombstoneLog replays the log at path into the deletions younger than
+// ttl and compacts it. A missing file holds no deletion.
+func openTombstoneLog(path string, ttl time.Duration, now time.Time) (*tombstoneLog, map[objectRef]time.Time, error) {
+	tombstones := make(map[objectRef]time.Time)
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec tombstoneRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// A torn line is a deletion whose write was interrupted
+				log.Printf("Cluster: skipping corrupted tombstone in %s: %v", path, err)
+				continue
+			}
+			ref := objectRef{rec.Bucket, rec.Key}
+			if rec.Deleted.IsZero() {
+				delete(tombstones, ref)
+			} else {
+				tombstones[ref] = rec.Deleted
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for ref, deleted := range tombstones {
+		if now.Sub(deleted) > ttl {
+			delete(tombstones, ref)
+		}
+	}
+
+	l := &tombstoneLog{path: path}
+	if err := l.compact(tombstones); err != nil {
+		return nil, nil, err
+	}
+	return l, tombstones, nil
+}
+
+// append records a deletion, or forgets it when deleted is zero
+func (l *tombstoneLog) append(ref objectRef, deleted time.Time) error {
+	line, err := json.Marshal(tombstoneRecord{Bucket: ref.bucket, Key: ref.objectID, Deleted: deleted})
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// compact replaces the log with the given deletions
+func (l *tombstoneLog) compact(tombstones map[objectRef]time.Time) error {
+	dir := filepath.Dir(l.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(l.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for ref, deleted := range tombstones {
+		line, err := json.Marshal(tombstoneRecord{Bucket: ref.bucket, Key: ref.objectID, Deleted: deleted})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
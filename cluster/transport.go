@@ -0,0 +1,375 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/gorilla/mux"
+)
+
+// Internal API between nodes
+const (
+	// PathPrefix is the prefix of the routes nodes use to reach each other
+	PathPrefix = "/internal/cluster"
+	// HeaderSecret carries the shared secret of the cluster
+	HeaderSecret = "X-Cluster-Secret"
+	// headerMetadata carries the URL-encoded metadata of an object
+	headerMetadata = "X-Object-Metadata"
+	// headerModTime carries the modification time of an object copied by
+	// rebalancing, the copy is refused when the object was deleted since
+	headerModTime = "X-Object-ModTime"
+)
+
+// Handler serves the internal API used by the other nodes, it operates on the
+// local storage of this node
+func (c *Cluster) Handler() http.Handler {
+	r := mux.NewRouter().UseEncodedPath()
+	r.Use(c.authenticatePeer)
+	r.HandleFunc(PathPrefix+"/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(c.self.ID))
+	}).Methods("GET")
+	r.HandleFunc(PathPrefix+"/buckets", c.listBucketsHandler).Methods("GET")
+	r.HandleFunc(PathPrefix+"/objects/{bucket}", c.listObjectsHandler).Methods("GET")
+	r.HandleFunc(PathPrefix+"/objects/{bucket}/{object}", c.putHandler).Methods("PUT")
+	r.HandleFunc(PathPrefix+"/objects/{bucket}/{object}", c.getHandler).Methods("GET", "HEAD")
+	r.HandleFunc(PathPrefix+"/objects/{bucket}/{object}", c.deleteHandler).Methods("DELETE")
+	r.HandleFunc(PathPrefix+"/objects/{bucket}/{object}", c.updateHandler).Methods("PATCH")
+	return r
+}
+
+func (c *Cluster) authenticatePeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An empty secret never authenticates, even against an empty header
+		if c.config.Secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(HeaderSecret)), []byte(c.config.Secret)) != 1 {
+			http.Error(w, "invalid cluster secret", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// objectVars returns the unescaped bucket and object of an internal request
+func objectVars(r *http.Request) (string, string, error) {
+	vars := mux.Vars(r)
+	bucket, err := url.PathUnescape(vars["bucket"])
+	if err != nil {
+		return "", "", err
+	}
+	object, err := url.PathUnescape(vars["object"])
+	return bucket, object, err
+}
+
+func (c *Cluster) putHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, objectID, err := objectVars(r)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	meta, err := decodeMetadata(r.Header.Get(headerMetadata))
+	if err != nil {
+		http.Error(w, "invalid metadata", http.StatusBadRequest)
+		return
+	}
+	if v := r.Header.Get(headerModTime); v != "" {
+		modTime, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, "invalid modification time", http.StatusBadRequest)
+			return
+		}
+		if c.deletedSince(bucket, objectID, modTime) {
+			http.Error(w, errDeleted.Error(), http.StatusGone)
+			return
+		}
+	} else {
+		c.unbury(bucket, objectID)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	created, err := domain.PutWithMetadata(c.local, bucket, objectID, data, meta)
+	if err != nil {
+		log.Println("Cluster error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (c *Cluster) getHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, objectID, err := objectVars(r)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodHead {
+		exists, err := domain.Exists(c.local, bucket, objectID)
+		if err == nil && !exists {
+			err = domain.ErrNotFound
+		}
+		if err != nil {
+			w.WriteHeader(statusOf(err))
+		}
+		return
+	}
+	data, meta, err := domain.GetWithMetadata(c.local, bucket, objectID)
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	w.Header().Set(headerMetadata, encodeMetadata(meta))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+func (c *Cluster) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, objectID, err := objectVars(r)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if err := c.bury(bucket, objectID); err != nil {
+		log.Println("Cluster error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := c.local.Delete(bucket, objectID); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateHandler sets the keys of the metadata header in the metadata of a
+// local object
+func (c *Cluster) updateHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, objectID, err := objectVars(r)
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	changes, err := decodeMetadata(r.Header.Get(headerMetadata))
+	if err != nil {
+		http.Error(w, "invalid metadata", http.StatusBadRequest)
+		return
+	}
+	if err := domain.UpdateMetadata(c.local, bucket, objectID, changes); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Cluster) listBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	buckets, err := c.lister.ListBuckets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+func (c *Cluster) listObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, err := url.PathUnescape(mux.Vars(r)["bucket"])
+	if err != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	infos, err := c.lister.ListObjects(bucket, r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func statusOf(err error) int {
+	if errors.Is(err, domain.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, domain.ErrUpdateNotSupported) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func encodeMetadata(meta domain.Metadata) string {
+	values := url.Values{}
+	for k, v := range meta {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+func decodeMetadata(encoded string) (domain.Metadata, error) {
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil, err
+	}
+	meta := domain.Metadata{}
+	for k := range values {
+		meta[k] = values.Get(k)
+	}
+	return meta, nil
+}
+
+// call performs a request on the internal API of a peer
+func (c *Cluster) call(ctx context.Context, n Node, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, n.URL+PathPrefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set(HeaderSecret, c.config.Secret)
+	return c.client.Do(req)
+}
+
+// expect drains the response and checks its status is one of codes
+func expect(resp *http.Response, codes ...int) error {
+	defer resp.Body.Close()
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			io.Copy(io.Discard, resp.Body)
+			return nil
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return domain.ErrNotFound
+	}
+	if resp.StatusCode == http.StatusNotImplemented {
+		return domain.ErrUpdateNotSupported
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("node returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+func objectPath(bucket, objectID string) string {
+	return "/objects/" + url.PathEscape(bucket) + "/" + url.PathEscape(objectID)
+}
+
+func (c *Cluster) ping(ctx context.Context, n Node) error {
+	resp, err := c.call(ctx, n, http.MethodGet, "/ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, http.StatusOK)
+}
+
+// remotePut stores an object on a peer. A copy made by rebalancing carries
+// the modification time of the object and fails with errDeleted when the
+// peer saw a newer deletion, modTime is zero for new writes.
+func (c *Cluster) remotePut(ctx context.Context, n Node, bucket, objectID string, data []byte, meta domain.Metadata, modTime time.Time) (bool, error) {
+	proxiedRequests.WithLabelValues("put").Inc()
+	header := http.Header{}
+	header.Set(headerMetadata, encodeMetadata(meta))
+	if !modTime.IsZero() {
+		header.Set(headerModTime, modTime.UTC().Format(time.RFC3339Nano))
+	}
+	resp, err := c.call(ctx, n, http.MethodPut, objectPath(bucket, objectID), header, data)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return false, errDeleted
+	}
+	created := resp.StatusCode == http.StatusCreated
+	return created, expect(resp, http.StatusOK, http.StatusCreated)
+}
+
+func (c *Cluster) remoteGet(ctx context.Context, n Node, bucket, objectID string) ([]byte, domain.Metadata, error) {
+	proxiedRequests.WithLabelValues("get").Inc()
+	resp, err := c.call(ctx, n, http.MethodGet, objectPath(bucket, objectID), nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, expect(resp, http.StatusOK)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := decodeMetadata(resp.Header.Get(headerMetadata))
+	return data, meta, err
+}
+
+func (c *Cluster) remoteExists(ctx context.Context, n Node, bucket, objectID string) (bool, error) {
+	resp, err := c.call(ctx, n, http.MethodHead, objectPath(bucket, objectID), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	err = expect(resp, http.StatusOK)
+	if errors.Is(err, domain.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *Cluster) remoteDelete(ctx context.Context, n Node, bucket, objectID string) error {
+	proxiedRequests.WithLabelValues("delete").Inc()
+	resp, err := c.call(ctx, n, http.MethodDelete, objectPath(bucket, objectID), nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, http.StatusNoContent)
+}
+
+func (c *Cluster) remoteUpdateMetadata(ctx context.Context, n Node, bucket, objectID string, changes domain.Metadata) error {
+	proxiedRequests.WithLabelValues("update").Inc()
+	header := http.Header{}
+	header.Set(headerMetadata, encodeMetadata(changes))
+	resp, err := c.call(ctx, n, http.MethodPatch, objectPath(bucket, objectID), header, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, http.StatusNoContent)
+}
+
+func (c *Cluster) remoteListBuckets(ctx context.Context, n Node) ([]string, error) {
+	proxiedRequests.WithLabelValues("list").Inc()
+	resp, err := c.call(ctx, n, http.MethodGet, "/buckets", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, expect(resp, http.StatusOK)
+	}
+	defer resp.Body.Close()
+	var buckets []string
+	return buckets, json.NewDecoder(resp.Body).Decode(&buckets)
+}
+
+func (c *Cluster) remoteListObjects(ctx context.Context, n Node, bucket, prefix string) ([]domain.ObjectInfo, error) {
+	proxiedRequests.WithLabelValues("list").Inc()
+	path := "/objects/" + url.PathEscape(bucket) + "?prefix=" + url.QueryEscape(prefix)
+	resp, err := c.call(ctx, n, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, expect(resp, http.StatusOK)
+	}
+	defer resp.Body.Close()
+	var infos []domain.ObjectInfo
+	return infos, json.NewDecoder(resp.Body).Decode(&infos)
+}
@@ -0,0 +1,323 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/hashicorp/raft"
+)
+
+type testNode struct {
+	store     *Store
+	transport *raft.InmemTransport
+	member    Member
+}
+
+func testRaftConfig() *raft.Config {
+	c := raft.DefaultConfig()
+	c.HeartbeatTimeout = 50 * time.Millisecond
+	c.ElectionTimeout = 50 * time.Millisecond
+	c.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.CommitTimeout = 5 * time.Millisecond
+	c.LogOutput = io.Discard
+	return c
+}
+
+// startNodes runs n in-process nodes, only the first one is a member until
+// the others are added
+func startNodes(t *testing.T, n int) []*testNode {
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		id := fmt.Sprintf("node-%d", i+1)
+		addr, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+		server := httptest.NewUnstartedServer(nil)
+		member := Member{ID: id, Address: string(addr), URL: "http://" + server.Listener.Addr().String()}
+
+		store, err := Open(Config{
+			ID:        id,
+			URL:       member.URL,
+			Bootstrap: i == 0,
+			Secret:    "s3cr3t",
+			Timeout:   time.Second,
+			Raft:      testRaftConfig(),
+		}, transport)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		server.Config.Handler = store.Handler()
+		server.Start()
+		t.Cleanup(server.Close)
+		t.Cleanup(func() { store.Shutdown() })
+		nodes[i] = &testNode{store: store, transport: transport, member: member}
+	}
+	connect(nodes)
+	return nodes
+}
+
+// connect links the transports of every pair of nodes
+func connect(nodes []*testNode) {
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.transport.Connect(b.transport.LocalAddr(), b.transport)
+			}
+		}
+	}
+}
+
+// isolate cuts a node off the others
+func isolate(node *testNode, nodes []*testNode) {
+	node.transport.DisconnectAll()
+	for _, other := range nodes {
+		if other != node {
+			other.transport.Disconnect(node.transport.LocalAddr())
+		}
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader returns the node leading among nodes once it serves requests
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	eventually(t, "a leader", func() bool {
+		for _, n := range nodes {
+			if n.store.raft.State() == raft.Leader && n.store.ready.Load() {
+				if _, ok := n.store.fsm.member(n.member.ID); ok {
+					leader = n
+					return true
+				}
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// startCluster runs n nodes, all members of the cluster
+func startCluster(t *testing.T, n int) []*testNode {
+	nodes := startNodes(t, n)
+	leader := waitLeader(t, nodes[:1])
+	for _, node := range nodes[1:] {
+		if err := leader.store.AddMember(node.member); err != nil {
+			t.Fatalf("AddMember failed: %v", err)
+		}
+	}
+	return nodes
+}
+
+func TestStorage_ReplicatesAndForwards(t *testing.T) {
+	nodes := startCluster(t, 3)
+	data := persistence.NewInMemoryStorage()
+	follower := NewStorage(nodes[2].store, data)
+
+	created, err := follower.PutWithMetadata("photos", "cat.png", []byte("v1"), domain.Metadata{"tags": "pet"})
+	if err != nil || !created {
+		t.Fatalf("Put through a follower failed: created %v, err %v", created, err)
+	}
+	v1, _ := nodes[0].store.Get("photos", "cat.png")
+	if created, err := follower.PutWithMetadata("photos", "cat.png", []byte("v1"), domain.Metadata{"tags": "pet"}); err != nil || created {
+		t.Errorf("expected an identical put to leave the object unchanged, got created %v, err %v", created, err)
+	}
+	if _, err := follower.Put("photos", "cat.png", []byte("v2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	follower.Put("photos", "dog.png", []byte("woof"))
+
+	// Every node reads the last acknowledged write
+	for _, n := range nodes {
+		got, meta, err := NewStorage(n.store, data).GetWithMetadata("photos", "cat.png")
+		if err != nil || string(got) != "v2" || len(meta) != 0 {
+			t.Errorf("%s: expected v2 without metadata, got %q %v (err %v)", n.member.ID, got, meta, err)
+		}
+	}
+	v2, _ := nodes[1].store.Get("photos", "cat.png")
+	if v2.Version <= v1.Version || v2.DataID == v1.DataID {
+		t.Errorf("expected a new version, got %+v after %+v", v2, v1)
+	}
+	// Every node applies the committed entries
+	for _, n := range nodes {
+		eventually(t, "the replicated record", func() bool {
+			rec, ok := n.store.fsm.get("photos", "cat.png")
+			return ok && rec.Version == v2.Version
+		})
+	}
+
+	// Metadata updates keep the data of the version
+	if err := follower.UpdateMetadata("photos", "cat.png", domain.Metadata{"status": "done"}); err != nil {
+		t.Fatalf("UpdateMetadata failed: %v", err)
+	}
+	updated, _ := nodes[0].store.Get("photos", "cat.png")
+	if updated.DataID != v2.DataID || !updated.ModTime.Equal(v2.ModTime) || updated.Metadata["status"] != "done" {
+		t.Errorf("expected only the metadata to change, got %+v after %+v", updated, v2)
+	}
+	if err := follower.UpdateMetadata("photos", "missing", domain.Metadata{"status": "done"}); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	infos, err := NewStorage(nodes[1].store, data).ListObjects("photos", "")
+	if err != nil || len(infos) != 2 || infos[0].ID != "cat.png" || infos[0].Size != 2 {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+	if err := follower.Delete("photos", "cat.png"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := follower.Delete("photos", "cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	// Replaced and deleted versions are dropped
+	if blobs, _ := data.ListObjects("photos", ""); len(blobs) != 1 {
+		t.Errorf("expected only the data of dog.png to remain, got %d objects", len(blobs))
+	}
+	buckets, err := follower.ListBuckets()
+	if err != nil || len(buckets) != 1 || buckets[0] != "photos" {
+		t.Errorf("unexpected buckets %v (err %v)", buckets, err)
+	}
+}
+
+func TestStore_Partition(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	if _, _, err := leader.store.Put(Record{Bucket: "b", Key: "k", DataID: "v1"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// A leader cut off the majority can no longer commit nor serve reads
+	isolate(leader, nodes)
+	if _, _, err := leader.store.Put(Record{Bucket: "b", Key: "k", DataID: "lost"}); err == nil {
+		t.Fatalf("expected the minority to fail committing")
+	}
+	if _, err := leader.store.Get("b", "k"); err == nil {
+		t.Errorf("expected the minority to fail serving reads")
+	}
+
+	var majority []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			majority = append(majority, n)
+		}
+	}
+	newLeader := waitLeader(t, majority)
+	if _, _, err := majority[0].store.Put(Record{Bucket: "b", Key: "k", DataID: "v2"}); err != nil {
+		t.Fatalf("Put on the majority failed: %v", err)
+	}
+
+	// Once the partition heals, the former leader follows the new one
+	connect(nodes)
+	eventually(t, "the former leader to catch up", func() bool {
+		rec, ok := leader.store.fsm.get("b", "k")
+		return ok && rec.DataID == "v2"
+	})
+	rec, err := leader.store.Get("b", "k")
+	if err != nil || rec.DataID != "v2" {
+		t.Errorf("expected v2 through %s, got %+v (err %v)", newLeader.member.ID, rec, err)
+	}
+}
+
+func TestStore_MembershipAndSnapshots(t *testing.T) {
+	nodes := startNodes(t, 2)
+	leader := waitLeader(t, nodes[:1])
+	for i := 0; i < 20; i++ {
+		if _, _, err := leader.store.Put(Record{Bucket: "b", Key: fmt.Sprintf("k%d", i)}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := leader.store.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	if err := leader.store.AddMember(Member{ID: "node-3"}); !errors.Is(err, ErrInvalidMember) {
+		t.Errorf("expected ErrInvalidMember, got %v", err)
+	}
+	if err := leader.store.AddMember(nodes[1].member); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	eventually(t, "the new member to receive the state", func() bool {
+		return len(nodes[1].store.fsm.list("b", "")) == 20
+	})
+	status, err := nodes[1].store.Status()
+	if err != nil || len(status.Members) != 2 || status.Leader != "node-1" || status.Members[1].URL != nodes[1].member.URL {
+		t.Fatalf("unexpected status %+v (err %v)", status, err)
+	}
+
+	// Removing a member through another node is forwarded to the leader
+	if err := nodes[1].store.RemoveMember("node-9"); err != ErrUnknownMember {
+		t.Errorf("expected ErrUnknownMember, got %v", err)
+	}
+	if err := nodes[1].store.RemoveMember("node-2"); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	if status, _ := leader.store.Status(); len(status.Members) != 1 {
+		t.Errorf("expected a single member left, got %+v", status.Members)
+	}
+}
+
+func TestOpen_RequiresSecret(t *testing.T) {
+	_, transport := raft.NewInmemTransport("node-1")
+	if _, err := Open(Config{ID: "node-1", URL: "http://node-1:8080"}, transport); err == nil {
+		t.Errorf("expected a node without secret to be rejected")
+	}
+}
+
+func TestStore_Restart(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store {
+		_, transport := raft.NewInmemTransport("node-1")
+		store, err := Open(Config{
+			ID:        "node-1",
+			URL:       "http://node-1:8080",
+			Bootstrap: true,
+			Secret:    "s3cr3t",
+			Dir:       dir,
+			Timeout:   time.Second,
+			Raft:      testRaftConfig(),
+		}, transport)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		return store
+	}
+
+	store := open()
+	node := &testNode{store: store, member: Member{ID: "node-1"}}
+	waitLeader(t, []*testNode{node})
+	for i := 0; i < 10; i++ {
+		if _, _, err := store.Put(Record{Bucket: "b", Key: fmt.Sprintf("k%d", i)}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if i == 4 {
+			if err := store.raft.Snapshot().Error(); err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+		}
+	}
+	if err := store.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// The restarted node recovers the snapshot and the entries logged after it
+	store = open()
+	defer store.Shutdown()
+	node.store = store
+	waitLeader(t, []*testNode{node})
+	records, err := store.List("b", "")
+	if err != nil || len(records) != 10 {
+		t.Fatalf("expected the records to survive a restart, got %d (err %v)", len(records), err)
+	}
+}
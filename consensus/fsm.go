@@ -0,0 +1,251 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/hashicorp/raft"
+)
+
+// Record is the replicated metadata of an object
+type Record struct {
+	Bucket   string          `json:"bucket"`
+	Key      string          `json:"key"`
+	Size     int64           `json:"size"`
+	ETag     string          `json:"etag"`
+	Metadata domain.Metadata `json:"metadata,omitempty"`
+	// DataID is the key the data of this version is stored at in the data storage
+	DataID string `json:"dataId"`
+	// Version is the index of the log entry which wrote the record, it grows
+	// with every write of the object
+	Version uint64    `json:"version"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Member is a node of the Raft cluster
+type Member struct {
+	ID string `json:"id"`
+	// Address is the Raft address of the node, such as "node-1:7000"
+	Address string `json:"address"`
+	// URL is the base URL of the HTTP API of the node, requests are forwarded
+	// to the leader through it
+	URL string `json:"url"`
+}
+
+// Operations of the replicated log
+const (
+	opPut          = "put"
+	opDelete       = "delete"
+	opUpdate       = "update"
+	opSetMember    = "set-member"
+	opRemoveMember = "remove-member"
+)
+
+// command is an entry of the replicated log
+type command struct {
+	Op     string  `json:"op"`
+	Record *Record `json:"record,omitempty"`
+	Bucket string  `json:"bucket,omitempty"`
+	Key    string  `json:"key,omitempty"`
+	Member *Member `json:"member,omitempty"`
+	// Metadata holds the keys an update sets in the metadata of a record
+	Metadata domain.Metadata `json:"metadata,omitempty"`
+}
+
+// result is the outcome of applying a command
+type result struct {
+	// Record is the record written by a put
+	Record *Record `json:"record,omitempty"`
+	// Previous is the record replaced or deleted
+	Previous *Record `json:"previous,omitempty"`
+	// NotFound reports the deletion of a missing object
+	NotFound bool `json:"notFound,omitempty"`
+}
+
+// state is the replicated state machine, it is what snapshots hold
+type state struct {
+	Objects map[string]map[string]Record `json:"objects"` // bucket -> key -> record
+	Members map[string]Member            `json:"members"` // node ID -> member
+	Applied uint64                       `json:"applied"`
+}
+
+// fsm applies the committed log entries to the state
+type fsm struct {
+	mu      sync.RWMutex
+	state   state
+	applied atomic.Uint64
+}
+
+func newFSM() *fsm {
+	return &fsm{state: state{
+		Objects: make(map[string]map[string]Record),
+		Members: make(map[string]Member),
+	}}
+}
+
+// Apply implements raft.FSM
+func (f *fsm) Apply(entry *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return fmt.Errorf("invalid log entry %d: %w", entry.Index, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.setApplied(entry.Index)
+
+	switch cmd.Op {
+	case opPut:
+		rec := *cmd.Record
+		rec.Version = entry.Index
+		objects := f.state.Objects[rec.Bucket]
+		if objects == nil {
+			objects = make(map[string]Record)
+			f.state.Objects[rec.Bucket] = objects
+		}
+		res := result{Record: &rec}
+		if prev, ok := objects[rec.Key]; ok {
+			res.Previous = &prev
+		}
+		objects[rec.Key] = rec
+		return res
+	case opDelete:
+		prev, ok := f.state.Objects[cmd.Bucket][cmd.Key]
+		if !ok {
+			return result{NotFound: true}
+		}
+		delete(f.state.Objects[cmd.Bucket], cmd.Key)
+		if len(f.state.Objects[cmd.Bucket]) == 0 {
+			delete(f.state.Objects, cmd.Bucket)
+		}
+		return result{Previous: &prev}
+	case opUpdate:
+		prev, ok := f.state.Objects[cmd.Bucket][cmd.Key]
+		if !ok {
+			return result{NotFound: true}
+		}
+		rec := prev
+		rec.Metadata = prev.Metadata.With(cmd.Metadata)
+		rec.Version = entry.Index
+		f.state.Objects[cmd.Bucket][cmd.Key] = rec
+		return result{Record: &rec, Previous: &prev}
+	case opSetMember:
+		f.state.Members[cmd.Member.ID] = *cmd.Member
+		return result{}
+	case opRemoveMember:
+		delete(f.state.Members, cmd.Member.ID)
+		return result{}
+	}
+	return fmt.Errorf("unknown operation %q", cmd.Op)
+}
+
+// setApplied records the index of the last applied entry, f.mu must be held
+func (f *fsm) setApplied(index uint64) {
+	f.state.Applied = index
+	f.applied.Store(index)
+}
+
+// Snapshot implements raft.FSM. Records are never modified in place, so
+// copying the maps is enough for the snapshot to be consistent.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	snapshot := state{
+		Objects: make(map[string]map[string]Record, len(f.state.Objects)),
+		Members: make(map[string]Member, len(f.state.Members)),
+		Applied: f.state.Applied,
+	}
+	for bucket, objects := range f.state.Objects {
+		copied := make(map[string]Record, len(objects))
+		for key, rec := range objects {
+			copied[key] = rec
+		}
+		snapshot.Objects[bucket] = copied
+	}
+	for id, m := range f.state.Members {
+		snapshot.Members[id] = m
+	}
+	return &fsmSnapshot{state: snapshot}, nil
+}
+
+// Restore implements raft.FSM
+func (f *fsm) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	restored := state{}
+	if err := json.NewDecoder(snapshot).Decode(&restored); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if restored.Objects == nil {
+		restored.Objects = make(map[string]map[string]Record)
+	}
+	if restored.Members == nil {
+		restored.Members = make(map[string]Member)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = restored
+	f.applied.Store(restored.Applied)
+	return nil
+}
+
+func (f *fsm) get(bucket, key string) (Record, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rec, ok := f.state.Objects[bucket][key]
+	return rec, ok
+}
+
+func (f *fsm) buckets() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	buckets := make([]string, 0, len(f.state.Objects))
+	for bucket := range f.state.Objects {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+func (f *fsm) list(bucket, prefix string) []Record {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var records []Record
+	for key, rec := range f.state.Objects[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+func (f *fsm) member(id string) (Member, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	m, ok := f.state.Members[id]
+	return m, ok
+}
+
+type fsmSnapshot struct {
+	state state
+}
+
+// Persist implements raft.FSMSnapshot
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,161 @@
+package consensus
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+// Storage is a domain.Storage keeping the metadata of objects in the Raft
+// store and their data in another storage, such as a cluster placing it on
+// its nodes.
+//
+// Every version of an object is stored under a new data ID, only referenced
+// by the index once its record committed: readers never see partial writes
+// and the previous data is dropped once it is no longer referenced.
+type Storage struct {
+	store *Store
+	data  domain.Storage
+}
+
+// NewStorage creates a storage indexing in store the objects held by data
+func NewStorage(store *Store, data domain.Storage) *Storage {
+	return &Storage{store: store, data: data}
+}
+
+// Put stores an object and commits its record
+func (s *Storage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores an object and its metadata. It is acknowledged
+// once the record of the object is committed by a quorum.
+func (s *Storage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+	if current, err := s.store.Get(bucket, objectID); err == nil && current.ETag == etag && maps.Equal(current.Metadata, meta) {
+		return false, nil
+	} else if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return false, err
+	}
+
+	dataID := newDataID()
+	if _, err := s.data.Put(bucket, dataID, data); err != nil {
+		return false, err
+	}
+	_, previous, err := s.store.Put(Record{
+		Bucket:   bucket,
+		Key:      objectID,
+		Size:     int64(len(data)),
+		ETag:     etag,
+		Metadata: meta,
+		DataID:   dataID,
+		ModTime:  time.Now().UTC(),
+	})
+	if err != nil {
+		// Without a leader the record was never proposed. Otherwise it may
+		// still commit, so the data is kept rather than risking a dangling record.
+		if errors.Is(err, ErrNoLeader) {
+			s.dropData(bucket, dataID)
+		}
+		return false, err
+	}
+	if previous != nil && previous.DataID != dataID {
+		s.dropData(bucket, previous.DataID)
+	}
+	return true, nil
+}
+
+// Get retrieves an object
+func (s *Storage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves an object and its metadata as of its last
+// committed record
+func (s *Storage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	for attempt := 0; ; attempt++ {
+		rec, err := s.store.Get(bucket, objectID)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := s.data.Get(bucket, rec.DataID)
+		if err == nil {
+			return data, rec.Metadata, nil
+		}
+		// The version read was replaced and dropped meanwhile, the new record is read again
+		if !errors.Is(err, domain.ErrNotFound) || attempt == 2 {
+			return nil, nil, err
+		}
+	}
+}
+
+// Exists reports whether the object has a committed record, without reading its data
+func (s *Storage) Exists(bucket, objectID string) (bool, error) {
+	_, err := s.store.Get(bucket, objectID)
+	if errors.Is(err, domain.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UpdateMetadata commits the keys of changes in the record of an object,
+// its data is left untouched
+func (s *Storage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	_, err := s.store.UpdateMetadata(bucket, objectID, changes)
+	return err
+}
+
+// Delete removes the record of an object, then its data
+func (s *Storage) Delete(bucket, objectID string) error {
+	previous, err := s.store.Delete(bucket, objectID)
+	if err != nil {
+		return err
+	}
+	s.dropData(bucket, previous.DataID)
+	return nil
+}
+
+// ListBuckets lists the buckets holding objects
+func (s *Storage) ListBuckets() ([]string, error) {
+	return s.store.Buckets()
+}
+
+// ListObjects lists the objects of a bucket from the index
+func (s *Storage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	records, err := s.store.List(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]domain.ObjectInfo, 0, len(records))
+	for _, rec := range records {
+		infos = append(infos, domain.ObjectInfo{
+			Bucket:   rec.Bucket,
+			ID:       rec.Key,
+			Size:     rec.Size,
+			ModTime:  rec.ModTime,
+			Metadata: rec.Metadata,
+		})
+	}
+	return infos, nil
+}
+
+// dropData deletes the data of a version no longer referenced
+func (s *Storage) dropData(bucket, dataID string) {
+	if err := s.data.Delete(bucket, dataID); err != nil && !errors.Is(err, domain.ErrNotFound) {
+		log.Printf("Raft: dropping data %s/%s failed: %v", bucket, dataID, err)
+	}
+}
+
+func newDataID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,531 @@
+// Package consensus keeps the metadata of objects (the buckets, the object
+// index and the versions of objects) in a store replicated with Raft, while
+// the data of objects lives in a separate storage, such as a cluster placing
+// it on its nodes.
+//
+// Writes are acknowledged once committed by a quorum of the nodes and reads
+// are linearizable: both are served by the leader, the other nodes forward
+// them to it over HTTP.
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrNoLeader is returned when no leader is available to serve a request
+	ErrNoLeader = errors.New("no raft leader available")
+	// ErrInvalidMember is returned when adding a member without ID, address or URL
+	ErrInvalidMember = errors.New("invalid raft member")
+	// ErrUnknownMember is returned when removing a node which is not a member
+	ErrUnknownMember = errors.New("unknown raft member")
+)
+
+var (
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consensus_leader",
+		Help: "Whether this node is the Raft leader (1) or not (0).",
+	})
+	appliedCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consensus_commands_total",
+		Help: "Commands applied to the replicated log by this node as leader, by operation and result.",
+	}, []string{"operation", "result"})
+	forwardedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consensus_forwarded_requests_total",
+		Help: "Requests forwarded to the leader, by operation.",
+	}, []string{"operation"})
+)
+
+// Config describes a node of the Raft cluster
+type Config struct {
+	// ID identifies the node, it must be unique in the cluster
+	ID string
+	// URL is the base URL of the HTTP API of the node, such as "http://node-1:8080"
+	URL string
+	// Bootstrap starts a new cluster with this node as its only member, the
+	// other nodes are then added through the membership API
+	Bootstrap bool
+	// Secret authenticates the requests forwarded between nodes, it is required
+	Secret string
+	// Dir keeps the log and the snapshots, they are kept in memory when empty
+	Dir string
+	// Timeout bounds the time waited for a leader and for a command to commit
+	Timeout time.Duration
+	// Raft tunes the Raft protocol, the defaults of the raft package are used when nil
+	Raft *raft.Config
+}
+
+// MemberStatus describes a member as seen by this node
+type MemberStatus struct {
+	Member
+	Voter  bool `json:"voter"`
+	Leader bool `json:"leader"`
+	Self   bool `json:"self"`
+}
+
+// Status describes the Raft cluster as seen by this node
+type Status struct {
+	ID      string         `json:"id"`
+	State   string         `json:"state"`
+	Leader  string         `json:"leader"`
+	Applied uint64         `json:"applied"`
+	Members []MemberStatus `json:"members"`
+}
+
+// Store is a node of the Raft cluster replicating the metadata of objects.
+//
+// The log and the snapshots are kept in a directory so that a node which
+// restarts rejoins the cluster with its state, catching up with the leader
+// on the entries it missed.
+type Store struct {
+	config    Config
+	raft      *raft.Raft
+	fsm       *fsm
+	transport raft.Transport
+	client    *http.Client
+	// logs is closed on shutdown when the log is kept on disk
+	logs io.Closer
+
+	// ready is set once the leader applied the entries of previous terms
+	ready atomic.Bool
+	done  chan struct{}
+}
+
+// Open starts a node of the Raft cluster communicating with the other nodes
+// over transport
+func Open(config Config, transport raft.Transport) (*Store, error) {
+	if config.ID == "" {
+		return nil, errors.New("raft node ID is required")
+	}
+	if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid raft node URL %q", config.URL)
+	}
+	if config.Secret == "" {
+		return nil, errors.New("raft cluster secret is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LogLevel = "WARN"
+	if config.Raft != nil {
+		copied := *config.Raft
+		rc = &copied
+	}
+	rc.LocalID = raft.ServerID(config.ID)
+
+	s := &Store{
+		config:    config,
+		fsm:       newFSM(),
+		transport: transport,
+		client:    &http.Client{Timeout: config.Timeout + 5*time.Second},
+		done:      make(chan struct{}),
+	}
+	logs, stable, snapshots, err := s.openStores()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil {
+		s.closeLogs()
+		return nil, fmt.Errorf("reading raft state: %w", err)
+	}
+	r, err := raft.NewRaft(rc, s.fsm, logs, stable, snapshots, transport)
+	if err != nil {
+		s.closeLogs()
+		return nil, fmt.Errorf("starting raft: %w", err)
+	}
+	s.raft = r
+
+	// A restarted node already belongs to its cluster
+	if config.Bootstrap && !existing {
+		servers := []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}}
+		if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			r.Shutdown()
+			s.closeLogs()
+			return nil, fmt.Errorf("bootstrapping raft: %w", err)
+		}
+	}
+	go s.watchLeadership()
+	return s, nil
+}
+
+// openStores opens the log, stable and snapshot stores of the node, in
+// config.Dir or in memory
+func (s *Store) openStores() (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if s.config.Dir == "" {
+		logs := raft.NewInmemStore()
+		return logs, logs, raft.NewInmemSnapshotStore(), nil
+	}
+	if err := os.MkdirAll(s.config.Dir, 0o755); err != nil {
+		return nil, nil, nil, fmt.Errorf("creating raft directory: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(s.config.Dir, 2, io.Discard)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("opening raft snapshots: %w", err)
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(s.config.Dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("opening raft log: %w", err)
+	}
+	s.logs = logs
+	return logs, logs, snapshots, nil
+}
+
+func (s *Store) closeLogs() error {
+	if s.logs == nil {
+		return nil
+	}
+	return s.logs.Close()
+}
+
+// Shutdown stops the node
+func (s *Store) Shutdown() error {
+	close(s.done)
+	leaderGauge.Set(0)
+	err := s.raft.Shutdown().Error()
+	if cerr := s.closeLogs(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ID returns the ID of this node
+func (s *Store) ID() string {
+	return s.config.ID
+}
+
+// watchLeadership prepares this node to serve requests when it becomes leader
+func (s *Store) watchLeadership() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case leader := <-s.raft.LeaderCh():
+			s.ready.Store(false)
+			leaderGauge.Set(0)
+			if !leader {
+				continue
+			}
+			// Entries committed by the previous leaders must be applied
+			// before reads can be served from the local state
+			if err := s.raft.Barrier(s.config.Timeout).Error(); err != nil {
+				log.Println("Raft: leader barrier failed:", err)
+				continue
+			}
+			s.ready.Store(true)
+			leaderGauge.Set(1)
+
+			// The bootstrap node registers its URL so that the others can forward to it
+			self := Member{ID: s.config.ID, Address: string(s.transport.LocalAddr()), URL: s.config.URL}
+			if m, ok := s.fsm.member(self.ID); !ok || m != self {
+				if _, err := s.applyLocal(command{Op: opSetMember, Member: &self}); err != nil {
+					log.Println("Raft: registering this node failed:", err)
+				}
+			}
+		}
+	}
+}
+
+// onLeader runs local when this node is the leader, or forward with the
+// leader otherwise. It waits for a leader to be elected, up to the timeout.
+func (s *Store) onLeader(local func() error, forward func(leader Member) error) error {
+	deadline := time.Now().Add(s.config.Timeout)
+	for {
+		var err error
+		if s.raft.State() == raft.Leader {
+			err = local()
+		} else if leader, ok := s.leader(); ok {
+			err = forward(leader)
+		} else {
+			err = ErrNoLeader
+		}
+		// Only requests which were not attempted are retried
+		if !errors.Is(err, ErrNoLeader) && !errors.Is(err, raft.ErrNotLeader) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return ErrNoLeader
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// leader returns the current leader, as far as this node knows
+func (s *Store) leader() (Member, bool) {
+	_, id := s.raft.LeaderWithID()
+	if id == "" {
+		return Member{}, false
+	}
+	return s.fsm.member(string(id))
+}
+
+// applyLocal appends a command to the log and waits for a quorum to commit it
+func (s *Store) applyLocal(cmd command) (result, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return result{}, err
+	}
+	future := s.raft.Apply(data, s.config.Timeout)
+	if err := future.Error(); err != nil {
+		appliedCommands.WithLabelValues(cmd.Op, "error").Inc()
+		return result{}, err
+	}
+	if err, ok := future.Response().(error); ok {
+		appliedCommands.WithLabelValues(cmd.Op, "error").Inc()
+		return result{}, err
+	}
+	appliedCommands.WithLabelValues(cmd.Op, "success").Inc()
+	return future.Response().(result), nil
+}
+
+// apply commits a command through the leader
+func (s *Store) apply(cmd command) (result, error) {
+	var res result
+	err := s.onLeader(func() error {
+		var err error
+		res, err = s.applyLocal(cmd)
+		return err
+	}, func(leader Member) error {
+		forwardedRequests.WithLabelValues(cmd.Op).Inc()
+		var err error
+		res, err = s.remoteApply(leader, cmd)
+		return err
+	})
+	return res, err
+}
+
+// linearize makes sure the local state reflects every write acknowledged
+// before the call, it fails when this node is not the leader. Writes are
+// acknowledged once applied by the leader and the entries of previous terms
+// are applied when it is elected, so confirming the leadership is enough.
+func (s *Store) linearize() error {
+	deadline := time.Now().Add(s.config.Timeout)
+	for !s.ready.Load() {
+		if s.raft.State() != raft.Leader || time.Now().After(deadline) {
+			return ErrNoLeader
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return ErrNoLeader
+	}
+	return nil
+}
+
+// read runs local on the leader once its state is up to date, or forward
+// with the leader otherwise
+func (s *Store) read(operation string, local func(), forward func(leader Member) error) error {
+	return s.onLeader(func() error {
+		if err := s.linearize(); err != nil {
+			return err
+		}
+		local()
+		return nil
+	}, func(leader Member) error {
+		forwardedRequests.WithLabelValues(operation).Inc()
+		return forward(leader)
+	})
+}
+
+// Put writes the record of an object. It returns the record as committed,
+// with its version, and the record it replaced if any.
+func (s *Store) Put(rec Record) (Record, *Record, error) {
+	res, err := s.apply(command{Op: opPut, Record: &rec})
+	if err != nil {
+		return Record{}, nil, err
+	}
+	return *res.Record, res.Previous, nil
+}
+
+// Delete removes the record of an object and returns it
+func (s *Store) Delete(bucket, key string) (Record, error) {
+	res, err := s.apply(command{Op: opDelete, Bucket: bucket, Key: key})
+	if err != nil {
+		return Record{}, err
+	}
+	if res.NotFound {
+		return Record{}, domain.ErrNotFound
+	}
+	return *res.Previous, nil
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the record of
+// an object, keeping its data and modification time
+func (s *Store) UpdateMetadata(bucket, key string, changes domain.Metadata) (Record, error) {
+	res, err := s.apply(command{Op: opUpdate, Bucket: bucket, Key: key, Metadata: changes})
+	if err != nil {
+		return Record{}, err
+	}
+	if res.NotFound {
+		return Record{}, domain.ErrNotFound
+	}
+	return *res.Record, nil
+}
+
+// Get returns the record of an object
+func (s *Store) Get(bucket, key string) (Record, error) {
+	var rec Record
+	var found bool
+	err := s.read("get", func() {
+		rec, found = s.fsm.get(bucket, key)
+	}, func(leader Member) error {
+		var err error
+		rec, err = s.remoteGet(leader, bucket, key)
+		found = err == nil
+		if errors.Is(err, domain.ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	if !found {
+		return Record{}, domain.ErrNotFound
+	}
+	return rec, nil
+}
+
+// List returns the records of the objects of a bucket starting with prefix, sorted by key
+func (s *Store) List(bucket, prefix string) ([]Record, error) {
+	var records []Record
+	err := s.read("list", func() {
+		records = s.fsm.list(bucket, prefix)
+	}, func(leader Member) error {
+		var err error
+		records, err = s.remoteList(leader, bucket, prefix)
+		return err
+	})
+	return records, err
+}
+
+// Buckets returns the buckets holding objects, sorted by name
+func (s *Store) Buckets() ([]string, error) {
+	var buckets []string
+	err := s.read("list", func() {
+		buckets = s.fsm.buckets()
+	}, func(leader Member) error {
+		var err error
+		buckets, err = s.remoteBuckets(leader)
+		return err
+	})
+	return buckets, err
+}
+
+// AddMember adds a node to the cluster as a voter. The node must have been
+// started without bootstrapping, it then receives the state from the leader.
+func (s *Store) AddMember(m Member) error {
+	if m.ID == "" || m.Address == "" {
+		return fmt.Errorf("%w: id and address are required", ErrInvalidMember)
+	}
+	if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidMember)
+	}
+	return s.onLeader(func() error {
+		return s.addMemberLocal(m)
+	}, func(leader Member) error {
+		forwardedRequests.WithLabelValues("add-member").Inc()
+		return s.remoteAddMember(leader, m)
+	})
+}
+
+func (s *Store) addMemberLocal(m Member) error {
+	// The URL is registered first so that the node can forward as soon as it joins
+	if _, err := s.applyLocal(command{Op: opSetMember, Member: &m}); err != nil {
+		return err
+	}
+	err := s.raft.AddVoter(raft.ServerID(m.ID), raft.ServerAddress(m.Address), 0, s.config.Timeout).Error()
+	if err != nil {
+		return fmt.Errorf("adding %s: %w", m.ID, err)
+	}
+	log.Printf("Raft: added member %s at %s", m.ID, m.Address)
+	return nil
+}
+
+// RemoveMember removes a node from the cluster, possibly the leader itself
+func (s *Store) RemoveMember(id string) error {
+	return s.onLeader(func() error {
+		return s.removeMemberLocal(id)
+	}, func(leader Member) error {
+		forwardedRequests.WithLabelValues("remove-member").Inc()
+		return s.remoteRemoveMember(leader, id)
+	})
+}
+
+func (s *Store) removeMemberLocal(id string) error {
+	servers, err := s.servers()
+	if err != nil {
+		return err
+	}
+	known := false
+	for _, server := range servers {
+		known = known || string(server.ID) == id
+	}
+	if !known {
+		return ErrUnknownMember
+	}
+	// Once removed, the leader steps down, so the member is unregistered first
+	if _, err := s.applyLocal(command{Op: opRemoveMember, Member: &Member{ID: id}}); err != nil {
+		return err
+	}
+	if err := s.raft.RemoveServer(raft.ServerID(id), 0, s.config.Timeout).Error(); err != nil {
+		return fmt.Errorf("removing %s: %w", id, err)
+	}
+	log.Printf("Raft: removed member %s", id)
+	return nil
+}
+
+func (s *Store) servers() ([]raft.Server, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	return future.Configuration().Servers, nil
+}
+
+// Status returns the state of this node and the members of the cluster
+func (s *Store) Status() (Status, error) {
+	servers, err := s.servers()
+	if err != nil {
+		return Status{}, err
+	}
+	_, leader := s.raft.LeaderWithID()
+	status := Status{
+		ID:      s.config.ID,
+		State:   s.raft.State().String(),
+		Leader:  string(leader),
+		Applied: s.fsm.applied.Load(),
+		Members: make([]MemberStatus, 0, len(servers)),
+	}
+	for _, server := range servers {
+		m, ok := s.fsm.member(string(server.ID))
+		if !ok {
+			m = Member{ID: string(server.ID), Address: string(server.Address)}
+		}
+		status.Members = append(status.Members, MemberStatus{
+			Member: m,
+			Voter:  server.Suffrage == raft.Voter,
+			Leader: server.ID == leader,
+			Self:   string(server.ID) == s.config.ID,
+		})
+	}
+	return status, nil
+}
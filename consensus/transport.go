@@ -0,0 +1,223 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+)
+
+// Internal API used to forward requests to the leader
+const (
+	// PathPrefix is the prefix of the routes nodes use to reach the leader
+	PathPrefix = "/internal/raft"
+	// HeaderSecret carries the shared secret of the cluster
+	HeaderSecret = "X-Cluster-Secret"
+)
+
+// Handler serves the requests forwarded by the other nodes. Only the leader
+// serves them, the other nodes answer 503 so that the caller retries.
+func (s *Store) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(s.authenticatePeer)
+	r.HandleFunc(PathPrefix+"/apply", s.applyHandler).Methods("POST")
+	r.HandleFunc(PathPrefix+"/object", s.getHandler).Methods("GET")
+	r.HandleFunc(PathPrefix+"/objects", s.listHandler).Methods("GET")
+	r.HandleFunc(PathPrefix+"/buckets", s.bucketsHandler).Methods("GET")
+	r.HandleFunc(PathPrefix+"/members", s.addMemberHandler).Methods("POST")
+	r.HandleFunc(PathPrefix+"/members/{id}", s.removeMemberHandler).Methods("DELETE")
+	return r
+}
+
+func (s *Store) authenticatePeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An empty secret never authenticates, even against an empty header
+		if s.config.Secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(HeaderSecret)), []byte(s.config.Secret)) != 1 {
+			http.Error(w, "invalid cluster secret", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusOf maps an error to the status of the internal API, 503 meaning the
+// request was not attempted
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrNoLeader), errors.Is(err, raft.ErrNotLeader):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, domain.ErrNotFound), errors.Is(err, ErrUnknownMember):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidMember):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Store) applyHandler(w http.ResponseWriter, r *http.Request) {
+	var cmd command
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "invalid command", http.StatusBadRequest)
+		return
+	}
+	if s.raft.State() != raft.Leader {
+		http.Error(w, ErrNoLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	res, err := s.applyLocal(cmd)
+	if err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *Store) getHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.linearize(); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	rec, ok := s.fsm.get(r.URL.Query().Get("bucket"), r.URL.Query().Get("key"))
+	if !ok {
+		http.Error(w, domain.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, rec)
+}
+
+func (s *Store) listHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.linearize(); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	writeJSON(w, s.fsm.list(r.URL.Query().Get("bucket"), r.URL.Query().Get("prefix")))
+}
+
+func (s *Store) bucketsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.linearize(); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	writeJSON(w, s.fsm.buckets())
+}
+
+func (s *Store) addMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var m Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "invalid member", http.StatusBadRequest)
+		return
+	}
+	if s.raft.State() != raft.Leader {
+		http.Error(w, ErrNoLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.addMemberLocal(m); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Store) removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if s.raft.State() != raft.Leader {
+		http.Error(w, ErrNoLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.removeMemberLocal(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, err.Error(), statusOf(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// call performs a request on the internal API of the leader and decodes its
+// JSON response into out, when not nil
+func (s *Store) call(leader Member, method, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, leader.URL+PathPrefix+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderSecret, s.config.Secret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("reaching leader %s: %w", leader.ID, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNoContent:
+		return nil
+	case http.StatusServiceUnavailable:
+		// The node lost its leadership, the caller retries with the new leader
+		return ErrNoLeader
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	text := strings.TrimSpace(string(msg))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if text == ErrUnknownMember.Error() {
+			return ErrUnknownMember
+		}
+		return domain.ErrNotFound
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w: %s", ErrInvalidMember, text)
+	}
+	return fmt.Errorf("leader %s returned %d: %s", leader.ID, resp.StatusCode, text)
+}
+
+func (s *Store) remoteApply(leader Member, cmd command) (result, error) {
+	var res result
+	return res, s.call(leader, http.MethodPost, "/apply", cmd, &res)
+}
+
+func (s *Store) remoteGet(leader Member, bucket, key string) (Record, error) {
+	var rec Record
+	query := url.Values{"bucket": {bucket}, "key": {key}}
+	return rec, s.call(leader, http.MethodGet, "/object?"+query.Encode(), nil, &rec)
+}
+
+func (s *Store) remoteList(leader Member, bucket, prefix string) ([]Record, error) {
+	var records []Record
+	query := url.Values{"bucket": {bucket}, "prefix": {prefix}}
+	return records, s.call(leader, http.MethodGet, "/objects?"+query.Encode(), nil, &records)
+}
+
+func (s *Store) remoteBuckets(leader Member) ([]string, error) {
+	var buckets []string
+	return buckets, s.call(leader, http.MethodGet, "/buckets", nil, &buckets)
+}
+
+func (s *Store) remoteAddMember(leader Member, m Member) error {
+	return s.call(leader, http.MethodPost, "/members", m, nil)
+}
+
+func (s *Store) remoteRemoveMember(leader Member, id string) error {
+	return s.call(leader, http.MethodDelete, "/members/"+url.PathEscape(id), nil, nil)
+}
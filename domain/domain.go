@@ -1,6 +1,10 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"strings"
+	"time"
+)
 
 type Object struct {
 	ID     string
@@ -14,7 +18,157 @@ type Storage interface {
 	Delete(bucket, objectID string) error
 }
 
+// Metadata holds per-object attributes stored alongside the object data
+type Metadata map[string]string
+
+// MetadataStorage is implemented by storages able to keep metadata next to the object data
+type MetadataStorage interface {
+	PutWithMetadata(bucket, objectID string, data []byte, meta Metadata) (bool, error)
+	GetWithMetadata(bucket, objectID string) ([]byte, Metadata, error)
+}
+
+// ObjectInfo describes a stored object without its data
+type ObjectInfo struct {
+	Bucket   string
+	ID       string
+	Size     int64
+	ModTime  time.Time
+	Metadata Metadata
+}
+
+// ExistenceChecker is implemented by storages able to tell whether an object
+// exists without reading its data
+type ExistenceChecker interface {
+	Exists(bucket, objectID string) (bool, error)
+}
+
+// MetadataUpdater is implemented by storages able to change the metadata of
+// an object without rewriting its data through the layers above nor
+// changing its modification time. The keys of changes are set, the other
+// keys are left untouched.
+type MetadataUpdater interface {
+	UpdateMetadata(bucket, objectID string, changes Metadata) error
+}
+
+// Lister is implemented by storages able to enumerate their content
+type Lister interface {
+	ListBuckets() ([]string, error)
+	ListObjects(bucket, prefix string) ([]ObjectInfo, error) // sorted by ID
+}
+
+// MultipartUpload describes an upload which has been initiated but not completed
+type MultipartUpload struct {
+	Bucket    string
+	ID        string
+	UploadID  string
+	Initiated time.Time
+}
+
+// MultipartStorage is implemented by storages supporting multipart uploads
+type MultipartStorage interface {
+	ListMultipartUploads(bucket string) ([]MultipartUpload, error)
+	AbortMultipartUpload(bucket, objectID, uploadID string) error
+}
+
+// Version describes a noncurrent version of an object
+type Version struct {
+	Bucket    string
+	ID        string
+	VersionID string
+	// NoncurrentSince is when the version was superseded by a newer one
+	NoncurrentSince time.Time
+}
+
+// VersionedStorage is implemented by storages keeping previous versions of objects
+type VersionedStorage interface {
+	ListNoncurrentVersions(bucket string) ([]Version, error)
+	DeleteVersion(bucket, objectID, versionID string) error
+}
+
+// PutWithMetadata stores data together with meta if the storage supports it, otherwise only data is stored
+func PutWithMetadata(s Storage, bucket, objectID string, data []byte, meta Metadata) (bool, error) {
+	if ms, ok := s.(MetadataStorage); ok {
+		return ms.PutWithMetadata(bucket, objectID, data, meta)
+	}
+	return s.Put(bucket, objectID, data)
+}
+
+// GetWithMetadata retrieves data and metadata; storages without metadata support return empty metadata
+func GetWithMetadata(s Storage, bucket, objectID string) ([]byte, Metadata, error) {
+	if ms, ok := s.(MetadataStorage); ok {
+		return ms.GetWithMetadata(bucket, objectID)
+	}
+	data, err := s.Get(bucket, objectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, Metadata{}, nil
+}
+
+// Exists reports whether the object exists; on storages without ExistenceChecker support the object is read
+func Exists(s Storage, bucket, objectID string) (bool, error) {
+	if c, ok := s.(ExistenceChecker); ok {
+		return c.Exists(bucket, objectID)
+	}
+	_, err := s.Get(bucket, objectID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object,
+// ErrUpdateNotSupported is returned by storages without MetadataUpdater support
+func UpdateMetadata(s Storage, bucket, objectID string, changes Metadata) error {
+	if u, ok := s.(MetadataUpdater); ok {
+		return u.UpdateMetadata(bucket, objectID, changes)
+	}
+	return ErrUpdateNotSupported
+}
+
+// TenantBucket qualifies bucket with the namespace of tenant. Tenant buckets
+// reach the storage as "<tenant>/<bucket>" so that every tenant gets its own
+// namespace, buckets of the global namespace (empty tenant) are unqualified.
+func TenantBucket(tenant, bucket string) string {
+	if tenant == "" {
+		return bucket
+	}
+	return tenant + "/" + bucket
+}
+
+// SplitTenantBucket returns the tenant and the bucket name of a qualified bucket
+func SplitTenantBucket(qualified string) (tenant, bucket string) {
+	if tenant, bucket, ok := strings.Cut(qualified, "/"); ok {
+		return tenant, bucket
+	}
+	return "", qualified
+}
+
+// Clone returns a copy of the metadata that can be modified freely
+func (m Metadata) Clone() Metadata {
+	c := make(Metadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// With returns a copy of the metadata with the keys of changes set
+func (m Metadata) With(changes Metadata) Metadata {
+	c := m.Clone()
+	for k, v := range changes {
+		c[k] = v
+	}
+	return c
+}
+
 var (
 	ErrNotFound     = errors.New("object not found")
 	ErrAlreadyExist = errors.New("object already exists in bucket")
+	// ErrListNotSupported is returned when listing a storage which cannot be enumerated
+	ErrListNotSupported = errors.New("storage does not support listing")
+	// ErrCorrupt is returned instead of the data of objects failing their integrity checks
+	ErrCorrupt = errors.New("object data is corrupt")
+	// ErrUpdateNotSupported is returned when updating the metadata of a storage which cannot do it in place
+	ErrUpdateNotSupported = errors.New("storage does not support metadata updates")
 )
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCursorExpired is returned when reading a change log from a cursor older
+// than its retention, or unknown to it (for example after a restart)
+var ErrCursorExpired = errors.New("change log cursor expired")
+
+// Change is an event recorded in a change log, Seq is its cursor
+type Change struct {
+	Seq uint64 `json:"seq"`
+	Event
+}
+
+// ChangeLog keeps the most recent events in memory so that watchers can
+// follow the changes of a bucket and resume from a cursor. It retains at most
+// capacity events, none older than retention.
+type ChangeLog struct {
+	mu          sync.Mutex
+	changes     []Change // oldest first
+	capacity    int
+	retention   time.Duration
+	lastSeq     uint64
+	subscribers map[chan struct{}]struct{}
+	now         func() time.Time
+}
+
+// NewChangeLog creates an empty change log
+func NewChangeLog(capacity int, retention time.Duration) *ChangeLog {
+	return &ChangeLog{
+		capacity:    capacity,
+		retention:   retention,
+		subscribers: make(map[chan struct{}]struct{}),
+		now:         time.Now,
+	}
+}
+
+// Publish records an event and wakes up the subscribers
+func (l *ChangeLog) Publish(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastSeq++
+	l.changes = append(l.changes, Change{Seq: l.lastSeq, Event: e})
+	l.trim()
+	for ch := range l.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// trim drops the changes beyond the capacity or the retention, l.mu must be held
+func (l *ChangeLog) trim() {
+	drop := max(len(l.changes)-l.capacity, 0)
+	cutoff := l.now().Add(-l.retention)
+	for drop < len(l.changes) && l.changes[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		l.changes = append(l.changes[:0:0], l.changes[drop:]...)
+	}
+}
+
+// Cursor returns the cursor of the latest change, reading from it only returns new changes
+func (l *ChangeLog) Cursor() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSeq
+}
+
+// Read returns up to limit changes after cursor selected by match, and the
+// cursor to continue from. ErrCursorExpired is returned, along with the
+// cursor of the oldest retained change, when changes after cursor were
+// already dropped.
+func (l *ChangeLog) Read(cursor uint64, match func(Event) bool, limit int) ([]Change, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trim()
+
+	oldest := l.lastSeq + 1
+	if len(l.changes) > 0 {
+		oldest = l.changes[0].Seq
+	}
+	if cursor > l.lastSeq || cursor+1 < oldest {
+		return nil, oldest - 1, ErrCursorExpired
+	}
+
+	var changes []Change
+	next := cursor
+	for _, c := range l.changes[cursor+1-oldest:] {
+		if len(changes) == limit {
+			break
+		}
+		next = c.Seq
+		if match(c.Event) {
+			changes = append(changes, c)
+		}
+	}
+	return changes, next, nil
+}
+
+// Subscribe returns a channel signalled when changes are published, cancel
+// must be called once the subscriber is done
+func (l *ChangeLog) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	l.mu.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mu.Unlock()
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,165 @@
+// Package events emits notifications about object changes from a
+// domain.Storage decorator, so that every code path writing to the storage
+// produces them.
+package events
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+// Types of events
+const (
+	ObjectCreatedPut    = "ObjectCreated:Put"
+	ObjectRemovedDelete = "ObjectRemoved:Delete"
+	// ObjectRemovedEvicted reports an object dropped by a bounded backend, such as the cache
+	ObjectRemovedEvicted = "ObjectRemoved:Evicted"
+)
+
+// Event describes a change of an object
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Bucket is the bucket as seen by the storage, qualified with the tenant
+	// namespace if any (see domain.TenantBucket)
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size,omitempty"`
+	// ETag is the hex encoded MD5 of the object created
+	ETag string `json:"etag,omitempty"`
+	// Overwrite is set when ObjectCreated:Put replaced an existing object
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// Tenant returns the tenant owning the bucket of the event and the bucket name within its namespace
+func (e Event) Tenant() (tenant, bucket string) {
+	return domain.SplitTenantBucket(e.Bucket)
+}
+
+// Publisher receives the events of a Storage
+type Publisher interface {
+	Publish(Event)
+}
+
+// PublisherFunc adapts a function to a Publisher
+type PublisherFunc func(Event)
+
+// Publish calls f(e)
+func (f PublisherFunc) Publish(e Event) {
+	f(e)
+}
+
+// Storage is a domain.Storage decorator publishing an event for every object
+// created, overwritten or removed
+type Storage struct {
+	inner      domain.Storage
+	publishers []Publisher
+	now        func() time.Time
+}
+
+// NewStorage wraps inner, publishing its changes to publishers
+func NewStorage(inner domain.Storage, publishers ...Publisher) *Storage {
+	return &Storage{inner: inner, publishers: publishers, now: time.Now}
+}
+
+// Put stores the object and publishes ObjectCreated:Put if it changed
+func (s *Storage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object with its metadata and publishes ObjectCreated:Put if it changed
+func (s *Storage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	// The check only sets the Overwrite flag of the event, failing it does not fail the write
+	existed, _ := domain.Exists(s.inner, bucket, objectID)
+
+	created, err := domain.PutWithMetadata(s.inner, bucket, objectID, data, meta)
+	if err != nil {
+		return false, err
+	}
+	if created {
+		sum := md5.Sum(data)
+		s.publish(Event{
+			Type:      ObjectCreatedPut,
+			Bucket:    bucket,
+			Key:       objectID,
+			Size:      int64(len(data)),
+			ETag:      hex.EncodeToString(sum[:]),
+			Overwrite: existed,
+		})
+	}
+	return created, nil
+}
+
+// Get retrieves the object
+func (s *Storage) Get(bucket, objectID string) ([]byte, error) {
+	return s.inner.Get(bucket, objectID)
+}
+
+// GetWithMetadata retrieves the object and its metadata
+func (s *Storage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	return domain.GetWithMetadata(s.inner, bucket, objectID)
+}
+
+// Exists reports whether the object exists in the underlying storage
+func (s *Storage) Exists(bucket, objectID string) (bool, error) {
+	return domain.Exists(s.inner, bucket, objectID)
+}
+
+// UpdateMetadata forwards the metadata update to the underlying storage
+func (s *Storage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	return domain.UpdateMetadata(s.inner, bucket, objectID, changes)
+}
+
+// Delete removes the object and publishes ObjectRemoved:Delete
+func (s *Storage) Delete(bucket, objectID string) error {
+	if err := s.inner.Delete(bucket, objectID); err != nil {
+		return err
+	}
+	s.publish(Event{Type: ObjectRemovedDelete, Bucket: bucket, Key: objectID})
+	return nil
+}
+
+// Evicted publishes ObjectRemoved:Evicted for an object the underlying
+// storage dropped on its own
+func (s *Storage) Evicted(bucket, objectID string) {
+	s.publish(Event{Type: ObjectRemovedEvicted, Bucket: bucket, Key: objectID})
+}
+
+// ListBuckets lists the buckets of the underlying storage
+func (s *Storage) ListBuckets() ([]string, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListBuckets()
+}
+
+// ListObjects lists the objects of the underlying storage
+func (s *Storage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListObjects(bucket, prefix)
+}
+
+// publish stamps the event with an ID and the current time and hands it to the publishers
+func (s *Storage) publish(e Event) {
+	e.ID = newID()
+	e.Time = s.now().UTC()
+	for _, p := range s.publishers {
+		p.Publish(e)
+	}
+}
+
+// newID returns a random event identifier
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+)
+
+func TestStorage_PublishesChanges(t *testing.T) {
+	var published []Event
+	s := NewStorage(persistence.NewInMemoryStorage(), PublisherFunc(func(e Event) {
+		published = append(published, e)
+	}))
+
+	s.Put("acme/photos", "a.jpg", []byte("data"))
+	s.Put("acme/photos", "a.jpg", []byte("data")) // unchanged, no event
+	s.Put("acme/photos", "a.jpg", []byte("new data"))
+	s.Delete("acme/photos", "a.jpg")
+	s.Delete("acme/photos", "a.jpg") // not found, no event
+	s.Evicted("acme/photos", "a.jpg")
+
+	if len(published) != 4 {
+		t.Fatalf("expected 4 events, got %+v", published)
+	}
+	want := []string{ObjectCreatedPut, ObjectCreatedPut, ObjectRemovedDelete, ObjectRemovedEvicted}
+	for i, e := range published {
+		if e.Type != want[i] || e.Bucket != "acme/photos" || e.Key != "a.jpg" || e.ID == "" || e.Time.IsZero() {
+			t.Errorf("unexpected event %d: %+v", i, e)
+		}
+	}
+	if published[1].Size != 8 {
+		t.Errorf("expected size 8, got %d", published[1].Size)
+	}
+	if tenant, bucket := published[0].Tenant(); tenant != "acme" || bucket != "photos" {
+		t.Errorf("unexpected tenant %q and bucket %q", tenant, bucket)
+	}
+}
+
+// readCounter counts the objects read from the storage
+type readCounter struct {
+	*persistence.InMemoryStorage
+	reads int
+}
+
+func (s *readCounter) Get(bucket, objectID string) ([]byte, error) {
+	s.reads++
+	return s.InMemoryStorage.Get(bucket, objectID)
+}
+
+func (s *readCounter) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	s.reads++
+	return s.InMemoryStorage.GetWithMetadata(bucket, objectID)
+}
+
+func TestStorage_OverwriteWithoutReads(t *testing.T) {
+	var published []Event
+	inner := &readCounter{InMemoryStorage: persistence.NewInMemoryStorage()}
+	s := NewStorage(inner, PublisherFunc(func(e Event) {
+		published = append(published, e)
+	}))
+
+	s.Put("photos", "a.jpg", []byte("data"))
+	s.Put("photos", "a.jpg", []byte("new data"))
+	if len(published) != 2 || published[0].Overwrite || !published[1].Overwrite {
+		t.Errorf("expected a create then an overwrite: %+v", published)
+	}
+	if inner.reads != 0 {
+		t.Errorf("expected the objects not to be read, got %d reads", inner.reads)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	l := NewChangeLog(3, time.Hour)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	all := func(Event) bool { return true }
+
+	start := l.Cursor()
+	s := NewStorage(persistence.NewInMemoryStorage(), l)
+	s.now = l.now
+	s.Put("photos", "a.jpg", []byte("data"))
+	s.Put("photos", "a.jpg", []byte("new data"))
+
+	changes, cursor, err := l.Read(start, all, 10)
+	if err != nil || len(changes) != 2 || cursor != 2 {
+		t.Fatalf("unexpected read: %+v, cursor %d, err %v", changes, cursor, err)
+	}
+	if changes[0].Overwrite || !changes[1].Overwrite || changes[1].ETag == "" {
+		t.Errorf("expected a create then an overwrite: %+v", changes)
+	}
+
+	// Capacity drops the oldest changes
+	s.Delete("photos", "a.jpg")
+	s.Put("photos", "b.jpg", []byte("b"))
+	if _, cursor, err := l.Read(start, all, 10); !errors.Is(err, ErrCursorExpired) || cursor != 1 {
+		t.Errorf("expected cursor to expire and resume after 1, got %d, %v", cursor, err)
+	}
+	changes, _, err = l.Read(3, func(e Event) bool { return e.Key == "b.jpg" }, 10)
+	if err != nil || len(changes) != 1 || changes[0].Seq != 4 {
+		t.Errorf("unexpected filtered read: %+v, %v", changes, err)
+	}
+	if _, _, err := l.Read(10, all, 10); !errors.Is(err, ErrCursorExpired) {
+		t.Errorf("expected unknown cursor to expire, got %v", err)
+	}
+
+	// Retention drops old changes
+	now = now.Add(2 * time.Hour)
+	if _, cursor, err := l.Read(3, all, 10); !errors.Is(err, ErrCursorExpired) || cursor != 4 {
+		t.Errorf("expected retention to expire the cursor, got %d, %v", cursor, err)
+	}
+
+	signal, cancel := l.Subscribe()
+	defer cancel()
+	s.Put("photos", "c.jpg", []byte("c"))
+	select {
+	case <-signal:
+	default:
+		t.Errorf("expected subscriber to be signalled")
+	}
+}
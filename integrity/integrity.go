@@ -0,0 +1,299 @@
+// Package integrity protects objects against silent corruption. Checksums
+// are recorded when objects are written and verified whenever they are read,
+// and a scrubber periodically verifies every object and repairs the corrupt
+// ones from redundant copies.
+package integrity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metadata keys recording the checksums of an object
+const (
+	// MetadataChecksum is the hex SHA-256 of the stored data
+	MetadataChecksum = "checksum"
+	// MetadataChunkChecksums lists the hex CRC-32C of every chunk of large
+	// objects, locating the corrupt parts
+	MetadataChunkChecksums = "chunk-checksums"
+)
+
+// ChunkSize is the size of the chunks of large objects
+const ChunkSize = 1 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	corruptObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integrity_corrupt_objects_total",
+		Help: "Corrupt objects detected, by source (read or scrub).",
+	}, []string{"source"})
+	quarantinedObjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "integrity_quarantined_objects",
+		Help: "Objects currently quarantined as corrupt.",
+	})
+)
+
+// Quarantined describes a corrupt object. Reads of quarantined objects fail
+// until they are repaired, rewritten or deleted.
+type Quarantined struct {
+	Bucket string `json:"bucket"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+	// Chunk is the index of the first corrupt chunk, -1 when unknown
+	Chunk      int       `json:"chunk"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// corruption describes a checksum mismatch
+type corruption struct {
+	reason string
+	chunk  int
+}
+
+func (c *corruption) Error() string {
+	return c.reason
+}
+
+func (c *corruption) Unwrap() error {
+	return domain.ErrCorrupt
+}
+
+// checksums returns the checksum of data and, for large objects, the
+// checksums of its chunks
+func checksums(data []byte) (string, string) {
+	sum := sha256.Sum256(data)
+	if len(data) <= ChunkSize {
+		return hex.EncodeToString(sum[:]), ""
+	}
+	var chunks []string
+	for start := 0; start < len(data); start += ChunkSize {
+		chunk := data[start:min(start+ChunkSize, len(data))]
+		chunks = append(chunks, fmt.Sprintf("%08x", crc32.Checksum(chunk, castagnoli)))
+	}
+	return hex.EncodeToString(sum[:]), strings.Join(chunks, ",")
+}
+
+// verify checks data against the checksums recorded in meta. Objects
+// without checksums, written before they were recorded, are not verified.
+func verify(data []byte, meta domain.Metadata) (verified bool, err error) {
+	expected, ok := meta[MetadataChecksum]
+	if !ok {
+		return false, nil
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) == expected {
+		return true, nil
+	}
+
+	c := &corruption{reason: "checksum mismatch", chunk: -1}
+	if chunks := meta[MetadataChunkChecksums]; chunks != "" {
+		for i, want := range strings.Split(chunks, ",") {
+			start := i * ChunkSize
+			if start >= len(data) {
+				c.chunk = i
+				break
+			}
+			chunk := data[start:min(start+ChunkSize, len(data))]
+			if fmt.Sprintf("%08x", crc32.Checksum(chunk, castagnoli)) != want {
+				c.chunk = i
+				break
+			}
+		}
+		if c.chunk >= 0 {
+			c.reason = "checksum mismatch in chunk " + strconv.Itoa(c.chunk)
+		}
+	}
+	return true, c
+}
+
+// strip removes the checksums from metadata returned to the callers
+func strip(meta domain.Metadata) domain.Metadata {
+	if _, ok := meta[MetadataChecksum]; !ok {
+		return meta
+	}
+	stripped := meta.Clone()
+	delete(stripped, MetadataChecksum)
+	delete(stripped, MetadataChunkChecksums)
+	return stripped
+}
+
+type objectRef struct {
+	bucket, id string
+}
+
+// Storage is a domain.Storage decorator recording checksums of the data
+// written to the underlying storage and verifying them on every read, so
+// that corrupt data is reported instead of being served.
+type Storage struct {
+	inner domain.Storage
+
+	mu          sync.RWMutex
+	quarantined map[objectRef]Quarantined
+}
+
+// NewStorage protects the objects of inner with checksums
+func NewStorage(inner domain.Storage) *Storage {
+	return &Storage{inner: inner, quarantined: make(map[objectRef]Quarantined)}
+}
+
+// Put stores the object with its checksums
+func (s *Storage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object and its metadata with its checksums.
+// Rewriting a quarantined object releases it.
+func (s *Storage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	stored := meta.Clone()
+	stored[MetadataChecksum], stored[MetadataChunkChecksums] = checksums(data)
+	if stored[MetadataChunkChecksums] == "" {
+		delete(stored, MetadataChunkChecksums)
+	}
+	created, err := domain.PutWithMetadata(s.inner, bucket, objectID, data, stored)
+	if err != nil {
+		return false, err
+	}
+	s.release(bucket, objectID)
+	return created, nil
+}
+
+// Get retrieves the object once verified
+func (s *Storage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object and its metadata once verified. It
+// returns an error wrapping domain.ErrCorrupt rather than corrupt data.
+func (s *Storage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	if q, ok := s.quarantine(bucket, objectID); ok {
+		return nil, nil, fmt.Errorf("%s/%s is quarantined: %s: %w", bucket, objectID, q.Reason, domain.ErrCorrupt)
+	}
+	data, meta, err := domain.GetWithMetadata(s.inner, bucket, objectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := verify(data, meta); err != nil {
+		corruptObjects.WithLabelValues("read").Inc()
+		s.isolate(bucket, objectID, err)
+		return nil, nil, fmt.Errorf("%s/%s: %w", bucket, objectID, err)
+	}
+	return data, strip(meta), nil
+}
+
+// Exists reports whether the object exists in the underlying storage
+func (s *Storage) Exists(bucket, objectID string) (bool, error) {
+	return domain.Exists(s.inner, bucket, objectID)
+}
+
+// UpdateMetadata forwards the metadata update to the underlying storage
+func (s *Storage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	return domain.UpdateMetadata(s.inner, bucket, objectID, changes)
+}
+
+// Delete removes the object, releasing it from quarantine
+func (s *Storage) Delete(bucket, objectID string) error {
+	err := s.inner.Delete(bucket, objectID)
+	s.release(bucket, objectID)
+	return err
+}
+
+// ListBuckets forwards to the underlying storage when it supports listing
+func (s *Storage) ListBuckets() ([]string, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListBuckets()
+}
+
+// ListObjects forwards to the underlying storage when it supports listing
+func (s *Storage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	infos, err := lister.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range infos {
+		infos[i].Metadata = strip(infos[i].Metadata)
+	}
+	return infos, nil
+}
+
+// check reads an object and verifies it, quarantining it when corrupt
+func (s *Storage) check(bucket, objectID string) (size int, verified bool, err error) {
+	data, meta, err := domain.GetWithMetadata(s.inner, bucket, objectID)
+	if err != nil {
+		return 0, false, err
+	}
+	verified, err = verify(data, meta)
+	if err != nil {
+		s.isolate(bucket, objectID, err)
+		return len(data), verified, err
+	}
+	s.release(bucket, objectID)
+	return len(data), verified, nil
+}
+
+// Quarantined returns the quarantined objects
+func (s *Storage) Quarantined() []Quarantined {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	objects := make([]Quarantined, 0, len(s.quarantined))
+	for _, q := range s.quarantined {
+		objects = append(objects, q)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Bucket != objects[j].Bucket {
+			return objects[i].Bucket < objects[j].Bucket
+		}
+		return objects[i].ID < objects[j].ID
+	})
+	return objects
+}
+
+func (s *Storage) quarantine(bucket, objectID string) (Quarantined, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q, ok := s.quarantined[objectRef{bucket, objectID}]
+	return q, ok
+}
+
+// isolate quarantines a corrupt object
+func (s *Storage) isolate(bucket, objectID string, err error) {
+	q := Quarantined{Bucket: bucket, ID: objectID, Reason: err.Error(), Chunk: -1, DetectedAt: time.Now().UTC()}
+	if c, ok := err.(*corruption); ok {
+		q.Chunk = c.chunk
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.quarantined[objectRef{bucket, objectID}]; !ok {
+		s.quarantined[objectRef{bucket, objectID}] = q
+		quarantinedObjects.Set(float64(len(s.quarantined)))
+	}
+}
+
+// release lifts the quarantine of an object
+func (s *Storage) release(bucket, objectID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.quarantined[objectRef{bucket, objectID}]; ok {
+		delete(s.quarantined, objectRef{bucket, objectID})
+		quarantinedObjects.Set(float64(len(s.quarantined)))
+	}
+}
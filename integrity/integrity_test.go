@@ -0,0 +1,122 @@
+package integrity
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+)
+
+// corrupt flips a byte of a stored object, keeping its checksums
+func corrupt(t *testing.T, inner *persistence.InMemoryStorage, bucket, objectID string, offset int) {
+	t.Helper()
+	data, meta, err := inner.GetWithMetadata(bucket, objectID)
+	if err != nil {
+		t.Fatalf("GetWithMetadata failed: %v", err)
+	}
+	damaged := bytes.Clone(data)
+	damaged[offset] ^= 0xff
+	inner.PutWithMetadata(bucket, objectID, damaged, meta)
+}
+
+func TestStorage_DetectsCorruption(t *testing.T) {
+	inner := persistence.NewInMemoryStorage()
+	s := NewStorage(inner)
+
+	if created, err := s.PutWithMetadata("b", "small", []byte("hello"), domain.Metadata{"tags": "a=1"}); err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("b", "small", []byte("hello"), domain.Metadata{"tags": "a=1"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	if _, meta, _ := inner.GetWithMetadata("b", "small"); meta[MetadataChecksum] == "" || meta[MetadataChunkChecksums] != "" {
+		t.Errorf("expected a checksum without chunks, got %v", meta)
+	}
+	data, meta, err := s.GetWithMetadata("b", "small")
+	if err != nil || string(data) != "hello" || len(meta) != 1 || meta["tags"] != "a=1" {
+		t.Fatalf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+
+	large := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
+	s.Put("b", "large", large)
+	corrupt(t, inner, "b", "large", ChunkSize+ChunkSize/2)
+	if _, err := s.Get("b", "large"); !errors.Is(err, domain.ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	quarantined := s.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].ID != "large" || quarantined[0].Chunk != 1 {
+		t.Fatalf("expected chunk 1 of large to be quarantined, got %+v", quarantined)
+	}
+
+	// Rewriting the object releases it
+	s.Put("b", "large", large)
+	if got, err := s.Get("b", "large"); err != nil || !bytes.Equal(got, large) || len(s.Quarantined()) != 0 {
+		t.Errorf("expected the rewritten object to be served (err %v)", err)
+	}
+
+	// Objects written without checksums are served unverified
+	inner.Put("b", "legacy", []byte("old"))
+	if got, err := s.Get("b", "legacy"); err != nil || string(got) != "old" {
+		t.Errorf("expected the legacy object, got %q (err %v)", got, err)
+	}
+}
+
+// copyRepairer restores objects from another storage
+type copyRepairer struct {
+	copies *Storage
+	target *Storage
+}
+
+func (r *copyRepairer) Repair(bucket, objectID string) (bool, error) {
+	data, meta, err := r.copies.GetWithMetadata(bucket, objectID)
+	if errors.Is(err, domain.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = r.target.PutWithMetadata(bucket, objectID, data, meta)
+	return err == nil, err
+}
+
+func TestScrubber(t *testing.T) {
+	inner := persistence.NewInMemoryStorage()
+	s := NewStorage(inner)
+	replica := NewStorage(persistence.NewInMemoryStorage())
+	for _, key := range []string{"a", "b", "c"} {
+		s.Put("photos", key, []byte("data of "+key))
+		if key != "c" {
+			replica.Put("photos", key, []byte("data of "+key))
+		}
+	}
+	inner.Put("photos", "legacy", []byte("old"))
+	corrupt(t, inner, "photos", "a", 0)
+	corrupt(t, inner, "photos", "c", 0)
+
+	sc, err := NewScrubber(s, time.Hour, 1<<20, &copyRepairer{copies: replica, target: s})
+	if err != nil {
+		t.Fatalf("NewScrubber failed: %v", err)
+	}
+	report, err := sc.Scrub(context.Background())
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if report.Objects != 4 || report.Unverified != 1 || report.Corrupt != 2 || report.Repaired != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if got, err := s.Get("photos", "a"); err != nil || string(got) != "data of a" {
+		t.Errorf("expected a to be repaired from the replica, got %q (err %v)", got, err)
+	}
+	// Without a copy, the object stays quarantined
+	status := sc.Status()
+	if len(status.Quarantined) != 1 || status.Quarantined[0].ID != "c" || status.LastRun == nil || status.Running {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if _, err := s.Get("photos", "c"); !errors.Is(err, domain.ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package integrity
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	scrubbedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integrity_scrubbed_bytes_total",
+		Help: "Bytes verified by the scrubber.",
+	})
+	repairedObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integrity_repaired_objects_total",
+		Help: "Corrupt objects repaired from redundant copies.",
+	})
+)
+
+// Repairer restores a corrupt object from a redundant copy, such as the
+// parity shards of an erasure-coded storage or the replicas held by other
+// nodes. It reports whether a copy was available.
+type Repairer interface {
+	Repair(bucket, objectID string) (bool, error)
+}
+
+// Report summarizes a scrubbing run
+type Report struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Objects    int       `json:"objects"`
+	Bytes      int64     `json:"bytes"`
+	// Unverified counts the objects written without checksums
+	Unverified int `json:"unverified"`
+	Corrupt    int `json:"corrupt"`
+	Repaired   int `json:"repaired"`
+}
+
+// ScrubStatus describes the scrubber
+type ScrubStatus struct {
+	Running     bool          `json:"running"`
+	LastRun     *Report       `json:"lastRun,omitempty"`
+	Quarantined []Quarantined `json:"quarantined"`
+}
+
+// Scrubber walks every object of a storage at a bounded rate, verifying its
+// checksums and repairing the corrupt ones
+type Scrubber struct {
+	storage   *Storage
+	lister    domain.Lister
+	limiter   *rate.Limiter
+	repairers []Repairer
+	interval  time.Duration
+
+	mu      sync.Mutex
+	running bool
+	last    *Report
+	trigger chan struct{}
+}
+
+// NewScrubber scrubs storage every interval, reading at most bytesPerSecond
+// (unlimited when not positive) and repairing corrupt objects with the first
+// repairer having a copy. The underlying storage must support listing.
+func NewScrubber(storage *Storage, interval time.Duration, bytesPerSecond int, repairers ...Repairer) (*Scrubber, error) {
+	lister, ok := storage.inner.(domain.Lister)
+	if !ok {
+		return nil, errors.New("scrubbed storage must support listing")
+	}
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if bytesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), max(bytesPerSecond, ChunkSize))
+	}
+	return &Scrubber{
+		storage:   storage,
+		lister:    lister,
+		limiter:   limiter,
+		repairers: repairers,
+		interval:  interval,
+		trigger:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Run scrubs every interval, and whenever triggered, until ctx is done
+func (sc *Scrubber) Run(ctx context.Context) {
+	ticker := time.NewTicker(sc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sc.trigger:
+		}
+		report, err := sc.Scrub(ctx)
+		if err != nil {
+			log.Println("Scrubber: run failed:", err)
+			continue
+		}
+		log.Printf("Scrubber: verified %d objects, %d corrupt, %d repaired", report.Objects, report.Corrupt, report.Repaired)
+	}
+}
+
+// Trigger starts a run as soon as possible
+func (sc *Scrubber) Trigger() {
+	select {
+	case sc.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the last run and the quarantined objects
+func (sc *Scrubber) Status() ScrubStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return ScrubStatus{Running: sc.running, LastRun: sc.last, Quarantined: sc.storage.Quarantined()}
+}
+
+// Scrub verifies every object once
+func (sc *Scrubber) Scrub(ctx context.Context) (Report, error) {
+	sc.mu.Lock()
+	sc.running = true
+	sc.mu.Unlock()
+	report := Report{StartedAt: time.Now().UTC()}
+	defer func() {
+		report.FinishedAt = time.Now().UTC()
+		sc.mu.Lock()
+		sc.running = false
+		sc.last = &report
+		sc.mu.Unlock()
+	}()
+
+	buckets, err := sc.lister.ListBuckets()
+	if err != nil {
+		return report, err
+	}
+	for _, bucket := range buckets {
+		infos, err := sc.lister.ListObjects(bucket, "")
+		if err != nil {
+			return report, err
+		}
+		for _, info := range infos {
+			if err := sc.wait(ctx, info.Size); err != nil {
+				return report, err
+			}
+			sc.scrubObject(bucket, info.ID, &report)
+		}
+	}
+	return report, nil
+}
+
+// wait paces the reads to the configured rate
+func (sc *Scrubber) wait(ctx context.Context, size int64) error {
+	if sc.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	for size > 0 {
+		n := min(size, int64(sc.limiter.Burst()))
+		if err := sc.limiter.WaitN(ctx, int(n)); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return ctx.Err()
+}
+
+func (sc *Scrubber) scrubObject(bucket, objectID string, report *Report) {
+	size, verified, err := sc.storage.check(bucket, objectID)
+	if errors.Is(err, domain.ErrNotFound) {
+		// Deleted meanwhile
+		return
+	}
+	report.Objects++
+	report.Bytes += int64(size)
+	scrubbedBytes.Add(float64(size))
+	if !verified && err == nil {
+		report.Unverified++
+		return
+	}
+	if !errors.Is(err, domain.ErrCorrupt) {
+		if err != nil {
+			log.Printf("Scrubber: reading %s/%s failed: %v", bucket, objectID, err)
+		}
+		return
+	}
+
+	report.Corrupt++
+	corruptObjects.WithLabelValues("scrub").Inc()
+	log.Printf("Scrubber: %s/%s is corrupt: %v", bucket, objectID, err)
+	if sc.repair(bucket, objectID) {
+		report.Repaired++
+		repairedObjects.Inc()
+		log.Printf("Scrubber: repaired %s/%s", bucket, objectID)
+	}
+}
+
+// repair restores an object with the first repairer having a copy, the
+// repaired object is verified again before being released
+func (sc *Scrubber) repair(bucket, objectID string) bool {
+	for _, r := range sc.repairers {
+		ok, err := r.Repair(bucket, objectID)
+		if err != nil {
+			log.Printf("Scrubber: repairing %s/%s failed: %v", bucket, objectID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if _, _, err := sc.storage.check(bucket, objectID); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package lifecycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+)
+
+func TestConfiguration_Validate(t *testing.T) {
+	valid := Configuration{Rules: []Rule{{ID: "tmp", Enabled: true, ExpirationDays: 1}}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected valid configuration, got: %v", err)
+	}
+
+	invalid := []Configuration{
+		{},
+		{Rules: []Rule{{ID: "", ExpirationDays: 1}}},
+		{Rules: []Rule{{ID: "noop"}}},
+		{Rules: []Rule{{ID: "neg", ExpirationDays: -1}}},
+		{Rules: []Rule{{ID: "dup", ExpirationDays: 1}, {ID: "dup", ExpirationDays: 2}}},
+	}
+	for i, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("configuration %d: expected validation error", i)
+		}
+	}
+}
+
+func TestScheduler_ExpirationRules(t *testing.T) {
+	storage := persistence.NewInMemoryStorage()
+	storage.Put("builds", "tmp/artifact-1", []byte("old build"))
+	storage.PutWithMetadata("builds", "tagged/artifact-2", []byte("tagged build"), domain.Metadata{MetadataTagging: "kind=ci"})
+	storage.Put("builds", "release/v1", []byte("release"))
+
+	store := NewStore()
+	err := store.Set("builds", Configuration{Rules: []Rule{
+		{ID: "tmp", Enabled: true, Filter: Filter{Prefix: "tmp/"}, ExpirationDays: 1},
+		{ID: "ci", Enabled: true, Filter: Filter{Tags: map[string]string{"kind": "ci"}}, ExpirationDays: 1},
+		{ID: "disabled", Enabled: false, Filter: Filter{Prefix: "release/"}, ExpirationDays: 1},
+	}})
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	scheduler := NewScheduler(storage, store, time.Hour)
+
+	// Nothing is old enough yet
+	report, err := scheduler.RunOnce()
+	if err != nil || report.ObjectsExpired != 0 {
+		t.Fatalf("expected no expiration, got %d (err %v)", report.ObjectsExpired, err)
+	}
+
+	scheduler.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	report, err = scheduler.RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	if report.ObjectsExpired != 2 {
+		t.Errorf("expected 2 expired objects, got %d", report.ObjectsExpired)
+	}
+	if _, err := storage.Get("builds", "release/v1"); err != nil {
+		t.Errorf("expected object matched by disabled rule to be kept")
+	}
+	if _, err := storage.Get("builds", "tmp/artifact-1"); err != domain.ErrNotFound {
+		t.Errorf("expected tmp/artifact-1 to be expired")
+	}
+}
+
+func TestScheduler_TTL(t *testing.T) {
+	storage := persistence.NewInMemoryStorage()
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	storage.PutWithMetadata("bucket", "expired", []byte("a"), domain.Metadata{MetadataExpires: past})
+	storage.PutWithMetadata("bucket", "alive", []byte("b"), domain.Metadata{MetadataExpires: future})
+
+	report, err := NewScheduler(storage, NewStore(), time.Hour).RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	if report.ObjectsExpired != 1 {
+		t.Errorf("expected 1 expired object, got %d", report.ObjectsExpired)
+	}
+	if _, err := storage.Get("bucket", "alive"); err != nil {
+		t.Errorf("expected object with future TTL to be kept")
+	}
+}
+
+type multipartStorage struct {
+	*persistence.InMemoryStorage
+	uploads []domain.MultipartUpload
+}
+
+func (s *multipartStorage) ListMultipartUploads(bucket string) ([]domain.MultipartUpload, error) {
+	return s.uploads, nil
+}
+
+func (s *multipartStorage) AbortMultipartUpload(bucket, objectID, uploadID string) error {
+	for i, u := range s.uploads {
+		if u.UploadID == uploadID {
+			s.uploads = append(s.uploads[:i], s.uploads[i+1:]...)
+			return nil
+		}
+	}
+	return domain.ErrNotFound
+}
+
+func TestScheduler_AbortIncompleteMultipart(t *testing.T) {
+	storage := &multipartStorage{InMemoryStorage: persistence.NewInMemoryStorage()}
+	storage.Put("bucket", "obj", []byte("data"))
+	storage.uploads = []domain.MultipartUpload{
+		{Bucket: "bucket", ID: "big", UploadID: "old", Initiated: time.Now().AddDate(0, 0, -10)},
+		{Bucket: "bucket", ID: "big", UploadID: "recent", Initiated: time.Now()},
+	}
+
+	store := NewStore()
+	store.Set("bucket", Configuration{Rules: []Rule{{ID: "mp", Enabled: true, AbortIncompleteMultipartDays: 7}}})
+
+	report, err := NewScheduler(storage, store, time.Hour).RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	if report.UploadsAborted != 1 || len(storage.uploads) != 1 || storage.uploads[0].UploadID != "recent" {
+		t.Errorf("expected only the old upload to be aborted, got %+v", storage.uploads)
+	}
+}
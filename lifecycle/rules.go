@@ -0,0 +1,154 @@
+// Package lifecycle implements bucket lifecycle rules and per-object TTLs.
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+const (
+	// MetadataExpires is the metadata key holding the RFC 3339 expiry time of an object
+	MetadataExpires = "expires"
+	// MetadataTagging is the metadata key holding the URL-encoded tags of an object (k1=v1&k2=v2)
+	MetadataTagging = "tagging"
+)
+
+// Filter selects the objects a rule applies to. An empty filter matches every object.
+type Filter struct {
+	Prefix string            `json:"prefix,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// Rule is a single lifecycle rule of a bucket
+type Rule struct {
+	ID      string `json:"id"`
+	Enabled bool   `json:"enabled"`
+	Filter  Filter `json:"filter"`
+	// ExpirationDays deletes objects this many days after their last modification
+	ExpirationDays int `json:"expirationDays,omitempty"`
+	// AbortIncompleteMultipartDays aborts uploads not completed this many days after initiation
+	AbortIncompleteMultipartDays int `json:"abortIncompleteMultipartDays,omitempty"`
+	// NoncurrentVersionExpirationDays deletes versions this many days after they became noncurrent
+	NoncurrentVersionExpirationDays int `json:"noncurrentVersionExpirationDays,omitempty"`
+}
+
+// Configuration holds the lifecycle rules of a bucket
+type Configuration struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Validate checks the configuration is consistent
+func (c Configuration) Validate() error {
+	if len(c.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+	ids := make(map[string]bool)
+	for _, rule := range c.Rules {
+		if rule.ID == "" {
+			return errors.New("rule id is required")
+		}
+		if ids[rule.ID] {
+			return fmt.Errorf("duplicate rule id %q", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.ExpirationDays < 0 || rule.AbortIncompleteMultipartDays < 0 || rule.NoncurrentVersionExpirationDays < 0 {
+			return fmt.Errorf("rule %q: days must not be negative", rule.ID)
+		}
+		if rule.ExpirationDays == 0 && rule.AbortIncompleteMultipartDays == 0 && rule.NoncurrentVersionExpirationDays == 0 {
+			return fmt.Errorf("rule %q: no action configured", rule.ID)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule filter selects an object with the given ID and metadata
+func (f Filter) matches(objectID string, meta domain.Metadata) bool {
+	if !strings.HasPrefix(objectID, f.Prefix) {
+		return false
+	}
+	if len(f.Tags) == 0 {
+		return true
+	}
+	tags := ParseTags(meta[MetadataTagging])
+	for k, v := range f.Tags {
+		if tags.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTags decodes the tagging metadata of an object, invalid tagging is ignored
+func ParseTags(tagging string) url.Values {
+	tags, err := url.ParseQuery(tagging)
+	if err != nil {
+		return url.Values{}
+	}
+	return tags
+}
+
+// ExpiresAt returns the TTL expiry of an object, if any
+func ExpiresAt(meta domain.Metadata) (time.Time, bool) {
+	value, ok := meta[MetadataExpires]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Expired reports whether the TTL of an object has passed. Expired objects
+// are treated as missing until the scheduler removes them.
+func Expired(meta domain.Metadata, now time.Time) bool {
+	expires, ok := ExpiresAt(meta)
+	return ok && !now.Before(expires)
+}
+
+// Store keeps the lifecycle configuration of every bucket
+type Store struct {
+	mu      sync.RWMutex
+	buckets map[string]Configuration
+}
+
+// NewStore creates an empty lifecycle configuration store
+func NewStore() *Store {
+	return &Store{buckets: make(map[string]Configuration)}
+}
+
+// Set replaces the lifecycle configuration of a bucket
+func (s *Store) Set(bucket string, cfg Configuration) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = cfg
+	return nil
+}
+
+// Get returns the lifecycle configuration of a bucket
+func (s *Store) Get(bucket string) (Configuration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg, ok := s.buckets[bucket]
+	return cfg, ok
+}
+
+// Delete removes the lifecycle configuration of a bucket
+func (s *Store) Delete(bucket string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.buckets[bucket]
+	delete(s.buckets, bucket)
+	return ok
+}
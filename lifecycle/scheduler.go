@@ -0,0 +1,243 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	objectsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lifecycle_objects_expired_total",
+		Help: "Objects deleted by lifecycle rules or TTL, by reason.",
+	}, []string{"reason"})
+	bytesExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lifecycle_bytes_expired_total",
+		Help: "Bytes deleted by lifecycle rules or TTL.",
+	})
+	uploadsAborted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lifecycle_multipart_uploads_aborted_total",
+		Help: "Incomplete multipart uploads aborted by lifecycle rules.",
+	})
+	versionsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lifecycle_noncurrent_versions_expired_total",
+		Help: "Noncurrent object versions deleted by lifecycle rules.",
+	})
+	runDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "lifecycle_run_duration_seconds",
+		Help: "Duration of lifecycle enforcement runs.",
+	})
+	runErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lifecycle_errors_total",
+		Help: "Errors met while enforcing lifecycle rules.",
+	})
+)
+
+const (
+	ReasonTTL        = "ttl"
+	ReasonExpiration = "expiration"
+)
+
+// Report summarizes what a lifecycle run removed
+type Report struct {
+	ObjectsExpired  int
+	BytesExpired    int64
+	UploadsAborted  int
+	VersionsExpired int
+}
+
+// Scheduler periodically enforces lifecycle rules and TTLs against a storage
+type Scheduler struct {
+	storage  domain.Storage
+	rules    *Store
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewScheduler creates a scheduler enforcing the rules of store every interval.
+// The storage must implement domain.Lister for expiration to be enforced.
+func NewScheduler(storage domain.Storage, store *Store, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		storage:  storage,
+		rules:    store,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Run enforces the rules every interval until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.RunOnce()
+			if err != nil {
+				log.Println("Lifecycle error:", err)
+			}
+			if report.ObjectsExpired+report.UploadsAborted+report.VersionsExpired > 0 {
+				log.Printf("Lifecycle run: %d objects (%d bytes) expired, %d uploads aborted, %d versions expired",
+					report.ObjectsExpired, report.BytesExpired, report.UploadsAborted, report.VersionsExpired)
+			}
+		}
+	}
+}
+
+// RunOnce performs a single enforcement pass over every bucket
+func (s *Scheduler) RunOnce() (Report, error) {
+	start := time.Now()
+	defer func() { runDuration.Observe(time.Since(start).Seconds()) }()
+
+	var report Report
+	lister, ok := s.storage.(domain.Lister)
+	if !ok {
+		return report, domain.ErrListNotSupported
+	}
+	buckets, err := lister.ListBuckets()
+	if err != nil {
+		runErrors.Inc()
+		return report, err
+	}
+
+	var errs []error
+	now := s.now()
+	for _, bucket := range buckets {
+		cfg, _ := s.rules.Get(bucket)
+		if err := s.expireObjects(lister, bucket, cfg, now, &report); err != nil {
+			errs = append(errs, err)
+		}
+		if err := s.abortUploads(bucket, cfg, now, &report); err != nil {
+			errs = append(errs, err)
+		}
+		if err := s.expireVersions(bucket, cfg, now, &report); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	runErrors.Add(float64(len(errs)))
+	return report, errors.Join(errs...)
+}
+
+func (s *Scheduler) expireObjects(lister domain.Lister, bucket string, cfg Configuration, now time.Time, report *Report) error {
+	objects, err := lister.ListObjects(bucket, "")
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, obj := range objects {
+		reason := expiryReason(obj, cfg, now)
+		if reason == "" {
+			continue
+		}
+		if err := s.storage.Delete(bucket, obj.ID); err != nil {
+			if !errors.Is(err, domain.ErrNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		objectsExpired.WithLabelValues(reason).Inc()
+		bytesExpired.Add(float64(obj.Size))
+		report.ObjectsExpired++
+		report.BytesExpired += obj.Size
+	}
+	return errors.Join(errs...)
+}
+
+// expiryReason returns why an object has expired, or an empty string if it hasn't
+func expiryReason(obj domain.ObjectInfo, cfg Configuration, now time.Time) string {
+	if Expired(obj.Metadata, now) {
+		return ReasonTTL
+	}
+	for _, rule := range cfg.Rules {
+		if !rule.Enabled || rule.ExpirationDays == 0 || !rule.Filter.matches(obj.ID, obj.Metadata) {
+			continue
+		}
+		if !now.Before(obj.ModTime.AddDate(0, 0, rule.ExpirationDays)) {
+			return ReasonExpiration
+		}
+	}
+	return ""
+}
+
+func (s *Scheduler) abortUploads(bucket string, cfg Configuration, now time.Time, report *Report) error {
+	mp, ok := s.storage.(domain.MultipartStorage)
+	if !ok || !hasAction(cfg, func(r Rule) int { return r.AbortIncompleteMultipartDays }) {
+		return nil
+	}
+	uploads, err := mp.ListMultipartUploads(bucket)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, upload := range uploads {
+		for _, rule := range cfg.Rules {
+			days := rule.AbortIncompleteMultipartDays
+			if !rule.Enabled || days == 0 || !rule.Filter.matches(upload.ID, nil) {
+				continue
+			}
+			if now.Before(upload.Initiated.AddDate(0, 0, days)) {
+				continue
+			}
+			if err := mp.AbortMultipartUpload(bucket, upload.ID, upload.UploadID); err != nil {
+				errs = append(errs, err)
+			} else {
+				uploadsAborted.Inc()
+				report.UploadsAborted++
+			}
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scheduler) expireVersions(bucket string, cfg Configuration, now time.Time, report *Report) error {
+	vs, ok := s.storage.(domain.VersionedStorage)
+	if !ok || !hasAction(cfg, func(r Rule) int { return r.NoncurrentVersionExpirationDays }) {
+		return nil
+	}
+	versions, err := vs.ListNoncurrentVersions(bucket)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, version := range versions {
+		for _, rule := range cfg.Rules {
+			days := rule.NoncurrentVersionExpirationDays
+			if !rule.Enabled || days == 0 || !rule.Filter.matches(version.ID, nil) {
+				continue
+			}
+			if now.Before(version.NoncurrentSince.AddDate(0, 0, days)) {
+				continue
+			}
+			if err := vs.DeleteVersion(bucket, version.ID, version.VersionID); err != nil {
+				errs = append(errs, err)
+			} else {
+				versionsExpired.Inc()
+				report.VersionsExpired++
+			}
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// hasAction reports whether any enabled rule configures the action returned by days
+func hasAction(cfg Configuration, days func(Rule) int) bool {
+	for _, rule := range cfg.Rules {
+		if rule.Enabled && days(rule) > 0 {
+			return true
+		}
+	}
+	return false
+}
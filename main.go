@@ -1,11 +1,35 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/DanielePalaia/object-storage-service/api"
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/cluster"
+	"github.com/DanielePalaia/object-storage-service/consensus"
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/events"
+	"github.com/DanielePalaia/object-storage-service/integrity"
+	"github.com/DanielePalaia/object-storage-service/lifecycle"
+	"github.com/DanielePalaia/object-storage-service/notify"
 	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/policy"
+	"github.com/DanielePalaia/object-storage-service/queue"
+	"github.com/DanielePalaia/object-storage-service/quota"
+	"github.com/DanielePalaia/object-storage-service/ratelimit"
+	"github.com/DanielePalaia/object-storage-service/replication"
+	"github.com/DanielePalaia/object-storage-service/tenant"
+	"github.com/DanielePalaia/object-storage-service/tiering"
+	"github.com/hashicorp/raft"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -14,10 +38,638 @@ func main() {
 		port = "8080"
 	}
 
-	storage := persistence.NewInMemoryStorage()
-	srv := api.NewServer(storage, port)
+	codec, err := persistence.ParseCodec(os.Getenv("COMPRESSION_CODEC"))
+	if err != nil {
+		log.Fatalf("invalid COMPRESSION_CODEC: %v", err)
+	}
+
+	lifecycleInterval := time.Hour
+	if v := os.Getenv("LIFECYCLE_INTERVAL"); v != "" {
+		if lifecycleInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid LIFECYCLE_INTERVAL: %v", err)
+		}
+	}
+
+	var maxObjectSize int64
+	if v := os.Getenv("MAX_OBJECT_SIZE"); v != "" {
+		if maxObjectSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			log.Fatalf("invalid MAX_OBJECT_SIZE: %v", err)
+		}
+	}
+
+	changeLogRetention := time.Hour
+	if v := os.Getenv("CHANGELOG_RETENTION"); v != "" {
+		if changeLogRetention, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid CHANGELOG_RETENTION: %v", err)
+		}
+	}
+	changeLogSize := 10000
+	if v := os.Getenv("CHANGELOG_SIZE"); v != "" {
+		if changeLogSize, err = strconv.Atoi(v); err != nil || changeLogSize <= 0 {
+			log.Fatalf("invalid CHANGELOG_SIZE: %q", v)
+		}
+	}
+
+	// Objects evicted by the cache backend are reported to the layers above it once they exist
+	evictions := &evictionReporter{}
+	backend := tieringFromEnv(storageFromEnv(evictions.report))
+	// Checksums protect the data written to this node's backend
+	checked := integrity.NewStorage(backend)
+	var local domain.Storage = checked
+	node := clusterFromEnv(local)
+	if node != nil {
+		go node.Run(context.Background())
+		local = node
+	}
+	// With Raft, the metadata of objects is replicated while their data stays placed by the cluster
+	raftStore := raftFromEnv(port)
+	if raftStore != nil {
+		local = consensus.NewStorage(raftStore, local)
+	}
+
+	var repairers []integrity.Repairer
+	if r, ok := backend.(integrity.Repairer); ok {
+		repairers = append(repairers, r)
+	}
+	if node != nil {
+		repairers = append(repairers, node)
+	}
+	scrubber := scrubberFromEnv(checked, repairers)
+	go scrubber.Run(context.Background())
+
+	quotas := quota.NewManager()
+	// Usage is rebuilt from the objects already stored. In cluster mode it is
+	// rebuilt from the whole cluster but only kept up to date with the writes
+	// served by this node, so quotas are enforced per node until a restart.
+	if lister, ok := local.(domain.Lister); ok {
+		if err := quotas.Load(lister); err != nil {
+			log.Println("Quota usage could not be loaded:", err)
+		}
+	}
+	quotaStorage := quota.NewStorage(local, quotas)
+
+	compressed, err := persistence.NewCompressedStorage(quotaStorage, codec)
+	if err != nil {
+		log.Fatalf("failed to initialize compression: %v", err)
+	}
+
+	queueDir := os.Getenv("NOTIFICATION_QUEUE_DIR")
+	if queueDir == "" {
+		queueDir = filepath.Join("data", "notifications")
+	}
+	deliveries, err := queue.Open(queueDir)
+	if err != nil {
+		log.Fatalf("failed to open the notification queue: %v", err)
+	}
+	deadLetters, err := queue.Open(filepath.Join(queueDir, "dead-letters"))
+	if err != nil {
+		log.Fatalf("failed to open the notification dead letters: %v", err)
+	}
+	// The webhooks are kept next to the queue, queued deliveries need them after a restart
+	webhooks, err := notify.OpenStore(filepath.Join(queueDir, "webhooks.json"))
+	if err != nil {
+		log.Fatalf("failed to load the notification configuration: %v", err)
+	}
+	dispatcher := notify.NewDispatcher(webhooks, deliveries, deadLetters, notify.DefaultRetryPolicy)
+	go dispatcher.Run(context.Background())
+
+	replicationDir := os.Getenv("REPLICATION_QUEUE_DIR")
+	if replicationDir == "" {
+		replicationDir = filepath.Join("data", "replication")
+	}
+	replicationTasks, err := queue.Open(replicationDir)
+	if err != nil {
+		log.Fatalf("failed to open the replication queue: %v", err)
+	}
+	// The rules are kept next to the queue, queued operations need them after a restart
+	replicationRules, err := replication.OpenStore(filepath.Join(replicationDir, "rules.json"))
+	if err != nil {
+		log.Fatalf("failed to load the replication rules: %v", err)
+	}
+	replicated := replication.NewStorage(compressed, replicationRules, replicationTasks, replication.DefaultRetryPolicy)
+	go replicated.Run(context.Background())
+
+	changes := events.NewChangeLog(changeLogSize, changeLogRetention)
+	// Events are emitted above compression so that they report the object sizes seen by clients
+	storage := events.NewStorage(replicated, dispatcher, changes)
+	evictions.attach(quotas, storage)
+
+	lifecycleRules := lifecycle.NewStore()
+	go lifecycle.NewScheduler(storage, lifecycleRules, lifecycleInterval).Run(context.Background())
+
+	keys := auth.NewKeyStore()
+	if token := os.Getenv("ADMIN_API_KEY"); token != "" {
+		if _, err := keys.Import(token, "admin", []string{auth.RoleAdmin}); err != nil {
+			log.Fatalf("invalid ADMIN_API_KEY: %v", err)
+		}
+	}
+
+	tenants := tenant.NewRegistry()
+	for _, name := range strings.Split(os.Getenv("TENANTS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, err := tenants.Create(name); err != nil {
+			log.Fatalf("invalid TENANTS: %v", err)
+		}
+	}
+
+	opts := []api.Option{
+		api.WithCompression(compressed),
+		api.WithNotifications(dispatcher),
+		api.WithChangeLog(changes),
+		api.WithReplication(replicated),
+		api.WithLifecycle(lifecycleRules),
+		api.WithQuotas(quotas),
+		api.WithSizeLimits(api.NewSizeLimits(maxObjectSize)),
+		api.WithAPIKeys(keys),
+		api.WithAuthRequired(os.Getenv("AUTH_REQUIRED") == "true"),
+		api.WithTenants(tenants),
+		api.WithAuthorizer(policy.NewAuthorizer(os.Getenv("AUTHZ_DEFAULT_DENY") != "true")),
+	}
+	if v := os.Getenv("RATE_LIMITS"); v != "" {
+		limiter := ratelimit.NewLimiter()
+		if err := limiter.Configure(v); err != nil {
+			log.Fatalf("invalid RATE_LIMITS: %v", err)
+		}
+		opts = append(opts, api.WithRateLimits(limiter))
+	}
+	bandwidthConfig, err := ratelimit.ParseBandwidthConfig(os.Getenv("BANDWIDTH_LIMITS"))
+	if err != nil {
+		log.Fatalf("invalid BANDWIDTH_LIMITS: %v", err)
+	}
+	bandwidth, err := ratelimit.NewBandwidth(bandwidthConfig)
+	if err != nil {
+		log.Fatalf("invalid BANDWIDTH_LIMITS: %v", err)
+	}
+	opts = append(opts, api.WithBandwidth(bandwidth))
+	if v := os.Getenv("MAX_IN_FLIGHT"); v != "" {
+		maxInFlight, err := strconv.Atoi(v)
+		if err != nil || maxInFlight <= 0 {
+			log.Fatalf("invalid MAX_IN_FLIGHT: %q", v)
+		}
+		maxQueued := maxInFlight
+		if v := os.Getenv("MAX_QUEUED"); v != "" {
+			if maxQueued, err = strconv.Atoi(v); err != nil || maxQueued < 0 {
+				log.Fatalf("invalid MAX_QUEUED: %q", v)
+			}
+		}
+		queueTimeout := 5 * time.Second
+		if v := os.Getenv("QUEUE_TIMEOUT"); v != "" {
+			if queueTimeout, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("invalid QUEUE_TIMEOUT: %v", err)
+			}
+		}
+		opts = append(opts, api.WithConcurrencyLimit(ratelimit.NewConcurrency(maxInFlight, maxQueued, queueTimeout)))
+	}
+	if jwks := os.Getenv("JWT_JWKS"); jwks != "" {
+		jwtAuth, err := auth.NewJWTAuthenticator(auth.JWTConfig{
+			JWKS:         jwks,
+			Issuer:       os.Getenv("JWT_ISSUER"),
+			Audience:     os.Getenv("JWT_AUDIENCE"),
+			TenantClaim:  os.Getenv("JWT_TENANT_CLAIM"),
+			BucketsClaim: os.Getenv("JWT_BUCKETS_CLAIM"),
+			RolesClaim:   os.Getenv("JWT_ROLES_CLAIM"),
+		})
+		if err != nil {
+			log.Fatalf("invalid JWT configuration: %v", err)
+		}
+		opts = append(opts, api.WithAuthenticator(jwtAuth))
+	}
+	opts = append(opts, api.WithScrubber(scrubber))
+	if node != nil {
+		opts = append(opts, api.WithCluster(node))
+	}
+	if raftStore != nil {
+		opts = append(opts, api.WithRaft(raftStore))
+	}
+	srv := api.NewServer(storage, port, opts...)
 
 	if err := srv.Start(); err != nil {
 		log.Fatalf("failed to start server: %v", err)
 	}
 }
+
+// storageFromEnv creates the storage backend selected by STORAGE_BACKEND,
+// onEvict being called for the objects a bounded backend drops
+func storageFromEnv(onEvict func(persistence.Eviction)) domain.Storage {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "memory":
+		return persistence.NewInMemoryStorage()
+	case "erasure":
+		return erasureFromEnv()
+	case "wal":
+		return walFromEnv()
+	case "segments":
+		return segmentsFromEnv()
+	case "sqlite":
+		return sqliteFromEnv()
+	case "postgres":
+		return postgresFromEnv()
+	case "redis":
+		return redisFromEnv()
+	case "cache":
+		return cacheFromEnv(onEvict)
+	default:
+		log.Fatalf("invalid STORAGE_BACKEND: %q", backend)
+		return nil
+	}
+}
+
+// erasureFromEnv creates the erasure-coded storage spreading shards over
+// ERASURE_DIRS and starts its healer
+func erasureFromEnv() domain.Storage {
+	var dirs []string
+	for _, dir := range strings.Split(os.Getenv("ERASURE_DIRS"), ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	var err error
+	parityShards := 2
+	if v := os.Getenv("ERASURE_PARITY_SHARDS"); v != "" {
+		if parityShards, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("invalid ERASURE_PARITY_SHARDS: %q", v)
+		}
+	}
+	dataShards := len(dirs) - parityShards
+	if v := os.Getenv("ERASURE_DATA_SHARDS"); v != "" {
+		if dataShards, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("invalid ERASURE_DATA_SHARDS: %q", v)
+		}
+	}
+	healInterval := time.Hour
+	if v := os.Getenv("ERASURE_HEAL_INTERVAL"); v != "" {
+		if healInterval, err = time.ParseDuration(v); err != nil || healInterval <= 0 {
+			log.Fatalf("invalid ERASURE_HEAL_INTERVAL: %q", v)
+		}
+	}
+
+	storage, err := persistence.NewErasureStorage(dirs, dataShards, parityShards)
+	if err != nil {
+		log.Fatalf("invalid erasure coding configuration: %v", err)
+	}
+	go storage.Run(context.Background(), healInterval)
+	return storage
+}
+
+// walFromEnv opens the write-ahead log storage in WAL_DIR and starts its
+// checkpoints
+func walFromEnv() domain.Storage {
+	dir := os.Getenv("WAL_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "wal")
+	}
+	var config persistence.WALConfig
+	var err error
+	if config.Sync, err = persistence.ParseSyncPolicy(os.Getenv("WAL_SYNC")); err != nil {
+		log.Fatalf("invalid WAL_SYNC: %v", err)
+	}
+	if v := os.Getenv("WAL_SYNC_INTERVAL"); v != "" {
+		if config.SyncInterval, err = time.ParseDuration(v); err != nil || config.SyncInterval <= 0 {
+			log.Fatalf("invalid WAL_SYNC_INTERVAL: %q", v)
+		}
+	}
+	if v := os.Getenv("WAL_SEGMENT_SIZE"); v != "" {
+		if config.SegmentSize, err = strconv.ParseInt(v, 10, 64); err != nil || config.SegmentSize <= 0 {
+			log.Fatalf("invalid WAL_SEGMENT_SIZE: %q", v)
+		}
+	}
+	if v := os.Getenv("WAL_CHECKPOINT_INTERVAL"); v != "" {
+		if config.CheckpointInterval, err = time.ParseDuration(v); err != nil || config.CheckpointInterval <= 0 {
+			log.Fatalf("invalid WAL_CHECKPOINT_INTERVAL: %q", v)
+		}
+	}
+
+	storage, err := persistence.OpenWALStorage(dir, config)
+	if err != nil {
+		log.Fatalf("failed to open the write-ahead log: %v", err)
+	}
+	go storage.Run(context.Background())
+	return storage
+}
+
+// segmentsFromEnv opens the segment storage in SEGMENT_DIR and starts its
+// compaction
+func segmentsFromEnv() domain.Storage {
+	dir := os.Getenv("SEGMENT_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "segments")
+	}
+	var config persistence.SegmentConfig
+	var err error
+	if v := os.Getenv("SEGMENT_SIZE"); v != "" {
+		if config.SegmentSize, err = strconv.ParseInt(v, 10, 64); err != nil || config.SegmentSize <= 0 {
+			log.Fatalf("invalid SEGMENT_SIZE: %q", v)
+		}
+	}
+	if v := os.Getenv("SEGMENT_MAX_NEEDLE_SIZE"); v != "" {
+		if config.MaxNeedleSize, err = strconv.ParseInt(v, 10, 64); err != nil || config.MaxNeedleSize <= 0 {
+			log.Fatalf("invalid SEGMENT_MAX_NEEDLE_SIZE: %q", v)
+		}
+	}
+	if v := os.Getenv("SEGMENT_COMPACTION_RATIO"); v != "" {
+		if config.CompactionRatio, err = strconv.ParseFloat(v, 64); err != nil || config.CompactionRatio <= 0 || config.CompactionRatio > 1 {
+			log.Fatalf("invalid SEGMENT_COMPACTION_RATIO: %q", v)
+		}
+	}
+	compactionInterval := 10 * time.Minute
+	if v := os.Getenv("SEGMENT_COMPACTION_INTERVAL"); v != "" {
+		if compactionInterval, err = time.ParseDuration(v); err != nil || compactionInterval <= 0 {
+			log.Fatalf("invalid SEGMENT_COMPACTION_INTERVAL: %q", v)
+		}
+	}
+
+	storage, err := persistence.OpenSegmentStorage(dir, config)
+	if err != nil {
+		log.Fatalf("failed to open the segment storage: %v", err)
+	}
+	go storage.Run(context.Background(), compactionInterval)
+	return storage
+}
+
+// sqliteFromEnv opens the SQLite storage in SQLITE_DIR
+func sqliteFromEnv() domain.Storage {
+	dir := os.Getenv("SQLITE_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "sqlite")
+	}
+	inlineLimit := int64(64 << 10)
+	if v := os.Getenv("SQLITE_INLINE_LIMIT"); v != "" {
+		var err error
+		if inlineLimit, err = strconv.ParseInt(v, 10, 64); err != nil || inlineLimit < 0 {
+			log.Fatalf("invalid SQLITE_INLINE_LIMIT: %q", v)
+		}
+	}
+	storage, err := persistence.OpenSQLiteStorage(dir, inlineLimit)
+	if err != nil {
+		log.Fatalf("failed to open the SQLite storage: %v", err)
+	}
+	return storage
+}
+
+// postgresFromEnv connects the PostgreSQL storage to the database of
+// POSTGRES_DSN
+func postgresFromEnv() domain.Storage {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		log.Fatalf("POSTGRES_DSN is required by the postgres storage")
+	}
+	storage, err := persistence.OpenPostgresStorage(context.Background(), dsn)
+	if err != nil {
+		log.Fatalf("failed to open the PostgreSQL storage: %v", err)
+	}
+	return storage
+}
+
+// redisFromEnv creates the Redis storage on the server of REDIS_URL. Objects
+// with an expiry are given a Redis TTL.
+func redisFromEnv() domain.Storage {
+	rawURL := os.Getenv("REDIS_URL")
+	if rawURL == "" {
+		rawURL = "redis://localhost:6379/0"
+	}
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		log.Fatalf("invalid REDIS_URL: %v", err)
+	}
+	config := persistence.DefaultRedisConfig
+	config.Prefix = os.Getenv("REDIS_PREFIX")
+	config.Expiry = lifecycle.ExpiresAt
+	if v := os.Getenv("REDIS_CHUNK_SIZE"); v != "" {
+		if config.ChunkSize, err = strconv.Atoi(v); err != nil || config.ChunkSize <= 0 {
+			log.Fatalf("invalid REDIS_CHUNK_SIZE: %q", v)
+		}
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		log.Fatalf("failed to connect to Redis: %v", err)
+	}
+	return persistence.NewRedisStorage(client, config)
+}
+
+// evictionReporter releases the quota usage of the objects dropped by the
+// cache and publishes ObjectRemoved:Evicted for them. Objects spilled to
+// disk are still stored and are not reported.
+type evictionReporter struct {
+	mu      sync.RWMutex
+	quotas  *quota.Manager
+	storage *events.Storage
+}
+
+// attach sets the quotas and events storage the evictions are reported to
+func (r *evictionReporter) attach(quotas *quota.Manager, storage *events.Storage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.quotas, r.storage = quotas, storage
+}
+
+func (r *evictionReporter) report(ev persistence.Eviction) {
+	if ev.Spilled {
+		return
+	}
+	r.mu.RLock()
+	quotas, storage := r.quotas, r.storage
+	r.mu.RUnlock()
+	if quotas != nil {
+		quotas.Forget(ev.Bucket, ev.ID)
+	}
+	if storage != nil {
+		storage.Evicted(ev.Bucket, ev.ID)
+	}
+}
+
+// cacheFromEnv creates the memory-bounded cache storage holding up to
+// CACHE_MAX_BYTES, spilling evicted objects to CACHE_SPILL_DIR if set
+func cacheFromEnv(onEvict func(persistence.Eviction)) domain.Storage {
+	config := persistence.CacheConfig{MaxBytes: 256 << 20, SpillDir: os.Getenv("CACHE_SPILL_DIR"), OnEvict: onEvict}
+	var err error
+	if v := os.Getenv("CACHE_MAX_BYTES"); v != "" {
+		if config.MaxBytes, err = strconv.ParseInt(v, 10, 64); err != nil || config.MaxBytes <= 0 {
+			log.Fatalf("invalid CACHE_MAX_BYTES: %q", v)
+		}
+	}
+	if config.Policy, err = persistence.ParseEvictionPolicy(os.Getenv("CACHE_EVICTION")); err != nil {
+		log.Fatalf("invalid CACHE_EVICTION: %v", err)
+	}
+	if v := os.Getenv("CACHE_SPILL_MAX_BYTES"); v != "" {
+		if config.SpillMaxBytes, err = strconv.ParseInt(v, 10, 64); err != nil || config.SpillMaxBytes < 0 {
+			log.Fatalf("invalid CACHE_SPILL_MAX_BYTES: %q", v)
+		}
+	}
+	storage, err := persistence.NewCacheStorage(config)
+	if err != nil {
+		log.Fatalf("failed to initialize the cache storage: %v", err)
+	}
+	return storage
+}
+
+// tieringFromEnv puts an in-memory hot tier in front of cold when TIER_MODE
+// is set, and returns cold otherwise
+func tieringFromEnv(cold domain.Storage) domain.Storage {
+	v := os.Getenv("TIER_MODE")
+	if v == "" {
+		return cold
+	}
+	var config tiering.Config
+	var err error
+	if config.Mode, err = tiering.ParseWriteMode(v); err != nil {
+		log.Fatalf("invalid TIER_MODE: %v", err)
+	}
+	if config.Policy, err = tiering.ParsePolicy(os.Getenv("TIER_POLICY")); err != nil {
+		log.Fatalf("invalid TIER_POLICY: %v", err)
+	}
+	for name, limit := range map[string]*int64{
+		"TIER_HOT_BYTES":       &config.Hot.Bytes,
+		"TIER_COLD_BYTES":      &config.Cold.Bytes,
+		"TIER_MAX_OBJECT_SIZE": &config.MaxObjectSize,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if *limit, err = strconv.ParseInt(v, 10, 64); err != nil || *limit < 0 {
+				log.Fatalf("invalid %s: %q", name, v)
+			}
+		}
+	}
+	for name, limit := range map[string]*int{
+		"TIER_HOT_OBJECTS":  &config.Hot.Objects,
+		"TIER_COLD_OBJECTS": &config.Cold.Objects,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if *limit, err = strconv.Atoi(v); err != nil || *limit < 0 {
+				log.Fatalf("invalid %s: %q", name, v)
+			}
+		}
+	}
+	if v := os.Getenv("TIER_MAX_AGE"); v != "" {
+		if config.MaxAge, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid TIER_MAX_AGE: %v", err)
+		}
+	}
+	if v := os.Getenv("TIER_FLUSH_INTERVAL"); v != "" {
+		if config.FlushInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid TIER_FLUSH_INTERVAL: %v", err)
+		}
+	}
+	storage, err := tiering.NewStorage(persistence.NewInMemoryStorage(), cold, config)
+	if err != nil {
+		log.Fatalf("failed to initialize the storage tiers: %v", err)
+	}
+	go storage.Run(context.Background())
+	return storage
+}
+
+// scrubberFromEnv creates the scrubber verifying the objects of storage every
+// SCRUB_INTERVAL at SCRUB_RATE bytes per second
+func scrubberFromEnv(storage *integrity.Storage, repairers []integrity.Repairer) *integrity.Scrubber {
+	var err error
+	interval := 24 * time.Hour
+	if v := os.Getenv("SCRUB_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+			log.Fatalf("invalid SCRUB_INTERVAL: %q", v)
+		}
+	}
+	bytesPerSecond := 10 << 20
+	if v := os.Getenv("SCRUB_RATE"); v != "" {
+		if bytesPerSecond, err = strconv.Atoi(v); err != nil || bytesPerSecond < 0 {
+			log.Fatalf("invalid SCRUB_RATE: %q", v)
+		}
+	}
+	scrubber, err := integrity.NewScrubber(storage, interval, bytesPerSecond, repairers...)
+	if err != nil {
+		log.Fatalf("failed to initialize the scrubber: %v", err)
+	}
+	return scrubber
+}
+
+// clusterFromEnv creates this node of the cluster described by CLUSTER_PEERS,
+// or returns nil when running standalone
+func clusterFromEnv(local domain.Storage) *cluster.Cluster {
+	peers := os.Getenv("CLUSTER_PEERS")
+	if peers == "" {
+		return nil
+	}
+	nodes, err := cluster.ParsePeers(peers)
+	if err != nil {
+		log.Fatalf("invalid CLUSTER_PEERS: %v", err)
+	}
+
+	config := cluster.Config{
+		Self:              os.Getenv("CLUSTER_NODE_ID"),
+		Nodes:             nodes,
+		ReplicationFactor: 2,
+		Secret:            os.Getenv("CLUSTER_SECRET"),
+		TombstoneFile:     os.Getenv("CLUSTER_TOMBSTONE_FILE"),
+	}
+	if config.TombstoneFile == "" {
+		config.TombstoneFile = filepath.Join("data", "cluster", "tombstones.log")
+	}
+	if v := os.Getenv("CLUSTER_REPLICATION_FACTOR"); v != "" {
+		if config.ReplicationFactor, err = strconv.Atoi(v); err != nil || config.ReplicationFactor <= 0 {
+			log.Fatalf("invalid CLUSTER_REPLICATION_FACTOR: %q", v)
+		}
+	}
+	if v := os.Getenv("CLUSTER_VNODES"); v != "" {
+		if config.VirtualNodes, err = strconv.Atoi(v); err != nil || config.VirtualNodes <= 0 {
+			log.Fatalf("invalid CLUSTER_VNODES: %q", v)
+		}
+	}
+	if v := os.Getenv("CLUSTER_PROBE_INTERVAL"); v != "" {
+		if config.ProbeInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid CLUSTER_PROBE_INTERVAL: %v", err)
+		}
+	}
+	if v := os.Getenv("CLUSTER_TOMBSTONE_TTL"); v != "" {
+		if config.TombstoneTTL, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid CLUSTER_TOMBSTONE_TTL: %v", err)
+		}
+	}
+
+	node, err := cluster.New(local, config)
+	if err != nil {
+		log.Fatalf("invalid cluster configuration: %v", err)
+	}
+	return node
+}
+
+// raftFromEnv starts this node of the Raft cluster listening at RAFT_ADDRESS,
+// or returns nil when the metadata is not replicated
+func raftFromEnv(port string) *consensus.Store {
+	address := os.Getenv("RAFT_ADDRESS")
+	if address == "" {
+		return nil
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		log.Fatalf("invalid RAFT_ADDRESS: %v", err)
+	}
+	bind := os.Getenv("RAFT_BIND")
+	if bind == "" {
+		bind = address
+	}
+	transport, err := raft.NewTCPTransport(bind, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		log.Fatalf("failed to start the raft transport: %v", err)
+	}
+
+	config := consensus.Config{
+		ID:        os.Getenv("RAFT_NODE_ID"),
+		URL:       os.Getenv("RAFT_URL"),
+		Bootstrap: os.Getenv("RAFT_BOOTSTRAP") == "true",
+		Secret:    os.Getenv("CLUSTER_SECRET"),
+		Dir:       os.Getenv("RAFT_DIR"),
+	}
+	if config.Dir == "" {
+		config.Dir = filepath.Join("data", "raft")
+	}
+	if config.ID == "" {
+		config.ID = os.Getenv("CLUSTER_NODE_ID")
+	}
+	if config.URL == "" {
+		config.URL = "http://localhost:" + port
+	}
+	store, err := consensus.Open(config, transport)
+	if err != nil {
+		log.Fatalf("invalid raft configuration: %v", err)
+	}
+	return store
+}
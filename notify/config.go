@@ -0,0 +1,214 @@
+// Package notify delivers bucket event notifications to HTTP webhooks.
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/DanielePalaia/object-storage-service/events"
+)
+
+// Filter selects the objects a webhook is notified about. An empty filter matches every object.
+type Filter struct {
+	Prefix string `json:"prefix,omitempty"`
+	Suffix string `json:"suffix,omitempty"`
+}
+
+// Webhook is an HTTP endpoint notified about the events of a bucket
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the payloads with HMAC-SHA256, it is never returned by the API
+	Secret string `json:"secret,omitempty"`
+	// Events lists the event types to deliver, wildcards such as "ObjectCreated:*" are allowed
+	Events []string `json:"events"`
+	Filter Filter   `json:"filter"`
+}
+
+// Configuration holds the webhooks of a bucket
+type Configuration struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// Validate checks the configuration is consistent
+func (c Configuration) Validate() error {
+	if len(c.Webhooks) == 0 {
+		return errors.New("at least one webhook is required")
+	}
+	ids := make(map[string]bool)
+	for _, w := range c.Webhooks {
+		if w.ID == "" {
+			return errors.New("webhook id is required")
+		}
+		if ids[w.ID] {
+			return fmt.Errorf("duplicate webhook id %q", w.ID)
+		}
+		ids[w.ID] = true
+
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q: url must be an absolute http or https url", w.ID)
+		}
+		if len(w.Events) == 0 {
+			return fmt.Errorf("webhook %q: at least one event type is required", w.ID)
+		}
+		for _, pattern := range w.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("webhook %q: invalid event pattern %q", w.ID, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration without the webhook secrets
+func (c Configuration) Redacted() Configuration {
+	redacted := Configuration{Webhooks: make([]Webhook, len(c.Webhooks))}
+	for i, w := range c.Webhooks {
+		w.Secret = ""
+		redacted.Webhooks[i] = w
+	}
+	return redacted
+}
+
+// matches reports whether the webhook is interested in the event
+func (w Webhook) matches(e events.Event) bool {
+	if !strings.HasPrefix(e.Key, w.Filter.Prefix) || !strings.HasSuffix(e.Key, w.Filter.Suffix) {
+		return false
+	}
+	for _, pattern := range w.Events {
+		if ok, _ := path.Match(pattern, e.Type); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps the notification configuration of every bucket
+type Store struct {
+	mu      sync.RWMutex
+	buckets map[string]Configuration
+	// path is the file the configurations are saved to, empty when they are
+	// only kept in memory
+	path string
+}
+
+// NewStore creates an empty notification configuration store kept in memory
+func NewStore() *Store {
+	return &Store{buckets: make(map[string]Configuration)}
+}
+
+// OpenStore loads the notification configurations saved at path and saves
+// every change to it, so that the webhooks of queued deliveries survive a
+// restart. A missing file is an empty store.
+func OpenStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.buckets); err != nil {
+		return nil, fmt.Errorf("corrupted notification configuration %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// save writes the configurations to the file of the store, s.mu must be held
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.buckets)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Set replaces the notification configuration of a bucket
+func (s *Store) Set(bucket string, cfg Configuration) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.buckets[bucket]
+	s.buckets[bucket] = cfg
+	if err := s.save(); err != nil {
+		if existed {
+			s.buckets[bucket] = previous
+		} else {
+			delete(s.buckets, bucket)
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the notification configuration of a bucket
+func (s *Store) Get(bucket string) (Configuration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg, ok := s.buckets[bucket]
+	return cfg, ok
+}
+
+// Delete removes the notification configuration of a bucket and reports
+// whether it existed
+func (s *Store) Delete(bucket string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.buckets[bucket]
+	if !ok {
+		return false, nil
+	}
+	delete(s.buckets, bucket)
+	if err := s.save(); err != nil {
+		s.buckets[bucket] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// webhook returns a webhook of a bucket
+func (s *Store) webhook(bucket, id string) (Webhook, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, w := range s.buckets[bucket].Webhooks {
+		if w.ID == id {
+			return w, true
+		}
+	}
+	return Webhook{}, false
+}
@@ -0,0 +1,337 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/events"
+	"github.com/DanielePalaia/object-storage-service/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Headers of webhook requests
+const (
+	HeaderSignature = "X-Signature-256"
+	HeaderEventType = "X-Event-Type"
+	HeaderDelivery  = "X-Delivery-ID"
+	HeaderAttempt   = "X-Delivery-Attempt"
+)
+
+var (
+	published = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_published_total",
+		Help: "Webhook deliveries queued, by event type.",
+	}, []string{"type"})
+	delivered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notifications_delivered_total",
+		Help: "Webhook deliveries acknowledged by their endpoint.",
+	})
+	failedAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notifications_failed_attempts_total",
+		Help: "Webhook delivery attempts which failed and will be retried or dead-lettered.",
+	})
+	deadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notifications_dead_lettered_total",
+		Help: "Webhook deliveries moved to the dead-letter store after exhausting their attempts.",
+	})
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "notifications_queue_depth",
+		Help: "Deliveries waiting, by queue (deliveries or dead_letters).",
+	}, []string{"queue"})
+)
+
+// RetryPolicy controls how failed deliveries are retried
+type RetryPolicy = queue.RetryPolicy
+
+// DefaultRetryPolicy retries a delivery for about an hour
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 15 * time.Minute}
+
+// Delivery is a queued notification of an event to a webhook
+type Delivery struct {
+	Bucket  string       `json:"bucket"`
+	Webhook string       `json:"webhook"`
+	Event   events.Event `json:"event"`
+}
+
+// Notification is the JSON body posted to webhooks
+type Notification struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size,omitempty"`
+	Webhook string    `json:"webhook"`
+}
+
+// DeadLetter is a delivery which exhausted its attempts
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Delivery  Delivery  `json:"delivery"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError"`
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+// Dispatcher queues a delivery for every webhook interested in a published
+// event and delivers them asynchronously. Deliveries are kept in a durable
+// queue until acknowledged with a 2xx status, failed ones are retried with
+// exponential backoff and parked in a dead-letter store once the attempts are
+// exhausted, from where they can be replayed.
+//
+// Payloads are signed with the webhook secret: the X-Signature-256 header
+// holds "sha256=" followed by the hex encoded HMAC-SHA256 of the body.
+type Dispatcher struct {
+	store       *Store
+	deliveries  *queue.Queue
+	deadLetters *queue.Queue
+	retry       RetryPolicy
+	client      *http.Client
+	workers     int
+	now         func() time.Time
+}
+
+// NewDispatcher creates a dispatcher for the webhooks of store
+func NewDispatcher(store *Store, deliveries, deadLetters *queue.Queue, retry RetryPolicy) *Dispatcher {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+	queueDepth.WithLabelValues("deliveries").Set(float64(deliveries.Len()))
+	queueDepth.WithLabelValues("dead_letters").Set(float64(deadLetters.Len()))
+	return &Dispatcher{
+		store:       store,
+		deliveries:  deliveries,
+		deadLetters: deadLetters,
+		retry:       retry,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		workers:     4,
+		now:         time.Now,
+	}
+}
+
+// Store returns the notification configurations
+func (d *Dispatcher) Store() *Store {
+	return d.store
+}
+
+// Publish queues a delivery of the event for every matching webhook
+func (d *Dispatcher) Publish(e events.Event) {
+	cfg, ok := d.store.Get(e.Bucket)
+	if !ok {
+		return
+	}
+	for _, w := range cfg.Webhooks {
+		if !w.matches(e) {
+			continue
+		}
+		payload, err := json.Marshal(Delivery{Bucket: e.Bucket, Webhook: w.ID, Event: e})
+		if err == nil {
+			_, err = d.deliveries.Enqueue(payload)
+		}
+		if err != nil {
+			log.Printf("Notification error: queueing %s for webhook %s: %v", e.Type, w.ID, err)
+			continue
+		}
+		published.WithLabelValues(e.Type).Inc()
+	}
+	queueDepth.WithLabelValues("deliveries").Set(float64(d.deliveries.Len()))
+}
+
+// Run delivers queued notifications until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		msg, ok := d.deliveries.Lease()
+		if ok {
+			d.deliver(ctx, msg)
+			continue
+		}
+
+		wait := time.Second
+		if next, ok := d.deliveries.NextReady(); ok {
+			wait = min(wait, max(next.Sub(d.now()), 10*time.Millisecond))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-d.deliveries.Notify():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliver attempts a delivery and acknowledges, retries or dead-letters it
+func (d *Dispatcher) deliver(ctx context.Context, msg queue.Message) {
+	defer func() {
+		queueDepth.WithLabelValues("deliveries").Set(float64(d.deliveries.Len()))
+		queueDepth.WithLabelValues("dead_letters").Set(float64(d.deadLetters.Len()))
+	}()
+
+	var delivery Delivery
+	if err := json.Unmarshal(msg.Payload, &delivery); err != nil {
+		log.Printf("Notification error: dropping corrupted delivery %s: %v", msg.ID, err)
+		d.deliveries.Ack(msg.ID)
+		return
+	}
+	webhook, ok := d.store.webhook(delivery.Bucket, delivery.Webhook)
+	if !ok {
+		// The webhook was removed since the event was queued
+		d.deliveries.Ack(msg.ID)
+		return
+	}
+
+	err := d.send(ctx, webhook, delivery, msg)
+	if err == nil {
+		delivered.Inc()
+		d.deliveries.Ack(msg.ID)
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down, the delivery is attempted again after a restart
+		return
+	}
+
+	failedAttempts.Inc()
+	attempts := msg.Attempts + 1
+	log.Printf("Notification error: delivery %s to webhook %s failed (attempt %d/%d): %v", msg.ID, webhook.ID, attempts, d.retry.MaxAttempts, err)
+	if attempts < d.retry.MaxAttempts {
+		d.deliveries.Retry(msg.ID, d.now().Add(d.retry.Backoff(attempts)), err.Error())
+		return
+	}
+
+	payload, _ := json.Marshal(DeadLetter{
+		Delivery:  delivery,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		FailedAt:  d.now().UTC(),
+	})
+	if _, err := d.deadLetters.Enqueue(payload); err != nil {
+		log.Printf("Notification error: dead-lettering delivery %s: %v", msg.ID, err)
+		d.deliveries.Retry(msg.ID, d.now().Add(d.retry.MaxBackoff), err.Error())
+		return
+	}
+	deadLettered.Inc()
+	d.deliveries.Ack(msg.ID)
+}
+
+// send posts the notification to the webhook
+func (d *Dispatcher) send(ctx context.Context, w Webhook, delivery Delivery, msg queue.Message) error {
+	tenant, bucket := delivery.Event.Tenant()
+	body, err := json.Marshal(Notification{
+		ID:      delivery.Event.ID,
+		Type:    delivery.Event.Type,
+		Time:    delivery.Event.Time,
+		Tenant:  tenant,
+		Bucket:  bucket,
+		Key:     delivery.Event.Key,
+		Size:    delivery.Event.Size,
+		Webhook: w.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventType, delivery.Event.Type)
+	req.Header.Set(HeaderDelivery, msg.ID)
+	req.Header.Set(HeaderAttempt, strconv.Itoa(msg.Attempts+1))
+	if w.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(w.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the signature of a payload as sent in the X-Signature-256 header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeadLetters lists the deliveries which exhausted their attempts
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	messages := d.deadLetters.List()
+	letters := make([]DeadLetter, 0, len(messages))
+	for _, msg := range messages {
+		var letter DeadLetter
+		if err := json.Unmarshal(msg.Payload, &letter); err != nil {
+			continue
+		}
+		letter.ID = msg.ID
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+// Replay queues a dead-lettered delivery again with a fresh set of attempts
+func (d *Dispatcher) Replay(id string) error {
+	msg, ok := d.deadLetters.Get(id)
+	if !ok {
+		return queue.ErrNotFound
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(msg.Payload, &letter); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(letter.Delivery)
+	if err != nil {
+		return err
+	}
+	if _, err := d.deliveries.Enqueue(payload); err != nil {
+		return err
+	}
+	queueDepth.WithLabelValues("deliveries").Set(float64(d.deliveries.Len()))
+	defer queueDepth.WithLabelValues("dead_letters").Set(float64(d.deadLetters.Len()))
+	return d.deadLetters.Ack(id)
+}
+
+// ReplayAll queues every dead-lettered delivery again and returns how many were replayed
+func (d *Dispatcher) ReplayAll() (int, error) {
+	replayed := 0
+	for _, msg := range d.deadLetters.List() {
+		if err := d.Replay(msg.ID); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
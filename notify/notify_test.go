@@ -0,0 +1,192 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/events"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/queue"
+)
+
+// endpoint records the notifications it receives and fails the first ones
+type endpoint struct {
+	mu       sync.Mutex
+	failures int
+	received []Notification
+	headers  []http.Header
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get(HeaderSignature) != Sign("s3cr3t", body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if e.failures > 0 {
+		e.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n Notification
+	json.Unmarshal(body, &n)
+	e.received = append(e.received, n)
+	e.headers = append(e.headers, r.Header.Clone())
+}
+
+func (e *endpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.received)
+}
+
+func newDispatcher(t *testing.T, url string, retry RetryPolicy) *Dispatcher {
+	store := NewStore()
+	err := store.Set("acme/photos", Configuration{Webhooks: []Webhook{{
+		ID:     "thumbnails",
+		URL:    url,
+		Secret: "s3cr3t",
+		Events: []string{"ObjectCreated:*"},
+		Filter: Filter{Prefix: "raw/", Suffix: ".jpg"},
+	}}})
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	deliveries, _ := queue.Open(t.TempDir())
+	deadLetters, _ := queue.Open(t.TempDir())
+	return NewDispatcher(store, deliveries, deadLetters, retry)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcher_DeliversMatchingEvents(t *testing.T) {
+	ep := &endpoint{failures: 2}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	d := newDispatcher(t, server.URL, RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	s := events.NewStorage(persistence.NewInMemoryStorage(), d)
+	s.Put("acme/photos", "raw/a.jpg", []byte("jpeg"))
+	s.Put("acme/photos", "raw/a.png", []byte("png"))      // suffix does not match
+	s.Put("acme/photos", "thumbs/a.jpg", []byte("thumb")) // prefix does not match
+	s.Put("acme/other", "raw/a.jpg", []byte("jpeg"))      // no configuration
+	s.Delete("acme/photos", "raw/a.jpg")                  // event type does not match
+
+	waitFor(t, func() bool { return ep.count() == 1 && d.deliveries.Len() == 0 })
+	n := ep.received[0]
+	if n.Type != events.ObjectCreatedPut || n.Tenant != "acme" || n.Bucket != "photos" || n.Key != "raw/a.jpg" || n.Size != 4 || n.Webhook != "thumbnails" {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	if attempt := ep.headers[0].Get(HeaderAttempt); attempt != "3" {
+		t.Errorf("expected delivery on the third attempt, got %q", attempt)
+	}
+	if len(d.DeadLetters()) != 0 {
+		t.Errorf("expected no dead letters")
+	}
+}
+
+func TestDispatcher_DeadLettersAndReplay(t *testing.T) {
+	ep := &endpoint{failures: 3}
+	server := httptest.NewServer(ep)
+	defer server.Close()
+
+	d := newDispatcher(t, server.URL, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Publish(events.Event{ID: "e1", Type: events.ObjectCreatedPut, Bucket: "acme/photos", Key: "raw/b.jpg"})
+	waitFor(t, func() bool { return len(d.DeadLetters()) == 1 })
+
+	letter := d.DeadLetters()[0]
+	if letter.Attempts != 3 || letter.LastError != "unexpected status 503" || letter.Delivery.Event.ID != "e1" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if d.deliveries.Len() != 0 {
+		t.Errorf("expected the delivery to leave the queue")
+	}
+
+	// The endpoint is fixed, replaying delivers the notification
+	if replayed, err := d.ReplayAll(); err != nil || replayed != 1 {
+		t.Fatalf("ReplayAll failed: %d %v", replayed, err)
+	}
+	waitFor(t, func() bool { return ep.count() == 1 })
+	if len(d.DeadLetters()) != 0 {
+		t.Errorf("expected dead letters to be replayed")
+	}
+	if err := d.Replay("missing"); err != queue.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStore_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	cfg := Configuration{Webhooks: []Webhook{{ID: "w", URL: "https://example.com/hook", Secret: "x", Events: []string{"*"}}}}
+	if err := store.Set("acme/photos", cfg); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	store.Set("acme/other", cfg)
+	if deleted, err := store.Delete("acme/other"); !deleted || err != nil {
+		t.Fatalf("expected the configuration to be deleted, got %v (err %v)", deleted, err)
+	}
+
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	if w, ok := reopened.webhook("acme/photos", "w"); !ok || w.Secret != "x" {
+		t.Errorf("expected the webhooks to survive a restart, got %+v", w)
+	}
+	if _, ok := reopened.Get("acme/other"); ok {
+		t.Errorf("expected deleted configurations to stay deleted")
+	}
+}
+
+func TestConfiguration_Validate(t *testing.T) {
+	valid := Webhook{ID: "w", URL: "https://example.com/hook", Events: []string{"*"}}
+	invalid := []Configuration{
+		{},
+		{Webhooks: []Webhook{valid, valid}},
+		{Webhooks: []Webhook{{ID: "w", URL: "ftp://example.com", Events: []string{"*"}}}},
+		{Webhooks: []Webhook{{ID: "w", URL: "https://example.com"}}},
+		{Webhooks: []Webhook{{ID: "w", URL: "https://example.com", Events: []string{"["}}}},
+	}
+	for i, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected configuration %d to be invalid", i)
+		}
+	}
+	cfg := Configuration{Webhooks: []Webhook{{ID: "w", URL: "https://example.com", Secret: "x", Events: []string{"*"}}}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if cfg.Redacted().Webhooks[0].Secret != "" || cfg.Webhooks[0].Secret != "x" {
+		t.Errorf("expected redaction to only affect the copy")
+	}
+}
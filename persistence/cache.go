@@ -0,0 +1,531 @@
+package persistence
+
+import (
+	"bytes"
+	"container/heap"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// spillExt is the extension of the files of spilled objects
+const spillExt = ".spill"
+
+// ErrObjectTooLarge is returned when an object exceeds the capacity of a
+// CacheStorage which does not spill
+var ErrObjectTooLarge = errors.New("object larger than the cache capacity")
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+		Help: "Reads of the cache storage, by result (hit, spill_hit or miss).",
+	}, []string{"result"})
+	cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_evictions_total",
+		Help: "Objects evicted from the memory of the cache storage, by action (spilled or dropped).",
+	}, []string{"action"})
+	cacheMemoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_memory_bytes",
+		Help: "Bytes of object data held in memory by the cache storage.",
+	})
+	cacheSpilledBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_spilled_bytes",
+		Help: "Bytes of object data spilled to disk by the cache storage.",
+	})
+)
+
+// EvictionPolicy selects the objects evicted when the cache is full
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used objects
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used objects, the least recently
+	// used first among equally used ones
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// ParseEvictionPolicy validates an eviction policy name
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(name); p {
+	case EvictLRU, EvictLFU:
+		return p, nil
+	case "":
+		return EvictLRU, nil
+	}
+	return "", fmt.Errorf("unsupported eviction policy %q", name)
+}
+
+// Eviction describes an object leaving the memory of a CacheStorage
+type Eviction struct {
+	Bucket string
+	ID     string
+	Size   int64
+	// Spilled is true when the object was moved to the spill directory,
+	// false when it was dropped
+	Spilled bool
+}
+
+// CacheConfig tunes a CacheStorage
+type CacheConfig struct {
+	// MaxBytes bounds the object data held in memory
+	MaxBytes int64
+	// Policy selects the objects evicted, EvictLRU by default
+	Policy EvictionPolicy
+	// SpillDir is the directory evicted objects are moved to, they are
+	// dropped when empty. The objects spilled by a previous cache are
+	// removed when the cache is created, other files are left untouched.
+	SpillDir string
+	// SpillMaxBytes bounds the spilled data, the objects spilled first
+	// being dropped beyond it. Zero is unlimited.
+	SpillMaxBytes int64
+	// OnEvict is called with every object evicted from memory or dropped
+	// from the spill directory, without locks held
+	OnEvict func(Eviction)
+}
+
+// cacheEntry is an object of the cache, in memory or spilled
+type cacheEntry struct {
+	ref     objectRef
+	data    []byte
+	meta    domain.Metadata
+	modTime time.Time
+	size    int64
+	// hits counts the reads and writes of the object, for EvictLFU
+	hits uint64
+	// used is the tick of the last read or write of the object
+	used uint64
+	// index is the position of the object in the eviction heap, -1 once spilled
+	index int
+	// spilled locates the object in the spill order once spilled
+	spilled *list.Element
+}
+
+// evictionHeap orders the objects in memory, the next one to evict first
+type evictionHeap struct {
+	entries []*cacheEntry
+	lfu     bool
+}
+
+func (h *evictionHeap) Len() int { return len(h.entries) }
+
+func (h *evictionHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if h.lfu && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.used < b.used
+}
+
+func (h *evictionHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *evictionHeap) Push(x any) {
+	e := x.(*cacheEntry)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *evictionHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	e.index = -1
+	return e
+}
+
+// CacheStorage is a domain.Storage holding objects in memory up to a
+// capacity, evicting the least recently or least frequently used objects
+// beyond it. Evicted objects are dropped, or spilled to a local directory
+// and moved back to memory when read.
+type CacheStorage struct {
+	config CacheConfig
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*cacheEntry
+	heap    evictionHeap
+	// spillOrder lists the spilled objects, the first spilled at the front
+	spillOrder   *list.List
+	memoryBytes  int64
+	spilledBytes int64
+	tick         uint64
+}
+
+// NewCacheStorage creates an empty cache storage
+func NewCacheStorage(config CacheConfig) (*CacheStorage, error) {
+	if config.MaxBytes <= 0 {
+		return nil, errors.New("the cache capacity must be positive")
+	}
+	policy, err := ParseEvictionPolicy(string(config.Policy))
+	if err != nil {
+		return nil, err
+	}
+	config.Policy = policy
+	if config.SpillDir != "" {
+		if err := os.MkdirAll(config.SpillDir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := removeSpilled(config.SpillDir); err != nil {
+			return nil, err
+		}
+	}
+	cacheMemoryBytes.Set(0)
+	cacheSpilledBytes.Set(0)
+	return &CacheStorage{
+		config:     config,
+		buckets:    make(map[string]map[string]*cacheEntry),
+		heap:       evictionHeap{lfu: policy == EvictLFU},
+		spillOrder: list.New(),
+	}, nil
+}
+
+// removeSpilled removes the objects spilled in dir by a previous cache and
+// the directories left empty
+func removeSpilled(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "??", "*"+spillExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		// Fails while the directory holds other files
+		os.Remove(filepath.Dir(file))
+	}
+	return nil
+}
+
+// spillPath returns the file of a spilled object, named after the hash of
+// its reference so that any key maps to a valid file name
+func (s *CacheStorage) spillPath(ref objectRef) string {
+	sum := sha256.Sum256([]byte(ref.bucket + "\x00" + ref.key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.config.SpillDir, name[:2], name+spillExt)
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *CacheStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object in memory, evicting other objects if
+// the cache is full. Objects larger than the capacity are spilled directly.
+func (s *CacheStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	var evictions []Eviction
+	defer func() { s.notify(evictions) }()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := objectRef{bucket, objectID}
+	size := int64(len(data))
+	if size > s.config.MaxBytes && s.config.SpillDir == "" {
+		return false, ErrObjectTooLarge
+	}
+	existing, exists := s.buckets[bucket][objectID]
+	if exists {
+		current, err := s.data(existing)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(current, data) && maps.Equal(existing.meta, meta) {
+			s.touch(existing)
+			return false, nil
+		}
+		if err := s.remove(existing); err != nil {
+			return false, err
+		}
+		s.drop(existing)
+	}
+
+	e := &cacheEntry{ref: ref, data: data, meta: meta.Clone(), modTime: time.Now().UTC(), size: size, index: -1}
+	if size > s.config.MaxBytes {
+		if err := s.spill(e); err != nil {
+			s.updateGauges()
+			return false, err
+		}
+	}
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*cacheEntry)
+	}
+	s.buckets[bucket][objectID] = e
+	if e.spilled != nil {
+		evictions = s.trimSpill()
+	} else {
+		s.touch(e)
+		heap.Push(&s.heap, e)
+		s.memoryBytes += size
+		evictions = s.evict(e)
+	}
+	s.updateGauges()
+	return true, nil
+}
+
+// Get retrieves the object data
+func (s *CacheStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata, moving
+// spilled objects back to memory when they fit
+func (s *CacheStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	var evictions []Eviction
+	defer func() { s.notify(evictions) }()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.buckets[bucket][objectID]
+	if !ok {
+		cacheRequests.WithLabelValues("miss").Inc()
+		return nil, nil, domain.ErrNotFound
+	}
+	if e.index >= 0 {
+		cacheRequests.WithLabelValues("hit").Inc()
+		s.touch(e)
+		return e.data, e.meta.Clone(), nil
+	}
+
+	data, err := os.ReadFile(s.spillPath(e.ref))
+	if err != nil {
+		return nil, nil, err
+	}
+	cacheRequests.WithLabelValues("spill_hit").Inc()
+	if e.size <= s.config.MaxBytes {
+		if err := s.unspill(e); err != nil {
+			return nil, nil, err
+		}
+		e.data = data
+		s.touch(e)
+		heap.Push(&s.heap, e)
+		s.memoryBytes += e.size
+		evictions = s.evict(e)
+		s.updateGauges()
+	}
+	return data, e.meta.Clone(), nil
+}
+
+// Exists reports whether the object is cached, in memory or spilled,
+// without counting as a use of it
+func (s *CacheStorage) Exists(bucket, objectID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.buckets[bucket][objectID]
+	return ok, nil
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object,
+// in memory or spilled, without counting as a use of it
+func (s *CacheStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.buckets[bucket][objectID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	e.meta = e.meta.With(changes)
+	return nil
+}
+
+// Delete removes the object if it exists
+func (s *CacheStorage) Delete(bucket, objectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.buckets[bucket][objectID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if err := s.remove(e); err != nil {
+		return err
+	}
+	delete(s.buckets[bucket], objectID)
+	if len(s.buckets[bucket]) == 0 {
+		delete(s.buckets, bucket)
+	}
+	s.updateGauges()
+	return nil
+}
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *CacheStorage) ListBuckets() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix,
+// in memory or spilled
+func (s *CacheStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var infos []domain.ObjectInfo
+	for id, e := range s.buckets[bucket] {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		infos = append(infos, domain.ObjectInfo{
+			Bucket:   bucket,
+			ID:       id,
+			Size:     e.size,
+			ModTime:  e.modTime,
+			Metadata: e.meta.Clone(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// touch records a use of the object, mu must be held
+func (s *CacheStorage) touch(e *cacheEntry) {
+	s.tick++
+	e.used = s.tick
+	e.hits++
+	if e.index >= 0 {
+		heap.Fix(&s.heap, e.index)
+	}
+}
+
+// data returns the data of the object, in memory or spilled. mu must be held.
+func (s *CacheStorage) data(e *cacheEntry) ([]byte, error) {
+	if e.index >= 0 {
+		return e.data, nil
+	}
+	return os.ReadFile(s.spillPath(e.ref))
+}
+
+// remove releases the memory or the file of the object, which stays in its
+// bucket. mu must be held.
+func (s *CacheStorage) remove(e *cacheEntry) error {
+	if e.index >= 0 {
+		heap.Remove(&s.heap, e.index)
+		s.memoryBytes -= e.size
+		e.data = nil
+		return nil
+	}
+	return s.unspill(e)
+}
+
+// evict moves objects out of memory until the cache fits in its capacity,
+// keeping the object just written or read so that with EvictLFU new objects
+// are not evicted before being used. mu must be held.
+func (s *CacheStorage) evict(keep *cacheEntry) []Eviction {
+	heap.Remove(&s.heap, keep.index)
+	defer heap.Push(&s.heap, keep)
+
+	var evictions []Eviction
+	for s.memoryBytes > s.config.MaxBytes {
+		e := heap.Pop(&s.heap).(*cacheEntry)
+		s.memoryBytes -= e.size
+		spilled := false
+		if s.config.SpillDir != "" {
+			if err := s.spill(e); err == nil {
+				spilled = true
+			}
+		}
+		if !spilled {
+			s.drop(e)
+			cacheEvictions.WithLabelValues("dropped").Inc()
+		} else {
+			cacheEvictions.WithLabelValues("spilled").Inc()
+		}
+		evictions = append(evictions, Eviction{Bucket: e.ref.bucket, ID: e.ref.key, Size: e.size, Spilled: spilled})
+	}
+	if len(evictions) > 0 {
+		evictions = append(evictions, s.trimSpill()...)
+	}
+	return evictions
+}
+
+// spill writes the data of an object out of memory to its file. mu must be held.
+func (s *CacheStorage) spill(e *cacheEntry) error {
+	path := s.spillPath(e.ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, e.data, 0o644); err != nil {
+		os.Remove(path)
+		return err
+	}
+	e.data = nil
+	e.spilled = s.spillOrder.PushBack(e)
+	s.spilledBytes += e.size
+	return nil
+}
+
+// unspill removes the file of a spilled object. mu must be held.
+func (s *CacheStorage) unspill(e *cacheEntry) error {
+	if err := os.Remove(s.spillPath(e.ref)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.spillOrder.Remove(e.spilled)
+	e.spilled = nil
+	s.spilledBytes -= e.size
+	return nil
+}
+
+// trimSpill drops the objects spilled first until the spilled data fits in
+// SpillMaxBytes. mu must be held.
+func (s *CacheStorage) trimSpill() []Eviction {
+	var evictions []Eviction
+	for s.config.SpillMaxBytes > 0 && s.spilledBytes > s.config.SpillMaxBytes {
+		e := s.spillOrder.Front().Value.(*cacheEntry)
+		if err := s.unspill(e); err != nil {
+			break
+		}
+		s.drop(e)
+		cacheEvictions.WithLabelValues("dropped").Inc()
+		evictions = append(evictions, Eviction{Bucket: e.ref.bucket, ID: e.ref.key, Size: e.size})
+	}
+	return evictions
+}
+
+// drop removes an evicted object from its bucket. mu must be held.
+func (s *CacheStorage) drop(e *cacheEntry) {
+	objects := s.buckets[e.ref.bucket]
+	if objects[e.ref.key] == e {
+		delete(objects, e.ref.key)
+		if len(objects) == 0 {
+			delete(s.buckets, e.ref.bucket)
+		}
+	}
+}
+
+func (s *CacheStorage) updateGauges() {
+	cacheMemoryBytes.Set(float64(s.memoryBytes))
+	cacheSpilledBytes.Set(float64(s.spilledBytes))
+}
+
+// notify calls OnEvict with the evictions of an operation, once mu is released
+func (s *CacheStorage) notify(evictions []Eviction) {
+	if s.config.OnEvict == nil {
+		return
+	}
+	for _, ev := range evictions {
+		s.config.OnEvict(ev)
+	}
+}
@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+func newTestCache(t *testing.T, config CacheConfig) (*CacheStorage, *[]Eviction) {
+	t.Helper()
+	var evictions []Eviction
+	config.OnEvict = func(ev Eviction) { evictions = append(evictions, ev) }
+	s, err := NewCacheStorage(config)
+	if err != nil {
+		t.Fatalf("NewCacheStorage failed: %v", err)
+	}
+	return s, &evictions
+}
+
+func TestCacheStorage_LRU(t *testing.T) {
+	s, evictions := newTestCache(t, CacheConfig{MaxBytes: 10})
+	s.Put("bucket", "a", []byte("aaaa"))
+	s.Put("bucket", "b", []byte("bbbb"))
+	s.Get("bucket", "a")
+	s.Put("bucket", "c", []byte("cccc"))
+
+	if _, err := s.Get("bucket", "b"); err != domain.ErrNotFound {
+		t.Errorf("expected the least recently used object to be evicted, got %v", err)
+	}
+	if len(*evictions) != 1 || (*evictions)[0] != (Eviction{Bucket: "bucket", ID: "b", Size: 4}) {
+		t.Errorf("unexpected evictions %+v", *evictions)
+	}
+	if infos, _ := s.ListObjects("bucket", ""); len(infos) != 2 {
+		t.Errorf("unexpected listing %+v", infos)
+	}
+	if _, err := s.Put("bucket", "large", make([]byte, 11)); err != ErrObjectTooLarge {
+		t.Errorf("expected ErrObjectTooLarge, got %v", err)
+	}
+}
+
+func TestCacheStorage_LFU(t *testing.T) {
+	s, _ := newTestCache(t, CacheConfig{MaxBytes: 10, Policy: EvictLFU})
+	s.Put("bucket", "a", []byte("aaaa"))
+	s.Put("bucket", "b", []byte("bbbb"))
+	s.Get("bucket", "a")
+	s.Get("bucket", "a")
+	s.Get("bucket", "b")
+	// b was used more recently, but less frequently
+	s.Put("bucket", "c", []byte("cc"))
+	s.Get("bucket", "c")
+	s.Get("bucket", "c")
+	s.Put("bucket", "d", []byte("dd"))
+
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, err := s.Get("bucket", key); (err == nil) != cached {
+			t.Errorf("unexpected presence of %s: %v", key, err)
+		}
+	}
+}
+
+func TestCacheStorage_Spill(t *testing.T) {
+	dir := t.TempDir()
+	// The objects of a previous cache are removed, other files are kept
+	os.MkdirAll(filepath.Join(dir, "ab"), 0o755)
+	os.WriteFile(filepath.Join(dir, "ab", "stale"+spillExt), []byte("stale"), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep"), 0o644)
+	s, evictions := newTestCache(t, CacheConfig{MaxBytes: 10, SpillDir: dir, SpillMaxBytes: 20})
+	if files := countFiles(t, dir, spillExt); files != 0 {
+		t.Fatalf("expected the spilled objects of a previous cache to be removed, got %d files", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Fatalf("expected other files to be kept: %v", err)
+	}
+
+	s.PutWithMetadata("bucket", "a", []byte("aaaaaa"), domain.Metadata{"tags": "x"})
+	s.Put("bucket", "b", []byte("bbbbbb"))
+	if files := countFiles(t, dir, spillExt); files != 1 || !(*evictions)[0].Spilled {
+		t.Fatalf("expected a to be spilled, got %d files and evictions %+v", files, *evictions)
+	}
+	infos, err := s.ListObjects("bucket", "")
+	if err != nil || len(infos) != 2 || infos[0].Size != 6 || infos[0].Metadata["tags"] != "x" {
+		t.Errorf("expected the spilled object to be listed, got %+v (err %v)", infos, err)
+	}
+
+	// Reading a spilled object moves it back to memory, spilling b
+	data, meta, err := s.GetWithMetadata("bucket", "a")
+	if err != nil || string(data) != "aaaaaa" || meta["tags"] != "x" {
+		t.Fatalf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+	if data, err := s.Get("bucket", "b"); err != nil || string(data) != "bbbbbb" {
+		t.Fatalf("unexpected object %q (err %v)", data, err)
+	}
+	if files := countFiles(t, dir, spillExt); files != 1 {
+		t.Errorf("expected a single spilled object, got %d files", files)
+	}
+
+	// Objects larger than the memory go to disk, the spill directory
+	// dropping the objects spilled first beyond its capacity
+	if _, err := s.Put("bucket", "large", make([]byte, 16)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if data, err := s.Get("bucket", "large"); err != nil || len(data) != 16 {
+		t.Errorf("unexpected large object of %d bytes (err %v)", len(data), err)
+	}
+	if _, err := s.Get("bucket", "a"); err != domain.ErrNotFound {
+		t.Errorf("expected the first spilled object to be dropped, got %v", err)
+	}
+
+	if err := s.Delete("bucket", "large"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if files := countFiles(t, dir, spillExt); files != 0 {
+		t.Errorf("expected the spilled objects to be removed, got %d files", files)
+	}
+}
+
+func TestCacheStorage_UpdateMetadata(t *testing.T) {
+	s, _ := newTestCache(t, CacheConfig{MaxBytes: 1024})
+	checkUpdateMetadata(t, s, "cat.png", []byte("meow"))
+}
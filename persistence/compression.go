@@ -0,0 +1,269 @@
+package persistence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies the compression algorithm used to store an object.
+// Values match the HTTP Content-Encoding tokens so they can be served as-is.
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+)
+
+// MetadataCodec is the metadata key recording the codec an object was stored with
+const MetadataCodec = "codec"
+
+const (
+	// minCompressSize is the size below which compression is not worth the overhead
+	minCompressSize = 256
+	// maxCompressRatio is the compressed/original ratio above which data is stored raw
+	maxCompressRatio = 0.9
+)
+
+// compressedSignatures are magic numbers of formats that are already compressed
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b},                         // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},             // zstd
+	{0x50, 0x4b, 0x03, 0x04},             // zip, jar, docx...
+	{0x42, 0x5a, 0x68},                   // bzip2
+	{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, // xz
+	{0x04, 0x22, 0x4d, 0x18},             // lz4
+	{0x37, 0x7a, 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x52, 0x61, 0x72, 0x21},             // rar
+	{0x89, 0x50, 0x4e, 0x47},             // png
+	{0xff, 0xd8, 0xff},                   // jpeg
+	{0x47, 0x49, 0x46, 0x38},             // gif
+	{0x1a, 0x45, 0xdf, 0xa3},             // webm, mkv
+}
+
+// ParseCodec validates a codec name
+func ParseCodec(name string) (Codec, error) {
+	switch c := Codec(name); c {
+	case CodecNone, CodecGzip, CodecZstd:
+		return c, nil
+	case "":
+		return CodecNone, nil
+	}
+	return "", fmt.Errorf("unsupported codec %q", name)
+}
+
+// CompressedStorage is a domain.Storage decorator compressing objects before
+// handing them to the underlying storage. The codec is configurable per bucket.
+type CompressedStorage struct {
+	inner        domain.Storage
+	defaultCodec Codec
+
+	mu      sync.RWMutex
+	buckets map[string]Codec
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+}
+
+// NewCompressedStorage wraps inner, compressing objects with defaultCodec unless a bucket overrides it
+func NewCompressedStorage(inner domain.Storage, defaultCodec Codec) (*CompressedStorage, error) {
+	zenc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	zdec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedStorage{
+		inner:        inner,
+		defaultCodec: defaultCodec,
+		buckets:      make(map[string]Codec),
+		zenc:         zenc,
+		zdec:         zdec,
+	}, nil
+}
+
+// SetBucketCodec configures the codec used for new objects written to bucket
+func (s *CompressedStorage) SetBucketCodec(bucket string, codec Codec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = codec
+}
+
+// BucketCodec returns the codec used for new objects written to bucket
+func (s *CompressedStorage) BucketCodec(bucket string) Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if codec, ok := s.buckets[bucket]; ok {
+		return codec
+	}
+	return s.defaultCodec
+}
+
+// Put compresses and stores the object
+func (s *CompressedStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata compresses the object and records the codec in its metadata
+func (s *CompressedStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	codec := s.BucketCodec(bucket)
+	if !worthCompressing(data) {
+		codec = CodecNone
+	}
+
+	encoded, err := s.encode(codec, data)
+	if err != nil {
+		return false, err
+	}
+	if codec != CodecNone && float64(len(encoded)) > float64(len(data))*maxCompressRatio {
+		codec, encoded = CodecNone, data
+	}
+
+	meta = meta.Clone()
+	meta[MetadataCodec] = string(codec)
+	return domain.PutWithMetadata(s.inner, bucket, objectID, encoded, meta)
+}
+
+// Get retrieves and decompresses the object
+func (s *CompressedStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves and decompresses the object, hiding the codec from the metadata
+func (s *CompressedStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	raw, meta, err := domain.GetWithMetadata(s.inner, bucket, objectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := s.decode(Codec(meta[MetadataCodec]), raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(meta, MetadataCodec)
+	return data, meta, nil
+}
+
+// GetEncoded retrieves the object as stored when accept reports the client
+// understands its codec, otherwise the object is decompressed. The returned
+// encoding is empty when data is not compressed.
+func (s *CompressedStorage) GetEncoded(bucket, objectID string, accept func(codec Codec) bool) ([]byte, Codec, error) {
+	data, _, codec, err := s.GetEncodedWithMetadata(bucket, objectID, accept)
+	return data, codec, err
+}
+
+// GetEncodedWithMetadata is GetEncoded also returning the metadata of the object
+func (s *CompressedStorage) GetEncodedWithMetadata(bucket, objectID string, accept func(codec Codec) bool) ([]byte, domain.Metadata, Codec, error) {
+	raw, meta, err := domain.GetWithMetadata(s.inner, bucket, objectID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	codec := Codec(meta[MetadataCodec])
+	delete(meta, MetadataCodec)
+	if codec == "" || codec == CodecNone {
+		return raw, meta, "", nil
+	}
+	if accept(codec) {
+		return raw, meta, codec, nil
+	}
+	data, err := s.decode(codec, raw)
+	return data, meta, "", err
+}
+
+// ListBuckets lists the buckets of the underlying storage
+func (s *CompressedStorage) ListBuckets() ([]string, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListBuckets()
+}
+
+// ListObjects lists the objects of the underlying storage, sizes are the stored (compressed) sizes
+func (s *CompressedStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	infos, err := lister.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range infos {
+		delete(infos[i].Metadata, MetadataCodec)
+	}
+	return infos, nil
+}
+
+// Exists reports whether the object exists in the underlying storage
+func (s *CompressedStorage) Exists(bucket, objectID string) (bool, error) {
+	return domain.Exists(s.inner, bucket, objectID)
+}
+
+// UpdateMetadata forwards the metadata update to the underlying storage
+func (s *CompressedStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	return domain.UpdateMetadata(s.inner, bucket, objectID, changes)
+}
+
+// Delete removes the object
+func (s *CompressedStorage) Delete(bucket, objectID string) error {
+	return s.inner.Delete(bucket, objectID)
+}
+
+func (s *CompressedStorage) encode(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecZstd:
+		return s.zenc.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported codec %q", codec)
+}
+
+func (s *CompressedStorage) decode(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CodecNone:
+		return data, nil
+	case CodecZstd:
+		return s.zdec.DecodeAll(data, nil)
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+	return nil, fmt.Errorf("unsupported codec %q", codec)
+}
+
+// worthCompressing reports whether data is large enough and not already compressed
+func worthCompressing(data []byte) bool {
+	if len(data) < minCompressSize {
+		return false
+	}
+	for _, sig := range compressedSignatures {
+		if bytes.HasPrefix(data, sig) {
+			return false
+		}
+	}
+	return true
+}
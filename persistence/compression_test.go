@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressedStorage_RoundTrip(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd} {
+		inner := NewInMemoryStorage()
+		storage, err := NewCompressedStorage(inner, codec)
+		if err != nil {
+			t.Fatalf("NewCompressedStorage failed: %v", err)
+		}
+
+		data := []byte(strings.Repeat(`{"level":"info","msg":"request served"}`, 100))
+		if _, err := storage.Put("logs", "app.json", data); err != nil {
+			t.Fatalf("%s: Put failed: %v", codec, err)
+		}
+
+		got, err := storage.Get("logs", "app.json")
+		if err != nil {
+			t.Fatalf("%s: Get failed: %v", codec, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: Get returned wrong data", codec)
+		}
+
+		// The codec must be recorded in the metadata of the stored object
+		raw, meta, err := inner.GetWithMetadata("logs", "app.json")
+		if err != nil {
+			t.Fatalf("%s: inner Get failed: %v", codec, err)
+		}
+		if meta[MetadataCodec] != string(codec) {
+			t.Errorf("expected codec %q in metadata, got %q", codec, meta[MetadataCodec])
+		}
+		if codec != CodecNone && len(raw) >= len(data) {
+			t.Errorf("%s: expected stored data to be compressed, got %d bytes for %d", codec, len(raw), len(data))
+		}
+	}
+}
+
+func TestCompressedStorage_PerBucketCodec(t *testing.T) {
+	inner := NewInMemoryStorage()
+	storage, err := NewCompressedStorage(inner, CodecNone)
+	if err != nil {
+		t.Fatalf("NewCompressedStorage failed: %v", err)
+	}
+	storage.SetBucketCodec("logs", CodecGzip)
+
+	data := []byte(strings.Repeat("line of text\n", 100))
+	storage.Put("logs", "a", data)
+	storage.Put("raw", "a", data)
+
+	if _, meta, _ := inner.GetWithMetadata("logs", "a"); meta[MetadataCodec] != string(CodecGzip) {
+		t.Errorf("expected gzip for bucket logs, got %q", meta[MetadataCodec])
+	}
+	if _, meta, _ := inner.GetWithMetadata("raw", "a"); meta[MetadataCodec] != string(CodecNone) {
+		t.Errorf("expected none for bucket raw, got %q", meta[MetadataCodec])
+	}
+}
+
+func TestCompressedStorage_SkipsCompressedContent(t *testing.T) {
+	inner := NewInMemoryStorage()
+	storage, err := NewCompressedStorage(inner, CodecZstd)
+	if err != nil {
+		t.Fatalf("NewCompressedStorage failed: %v", err)
+	}
+
+	// Data starting with the gzip magic number must be stored as-is
+	data := append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte("a"), 1000)...)
+	storage.Put("bucket", "archive.gz", data)
+
+	raw, meta, _ := inner.GetWithMetadata("bucket", "archive.gz")
+	if meta[MetadataCodec] != string(CodecNone) || !bytes.Equal(raw, data) {
+		t.Errorf("expected already compressed content to be stored raw, got codec %q", meta[MetadataCodec])
+	}
+}
+
+func TestCompressedStorage_GetEncoded(t *testing.T) {
+	storage, err := NewCompressedStorage(NewInMemoryStorage(), CodecZstd)
+	if err != nil {
+		t.Fatalf("NewCompressedStorage failed: %v", err)
+	}
+	data := []byte(strings.Repeat("compress me ", 100))
+	storage.Put("bucket", "obj", data)
+
+	raw, codec, err := storage.GetEncoded("bucket", "obj", func(c Codec) bool { return c == CodecZstd })
+	if err != nil || codec != CodecZstd || len(raw) >= len(data) {
+		t.Errorf("expected zstd encoded data, got codec %q err %v", codec, err)
+	}
+
+	plain, codec, err := storage.GetEncoded("bucket", "obj", func(Codec) bool { return false })
+	if err != nil || codec != "" || !bytes.Equal(plain, data) {
+		t.Errorf("expected decoded data, got codec %q err %v", codec, err)
+	}
+}
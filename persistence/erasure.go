@@ -0,0 +1,637 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/klauspost/reedsolomon"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrNotEnoughShards is returned when fewer shards than data shards of an object are intact
+var ErrNotEnoughShards = fmt.Errorf("not enough intact shards to reconstruct the object: %w", domain.ErrCorrupt)
+
+var (
+	degradedReads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "erasure_degraded_reads_total",
+		Help: "Reads of erasure-coded objects which reconstructed missing or corrupt shards.",
+	})
+	healedShards = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "erasure_healed_shards_total",
+		Help: "Shards rewritten by the healer.",
+	})
+	unrecoverableObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "erasure_unrecoverable_objects_total",
+		Help: "Objects the healer found with too few intact shards to be reconstructed.",
+	})
+)
+
+const (
+	// shardExt is the extension of shard files, temporary files use another one
+	shardExt = ".shard"
+	// healQueueSize bounds the objects queued for healing after degraded reads
+	healQueueSize = 1024
+)
+
+// shardHeader precedes the data of every shard file
+type shardHeader struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Version identifies the write the shard belongs to, shards of different
+	// writes are never mixed
+	Version      string          `json:"version"`
+	Index        int             `json:"index"`
+	DataShards   int             `json:"dataShards"`
+	ParityShards int             `json:"parityShards"`
+	Size         int64           `json:"size"`
+	ModTime      time.Time       `json:"modTime"`
+	Metadata     domain.Metadata `json:"metadata,omitempty"`
+	// Checksum is the hex SHA-256 of the shard data, detecting bit rot
+	Checksum string `json:"checksum"`
+}
+
+// shardSet is the version of an object read from the disks
+type shardSet struct {
+	header shardHeader
+	// shards holds the intact shards of the version, nil for the others
+	shards [][]byte
+	// damaged lists the shards missing, corrupt or belonging to another version
+	damaged []int
+}
+
+type objectRef struct {
+	bucket, key string
+}
+
+// ErasureStorage is a domain.Storage Reed-Solomon encoding every object into
+// data and parity shards stored on distinct directories, typically on
+// distinct disks. Objects can be read as long as any data shards of them are
+// intact, damaged shards are rewritten by the healer.
+type ErasureStorage struct {
+	dirs         []string
+	dataShards   int
+	parityShards int
+	enc          reedsolomon.Encoder
+
+	locks [64]sync.RWMutex
+	heal  chan objectRef
+}
+
+// NewErasureStorage stores objects as dataShards + parityShards shards spread
+// over dirs, which must be at least as many as the shards
+func NewErasureStorage(dirs []string, dataShards, parityShards int) (*ErasureStorage, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, fmt.Errorf("invalid erasure coding %d+%d: data and parity shards must be positive", dataShards, parityShards)
+	}
+	if len(dirs) < dataShards+parityShards {
+		return nil, fmt.Errorf("%d shards need as many directories, got %d", dataShards+parityShards, len(dirs))
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &ErasureStorage{
+		dirs:         dirs,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		enc:          enc,
+		heal:         make(chan objectRef, healQueueSize),
+	}, nil
+}
+
+func (s *ErasureStorage) lock(bucket, key string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + key))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+// escapeName turns a bucket or key into a file name
+func escapeName(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.Trim(escaped, ".") == "" {
+		// "." and ".." are not valid file names
+		escaped = strings.ReplaceAll(escaped, ".", "%2E")
+	}
+	return escaped
+}
+
+// shardPaths returns the path of every shard of an object. The shards of
+// objects start on different directories so that the load is spread.
+func (s *ErasureStorage) shardPaths(bucket, key string) []string {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + key))
+	start := int(h.Sum32() % uint32(len(s.dirs)))
+	paths := make([]string, s.dataShards+s.parityShards)
+	for i := range paths {
+		dir := s.dirs[(start+i)%len(s.dirs)]
+		paths[i] = filepath.Join(dir, escapeName(bucket), escapeName(key)+shardExt)
+	}
+	return paths
+}
+
+// encode splits data into shards and computes the parity shards
+func (s *ErasureStorage) encode(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return make([][]byte, s.dataShards+s.parityShards), nil
+	}
+	// Split may use the spare capacity of its argument
+	shards, err := s.enc.Split(bytes.Clone(data))
+	if err != nil {
+		return nil, err
+	}
+	return shards, s.enc.Encode(shards)
+}
+
+func writeShard(path string, header shardHeader, shard []byte) error {
+	sum := sha256.Sum256(shard)
+	header.Checksum = hex.EncodeToString(sum[:])
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(encoded)))
+	buf.Write(encoded)
+	buf.Write(shard)
+	// Shards are replaced atomically so that readers never see partial ones
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readShard reads a shard file. Without data, only its header is read and
+// its checksum is not verified.
+func readShard(path string, withData bool) (shardHeader, []byte, error) {
+	var header shardHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+
+	var size uint32
+	if err := binary.Read(f, binary.BigEndian, &size); err != nil {
+		return header, nil, fmt.Errorf("reading shard header: %w", err)
+	}
+	encoded := make([]byte, size)
+	if _, err := io.ReadFull(f, encoded); err != nil {
+		return header, nil, fmt.Errorf("reading shard header: %w", err)
+	}
+	if err := json.Unmarshal(encoded, &header); err != nil {
+		return header, nil, fmt.Errorf("decoding shard header: %w", err)
+	}
+	if !withData {
+		return header, nil, nil
+	}
+	shard, err := io.ReadAll(f)
+	if err != nil {
+		return header, nil, err
+	}
+	sum := sha256.Sum256(shard)
+	if hex.EncodeToString(sum[:]) != header.Checksum {
+		return header, nil, fmt.Errorf("shard %s is corrupt", path)
+	}
+	return header, shard, nil
+}
+
+// read loads the latest version of an object having enough intact shards.
+// Without data, only the headers of the shards are read.
+func (s *ErasureStorage) read(bucket, key string, withData bool) (*shardSet, error) {
+	paths := s.shardPaths(bucket, key)
+	headers := make([]*shardHeader, len(paths))
+	shards := make([][]byte, len(paths))
+	found := false
+	for i, path := range paths {
+		header, shard, err := readShard(path, withData)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		found = true
+		if err != nil {
+			log.Printf("Erasure: %v", err)
+			continue
+		}
+		if header.Index != i || header.Bucket != bucket || header.Key != key {
+			continue
+		}
+		headers[i], shards[i] = &header, shard
+	}
+	if !found {
+		return nil, domain.ErrNotFound
+	}
+
+	// A failed write may have left a newer version with too few shards
+	intact := make(map[string]int)
+	var versions []*shardHeader
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		if intact[h.Version] == 0 {
+			versions = append(versions, h)
+		}
+		intact[h.Version]++
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ModTime.After(versions[j].ModTime) })
+	for _, v := range versions {
+		if intact[v.Version] < s.dataShards {
+			continue
+		}
+		set := &shardSet{header: *v, shards: make([][]byte, len(paths))}
+		for i, h := range headers {
+			if h != nil && h.Version == v.Version {
+				set.shards[i] = shards[i]
+			} else {
+				set.damaged = append(set.damaged, i)
+			}
+		}
+		return set, nil
+	}
+	return nil, fmt.Errorf("%s/%s: %w", bucket, key, ErrNotEnoughShards)
+}
+
+// decode reconstructs the data of an object from its intact shards
+func (s *ErasureStorage) decode(set *shardSet) ([]byte, error) {
+	if set.header.Size == 0 {
+		return []byte{}, nil
+	}
+	if len(set.damaged) > 0 {
+		if err := s.enc.ReconstructData(set.shards); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := s.enc.Join(&buf, set.shards, int(set.header.Size)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *ErasureStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata encodes the object and writes its shards. It succeeds
+// when enough shards to read the object back are written, the others are
+// left to the healer.
+func (s *ErasureStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	l := s.lock(bucket, objectID)
+	l.Lock()
+	defer l.Unlock()
+
+	if set, err := s.read(bucket, objectID, true); err == nil {
+		if existing, err := s.decode(set); err == nil && bytes.Equal(existing, data) && maps.Equal(set.header.Metadata, meta) {
+			return false, nil
+		}
+	}
+
+	if err := s.write(bucket, objectID, data, meta, time.Now().UTC()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateMetadata writes the object again with the keys of changes set in
+// its metadata, keeping its modification time
+func (s *ErasureStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	l := s.lock(bucket, objectID)
+	l.Lock()
+	defer l.Unlock()
+
+	set, err := s.read(bucket, objectID, true)
+	if err != nil {
+		return err
+	}
+	data, err := s.decode(set)
+	if err != nil {
+		return err
+	}
+	return s.write(bucket, objectID, data, set.header.Metadata.With(changes), set.header.ModTime)
+}
+
+// write encodes data into a new version of the shards of the object, it
+// must be called with the lock of the object held
+func (s *ErasureStorage) write(bucket, objectID string, data []byte, meta domain.Metadata, modTime time.Time) error {
+	shards, err := s.encode(data)
+	if err != nil {
+		return err
+	}
+	version := make([]byte, 8)
+	rand.Read(version)
+	header := shardHeader{
+		Bucket:       bucket,
+		Key:          objectID,
+		Version:      hex.EncodeToString(version),
+		DataShards:   s.dataShards,
+		ParityShards: s.parityShards,
+		Size:         int64(len(data)),
+		ModTime:      modTime,
+		Metadata:     meta,
+	}
+	written := 0
+	var lastErr error
+	for i, path := range s.shardPaths(bucket, objectID) {
+		header.Index = i
+		if err := writeShard(path, header, shards[i]); err != nil {
+			log.Printf("Erasure: writing shard %d of %s/%s failed: %v", i, bucket, objectID, err)
+			lastErr = err
+			continue
+		}
+		written++
+	}
+	if written < s.dataShards {
+		return fmt.Errorf("only %d shards of %s/%s written: %w", written, bucket, objectID, lastErr)
+	}
+	if written < len(shards) {
+		s.queueHeal(bucket, objectID)
+	}
+	return nil
+}
+
+// Get retrieves the object data
+func (s *ErasureStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata reads the object from its intact shards, reconstructing
+// the missing or corrupt ones
+func (s *ErasureStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	l := s.lock(bucket, objectID)
+	l.RLock()
+	defer l.RUnlock()
+
+	set, err := s.read(bucket, objectID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := s.decode(set)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(set.damaged) > 0 {
+		degradedReads.Inc()
+		s.queueHeal(bucket, objectID)
+	}
+	return data, set.header.Metadata.Clone(), nil
+}
+
+// Exists reports whether the object is readable from the headers of its
+// shards, without reading their data
+func (s *ErasureStorage) Exists(bucket, objectID string) (bool, error) {
+	l := s.lock(bucket, objectID)
+	l.RLock()
+	defer l.RUnlock()
+
+	_, err := s.read(bucket, objectID, false)
+	if errors.Is(err, domain.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes every shard of the object
+func (s *ErasureStorage) Delete(bucket, objectID string) error {
+	l := s.lock(bucket, objectID)
+	l.Lock()
+	defer l.Unlock()
+
+	deleted := false
+	for _, path := range s.shardPaths(bucket, objectID) {
+		err := os.Remove(path)
+		if err == nil {
+			deleted = true
+			// Empty bucket directories are dropped, the others are kept
+			os.Remove(filepath.Dir(path))
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if !deleted {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// ListBuckets returns the names of the buckets holding objects on any directory
+func (s *ErasureStorage) ListBuckets() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, dir := range s.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			bucket, err := url.PathUnescape(entry.Name())
+			if err != nil {
+				continue
+			}
+			if keys, _ := s.keys(bucket, ""); len(keys) > 0 {
+				seen[bucket] = true
+			}
+		}
+	}
+	buckets := make([]string, 0, len(seen))
+	for bucket := range seen {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// keys returns the sorted keys of a bucket having a shard on any directory
+func (s *ErasureStorage) keys(bucket, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, dir := range s.dirs {
+		entries, err := os.ReadDir(filepath.Join(dir, escapeName(bucket)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), shardExt)
+			if !ok {
+				continue
+			}
+			key, err := url.PathUnescape(name)
+			if err == nil && strings.HasPrefix(key, prefix) {
+				seen[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix,
+// from the headers of their shards
+func (s *ErasureStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	keys, err := s.keys(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var infos []domain.ObjectInfo
+	for _, key := range keys {
+		l := s.lock(bucket, key)
+		l.RLock()
+		set, err := s.read(bucket, key, false)
+		l.RUnlock()
+		if err != nil {
+			// Deleted meanwhile or unrecoverable
+			continue
+		}
+		infos = append(infos, domain.ObjectInfo{
+			Bucket:   bucket,
+			ID:       key,
+			Size:     set.header.Size,
+			ModTime:  set.header.ModTime,
+			Metadata: set.header.Metadata.Clone(),
+		})
+	}
+	return infos, nil
+}
+
+func (s *ErasureStorage) queueHeal(bucket, key string) {
+	select {
+	case s.heal <- objectRef{bucket: bucket, key: key}:
+	default:
+		// The periodic scan will heal it
+	}
+}
+
+// Run heals the objects damaged by degraded reads as they are found, and
+// scans every object each interval, until ctx is done
+func (s *ErasureStorage) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ref := <-s.heal:
+			if _, err := s.healObject(ref.bucket, ref.key); err != nil {
+				log.Printf("Erasure: healing %s/%s failed: %v", ref.bucket, ref.key, err)
+			}
+		case <-ticker.C:
+			healed, err := s.Heal(ctx)
+			if err != nil {
+				log.Println("Erasure: healing failed:", err)
+			} else if healed > 0 {
+				log.Printf("Erasure: healed %d shards", healed)
+			}
+		}
+	}
+}
+
+// Heal checks every object and rewrites its missing, corrupt or stale
+// shards. It returns the number of shards rewritten.
+func (s *ErasureStorage) Heal(ctx context.Context) (int, error) {
+	buckets, err := s.ListBuckets()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, bucket := range buckets {
+		keys, err := s.keys(bucket, "")
+		if err != nil {
+			return total, err
+		}
+		for _, key := range keys {
+			if ctx.Err() != nil {
+				return total, ctx.Err()
+			}
+			healed, err := s.healObject(bucket, key)
+			if err != nil {
+				log.Printf("Erasure: healing %s/%s failed: %v", bucket, key, err)
+			}
+			total += healed
+		}
+	}
+	return total, nil
+}
+
+// Repair rewrites the damaged shards of an object from the intact ones, it
+// reports whether any shard was rewritten
+func (s *ErasureStorage) Repair(bucket, objectID string) (bool, error) {
+	healed, err := s.healObject(bucket, objectID)
+	return healed > 0, err
+}
+
+func (s *ErasureStorage) healObject(bucket, key string) (int, error) {
+	l := s.lock(bucket, key)
+	l.Lock()
+	defer l.Unlock()
+
+	set, err := s.read(bucket, key, true)
+	if errors.Is(err, domain.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotEnoughShards) {
+			unrecoverableObjects.Inc()
+		}
+		return 0, err
+	}
+	if len(set.damaged) == 0 {
+		return 0, nil
+	}
+	if set.header.Size > 0 {
+		if err := s.enc.Reconstruct(set.shards); err != nil {
+			return 0, err
+		}
+	}
+
+	paths := s.shardPaths(bucket, key)
+	healed := 0
+	for _, i := range set.damaged {
+		header := set.header
+		header.Index = i
+		if err := writeShard(paths[i], header, set.shards[i]); err != nil {
+			return healed, err
+		}
+		healed++
+		healedShards.Inc()
+	}
+	return healed, nil
+}
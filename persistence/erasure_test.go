@@ -0,0 +1,137 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+func newTestErasureStorage(t *testing.T) *ErasureStorage {
+	var dirs []string
+	for i := 0; i < 6; i++ {
+		dirs = append(dirs, filepath.Join(t.TempDir(), fmt.Sprintf("disk-%d", i)))
+	}
+	s, err := NewErasureStorage(dirs, 4, 2)
+	if err != nil {
+		t.Fatalf("NewErasureStorage failed: %v", err)
+	}
+	return s
+}
+
+func TestErasureStorage_PutGetDelete(t *testing.T) {
+	s := newTestErasureStorage(t)
+	data := []byte("hello erasure coded world")
+
+	created, err := s.PutWithMetadata("acme/photos", "2024/cat.png", data, domain.Metadata{"tags": "pet"})
+	if err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("acme/photos", "2024/cat.png", data, domain.Metadata{"tags": "pet"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	for _, path := range s.shardPaths("acme/photos", "2024/cat.png") {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected shard %s: %v", path, err)
+		}
+	}
+
+	got, meta, err := s.GetWithMetadata("acme/photos", "2024/cat.png")
+	if err != nil || string(got) != string(data) || meta["tags"] != "pet" {
+		t.Fatalf("unexpected object %q %v (err %v)", got, meta, err)
+	}
+	if exists, err := s.Exists("acme/photos", "2024/cat.png"); err != nil || !exists {
+		t.Errorf("expected the object to exist (err %v)", err)
+	}
+	s.Put("acme/photos", "empty", nil)
+	if got, err := s.Get("acme/photos", "empty"); err != nil || len(got) != 0 {
+		t.Errorf("expected an empty object, got %q (err %v)", got, err)
+	}
+
+	infos, err := s.ListObjects("acme/photos", "2024/")
+	if err != nil || len(infos) != 1 || infos[0].Size != int64(len(data)) || infos[0].Metadata["tags"] != "pet" {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+	buckets, _ := s.ListBuckets()
+	if len(buckets) != 1 || buckets[0] != "acme/photos" {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+
+	if err := s.Delete("acme/photos", "2024/cat.png"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.Get("acme/photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if exists, err := s.Exists("acme/photos", "2024/cat.png"); err != nil || exists {
+		t.Errorf("expected the object not to exist (err %v)", err)
+	}
+	if err := s.Delete("acme/photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestErasureStorage_DegradedReadsAndHealing(t *testing.T) {
+	s := newTestErasureStorage(t)
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	s.Put("b", "k", data)
+	paths := s.shardPaths("b", "k")
+
+	// One shard is lost and one rots, parity covers both
+	os.Remove(paths[0])
+	shard, _ := os.ReadFile(paths[3])
+	shard[len(shard)-1] ^= 0xff
+	os.WriteFile(paths[3], shard, 0o644)
+	got, err := s.Get("b", "k")
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("expected a degraded read to succeed (err %v)", err)
+	}
+
+	healed, err := s.Heal(context.Background())
+	if err != nil || healed != 2 {
+		t.Fatalf("expected 2 healed shards, got %d (err %v)", healed, err)
+	}
+	if set, err := s.read("b", "k", true); err != nil || len(set.damaged) != 0 {
+		t.Fatalf("expected every shard to be intact after healing (err %v)", err)
+	}
+
+	// A shard left over from a previous version is rewritten as well
+	previous, _ := os.ReadFile(paths[5])
+	s.Put("b", "k", []byte("v2"))
+	os.WriteFile(paths[5], previous, 0o644)
+	if got, _ := s.Get("b", "k"); string(got) != "v2" {
+		t.Errorf("expected v2, got %q", got)
+	}
+	if healed, _ := s.healObject("b", "k"); healed != 1 {
+		t.Errorf("expected the stale shard to be healed, got %d", healed)
+	}
+
+	// Beyond the parity shards, the object is lost
+	for _, path := range paths[:3] {
+		os.Remove(path)
+	}
+	if _, err := s.Get("b", "k"); !errors.Is(err, ErrNotEnoughShards) {
+		t.Errorf("expected ErrNotEnoughShards, got %v", err)
+	}
+}
+
+func TestNewErasureStorage_Validation(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	if _, err := NewErasureStorage(dirs, 2, 2); err == nil {
+		t.Errorf("expected 4 shards on 3 directories to be rejected")
+	}
+	if _, err := NewErasureStorage(dirs, 2, 0); err == nil {
+		t.Errorf("expected missing parity to be rejected")
+	}
+}
+
+func TestErasureStorage_UpdateMetadata(t *testing.T) {
+	checkUpdateMetadata(t, newTestErasureStorage(t), "cat.png", []byte("hello erasure coded world"))
+}
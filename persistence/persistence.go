@@ -2,53 +2,97 @@ package persistence
 
 import (
 	"bytes"
+	"maps"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/DanielePalaia/object-storage-service/domain"
 )
 
+type object struct {
+	data    []byte
+	meta    domain.Metadata
+	modTime time.Time
+}
+
 type InMemoryStorage struct {
 	mu      sync.RWMutex
-	buckets map[string]map[string][]byte // bucket -> objectID -> data
+	buckets map[string]map[string]object // bucket -> objectID -> object
 }
 
 // NewInMemoryStorage initializes the in-memory storage
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		buckets: make(map[string]map[string][]byte),
+		buckets: make(map[string]map[string]object),
 	}
 }
 
 // Put stores the object if it doesn't already exist in the bucket otherwise it updates it
 func (s *InMemoryStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object together with its metadata
+func (s *InMemoryStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.buckets[bucket]; !ok {
-		s.buckets[bucket] = make(map[string][]byte)
+		s.buckets[bucket] = make(map[string]object)
 	}
 
 	if existing, exists := s.buckets[bucket][objectID]; exists {
-		if bytes.Equal(existing, data) {
+		if bytes.Equal(existing.data, data) && maps.Equal(existing.meta, meta) {
 			return false, nil
 		}
 	}
 
-	s.buckets[bucket][objectID] = data
+	s.buckets[bucket][objectID] = object{data: data, meta: meta.Clone(), modTime: time.Now().UTC()}
 	return true, nil
 }
 
 // Get retrieves the object data
 func (s *InMemoryStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata
+func (s *InMemoryStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	if objects, ok := s.buckets[bucket]; ok {
-		if data, ok := objects[objectID]; ok {
-			return data, nil
+		if obj, ok := objects[objectID]; ok {
+			return obj.data, obj.meta.Clone(), nil
 		}
 	}
-	return nil, domain.ErrNotFound
+	return nil, nil, domain.ErrNotFound
+}
+
+// Exists reports whether the object is stored
+func (s *InMemoryStorage) Exists(bucket, objectID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.buckets[bucket][objectID]
+	return ok, nil
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object
+func (s *InMemoryStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.buckets[bucket][objectID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	obj.meta = obj.meta.With(changes)
+	s.buckets[bucket][objectID] = obj
+	return nil
 }
 
 // Delete removes the object if it exists
@@ -64,3 +108,40 @@ func (s *InMemoryStorage) Delete(bucket, objectID string) error {
 	}
 	return domain.ErrNotFound
 }
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *InMemoryStorage) ListBuckets() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buckets := make([]string, 0, len(s.buckets))
+	for name, objects := range s.buckets {
+		if len(objects) > 0 {
+			buckets = append(buckets, name)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix
+func (s *InMemoryStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var infos []domain.ObjectInfo
+	for id, obj := range s.buckets[bucket] {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		infos = append(infos, domain.ObjectInfo{
+			Bucket:   bucket,
+			ID:       id,
+			Size:     int64(len(obj.data)),
+			ModTime:  obj.modTime,
+			Metadata: obj.meta.Clone(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
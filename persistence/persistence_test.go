@@ -2,6 +2,7 @@ package persistence
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -42,6 +43,38 @@ func TestInMemoryStorage_PutGetDelete(t *testing.T) {
 	}
 }
 
+// checkUpdateMetadata updates the metadata of an object of s and checks its
+// data and modification time are kept
+func checkUpdateMetadata(t *testing.T, s domain.Storage, objectID string, data []byte) {
+	t.Helper()
+	if _, err := domain.PutWithMetadata(s, "photos", objectID, data, domain.Metadata{"tags": "pet"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	before, err := s.(domain.Lister).ListObjects("photos", objectID)
+	if err != nil || len(before) != 1 {
+		t.Fatalf("ListObjects failed: %v (err %v)", before, err)
+	}
+	if err := domain.UpdateMetadata(s, "photos", objectID, domain.Metadata{"status": "done"}); err != nil {
+		t.Fatalf("UpdateMetadata failed: %v", err)
+	}
+
+	got, meta, err := domain.GetWithMetadata(s, "photos", objectID)
+	if err != nil || !bytes.Equal(got, data) || meta["tags"] != "pet" || meta["status"] != "done" {
+		t.Errorf("expected the data to be kept and the metadata merged, got %q %v (err %v)", got, meta, err)
+	}
+	after, _ := s.(domain.Lister).ListObjects("photos", objectID)
+	if len(after) != 1 || !after[0].ModTime.Equal(before[0].ModTime) {
+		t.Errorf("expected the modification time to be kept, got %v then %v", before, after)
+	}
+	if err := domain.UpdateMetadata(s, "photos", "missing", domain.Metadata{"status": "done"}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating a missing object, got %v", err)
+	}
+}
+
+func TestInMemoryStorage_UpdateMetadata(t *testing.T) {
+	checkUpdateMetadata(t, NewInMemoryStorage(), "cat.png", []byte("meow"))
+}
+
 func TestInMemoryStorage_Deduplication(t *testing.T) {
 	storage := NewInMemoryStorage()
 
@@ -0,0 +1,338 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var postgresRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "postgres_transaction_retries_total",
+	Help: "PostgreSQL transactions retried after a serialization failure or a deadlock.",
+})
+
+// postgresMigrations are the schema changes of the PostgreSQL storage,
+// applied in order once each. New changes are appended, applied ones are
+// never edited.
+var postgresMigrations = []string{
+	// 1: buckets, object metadata and object data split in chunks. Keys are
+	// compared bytewise so that listings by prefix are range scans of the
+	// primary key.
+	`CREATE TABLE buckets (
+		name       TEXT PRIMARY KEY,
+		created_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE objects (
+		bucket   TEXT NOT NULL REFERENCES buckets (name),
+		key      TEXT COLLATE "C" NOT NULL,
+		size     BIGINT NOT NULL,
+		checksum TEXT NOT NULL,
+		mod_time TIMESTAMPTZ NOT NULL,
+		metadata JSONB NOT NULL,
+		PRIMARY KEY (bucket, key)
+	);
+	CREATE TABLE object_chunks (
+		bucket TEXT NOT NULL,
+		key    TEXT COLLATE "C" NOT NULL,
+		seq    INTEGER NOT NULL,
+		data   BYTEA NOT NULL,
+		PRIMARY KEY (bucket, key, seq),
+		FOREIGN KEY (bucket, key) REFERENCES objects (bucket, key) ON DELETE CASCADE
+	);`,
+}
+
+const (
+	// postgresChunkSize is the size of the chunks object data is split in,
+	// keeping rows far below the limits of bytea values
+	postgresChunkSize = 1 << 20
+	// postgresMaxAttempts bounds the attempts of a transaction failing with
+	// a serialization failure
+	postgresMaxAttempts = 10
+	// postgresMigrationLock is the advisory lock serializing the migrations
+	// of instances started together
+	postgresMigrationLock = 0x6f626a73
+)
+
+// PostgresStorage is a domain.Storage keeping buckets and object metadata in
+// PostgreSQL tables, and object data as bytea chunks. Puts and deletes are
+// serializable transactions, retried when they conflict with concurrent ones.
+type PostgresStorage struct {
+	pool *pgxpool.Pool
+}
+
+// OpenPostgresStorage connects to the database of dsn and applies the pending
+// schema migrations. The connection pool is configured by the pool_*
+// parameters of dsn, such as pool_max_conns.
+func OpenPostgresStorage(ctx context.Context, dsn string) (*PostgresStorage, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &PostgresStorage{pool: pool}
+	if err := s.migrate(ctx, postgresMigrations); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("migrating the PostgreSQL schema: %w", err)
+	}
+	return s, nil
+}
+
+// migrate applies the migrations not recorded in schema_migrations, in a
+// transaction holding an advisory lock so that concurrent instances apply
+// them once
+func (s *PostgresStorage) migrate(ctx context.Context, migrations []string) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL
+		)`); err != nil {
+			return err
+		}
+		var current int
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+			return err
+		}
+		if current > len(migrations) {
+			return fmt.Errorf("database schema version %d is newer than the supported %d", current, len(migrations))
+		}
+		for version := current + 1; version <= len(migrations); version++ {
+			if _, err := tx.Exec(ctx, migrations[version-1]); err != nil {
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+			if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, now())`, version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// serializable runs fn in a serializable transaction, retrying it after a
+// growing random delay while it fails with a serialization failure or a
+// deadlock
+func (s *PostgresStorage) serializable(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	delay := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := pgx.BeginTxFunc(ctx, s.pool, pgx.TxOptions{IsoLevel: pgx.Serializable}, fn)
+		if err == nil || attempt == postgresMaxAttempts || !retryable(err) {
+			return err
+		}
+		postgresRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay/2 + rand.N(delay)):
+		}
+		delay = min(2*delay, time.Second)
+	}
+}
+
+// retryable reports serialization failures and deadlocks, which succeed
+// when the transaction is retried
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *PostgresStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata replaces the row and the chunks of the object in a transaction
+func (s *PostgresStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	ctx := context.Background()
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	meta = meta.Clone()
+
+	var created bool
+	err := s.serializable(ctx, func(tx pgx.Tx) error {
+		created = false
+		var (
+			currentChecksum string
+			currentMeta     domain.Metadata
+		)
+		err := tx.QueryRow(ctx, `SELECT checksum, metadata FROM objects WHERE bucket = $1 AND key = $2`, bucket, objectID).Scan(&currentChecksum, &currentMeta)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+		case err != nil:
+			return err
+		case currentChecksum == checksum && maps.Equal(currentMeta, meta):
+			return nil
+		}
+
+		now := time.Now().UTC()
+		if _, err := tx.Exec(ctx, `INSERT INTO buckets (name, created_at) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`, bucket, now); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO objects (bucket, key, size, checksum, mod_time, metadata)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (bucket, key) DO UPDATE SET
+				size = excluded.size, checksum = excluded.checksum,
+				mod_time = excluded.mod_time, metadata = excluded.metadata`,
+			bucket, objectID, len(data), checksum, now, meta); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM object_chunks WHERE bucket = $1 AND key = $2`, bucket, objectID); err != nil {
+			return err
+		}
+		rows := make([][]any, 0, len(data)/postgresChunkSize+1)
+		for seq, start := 0, 0; start < len(data); seq, start = seq+1, start+postgresChunkSize {
+			rows = append(rows, []any{bucket, objectID, seq, data[start:min(start+postgresChunkSize, len(data))]})
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"object_chunks"}, []string{"bucket", "key", "seq", "data"}, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// Get retrieves the object data
+func (s *PostgresStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata. The row and
+// its chunks are read by a single statement, from the same snapshot.
+func (s *PostgresStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT o.size, o.metadata, c.data
+		FROM objects o LEFT JOIN object_chunks c ON c.bucket = o.bucket AND c.key = o.key
+		WHERE o.bucket = $1 AND o.key = $2
+		ORDER BY c.seq`, bucket, objectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		data  []byte
+		meta  domain.Metadata
+		found bool
+	)
+	for rows.Next() {
+		var (
+			size  int64
+			chunk []byte
+		)
+		if err := rows.Scan(&size, &meta, &chunk); err != nil {
+			return nil, nil, err
+		}
+		if !found {
+			data = make([]byte, 0, size)
+			found = true
+		}
+		data = append(data, chunk...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, domain.ErrNotFound
+	}
+	return data, meta, nil
+}
+
+// Exists reports whether the row of the object exists, without reading its chunks
+func (s *PostgresStorage) Exists(bucket, objectID string) (bool, error) {
+	var exists bool
+	err := s.pool.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM objects WHERE bucket = $1 AND key = $2)`,
+		bucket, objectID).Scan(&exists)
+	return exists, err
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object, without touching its chunks
+func (s *PostgresStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	tag, err := s.pool.Exec(context.Background(), `UPDATE objects SET metadata = metadata || $3 WHERE bucket = $1 AND key = $2`,
+		bucket, objectID, changes.Clone())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes the object and its chunks in a transaction, with its
+// bucket once empty
+func (s *PostgresStorage) Delete(bucket, objectID string) error {
+	ctx := context.Background()
+	return s.serializable(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM objects WHERE bucket = $1 AND key = $2`, bucket, objectID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return domain.ErrNotFound
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM buckets WHERE name = $1 AND NOT EXISTS (SELECT 1 FROM objects WHERE bucket = $1)`, bucket)
+		return err
+	})
+}
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *PostgresStorage) ListBuckets() ([]string, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT name FROM buckets ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if buckets == nil {
+		buckets = []string{}
+	}
+	return buckets, err
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix,
+// read as a range of the primary key
+func (s *PostgresStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	query := `SELECT key, size, mod_time, metadata FROM objects WHERE bucket = $1 AND key >= $2`
+	args := []any{bucket, prefix}
+	// Text values must be valid UTF-8, the bound is otherwise replaced by a filter
+	if end, ok := prefixEnd(prefix); ok && utf8.ValidString(end) {
+		query += ` AND key < $3`
+		args = append(args, end)
+	} else if prefix != "" {
+		query += ` AND starts_with(key, $2)`
+	}
+	rows, err := s.pool.Query(context.Background(), query+` ORDER BY key`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []domain.ObjectInfo
+	for rows.Next() {
+		info := domain.ObjectInfo{Bucket: bucket}
+		if err := rows.Scan(&info.ID, &info.Size, &info.ModTime, &info.Metadata); err != nil {
+			return nil, err
+		}
+		info.ModTime = info.ModTime.UTC()
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// Close closes the connections of the pool
+func (s *PostgresStorage) Close() {
+	s.pool.Close()
+}
@@ -0,0 +1,183 @@
+//go:build postgres
+
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/jackc/pgx/v5"
+)
+
+// These integration tests run with "go test -tags postgres". They use the
+// database of POSTGRES_TEST_DSN, dropping its tables, or spawn a server with
+// the initdb and postgres binaries found in PATH or the PostgreSQL install
+// directories.
+
+// postgresDSN returns the DSN of an empty test database
+func postgresDSN(t *testing.T) string {
+	t.Helper()
+	if dsn := os.Getenv("POSTGRES_TEST_DSN"); dsn != "" {
+		conn, err := pgx.Connect(context.Background(), dsn)
+		if err != nil {
+			t.Fatalf("connecting to POSTGRES_TEST_DSN failed: %v", err)
+		}
+		defer conn.Close(context.Background())
+		if _, err := conn.Exec(context.Background(), `DROP TABLE IF EXISTS object_chunks, objects, buckets, schema_migrations`); err != nil {
+			t.Fatalf("resetting the test database failed: %v", err)
+		}
+		return dsn
+	}
+	return spawnPostgres(t)
+}
+
+// spawnPostgres starts a throwaway server in a temporary directory
+func spawnPostgres(t *testing.T) string {
+	t.Helper()
+	initdb, postgres := findPostgres()
+	if initdb == "" {
+		t.Skip("no PostgreSQL binaries found, set POSTGRES_TEST_DSN")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("PostgreSQL refuses to run as root, set POSTGRES_TEST_DSN")
+	}
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "--auth=trust", "-E", "UTF8").CombinedOutput(); err != nil {
+		t.Fatalf("initdb failed: %v\n%s", err, out)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port failed: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cmd := exec.Command(postgres, "-D", data, "-p", fmt.Sprint(port), "-k", dir,
+		"-c", "listen_addresses=127.0.0.1", "-c", "fsync=off")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting postgres failed: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+	})
+
+	dsn := fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		conn, err := pgx.Connect(context.Background(), dsn)
+		if err == nil {
+			conn.Close(context.Background())
+			return dsn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("postgres did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func findPostgres() (initdb, postgres string) {
+	if path, err := exec.LookPath("initdb"); err == nil {
+		return path, filepath.Join(filepath.Dir(path), "postgres")
+	}
+	matches, _ := filepath.Glob("/usr/lib/postgresql/*/bin/initdb")
+	if len(matches) == 0 {
+		return "", ""
+	}
+	path := matches[len(matches)-1]
+	return path, filepath.Join(filepath.Dir(path), "postgres")
+}
+
+func TestPostgresStorage(t *testing.T) {
+	dsn := postgresDSN(t)
+	s, err := OpenPostgresStorage(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("OpenPostgresStorage failed: %v", err)
+	}
+	defer s.Close()
+
+	// Large objects span several chunks
+	large := bytes.Repeat([]byte("0123456789"), postgresChunkSize/4)
+	created, err := s.PutWithMetadata("photos", "2024/cat.png", large, domain.Metadata{"tags": "pet"})
+	if err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("photos", "2024/cat.png", large, domain.Metadata{"tags": "pet"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	data, meta, err := s.GetWithMetadata("photos", "2024/cat.png")
+	if err != nil || !bytes.Equal(data, large) || meta["tags"] != "pet" {
+		t.Fatalf("unexpected object of %d bytes %v (err %v)", len(data), meta, err)
+	}
+	s.Put("photos", "2024/cat.png", []byte("meow"))
+	s.Put("photos", "2024/dog.png", []byte("woof"))
+	s.Put("photos", "2025/empty", nil)
+	if data, err := s.Get("photos", "2024/cat.png"); err != nil || string(data) != "meow" {
+		t.Errorf("expected the overwritten object, got %q (err %v)", data, err)
+	}
+	if data, err := s.Get("photos", "2025/empty"); err != nil || len(data) != 0 {
+		t.Errorf("expected an empty object, got %q (err %v)", data, err)
+	}
+	infos, err := s.ListObjects("photos", "2024/")
+	if err != nil || len(infos) != 2 || infos[0].ID != "2024/cat.png" || infos[0].Size != 4 {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+
+	for _, key := range []string{"2024/cat.png", "2024/dog.png", "2025/empty"} {
+		if err := s.Delete("photos", key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if _, err := s.Get("photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Delete("photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if buckets, _ := s.ListBuckets(); len(buckets) != 0 {
+		t.Errorf("expected the empty bucket to be removed, got %v", buckets)
+	}
+
+	// Reopening applies no migration twice
+	again, err := OpenPostgresStorage(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	again.Close()
+}
+
+func TestPostgresStorage_ConcurrentWrites(t *testing.T) {
+	s, err := OpenPostgresStorage(context.Background(), postgresDSN(t))
+	if err != nil {
+		t.Fatalf("OpenPostgresStorage failed: %v", err)
+	}
+	defer s.Close()
+
+	// Conflicting transactions are retried rather than failed
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Put("hot", fmt.Sprint("key-", i%2), []byte(fmt.Sprint(i))); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	infos, err := s.ListObjects("hot", "")
+	if err != nil || len(infos) != 2 {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+}
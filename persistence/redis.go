@@ -0,0 +1,388 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis layout, every key starting with the configured prefix and bucket
+// names being query-escaped so that they contain no ':':
+//
+//	o:<bucket>:<key>      hash of the object size, checksum, modification
+//	                      time, metadata (JSON) and number of chunks
+//	c:<bucket>:<n>:<key>  string holding the n-th chunk of the object data
+//	i:<bucket>            sorted set of the object keys, all scored 0 so that
+//	                      they are ordered bytewise for listings by prefix
+//	buckets               set of the buckets holding objects
+//
+// The scripts derive the chunk keys from the object, so the keys of an object
+// must live on a single Redis server.
+
+// redisPut replaces the object unless it has the same checksum and metadata,
+// returning 1 if it was written.
+// KEYS: object, index, buckets.
+// ARGV: checksum, metadata, size, mod time, expiry (unix ms, 0 for none),
+// chunk prefix, key, bucket, chunks...
+var redisPut = redis.NewScript(`
+local current = redis.call('HMGET', KEYS[1], 'checksum', 'metadata', 'chunks')
+if current[1] == ARGV[1] and current[2] == ARGV[2] then
+	return 0
+end
+local chunks = #ARGV - 8
+for n = chunks, (tonumber(current[3]) or 0) - 1 do
+	redis.call('DEL', ARGV[6] .. n .. ':' .. ARGV[7])
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'checksum', ARGV[1], 'metadata', ARGV[2], 'size', ARGV[3], 'mod_time', ARGV[4], 'chunks', chunks)
+local expiry = tonumber(ARGV[5])
+if expiry > 0 then
+	redis.call('PEXPIREAT', KEYS[1], expiry)
+end
+for n = 0, chunks - 1 do
+	local chunk = ARGV[6] .. n .. ':' .. ARGV[7]
+	redis.call('SET', chunk, ARGV[9 + n])
+	if expiry > 0 then
+		redis.call('PEXPIREAT', chunk, expiry)
+	end
+end
+redis.call('ZADD', KEYS[2], 0, ARGV[7])
+redis.call('SADD', KEYS[3], ARGV[8])
+return 1
+`)
+
+// redisGet returns the metadata and the chunks of the object, or nil.
+// KEYS: object. ARGV: chunk prefix, key.
+var redisGet = redis.NewScript(`
+local current = redis.call('HMGET', KEYS[1], 'metadata', 'chunks')
+if not current[1] then
+	return false
+end
+local result = {current[1]}
+for n = 0, tonumber(current[2]) - 1 do
+	result[n + 2] = redis.call('GET', ARGV[1] .. n .. ':' .. ARGV[2]) or ''
+end
+return result
+`)
+
+// redisDelete removes the object, and the bucket once empty, returning 1 if
+// the object existed.
+// KEYS: object, index, buckets. ARGV: chunk prefix, key, bucket.
+var redisDelete = redis.NewScript(`
+local chunks = redis.call('HGET', KEYS[1], 'chunks')
+if chunks then
+	for n = 0, tonumber(chunks) - 1 do
+		redis.call('DEL', ARGV[1] .. n .. ':' .. ARGV[2])
+	end
+	redis.call('DEL', KEYS[1])
+end
+redis.call('ZREM', KEYS[2], ARGV[2])
+if redis.call('ZCARD', KEYS[2]) == 0 then
+	redis.call('SREM', KEYS[3], ARGV[3])
+end
+if chunks then
+	return 1
+end
+return 0
+`)
+
+// redisUpdateMetadata replaces the metadata of the object if it is still the
+// one read, returning 1, 0 when it changed meanwhile and -1 when the object
+// does not exist. A positive expiry is applied to the object keys.
+// KEYS: object. ARGV: current metadata, new metadata, expiry, chunk prefix, key.
+var redisUpdateMetadata = redis.NewScript(`
+local current = redis.call('HMGET', KEYS[1], 'metadata', 'chunks')
+if not current[1] then
+	return -1
+end
+if current[1] ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'metadata', ARGV[2])
+local expiry = tonumber(ARGV[3])
+if expiry > 0 then
+	redis.call('PEXPIREAT', KEYS[1], expiry)
+	for n = 0, tonumber(current[2]) - 1 do
+		redis.call('PEXPIREAT', ARGV[4] .. n .. ':' .. ARGV[5], expiry)
+	end
+end
+return 1
+`)
+
+// redisPrune removes from the index the keys of expired objects, and the
+// bucket once empty.
+// KEYS: index, buckets. ARGV: object prefix, bucket, keys...
+var redisPrune = redis.NewScript(`
+for i = 3, #ARGV do
+	if redis.call('EXISTS', ARGV[1] .. ARGV[i]) == 0 then
+		redis.call('ZREM', KEYS[1], ARGV[i])
+	end
+end
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[2], ARGV[2])
+end
+return 0
+`)
+
+// errConcurrentUpdate is returned when the metadata of an object keeps changing during an update
+var errConcurrentUpdate = errors.New("object metadata changed concurrently")
+
+// RedisConfig tunes a RedisStorage
+type RedisConfig struct {
+	// Prefix is prepended to every key, so that several storages share a database
+	Prefix string
+	// ChunkSize is the size of the chunks object data is split in
+	ChunkSize int
+	// Expiry returns when an object expires according to its metadata, its
+	// keys are then given a Redis TTL. Nil stores every object without TTL.
+	Expiry func(domain.Metadata) (time.Time, bool)
+}
+
+// DefaultRedisConfig splits objects in chunks of 1 MiB
+var DefaultRedisConfig = RedisConfig{ChunkSize: 1 << 20}
+
+// RedisStorage is a domain.Storage keeping objects in Redis, as a hash per
+// object with its data split in string chunks. Puts and deletes are Lua
+// scripts, so that they apply atomically.
+type RedisStorage struct {
+	client redis.UniversalClient
+	config RedisConfig
+}
+
+// NewRedisStorage creates a storage on client
+func NewRedisStorage(client redis.UniversalClient, config RedisConfig) *RedisStorage {
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = DefaultRedisConfig.ChunkSize
+	}
+	return &RedisStorage{client: client, config: config}
+}
+
+func (s *RedisStorage) objectPrefix(bucket string) string {
+	return s.config.Prefix + "o:" + url.QueryEscape(bucket) + ":"
+}
+
+func (s *RedisStorage) chunkPrefix(bucket string) string {
+	return s.config.Prefix + "c:" + url.QueryEscape(bucket) + ":"
+}
+
+func (s *RedisStorage) indexKey(bucket string) string {
+	return s.config.Prefix + "i:" + url.QueryEscape(bucket)
+}
+
+func (s *RedisStorage) bucketsKey() string {
+	return s.config.Prefix + "buckets"
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *RedisStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata replaces the object unless it is unchanged, giving its keys
+// a TTL when the metadata sets an expiry
+func (s *RedisStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	encoded, err := json.Marshal(meta.Clone())
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	var expiry int64
+	if s.config.Expiry != nil {
+		if t, ok := s.config.Expiry(meta); ok {
+			// PEXPIREAT 0 would mean no expiry
+			expiry = max(t.UnixMilli(), 1)
+		}
+	}
+
+	args := []any{hex.EncodeToString(sum[:]), encoded, len(data), time.Now().UnixNano(), expiry,
+		s.chunkPrefix(bucket), objectID, bucket}
+	for start := 0; start < len(data); start += s.config.ChunkSize {
+		args = append(args, data[start:min(start+s.config.ChunkSize, len(data))])
+	}
+	keys := []string{s.objectPrefix(bucket) + objectID, s.indexKey(bucket), s.bucketsKey()}
+	written, err := redisPut.Run(context.Background(), s.client, keys, args...).Int()
+	return written == 1, err
+}
+
+// Get retrieves the object data
+func (s *RedisStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata
+func (s *RedisStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	result, err := redisGet.Run(context.Background(), s.client,
+		[]string{s.objectPrefix(bucket) + objectID}, s.chunkPrefix(bucket), objectID).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil, domain.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := domain.Metadata{}
+	if err := json.Unmarshal([]byte(result[0]), &meta); err != nil {
+		return nil, nil, err
+	}
+	var size int
+	for _, chunk := range result[1:] {
+		size += len(chunk)
+	}
+	data := make([]byte, 0, size)
+	for _, chunk := range result[1:] {
+		data = append(data, chunk...)
+	}
+	return data, meta, nil
+}
+
+// Exists reports whether the key of the object exists, without reading its chunks
+func (s *RedisStorage) Exists(bucket, objectID string) (bool, error) {
+	n, err := s.client.Exists(context.Background(), s.objectPrefix(bucket)+objectID).Result()
+	return n > 0, err
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object,
+// leaving its chunks untouched. The metadata is read then replaced if it did
+// not change meanwhile, concurrent updates are retried.
+func (s *RedisStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	ctx := context.Background()
+	key := s.objectPrefix(bucket) + objectID
+	for attempt := 0; attempt < 5; attempt++ {
+		current, err := s.client.HGet(ctx, key, "metadata").Result()
+		if errors.Is(err, redis.Nil) {
+			return domain.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		meta := domain.Metadata{}
+		if err := json.Unmarshal([]byte(current), &meta); err != nil {
+			return err
+		}
+		meta = meta.With(changes)
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		var expiry int64
+		if s.config.Expiry != nil {
+			if t, ok := s.config.Expiry(meta); ok {
+				expiry = max(t.UnixMilli(), 1)
+			}
+		}
+
+		updated, err := redisUpdateMetadata.Run(ctx, s.client, []string{key},
+			current, encoded, expiry, s.chunkPrefix(bucket), objectID).Int()
+		if err != nil {
+			return err
+		}
+		switch updated {
+		case 1:
+			return nil
+		case -1:
+			return domain.ErrNotFound
+		}
+	}
+	return errConcurrentUpdate
+}
+
+// Delete removes the object, with its bucket once empty
+func (s *RedisStorage) Delete(bucket, objectID string) error {
+	keys := []string{s.objectPrefix(bucket) + objectID, s.indexKey(bucket), s.bucketsKey()}
+	deleted, err := redisDelete.Run(context.Background(), s.client, keys, s.chunkPrefix(bucket), objectID, bucket).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *RedisStorage) ListBuckets() ([]string, error) {
+	buckets, err := s.client.SMembers(context.Background(), s.bucketsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix,
+// read as a range of the bucket index. Objects expired by Redis are removed
+// from the index when they are listed.
+func (s *RedisStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	ctx := context.Background()
+	by := &redis.ZRangeBy{Min: "-", Max: "+"}
+	if prefix != "" {
+		by.Min = "[" + prefix
+		if end, ok := prefixEnd(prefix); ok {
+			by.Max = "(" + end
+		}
+	}
+	keys, err := s.client.ZRangeByLex(ctx, s.indexKey(bucket), by).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	objectPrefix := s.objectPrefix(bucket)
+	cmds := make([]*redis.SliceCmd, len(keys))
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HMGet(ctx, objectPrefix+key, "size", "mod_time", "metadata")
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var (
+		infos   []domain.ObjectInfo
+		expired []any
+	)
+	for i, cmd := range cmds {
+		values := cmd.Val()
+		if values[0] == nil {
+			expired = append(expired, keys[i])
+			continue
+		}
+		info := domain.ObjectInfo{Bucket: bucket, ID: keys[i], Metadata: domain.Metadata{}}
+		size, _ := values[0].(string)
+		modTime, _ := values[1].(string)
+		meta, _ := values[2].(string)
+		if info.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return nil, err
+		}
+		nanos, err := strconv.ParseInt(modTime, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		info.ModTime = time.Unix(0, nanos).UTC()
+		if err := json.Unmarshal([]byte(meta), &info.Metadata); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	if len(expired) > 0 {
+		args := append([]any{objectPrefix, bucket}, expired...)
+		if err := redisPrune.Run(ctx, s.client, []string{s.indexKey(bucket), s.bucketsKey()}, args...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// Close closes the connections of the client
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
+}
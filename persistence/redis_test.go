@@ -0,0 +1,125 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T, config RedisConfig) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	s := NewRedisStorage(redis.NewClient(&redis.Options{Addr: server.Addr()}), config)
+	t.Cleanup(func() { s.Close() })
+	return s, server
+}
+
+func TestRedisStorage_PutGetDelete(t *testing.T) {
+	s, server := newTestRedis(t, RedisConfig{Prefix: "test:", ChunkSize: 4})
+
+	created, err := s.PutWithMetadata("photos", "2024/cat.png", []byte("0123456789"), domain.Metadata{"tags": "pet"})
+	if err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("photos", "2024/cat.png", []byte("0123456789"), domain.Metadata{"tags": "pet"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	data, meta, err := s.GetWithMetadata("photos", "2024/cat.png")
+	if err != nil || string(data) != "0123456789" || meta["tags"] != "pet" {
+		t.Fatalf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+	if !server.Exists("test:c:photos:2:2024/cat.png") {
+		t.Errorf("expected the data in 3 chunks, got keys %v", server.Keys())
+	}
+
+	// Overwriting with less chunks removes the others
+	s.Put("photos", "2024/cat.png", []byte("meow"))
+	if server.Exists("test:c:photos:1:2024/cat.png") {
+		t.Errorf("expected the chunks of the previous data to be removed, got keys %v", server.Keys())
+	}
+	s.Put("photos", "2024/dog.png", []byte("woof"))
+	s.Put("photos", "2025/empty", nil)
+	if data, err := s.Get("photos", "2025/empty"); err != nil || len(data) != 0 {
+		t.Errorf("expected an empty object, got %q (err %v)", data, err)
+	}
+	infos, err := s.ListObjects("photos", "2024/")
+	if err != nil || len(infos) != 2 || infos[0].ID != "2024/cat.png" || infos[0].Size != 4 || infos[1].ID != "2024/dog.png" {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+
+	for _, key := range []string{"2024/cat.png", "2024/dog.png", "2025/empty"} {
+		if err := s.Delete("photos", key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if _, err := s.Get("photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Delete("photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("expected no key left, got %v", keys)
+	}
+}
+
+func TestRedisStorage_Expiry(t *testing.T) {
+	expiry := func(meta domain.Metadata) (time.Time, bool) {
+		t, err := time.Parse(time.RFC3339, meta["expires"])
+		return t, err == nil
+	}
+	s, server := newTestRedis(t, RedisConfig{ChunkSize: 4, Expiry: expiry})
+
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	s.PutWithMetadata("photos", "temporary", bytes.Repeat([]byte("x"), 10), domain.Metadata{"expires": expires})
+	s.Put("photos", "permanent", []byte("data"))
+	if ttl := server.TTL("o:photos:temporary"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("unexpected TTL %v", ttl)
+	}
+	if ttl := server.TTL("c:photos:2:temporary"); ttl <= 0 {
+		t.Errorf("expected the chunks to expire, got TTL %v", ttl)
+	}
+	if ttl := server.TTL("o:photos:permanent"); ttl != 0 {
+		t.Errorf("expected no TTL, got %v", ttl)
+	}
+
+	server.FastForward(2 * time.Hour)
+	if _, err := s.Get("photos", "temporary"); err != domain.ErrNotFound {
+		t.Errorf("expected the object to expire, got %v", err)
+	}
+	infos, err := s.ListObjects("photos", "")
+	if err != nil || len(infos) != 1 || infos[0].ID != "permanent" {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+	// Listing removed the expired object from the index
+	s.Delete("photos", "permanent")
+	if buckets, _ := s.ListBuckets(); len(buckets) != 0 {
+		t.Errorf("expected the empty bucket to be removed, got %v", buckets)
+	}
+}
+
+func TestRedisStorage_ConcurrentWrites(t *testing.T) {
+	s, _ := newTestRedis(t, DefaultRedisConfig)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Put(fmt.Sprint("bucket-", i%3), fmt.Sprint("key-", i), []byte(fmt.Sprint(i))); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	buckets, _ := s.ListBuckets()
+	infos, _ := s.ListObjects("bucket-0", "")
+	if len(buckets) != 3 || len(infos) != 7 {
+		t.Errorf("unexpected buckets %v and objects %+v", buckets, infos)
+	}
+}
@@ -0,0 +1,894 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errSegmentStorageClosed is returned by the operations of a closed SegmentStorage
+var errSegmentStorageClosed = errors.New("segment storage is closed")
+
+var (
+	compactedSegments = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "segment_compacted_segments_total",
+		Help: "Segments rewritten by the compaction.",
+	})
+	reclaimedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "segment_reclaimed_bytes_total",
+		Help: "Bytes of overwritten and deleted objects reclaimed by the compaction.",
+	})
+)
+
+// SegmentConfig configures a SegmentStorage, zero values select the defaults
+type SegmentConfig struct {
+	// SegmentSize is the size of the segment files, 256 MiB by default
+	SegmentSize int64
+	// MaxNeedleSize is the size above which objects are stored in their own
+	// blob file rather than in a segment, 1 MiB by default
+	MaxNeedleSize int64
+	// CompactionRatio is the share of dead bytes from which a segment is
+	// compacted, 0.5 by default
+	CompactionRatio float64
+}
+
+const (
+	needleSegmentExt = ".seg"
+	blobExt          = ".blob"
+	blobDir          = "blobs"
+
+	// needleMagic starts every needle, "NDL1"
+	needleMagic uint32 = 0x4e444c31
+	// needlePrefixSize is the size of the magic, the CRC-32C and the length
+	// preceding the body of a needle
+	needlePrefixSize = 12
+	// needleHeaderSize is the size of the fixed fields of the body: kind,
+	// sequence number, modification time and the lengths of the bucket, key
+	// and metadata
+	needleHeaderSize = 1 + 8 + 8 + 2 + 2 + 4
+
+	needlePut       byte = 1
+	needleTombstone byte = 2
+	// needleBlob records an object whose data is in a blob file, its data is
+	// the ID of the blob and the size of the object
+	needleBlob byte = 3
+)
+
+// needle is an entry of a segment: an object, a reference to a blob file or
+// the tombstone of a deleted object
+type needle struct {
+	kind byte
+	// seq orders the needles of an object, needles keep it when compacted
+	seq     uint64
+	modTime time.Time
+	bucket  string
+	key     string
+	meta    domain.Metadata
+	data    []byte
+}
+
+// encode lays out the needle: the magic, the CRC-32C and the length of the
+// body, then the body made of the fixed fields, the bucket, the key, the
+// JSON metadata and the data
+func (n *needle) encode() ([]byte, error) {
+	if len(n.bucket) > 0xffff || len(n.key) > 0xffff {
+		return nil, errors.New("bucket and object names are limited to 65535 bytes")
+	}
+	var meta []byte
+	if len(n.meta) > 0 {
+		var err error
+		if meta, err = json.Marshal(n.meta); err != nil {
+			return nil, err
+		}
+	}
+	size := needleHeaderSize + len(n.bucket) + len(n.key) + len(meta) + len(n.data)
+	buf := make([]byte, needlePrefixSize, needlePrefixSize+size)
+	binary.BigEndian.PutUint32(buf, needleMagic)
+	binary.BigEndian.PutUint32(buf[8:], uint32(size))
+	buf = append(buf, n.kind)
+	buf = binary.BigEndian.AppendUint64(buf, n.seq)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(n.modTime.UnixNano()))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(n.bucket)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(n.key)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(meta)))
+	buf = append(buf, n.bucket...)
+	buf = append(buf, n.key...)
+	buf = append(buf, meta...)
+	buf = append(buf, n.data...)
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(buf[needlePrefixSize:], walCRC))
+	return buf, nil
+}
+
+// decodeNeedle parses an encoded needle, verifying its checksum
+func decodeNeedle(buf []byte) (*needle, error) {
+	if len(buf) < needlePrefixSize+needleHeaderSize || binary.BigEndian.Uint32(buf) != needleMagic {
+		return nil, errTornRecord
+	}
+	body := buf[needlePrefixSize:]
+	if int(binary.BigEndian.Uint32(buf[8:])) != len(body) || crc32.Checksum(body, walCRC) != binary.BigEndian.Uint32(buf[4:]) {
+		return nil, errTornRecord
+	}
+	n := &needle{
+		kind:    body[0],
+		seq:     binary.BigEndian.Uint64(body[1:]),
+		modTime: time.Unix(0, int64(binary.BigEndian.Uint64(body[9:]))).UTC(),
+	}
+	bucketLen := int(binary.BigEndian.Uint16(body[17:]))
+	keyLen := int(binary.BigEndian.Uint16(body[19:]))
+	metaLen := int(binary.BigEndian.Uint32(body[21:]))
+	rest := body[needleHeaderSize:]
+	if bucketLen+keyLen+metaLen > len(rest) {
+		return nil, errTornRecord
+	}
+	n.bucket = string(rest[:bucketLen])
+	n.key = string(rest[bucketLen : bucketLen+keyLen])
+	if metaLen > 0 {
+		if err := json.Unmarshal(rest[bucketLen+keyLen:bucketLen+keyLen+metaLen], &n.meta); err != nil {
+			return nil, errTornRecord
+		}
+	}
+	n.data = rest[bucketLen+keyLen+metaLen:]
+	return n, nil
+}
+
+// segmentFile is an append-only file of needles
+type segmentFile struct {
+	id   uint64
+	path string
+	f    *os.File
+	size int64
+	// dead is the size of the needles overwritten, deleted or tombstones
+	dead int64
+}
+
+// scan reads the needles of the segment, calling fn for each with its offset
+// and size. It returns the offset following the last valid needle, and
+// errTornRecord when it is not the end of the file.
+func (seg *segmentFile) scan(fn func(n *needle, offset, size int64) error) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(seg.f, 0, seg.size))
+	prefix := make([]byte, needlePrefixSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(r, prefix); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errTornRecord
+		}
+		length := int64(binary.BigEndian.Uint32(prefix[8:]))
+		if binary.BigEndian.Uint32(prefix) != needleMagic || offset+needlePrefixSize+length > seg.size {
+			return offset, errTornRecord
+		}
+		buf := make([]byte, needlePrefixSize+length)
+		copy(buf, prefix)
+		if _, err := io.ReadFull(r, buf[needlePrefixSize:]); err != nil {
+			return offset, errTornRecord
+		}
+		n, err := decodeNeedle(buf)
+		if err != nil {
+			return offset, err
+		}
+		if err := fn(n, offset, int64(len(buf))); err != nil {
+			return offset, err
+		}
+		offset += int64(len(buf))
+	}
+}
+
+// needleLoc locates the live needle of an object in the index
+type needleLoc struct {
+	segment *segmentFile
+	offset  int64
+	// length is the size of the encoded needle
+	length  int64
+	kind    byte
+	seq     uint64
+	blob    uint64
+	size    int64
+	meta    domain.Metadata
+	modTime time.Time
+}
+
+// SegmentStorage is a domain.Storage for large numbers of small objects,
+// packed as needles into large append-only segment files rather than stored
+// one file per object. An in-memory index locates the needle of every
+// object, deletes append tombstones, and the compaction rewrites the live
+// needles of segments with much dead space before removing them. Objects
+// larger than MaxNeedleSize are stored in their own blob file, referenced by
+// a needle. Writes are acknowledged once flushed, concurrent writes sharing
+// a flush.
+type SegmentStorage struct {
+	dir    string
+	config SegmentConfig
+
+	// compactMu serializes compactions, syncMu the flushes. They are
+	// acquired before mu.
+	compactMu sync.Mutex
+	syncMu    sync.Mutex
+	synced    uint64
+
+	mu       sync.RWMutex
+	index    map[string]map[string]needleLoc
+	segments []*segmentFile // the last one is active
+	seq      uint64
+	written  uint64
+	err      error
+}
+
+// OpenSegmentStorage opens the segments stored in dir, creating the
+// directory if needed, and rebuilds the needle index from them
+func OpenSegmentStorage(dir string, config SegmentConfig) (*SegmentStorage, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = 256 << 20
+	}
+	if config.MaxNeedleSize <= 0 {
+		config.MaxNeedleSize = 1 << 20
+	}
+	if config.CompactionRatio <= 0 {
+		config.CompactionRatio = 0.5
+	}
+	if err := os.MkdirAll(filepath.Join(dir, blobDir), 0o755); err != nil {
+		return nil, err
+	}
+	s := &SegmentStorage{
+		dir:    dir,
+		config: config,
+		index:  make(map[string]map[string]needleLoc),
+	}
+	if err := s.recover(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover replays the segments, truncating a needle left incomplete by a
+// crash at the tail of the last one, and removes the blob files which no
+// needle references
+func (s *SegmentStorage) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if filepath.Ext(name) != needleSegmentExt {
+			continue
+		}
+		if id, err := strconv.ParseUint(strings.TrimSuffix(name, needleSegmentExt), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Compaction moves needles to newer segments, so the sequence numbers
+	// rather than the order of the segments tell the latest needle
+	deleted := make(map[objectRef]uint64)
+	for i, id := range ids {
+		seg, err := s.openSegment(id, os.O_RDWR|os.O_APPEND)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		end, err := seg.scan(func(n *needle, offset, length int64) error {
+			s.replay(seg, n, offset, length, deleted)
+			return nil
+		})
+		if err == nil {
+			continue
+		}
+		if i < len(ids)-1 {
+			return fmt.Errorf("segment %s is damaged at offset %d: %w", seg.path, end, domain.ErrCorrupt)
+		}
+		log.Printf("Segments: discarding %d bytes of an incomplete needle at the tail of %s", seg.size-end, seg.path)
+		if err := seg.f.Truncate(end); err != nil {
+			return err
+		}
+		if err := seg.f.Sync(); err != nil {
+			return err
+		}
+		seg.size = end
+	}
+	if len(s.segments) == 0 {
+		seg, err := s.openSegment(1, os.O_RDWR|os.O_APPEND|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+	return s.removeOrphanBlobs()
+}
+
+// replay applies a needle read from a segment to the index
+func (s *SegmentStorage) replay(seg *segmentFile, n *needle, offset, length int64, deleted map[objectRef]uint64) {
+	s.seq = max(s.seq, n.seq)
+	if n.kind == needleBlob && len(n.data) == 16 {
+		s.seq = max(s.seq, binary.BigEndian.Uint64(n.data))
+	}
+	ref := objectRef{n.bucket, n.key}
+	current, live := s.index[n.bucket][n.key]
+	if (live && n.seq <= current.seq) || n.seq <= deleted[ref] {
+		// Superseded, or a copy left by an interrupted compaction
+		seg.dead += length
+		return
+	}
+	if live {
+		current.segment.dead += current.length
+	}
+	if n.kind == needleTombstone {
+		deleted[ref] = n.seq
+		seg.dead += length
+		s.unset(n.bucket, n.key)
+		return
+	}
+	loc := needleLoc{segment: seg, offset: offset, length: length, kind: n.kind, seq: n.seq, size: int64(len(n.data)), meta: n.meta, modTime: n.modTime}
+	if n.kind == needleBlob && len(n.data) == 16 {
+		loc.blob = binary.BigEndian.Uint64(n.data)
+		loc.size = int64(binary.BigEndian.Uint64(n.data[8:]))
+	}
+	s.set(n.bucket, n.key, loc)
+}
+
+func (s *SegmentStorage) set(bucket, key string, loc needleLoc) {
+	objects, ok := s.index[bucket]
+	if !ok {
+		objects = make(map[string]needleLoc)
+		s.index[bucket] = objects
+	}
+	objects[key] = loc
+}
+
+func (s *SegmentStorage) unset(bucket, key string) {
+	delete(s.index[bucket], key)
+	if len(s.index[bucket]) == 0 {
+		delete(s.index, bucket)
+	}
+}
+
+// removeOrphanBlobs removes the blob files of writes interrupted before
+// their needle was appended, or of objects deleted before a crash
+func (s *SegmentStorage) removeOrphanBlobs() error {
+	referenced := make(map[string]bool)
+	for _, objects := range s.index {
+		for _, loc := range objects {
+			if loc.kind == needleBlob {
+				referenced[s.blobPath(loc.blob)] = true
+			}
+		}
+	}
+	return filepath.WalkDir(filepath.Join(s.dir, blobDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !referenced[path] {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func (s *SegmentStorage) openSegment(id uint64, flag int) (*segmentFile, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, needleSegmentExt))
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &segmentFile{id: id, path: path, f: f, size: info.Size()}, nil
+}
+
+// blobPath returns the file of a blob, spread over subdirectories
+func (s *SegmentStorage) blobPath(id uint64) string {
+	return filepath.Join(s.dir, blobDir, fmt.Sprintf("%02x", id%256), strconv.FormatUint(id, 10)+blobExt)
+}
+
+func (s *SegmentStorage) active() *segmentFile {
+	return s.segments[len(s.segments)-1]
+}
+
+// fail refuses further writes after a failed write or flush
+func (s *SegmentStorage) fail(err error) error {
+	if s.err == nil {
+		s.err = fmt.Errorf("segment storage failed, writes are refused until a restart: %w", err)
+		log.Println("Segments:", s.err)
+	}
+	return s.err
+}
+
+// append writes a needle at the end of the active segment, rotating it when
+// full. mu must be held.
+func (s *SegmentStorage) append(buf []byte) (*segmentFile, int64, error) {
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	if active := s.active(); active.size > 0 && active.size+int64(len(buf)) > s.config.SegmentSize {
+		if err := active.f.Sync(); err != nil {
+			return nil, 0, s.fail(err)
+		}
+		next, err := s.openSegment(active.id+1, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return nil, 0, s.fail(err)
+		}
+		s.segments = append(s.segments, next)
+		if err := syncDir(s.dir); err != nil {
+			return nil, 0, s.fail(err)
+		}
+	}
+	active := s.active()
+	offset := active.size
+	if _, err := active.f.Write(buf); err != nil {
+		return nil, 0, s.fail(err)
+	}
+	active.size += int64(len(buf))
+	s.written++
+	return active, offset, nil
+}
+
+// commit waits for the needles written so far to be flushed
+func (s *SegmentStorage) commit(written uint64) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if s.synced >= written {
+		// Flushed along with the needles of other writers
+		return nil
+	}
+	s.mu.RLock()
+	active, written, err := s.active(), s.written, s.err
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := active.f.Sync(); err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.fail(err)
+	}
+	s.synced = written
+	return nil
+}
+
+// writeBlob stores the data of a large object in its own file
+func (s *SegmentStorage) writeBlob(id uint64, data []byte) error {
+	return writeFileAtomic(s.blobPath(id), data)
+}
+
+// writeFileAtomic writes a file durably, creating its directory if needed.
+// Readers never see it partially written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// read returns the data of the object located by loc, verifying the
+// checksum of its needle. mu must be held.
+func (s *SegmentStorage) read(loc needleLoc) ([]byte, error) {
+	buf := make([]byte, loc.length)
+	if _, err := loc.segment.f.ReadAt(buf, loc.offset); err != nil {
+		return nil, err
+	}
+	n, err := decodeNeedle(buf)
+	if err != nil {
+		return nil, fmt.Errorf("needle at offset %d of %s: %w", loc.offset, loc.segment.path, domain.ErrCorrupt)
+	}
+	if loc.kind != needleBlob {
+		return n.data, nil
+	}
+	data, err := os.ReadFile(s.blobPath(loc.blob))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != loc.size {
+		return nil, fmt.Errorf("blob %s has %d bytes instead of %d: %w", s.blobPath(loc.blob), len(data), loc.size, domain.ErrCorrupt)
+	}
+	return data, nil
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *SegmentStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata appends a needle holding the object, or referencing its
+// blob file when larger than MaxNeedleSize
+func (s *SegmentStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	n := &needle{kind: needlePut, bucket: bucket, key: objectID, meta: meta.Clone(), data: data}
+	s.mu.Lock()
+	if current, ok := s.index[bucket][objectID]; ok && current.size == int64(len(data)) && maps.Equal(current.meta, meta) {
+		if existing, err := s.read(current); err == nil && bytes.Equal(existing, data) {
+			s.mu.Unlock()
+			return false, nil
+		}
+	}
+	var blob uint64
+	if int64(len(data)) > s.config.MaxNeedleSize {
+		s.seq++
+		blob = s.seq
+	}
+	s.mu.Unlock()
+
+	// Blobs are written outside the lock, under their own ID
+	if blob != 0 {
+		if err := s.writeBlob(blob, data); err != nil {
+			return false, err
+		}
+		n.kind = needleBlob
+		n.data = binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, blob), uint64(len(data)))
+	}
+
+	s.mu.Lock()
+	s.seq++
+	n.seq = s.seq
+	n.modTime = time.Now().UTC()
+	buf, err := n.encode()
+	if err != nil {
+		s.mu.Unlock()
+		s.removeBlob(blob)
+		return false, err
+	}
+	seg, offset, err := s.append(buf)
+	if err != nil {
+		s.mu.Unlock()
+		s.removeBlob(blob)
+		return false, err
+	}
+	previous, hadPrevious := s.index[bucket][objectID]
+	if hadPrevious {
+		previous.segment.dead += previous.length
+	}
+	s.set(bucket, objectID, needleLoc{segment: seg, offset: offset, length: int64(len(buf)), kind: n.kind, seq: n.seq, blob: blob, size: int64(len(data)), meta: n.meta, modTime: n.modTime})
+	written := s.written
+	s.mu.Unlock()
+
+	if err := s.commit(written); err != nil {
+		return false, err
+	}
+	if hadPrevious {
+		s.releaseBlob(previous)
+	}
+	return true, nil
+}
+
+// UpdateMetadata appends a needle with the keys of changes set in the
+// metadata of the object and its modification time kept. The needle of a
+// large object refers to its blob again, small objects are appended again
+// with their data.
+func (s *SegmentStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	s.mu.Lock()
+	current, ok := s.index[bucket][objectID]
+	if !ok {
+		s.mu.Unlock()
+		return domain.ErrNotFound
+	}
+	n := &needle{kind: current.kind, bucket: bucket, key: objectID, meta: current.meta.With(changes), modTime: current.modTime}
+	if current.kind == needleBlob {
+		n.data = binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, current.blob), uint64(current.size))
+	} else {
+		data, err := s.read(current)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		n.data = data
+	}
+	s.seq++
+	n.seq = s.seq
+	buf, err := n.encode()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	seg, offset, err := s.append(buf)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	current.segment.dead += current.length
+	s.set(bucket, objectID, needleLoc{segment: seg, offset: offset, length: int64(len(buf)), kind: n.kind, seq: n.seq, blob: current.blob, size: current.size, meta: n.meta, modTime: n.modTime})
+	written := s.written
+	s.mu.Unlock()
+
+	return s.commit(written)
+}
+
+// removeBlob removes a blob file whose needle was not appended
+func (s *SegmentStorage) removeBlob(id uint64) {
+	if id != 0 {
+		os.Remove(s.blobPath(id))
+	}
+}
+
+// releaseBlob removes the blob file of an overwritten or deleted object,
+// waiting for the readers of it
+func (s *SegmentStorage) releaseBlob(loc needleLoc) {
+	if loc.kind != needleBlob {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	os.Remove(s.blobPath(loc.blob))
+}
+
+// Get retrieves the object data
+func (s *SegmentStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata
+func (s *SegmentStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loc, ok := s.index[bucket][objectID]
+	if !ok {
+		return nil, nil, domain.ErrNotFound
+	}
+	data, err := s.read(loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, loc.meta.Clone(), nil
+}
+
+// Exists reports whether the object is in the index
+func (s *SegmentStorage) Exists(bucket, objectID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.index[bucket][objectID]
+	return ok, nil
+}
+
+// Delete appends a tombstone for the object
+func (s *SegmentStorage) Delete(bucket, objectID string) error {
+	s.mu.Lock()
+	previous, ok := s.index[bucket][objectID]
+	if !ok {
+		s.mu.Unlock()
+		return domain.ErrNotFound
+	}
+	s.seq++
+	n := &needle{kind: needleTombstone, seq: s.seq, modTime: time.Now().UTC(), bucket: bucket, key: objectID}
+	buf, err := n.encode()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	seg, _, err := s.append(buf)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.unset(bucket, objectID)
+	previous.segment.dead += previous.length
+	seg.dead += int64(len(buf))
+	written := s.written
+	s.mu.Unlock()
+
+	if err := s.commit(written); err != nil {
+		return err
+	}
+	s.releaseBlob(previous)
+	return nil
+}
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *SegmentStorage) ListBuckets() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buckets := make([]string, 0, len(s.index))
+	for name := range s.index {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix
+func (s *SegmentStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var infos []domain.ObjectInfo
+	for id, loc := range s.index[bucket] {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		infos = append(infos, domain.ObjectInfo{
+			Bucket:   bucket,
+			ID:       id,
+			Size:     loc.size,
+			ModTime:  loc.modTime,
+			Metadata: loc.meta.Clone(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// Run compacts the segments every interval until ctx is done
+func (s *SegmentStorage) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reclaimed, err := s.Compact()
+		if err != nil {
+			log.Println("Segments: compaction failed:", err)
+		} else if reclaimed > 0 {
+			log.Printf("Segments: compaction reclaimed %d bytes", reclaimed)
+		}
+	}
+}
+
+// Compact rewrites the live needles of the sealed segments whose dead bytes
+// reach CompactionRatio to the active segment, then removes those segments.
+// Reads and writes continue meanwhile. It returns the bytes reclaimed.
+func (s *SegmentStorage) Compact() (int64, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.RLock()
+	var candidates []*segmentFile
+	for _, seg := range s.segments[:len(s.segments)-1] {
+		if seg.size == 0 || float64(seg.dead) >= s.config.CompactionRatio*float64(seg.size) {
+			candidates = append(candidates, seg)
+		}
+	}
+	s.mu.RUnlock()
+
+	var reclaimed int64
+	for _, seg := range candidates {
+		n, err := s.compactSegment(seg)
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += n
+	}
+	return reclaimed, nil
+}
+
+// compactSegment moves the live needles of a sealed segment to the active
+// one and removes it
+func (s *SegmentStorage) compactSegment(seg *segmentFile) (int64, error) {
+	var moved int64
+	// Sealed segments are immutable, they are scanned without holding the lock
+	_, err := seg.scan(func(n *needle, offset, length int64) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if n.kind == needleTombstone {
+			// Dead needles of the object may remain in older segments, until
+			// the segment is the oldest one
+			if s.segments[0] == seg {
+				return nil
+			}
+		} else if loc, ok := s.index[n.bucket][n.key]; !ok || loc.segment != seg || loc.offset != offset {
+			return nil
+		}
+		buf, err := n.encode()
+		if err != nil {
+			return err
+		}
+		target, at, err := s.append(buf)
+		if err != nil {
+			return err
+		}
+		if n.kind == needleTombstone {
+			target.dead += length
+		} else {
+			loc := s.index[n.bucket][n.key]
+			loc.segment, loc.offset = target, at
+			s.set(n.bucket, n.key, loc)
+		}
+		moved += length
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The moved needles are flushed before their previous copies are removed
+	if err := s.active().f.Sync(); err != nil {
+		return 0, s.fail(err)
+	}
+	for i, candidate := range s.segments {
+		if candidate == seg {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	seg.f.Close()
+	if err := os.Remove(seg.path); err != nil {
+		return 0, err
+	}
+	compactedSegments.Inc()
+	reclaimedBytes.Add(float64(seg.size - moved))
+	return seg.size - moved, syncDir(s.dir)
+}
+
+// Close flushes the active segment and closes the segments
+func (s *SegmentStorage) Close() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errors.Is(s.err, errSegmentStorageClosed) {
+		return nil
+	}
+	err := s.err
+	if err == nil {
+		err = s.active().f.Sync()
+	}
+	s.closeFiles()
+	s.err = errSegmentStorageClosed
+	return err
+}
+
+func (s *SegmentStorage) closeFiles() {
+	for _, seg := range s.segments {
+		seg.f.Close()
+	}
+}
@@ -0,0 +1,168 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+func openTestSegments(t *testing.T, dir string, config SegmentConfig) *SegmentStorage {
+	t.Helper()
+	s, err := OpenSegmentStorage(dir, config)
+	if err != nil {
+		t.Fatalf("OpenSegmentStorage failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func countFiles(t *testing.T, dir, ext string) int {
+	t.Helper()
+	var n int
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Ext(path) == ext {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestSegmentStorage_NeedlesAndBlobs(t *testing.T) {
+	dir := t.TempDir()
+	config := SegmentConfig{MaxNeedleSize: 1024}
+	s := openTestSegments(t, dir, config)
+
+	for i := 0; i < 1000; i++ {
+		if _, err := s.Put("thumbs", fmt.Sprintf("%04d.png", i), []byte(fmt.Sprint("tiny ", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	large := bytes.Repeat([]byte("large"), 1000)
+	if created, err := s.PutWithMetadata("videos", "movie.mp4", large, domain.Metadata{"tags": "film"}); err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("videos", "movie.mp4", large, domain.Metadata{"tags": "film"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	// Small objects share a segment, large ones have their own blob
+	if segments, blobs := countFiles(t, dir, needleSegmentExt), countFiles(t, dir, blobExt); segments != 1 || blobs != 1 {
+		t.Errorf("expected 1 segment and 1 blob, got %d and %d", segments, blobs)
+	}
+	s.Delete("thumbs", "0000.png")
+	s.Put("videos", "movie.mp4", []byte("trailer"))
+	if blobs := countFiles(t, dir, blobExt); blobs != 0 {
+		t.Errorf("expected the overwritten blob to be removed, got %d", blobs)
+	}
+	s.Put("videos", "clip.mp4", large)
+	s.Close()
+
+	// The needle index is rebuilt from the segments
+	s = openTestSegments(t, dir, config)
+	if data, err := s.Get("thumbs", "0999.png"); err != nil || string(data) != "tiny 999" {
+		t.Errorf("unexpected object %q (err %v)", data, err)
+	}
+	if _, err := s.Get("thumbs", "0000.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	data, meta, err := s.GetWithMetadata("videos", "movie.mp4")
+	if err != nil || string(data) != "trailer" || len(meta) != 0 {
+		t.Errorf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+	if data, err := s.Get("videos", "clip.mp4"); err != nil || !bytes.Equal(data, large) {
+		t.Errorf("expected the blob (err %v)", err)
+	}
+	infos, _ := s.ListObjects("videos", "")
+	if len(infos) != 2 || infos[0].ID != "clip.mp4" || infos[0].Size != int64(len(large)) {
+		t.Errorf("unexpected listing %+v", infos)
+	}
+}
+
+func TestSegmentStorage_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	config := SegmentConfig{SegmentSize: 1024}
+	s := openTestSegments(t, dir, config)
+	for i := 0; i < 40; i++ {
+		s.Put("b", fmt.Sprint("key-", i%10), []byte(fmt.Sprint("version ", i)))
+	}
+	s.Put("b", "deleted", []byte("gone"))
+	s.Put("b", "kept", []byte("here"))
+	s.Delete("b", "deleted")
+	for i := 0; i < 10; i++ {
+		s.Put("b", "filler", []byte(fmt.Sprint("filler ", i)))
+	}
+	before := countFiles(t, dir, needleSegmentExt)
+
+	reclaimed, err := s.Compact()
+	if err != nil || reclaimed <= 0 {
+		t.Fatalf("expected compaction to reclaim space, got %d (err %v)", reclaimed, err)
+	}
+	if after := countFiles(t, dir, needleSegmentExt); after >= before {
+		t.Errorf("expected fewer segments than %d, got %d", before, after)
+	}
+	check := func() {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			if data, err := s.Get("b", fmt.Sprint("key-", i)); err != nil || string(data) != fmt.Sprint("version ", 30+i) {
+				t.Errorf("unexpected key-%d %q (err %v)", i, data, err)
+			}
+		}
+		if data, _ := s.Get("b", "kept"); string(data) != "here" {
+			t.Errorf("expected kept, got %q", data)
+		}
+		if _, err := s.Get("b", "deleted"); err != domain.ErrNotFound {
+			t.Errorf("expected the deleted object to stay deleted, got %v", err)
+		}
+	}
+	check()
+	s.Close()
+	s = openTestSegments(t, dir, config)
+	check()
+}
+
+func TestSegmentStorage_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSegments(t, dir, SegmentConfig{MaxNeedleSize: 4})
+	s.Put("b", "acknowledged", []byte("yes"))
+
+	// A crash interrupts a needle and leaves the blob of another write
+	n := &needle{kind: needlePut, seq: 100, bucket: "b", key: "torn", data: []byte("no")}
+	buf, _ := n.encode()
+	f, _ := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 1, needleSegmentExt)), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(buf[:len(buf)-3])
+	f.Close()
+	s.writeBlob(99, []byte("orphan"))
+
+	s = openTestSegments(t, dir, SegmentConfig{MaxNeedleSize: 4})
+	if data, err := s.Get("b", "acknowledged"); err != nil || string(data) != "yes" {
+		t.Errorf("expected the acknowledged write, got %q (err %v)", data, err)
+	}
+	if _, err := s.Get("b", "torn"); err != domain.ErrNotFound {
+		t.Errorf("expected the torn needle to be discarded, got %v", err)
+	}
+	if blobs := countFiles(t, dir, blobExt); blobs != 0 {
+		t.Errorf("expected the orphan blob to be removed, got %d", blobs)
+	}
+	if _, err := s.Put("b", "after", []byte("crash")); err != nil {
+		t.Errorf("Put after recovery failed: %v", err)
+	}
+}
+
+func TestSegmentStorage_UpdateMetadata(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSegments(t, dir, SegmentConfig{MaxNeedleSize: 1024})
+	checkUpdateMetadata(t, s, "small.png", []byte("meow"))
+	large := bytes.Repeat([]byte("x"), 4096)
+	checkUpdateMetadata(t, s, "large.png", large)
+	s.Close()
+
+	s = openTestSegments(t, dir, SegmentConfig{MaxNeedleSize: 1024})
+	data, meta, err := s.GetWithMetadata("photos", "large.png")
+	if err != nil || !bytes.Equal(data, large) || meta["status"] != "done" {
+		t.Errorf("expected the update to survive a restart, got %d bytes %v (err %v)", len(data), meta, err)
+	}
+}
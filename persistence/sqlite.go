@@ -0,0 +1,414 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are the schema changes of the SQLite storage, applied in
+// order once each. New changes are appended, applied ones are never edited.
+var sqliteMigrations = []string{
+	// 1: buckets and objects. The primary key of objects serves the listing
+	// of a bucket by key prefix as a range scan.
+	`CREATE TABLE buckets (
+		name       TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE objects (
+		bucket   TEXT NOT NULL REFERENCES buckets (name),
+		key      TEXT NOT NULL,
+		size     INTEGER NOT NULL,
+		checksum TEXT NOT NULL,
+		mod_time INTEGER NOT NULL,
+		metadata TEXT NOT NULL,
+		data     BLOB,
+		blob     TEXT,
+		PRIMARY KEY (bucket, key)
+	) WITHOUT ROWID;`,
+}
+
+// SQLiteStorage is a domain.Storage keeping buckets and object metadata in
+// an embedded SQLite database. Objects up to the inline limit are stored in
+// the database, larger ones in files referenced by their row. Puts and
+// deletes are transactions, the files of large objects being written before
+// the transaction and removed after it.
+type SQLiteStorage struct {
+	db          *sql.DB
+	blobDir     string
+	inlineLimit int64
+}
+
+// OpenSQLiteStorage opens the database in dir, creating it and applying the
+// pending schema migrations if needed. Objects larger than inlineLimit bytes
+// are stored as files in dir.
+func OpenSQLiteStorage(dir string, inlineLimit int64) (*SQLiteStorage, error) {
+	blobDir := filepath.Join(dir, blobDir)
+	if err := os.MkdirAll(blobDir, 0o755); err != nil {
+		return nil, err
+	}
+	// Writes take the database lock when their transaction begins, so that
+	// concurrent read-then-write transactions wait rather than fail
+	dsn := (&url.URL{
+		Scheme: "file",
+		Opaque: filepath.Join(dir, "metadata.db"),
+		RawQuery: url.Values{
+			"_pragma": {"journal_mode(WAL)", "synchronous(FULL)", "busy_timeout(10000)", "foreign_keys(1)"},
+			"_txlock": {"immediate"},
+		}.Encode(),
+	}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLiteStorage{db: db, blobDir: blobDir, inlineLimit: inlineLimit}
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", dir, err)
+	}
+	if err := s.removeOrphanBlobs(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the migrations not recorded in schema_migrations, each in
+// its own transaction
+func migrate(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported %d", current, len(migrations))
+	}
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphanBlobs removes the files of large objects whose transaction was
+// not committed, or whose removal was interrupted by a crash
+func (s *SQLiteStorage) removeOrphanBlobs() error {
+	referenced := make(map[string]bool)
+	rows, err := s.db.Query(`SELECT blob FROM objects WHERE blob IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		referenced[s.blobPath(name)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return filepath.WalkDir(s.blobDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !referenced[path] {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// blobPath returns the file of a large object, spread over subdirectories
+func (s *SQLiteStorage) blobPath(name string) string {
+	return filepath.Join(s.blobDir, name[:2], name+blobExt)
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *SQLiteStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object and its metadata in a transaction
+func (s *SQLiteStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	encodedMeta, err := json.Marshal(meta.Clone())
+	if err != nil {
+		return false, err
+	}
+
+	var inline []byte
+	var blob sql.NullString
+	if int64(len(data)) > s.inlineLimit {
+		id := make([]byte, 16)
+		rand.Read(id)
+		blob = sql.NullString{String: hex.EncodeToString(id), Valid: true}
+		if err := writeFileAtomic(s.blobPath(blob.String), data); err != nil {
+			return false, err
+		}
+	} else {
+		// A nil slice would be stored as NULL
+		inline = append([]byte{}, data...)
+	}
+
+	previous, changed, err := s.putTx(bucket, objectID, checksum, string(encodedMeta), int64(len(data)), inline, blob)
+	if err != nil || !changed {
+		if blob.Valid {
+			os.Remove(s.blobPath(blob.String))
+		}
+		return false, err
+	}
+	if previous.Valid {
+		os.Remove(s.blobPath(previous.String))
+	}
+	return true, nil
+}
+
+// putTx writes the row of an object unless it is unchanged, returning the
+// file of the previous version
+func (s *SQLiteStorage) putTx(bucket, objectID, checksum, meta string, size int64, inline []byte, blob sql.NullString) (sql.NullString, bool, error) {
+	var previous sql.NullString
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return previous, false, err
+	}
+	defer tx.Rollback()
+
+	var currentChecksum, currentMeta string
+	err = tx.QueryRow(`SELECT checksum, metadata, blob FROM objects WHERE bucket = ? AND key = ?`, bucket, objectID).Scan(&currentChecksum, &currentMeta, &previous)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return previous, false, err
+	case currentChecksum == checksum && currentMeta == meta:
+		return sql.NullString{}, false, nil
+	}
+
+	now := time.Now().UTC().UnixNano()
+	if _, err := tx.Exec(`INSERT INTO buckets (name, created_at) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`, bucket, now); err != nil {
+		return previous, false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO objects (bucket, key, size, checksum, mod_time, metadata, data, blob)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET
+			size = excluded.size, checksum = excluded.checksum, mod_time = excluded.mod_time,
+			metadata = excluded.metadata, data = excluded.data, blob = excluded.blob`,
+		bucket, objectID, size, checksum, now, meta, inline, blob); err != nil {
+		return previous, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return previous, false, err
+	}
+	return previous, true, nil
+}
+
+// Get retrieves the object data
+func (s *SQLiteStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata
+func (s *SQLiteStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	// The file of a large object may be removed by a concurrent overwrite
+	// between reading its row and the file, the row is then read again
+	for attempt := 0; ; attempt++ {
+		var (
+			data []byte
+			blob sql.NullString
+			meta string
+		)
+		err := s.db.QueryRow(`SELECT data, blob, metadata FROM objects WHERE bucket = ? AND key = ?`, bucket, objectID).Scan(&data, &blob, &meta)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, domain.ErrNotFound
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if blob.Valid {
+			data, err = os.ReadFile(s.blobPath(blob.String))
+			if errors.Is(err, fs.ErrNotExist) && attempt < 3 {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		var decoded domain.Metadata
+		if err := json.Unmarshal([]byte(meta), &decoded); err != nil {
+			return nil, nil, err
+		}
+		return data, decoded, nil
+	}
+}
+
+// Exists reports whether the row of the object exists
+func (s *SQLiteStorage) Exists(bucket, objectID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM objects WHERE bucket = ? AND key = ?)`, bucket, objectID).Scan(&exists)
+	return exists, err
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object in a transaction
+func (s *SQLiteStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT metadata FROM objects WHERE bucket = ? AND key = ?`, bucket, objectID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var meta domain.Metadata
+	if err := json.Unmarshal([]byte(current), &meta); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(meta.With(changes))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE objects SET metadata = ? WHERE bucket = ? AND key = ?`, string(encoded), bucket, objectID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes the object in a transaction, with its bucket once empty
+func (s *SQLiteStorage) Delete(bucket, objectID string) error {
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var blob sql.NullString
+	err = tx.QueryRow(`DELETE FROM objects WHERE bucket = ? AND key = ? RETURNING blob`, bucket, objectID).Scan(&blob)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM buckets WHERE name = ? AND NOT EXISTS (SELECT 1 FROM objects WHERE bucket = ?)`, bucket, bucket); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if blob.Valid {
+		os.Remove(s.blobPath(blob.String))
+	}
+	return nil
+}
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *SQLiteStorage) ListBuckets() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM buckets ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, name)
+	}
+	return buckets, rows.Err()
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix,
+// read as a range of the primary key
+func (s *SQLiteStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	query := `SELECT key, size, mod_time, metadata FROM objects WHERE bucket = ? AND key >= ?`
+	args := []any{bucket, prefix}
+	if end, ok := prefixEnd(prefix); ok {
+		query += ` AND key < ?`
+		args = append(args, end)
+	}
+	rows, err := s.db.Query(query+` ORDER BY key`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []domain.ObjectInfo
+	for rows.Next() {
+		var (
+			info    = domain.ObjectInfo{Bucket: bucket}
+			modTime int64
+			meta    string
+		)
+		if err := rows.Scan(&info.ID, &info.Size, &modTime, &meta); err != nil {
+			return nil, err
+		}
+		info.ModTime = time.Unix(0, modTime).UTC()
+		if err := json.Unmarshal([]byte(meta), &info.Metadata); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// prefixEnd returns the smallest string greater than every string starting
+// with prefix, if any
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// Close closes the database
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,142 @@
+package persistence
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+func openTestSQLite(t *testing.T, dir string) *SQLiteStorage {
+	t.Helper()
+	s, err := OpenSQLiteStorage(dir, 64)
+	if err != nil {
+		t.Fatalf("OpenSQLiteStorage failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteStorage_PutGetDelete(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSQLite(t, dir)
+	var journal string
+	if err := s.db.QueryRow(`PRAGMA journal_mode`).Scan(&journal); err != nil || journal != "wal" {
+		t.Errorf("expected the WAL journal mode, got %q (err %v)", journal, err)
+	}
+
+	large := bytes.Repeat([]byte("x"), 1000)
+	created, err := s.PutWithMetadata("photos", "2024/cat.png", large, domain.Metadata{"tags": "pet"})
+	if err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("photos", "2024/cat.png", large, domain.Metadata{"tags": "pet"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	if blobs := countFiles(t, dir, blobExt); blobs != 1 {
+		t.Errorf("expected the large object in a file, got %d files", blobs)
+	}
+	s.Put("photos", "2024/dog.png", []byte("woof"))
+	s.Put("photos", "2025/fish.png", nil)
+	// Overwriting a large object with a small one removes its file
+	s.Put("photos", "2024/cat.png", []byte("meow"))
+	if blobs := countFiles(t, dir, blobExt); blobs != 0 {
+		t.Errorf("expected the file to be removed, got %d files", blobs)
+	}
+	s.Close()
+
+	s = openTestSQLite(t, dir)
+	data, meta, err := s.GetWithMetadata("photos", "2024/cat.png")
+	if err != nil || string(data) != "meow" || len(meta) != 0 {
+		t.Fatalf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+	if data, err := s.Get("photos", "2025/fish.png"); err != nil || len(data) != 0 {
+		t.Errorf("expected an empty object, got %q (err %v)", data, err)
+	}
+	if exists, err := s.Exists("photos", "2024/dog.png"); err != nil || !exists {
+		t.Errorf("expected the object to exist (err %v)", err)
+	}
+	if exists, err := s.Exists("photos", "2024/bird.png"); err != nil || exists {
+		t.Errorf("expected the object not to exist (err %v)", err)
+	}
+	infos, err := s.ListObjects("photos", "2024/")
+	if err != nil || len(infos) != 2 || infos[0].ID != "2024/cat.png" || infos[1].Size != 4 {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+
+	for _, key := range []string{"2024/cat.png", "2024/dog.png", "2025/fish.png"} {
+		if err := s.Delete("photos", key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := s.Delete("photos", "2024/cat.png"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if buckets, _ := s.ListBuckets(); len(buckets) != 0 {
+		t.Errorf("expected the empty bucket to be removed, got %v", buckets)
+	}
+}
+
+func TestSQLiteStorage_ConcurrentWrites(t *testing.T) {
+	s := openTestSQLite(t, t.TempDir())
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Put(fmt.Sprint("bucket-", i%3), fmt.Sprint("key-", i), []byte(fmt.Sprint(i))); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	buckets, _ := s.ListBuckets()
+	infos, _ := s.ListObjects("bucket-0", "")
+	if len(buckets) != 3 || len(infos) != 7 {
+		t.Errorf("unexpected buckets %v and objects %+v", buckets, infos)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	defer db.Close()
+
+	migrations := []string{`CREATE TABLE a (id INTEGER)`}
+	if err := migrate(db, migrations); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	// Applied migrations are skipped, new ones applied
+	migrations = append(migrations, `ALTER TABLE a ADD COLUMN name TEXT`)
+	if err := migrate(db, migrations); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO a (id, name) VALUES (1, 'x')`); err != nil {
+		t.Errorf("expected the second migration to be applied: %v", err)
+	}
+	if err := migrate(db, migrations[:1]); err == nil {
+		t.Errorf("expected a newer schema to be rejected")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	if end, ok := prefixEnd("2024/"); !ok || end != "20240" {
+		t.Errorf("unexpected end %q", end)
+	}
+	if end, ok := prefixEnd("a\xff"); !ok || end != "b" {
+		t.Errorf("unexpected end %q", end)
+	}
+	if _, ok := prefixEnd(""); ok {
+		t.Errorf("expected no end for an empty prefix")
+	}
+}
+
+func TestSQLiteStorage_UpdateMetadata(t *testing.T) {
+	checkUpdateMetadata(t, openTestSQLite(t, t.TempDir()), "cat.png", []byte("meow"))
+}
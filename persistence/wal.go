@@ -0,0 +1,891 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errWALClosed is returned by the operations of a closed WALStorage
+var errWALClosed = errors.New("write-ahead log storage is closed")
+
+var (
+	walSyncs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wal_syncs_total",
+		Help: "Flushes of the write-ahead log to disk.",
+	})
+	walCheckpoints = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wal_checkpoints_total",
+		Help: "Checkpoints written, each compacting the write-ahead log.",
+	})
+	walTruncatedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wal_truncated_bytes_total",
+		Help: "Bytes of incomplete records discarded from the tail of the write-ahead log on recovery.",
+	})
+)
+
+// SyncPolicy controls when the write-ahead log is flushed to disk
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes the log before acknowledging every write
+	SyncAlways SyncPolicy = "always"
+	// SyncBatch flushes the log before acknowledging writes, concurrent
+	// writes sharing a single flush
+	SyncBatch SyncPolicy = "batch"
+	// SyncInterval flushes the log periodically: writes acknowledged since
+	// the last flush survive a crash of the process but not of the machine
+	SyncInterval SyncPolicy = "interval"
+)
+
+// ParseSyncPolicy validates a sync policy name
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch p := SyncPolicy(name); p {
+	case SyncAlways, SyncBatch, SyncInterval:
+		return p, nil
+	case "":
+		return SyncBatch, nil
+	}
+	return "", fmt.Errorf("unsupported sync policy %q", name)
+}
+
+// WALConfig configures a WALStorage, zero values select the defaults
+type WALConfig struct {
+	// Sync is the flush policy, SyncBatch by default
+	Sync SyncPolicy
+	// SyncInterval is the flush period of SyncInterval, 1s by default
+	SyncInterval time.Duration
+	// SegmentSize is the size of the log segments, 64 MiB by default
+	SegmentSize int64
+	// CheckpointInterval is the checkpoint period of Run, 10m by default
+	CheckpointInterval time.Duration
+}
+
+const (
+	segmentExt    = ".wal"
+	checkpointExt = ".checkpoint"
+
+	// walRecordHeaderSize is the size of the CRC-32C and of the length
+	// preceding the payload of every record
+	walRecordHeaderSize = 8
+
+	walOpPut    byte = 1
+	walOpDelete byte = 2
+)
+
+var walCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// walHeader describes the operation of a record, the object data follows it
+type walHeader struct {
+	Bucket   string          `json:"bucket"`
+	Key      string          `json:"key"`
+	Metadata domain.Metadata `json:"metadata,omitempty"`
+	ModTime  time.Time       `json:"modTime"`
+}
+
+// encodeWALRecord encodes an operation as a record of the log: the CRC-32C
+// and the length of the payload, then the payload made of the operation, the
+// length of the JSON header, the header and the object data. It also returns
+// the offset of the data in the record.
+func encodeWALRecord(op byte, header walHeader, data []byte) ([]byte, int64, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	payload := 5 + len(encoded) + len(data)
+	record := make([]byte, walRecordHeaderSize, walRecordHeaderSize+payload)
+	binary.BigEndian.PutUint32(record[4:], uint32(payload))
+	record = append(record, op)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(encoded)))
+	record = append(record, encoded...)
+	dataOffset := int64(len(record))
+	record = append(record, data...)
+	binary.BigEndian.PutUint32(record, crc32.Checksum(record[walRecordHeaderSize:], walCRC))
+	return record, dataOffset, nil
+}
+
+// errTornRecord reports an incomplete or corrupt record, which a crash in
+// the middle of a write leaves at the tail of the log
+var errTornRecord = errors.New("torn record")
+
+// walFile is a segment or a checkpoint
+type walFile struct {
+	id   uint64
+	path string
+	f    *os.File
+	size int64
+}
+
+func walFileName(id uint64, ext string) string {
+	return fmt.Sprintf("%020d%s", id, ext)
+}
+
+// scan reads the records of the file, calling fn for each. It returns the
+// offset following the last valid record, and errTornRecord when it is not
+// the end of the file.
+func (file *walFile) scan(fn func(op byte, header walHeader, dataOffset, size, recordSize int64)) (int64, error) {
+	info, err := file.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(file.f, 0, info.Size()))
+	prefix := make([]byte, walRecordHeaderSize)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(r, prefix); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errTornRecord
+		}
+		length := int64(binary.BigEndian.Uint32(prefix[4:]))
+		if length < 5 || offset+walRecordHeaderSize+length > info.Size() {
+			return offset, errTornRecord
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, errTornRecord
+		}
+		if crc32.Checksum(payload, walCRC) != binary.BigEndian.Uint32(prefix) {
+			return offset, errTornRecord
+		}
+		headerSize := int64(binary.BigEndian.Uint32(payload[1:5]))
+		var header walHeader
+		if 5+headerSize > length || json.Unmarshal(payload[5:5+headerSize], &header) != nil {
+			return offset, errTornRecord
+		}
+		recordSize := walRecordHeaderSize + length
+		fn(payload[0], header, offset+walRecordHeaderSize+5+headerSize, length-5-headerSize, recordSize)
+		offset += recordSize
+	}
+}
+
+// walEntry locates the live version of an object in the log
+type walEntry struct {
+	file *walFile
+	// offset is the position of the data in the file
+	offset int64
+	size   int64
+	// record is the size of the record, which becomes garbage once the
+	// object is overwritten or deleted
+	record  int64
+	meta    domain.Metadata
+	modTime time.Time
+}
+
+func (e walEntry) read() ([]byte, error) {
+	data := make([]byte, e.size)
+	if _, err := e.file.f.ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WALStorage is a domain.Storage persisting objects in an append-only
+// write-ahead log, split into segments, with an in-memory index of the live
+// version of every object. Checkpoints write the live objects to a new file
+// and remove the segments before it, compacting the log and bounding the
+// replay which rebuilds the index on startup. A crash in the middle of a
+// write leaves an incomplete record at the tail of the log, which recovery
+// discards: the write had not been acknowledged.
+type WALStorage struct {
+	dir    string
+	config WALConfig
+
+	// checkpointMu serializes checkpoints, syncMu the flushes. They are
+	// acquired before mu.
+	checkpointMu sync.Mutex
+	syncMu       sync.Mutex
+	// synced is the number of records written when the log was last flushed
+	synced uint64
+
+	mu         sync.RWMutex
+	index      map[string]map[string]walEntry
+	checkpoint *walFile
+	segments   []*walFile // the last one is active
+	written    uint64
+	// live is the size of the records of the live objects
+	live int64
+	// err is the failure of a write or flush: a record may be partially
+	// written or lost, so further writes are refused until a restart
+	err error
+
+	compact chan struct{}
+}
+
+// OpenWALStorage opens the log stored in dir, creating the directory if
+// needed, and rebuilds the index from the last checkpoint and the segments
+// written after it
+func OpenWALStorage(dir string, config WALConfig) (*WALStorage, error) {
+	if config.Sync == "" {
+		config.Sync = SyncBatch
+	}
+	if _, err := ParseSyncPolicy(string(config.Sync)); err != nil {
+		return nil, err
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = time.Second
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = 64 << 20
+	}
+	if config.CheckpointInterval <= 0 {
+		config.CheckpointInterval = 10 * time.Minute
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &WALStorage{
+		dir:     dir,
+		config:  config,
+		index:   make(map[string]map[string]walEntry),
+		compact: make(chan struct{}, 1),
+	}
+	if err := s.recover(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover loads the last checkpoint and replays the segments written after
+// it, removing the files a checkpoint interrupted by a crash left behind
+func (s *WALStorage) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var checkpoints, segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		ext := filepath.Ext(name)
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch ext {
+		case checkpointExt:
+			checkpoints = append(checkpoints, id)
+		case segmentExt:
+			segments = append(segments, id)
+		}
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i] < checkpoints[j] })
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	// A checkpoint holds the objects written before the segment of its ID
+	var first uint64 = 1
+	if len(checkpoints) > 0 {
+		first = checkpoints[len(checkpoints)-1]
+		for _, id := range checkpoints[:len(checkpoints)-1] {
+			os.Remove(filepath.Join(s.dir, walFileName(id, checkpointExt)))
+		}
+		file, err := s.openFile(first, checkpointExt, os.O_RDONLY)
+		if err != nil {
+			return err
+		}
+		s.checkpoint = file
+		if _, err := file.scan(s.replayer(file)); err != nil {
+			return fmt.Errorf("checkpoint %s: %w", file.path, domain.ErrCorrupt)
+		}
+	}
+
+	for i, id := range segments {
+		if id < first {
+			os.Remove(filepath.Join(s.dir, walFileName(id, segmentExt)))
+			continue
+		}
+		file, err := s.openFile(id, segmentExt, os.O_RDWR|os.O_APPEND)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, file)
+		end, err := file.scan(s.replayer(file))
+		if err == nil {
+			continue
+		}
+		if i < len(segments)-1 {
+			return fmt.Errorf("segment %s is damaged at offset %d: %w", file.path, end, domain.ErrCorrupt)
+		}
+		// The last write was interrupted by a crash
+		log.Printf("WAL: discarding %d bytes of an incomplete record at the tail of %s", file.size-end, file.path)
+		walTruncatedBytes.Add(float64(file.size - end))
+		if err := file.f.Truncate(end); err != nil {
+			return err
+		}
+		if err := file.f.Sync(); err != nil {
+			return err
+		}
+		file.size = end
+	}
+
+	if len(s.segments) == 0 {
+		file, err := s.openFile(first, segmentExt, os.O_RDWR|os.O_APPEND|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, file)
+		return syncDir(s.dir)
+	}
+	return nil
+}
+
+func (s *WALStorage) openFile(id uint64, ext string, flag int) (*walFile, error) {
+	path := filepath.Join(s.dir, walFileName(id, ext))
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &walFile{id: id, path: path, f: f, size: info.Size()}, nil
+}
+
+// replayer applies the records of file to the index
+func (s *WALStorage) replayer(file *walFile) func(byte, walHeader, int64, int64, int64) {
+	return func(op byte, header walHeader, dataOffset, size, recordSize int64) {
+		switch op {
+		case walOpPut:
+			s.set(header.Bucket, header.Key, walEntry{
+				file:    file,
+				offset:  dataOffset,
+				size:    size,
+				record:  recordSize,
+				meta:    header.Metadata,
+				modTime: header.ModTime,
+			})
+		case walOpDelete:
+			s.remove(header.Bucket, header.Key)
+		}
+	}
+}
+
+func (s *WALStorage) set(bucket, key string, entry walEntry) {
+	objects, ok := s.index[bucket]
+	if !ok {
+		objects = make(map[string]walEntry)
+		s.index[bucket] = objects
+	}
+	if previous, ok := objects[key]; ok {
+		s.live -= previous.record
+	}
+	objects[key] = entry
+	s.live += entry.record
+}
+
+func (s *WALStorage) remove(bucket, key string) bool {
+	previous, ok := s.index[bucket][key]
+	if !ok {
+		return false
+	}
+	delete(s.index[bucket], key)
+	if len(s.index[bucket]) == 0 {
+		delete(s.index, bucket)
+	}
+	s.live -= previous.record
+	return true
+}
+
+func (s *WALStorage) active() *walFile {
+	return s.segments[len(s.segments)-1]
+}
+
+// fail refuses further writes after a failed write or flush
+func (s *WALStorage) fail(err error) error {
+	if s.err == nil {
+		s.err = fmt.Errorf("write-ahead log failed, writes are refused until a restart: %w", err)
+		log.Println("WAL:", s.err)
+	}
+	return s.err
+}
+
+// append writes a record at the end of the log, rotating the active segment
+// when full, and returns the file and offset of the record
+func (s *WALStorage) append(record []byte) (*walFile, int64, error) {
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	if active := s.active(); active.size > 0 && active.size+int64(len(record)) > s.config.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return nil, 0, s.fail(err)
+		}
+	}
+	active := s.active()
+	offset := active.size
+	if _, err := active.f.Write(record); err != nil {
+		return nil, 0, s.fail(err)
+	}
+	active.size += int64(len(record))
+	s.written++
+	if s.config.Sync == SyncAlways {
+		if err := active.f.Sync(); err != nil {
+			return nil, 0, s.fail(err)
+		}
+		walSyncs.Inc()
+	}
+	s.maybeCompact()
+	return active, offset, nil
+}
+
+// rotate flushes the active segment and starts a new one
+func (s *WALStorage) rotate() error {
+	active := s.active()
+	if err := active.f.Sync(); err != nil {
+		return err
+	}
+	walSyncs.Inc()
+	next, err := s.openFile(active.id+1, segmentExt, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, next)
+	return syncDir(s.dir)
+}
+
+// maybeCompact requests a checkpoint once garbage makes up most of the log
+func (s *WALStorage) maybeCompact() {
+	var total int64
+	if s.checkpoint != nil {
+		total += s.checkpoint.size
+	}
+	for _, segment := range s.segments {
+		total += segment.size
+	}
+	if garbage := total - s.live; garbage > s.config.SegmentSize && garbage > s.live {
+		select {
+		case s.compact <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// commit waits for the records written so far to be flushed, as required
+// by the sync policy
+func (s *WALStorage) commit(written uint64) error {
+	if s.config.Sync != SyncBatch {
+		return nil
+	}
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if s.synced >= written {
+		// Flushed along with the records of other writers
+		return nil
+	}
+	return s.sync()
+}
+
+// sync flushes the active segment, the previous ones are flushed when
+// rotated. syncMu must be held.
+func (s *WALStorage) sync() error {
+	s.mu.RLock()
+	active, written, err := s.active(), s.written, s.err
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := active.f.Sync(); err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.fail(err)
+	}
+	walSyncs.Inc()
+	s.synced = written
+	return nil
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *WALStorage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata appends the object and its metadata to the log, it is
+// acknowledged once flushed as required by the sync policy
+func (s *WALStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	s.mu.Lock()
+	if existing, ok := s.index[bucket][objectID]; ok && existing.size == int64(len(data)) && maps.Equal(existing.meta, meta) {
+		if current, err := existing.read(); err == nil && bytes.Equal(current, data) {
+			s.mu.Unlock()
+			return false, nil
+		}
+	}
+
+	header := walHeader{Bucket: bucket, Key: objectID, Metadata: meta.Clone(), ModTime: time.Now().UTC()}
+	record, dataOffset, err := encodeWALRecord(walOpPut, header, data)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	file, offset, err := s.append(record)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.set(bucket, objectID, walEntry{
+		file:    file,
+		offset:  offset + dataOffset,
+		size:    int64(len(data)),
+		record:  int64(len(record)),
+		meta:    header.Metadata,
+		modTime: header.ModTime,
+	})
+	written := s.written
+	s.mu.Unlock()
+
+	if err := s.commit(written); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateMetadata appends the object again with the keys of changes set in
+// its metadata, keeping its modification time
+func (s *WALStorage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	s.mu.Lock()
+	current, ok := s.index[bucket][objectID]
+	if !ok {
+		s.mu.Unlock()
+		return domain.ErrNotFound
+	}
+	data, err := current.read()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	header := walHeader{Bucket: bucket, Key: objectID, Metadata: current.meta.With(changes), ModTime: current.modTime}
+	record, dataOffset, err := encodeWALRecord(walOpPut, header, data)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	file, offset, err := s.append(record)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.set(bucket, objectID, walEntry{
+		file:    file,
+		offset:  offset + dataOffset,
+		size:    current.size,
+		record:  int64(len(record)),
+		meta:    header.Metadata,
+		modTime: header.ModTime,
+	})
+	written := s.written
+	s.mu.Unlock()
+
+	return s.commit(written)
+}
+
+// Get retrieves the object data
+func (s *WALStorage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object data and its metadata
+func (s *WALStorage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.index[bucket][objectID]
+	if !ok {
+		return nil, nil, domain.ErrNotFound
+	}
+	data, err := entry.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, entry.meta.Clone(), nil
+}
+
+// Exists reports whether the object is in the index
+func (s *WALStorage) Exists(bucket, objectID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.index[bucket][objectID]
+	return ok, nil
+}
+
+// Delete appends the removal of the object to the log
+func (s *WALStorage) Delete(bucket, objectID string) error {
+	s.mu.Lock()
+	if _, ok := s.index[bucket][objectID]; !ok {
+		s.mu.Unlock()
+		return domain.ErrNotFound
+	}
+	record, _, err := encodeWALRecord(walOpDelete, walHeader{Bucket: bucket, Key: objectID, ModTime: time.Now().UTC()}, nil)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if _, _, err := s.append(record); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.remove(bucket, objectID)
+	written := s.written
+	s.mu.Unlock()
+
+	return s.commit(written)
+}
+
+// ListBuckets returns the names of the buckets holding objects
+func (s *WALStorage) ListBuckets() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buckets := make([]string, 0, len(s.index))
+	for name := range s.index {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects returns the objects of a bucket whose ID starts with prefix
+func (s *WALStorage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var infos []domain.ObjectInfo
+	for id, entry := range s.index[bucket] {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		infos = append(infos, domain.ObjectInfo{
+			Bucket:   bucket,
+			ID:       id,
+			Size:     entry.size,
+			ModTime:  entry.modTime,
+			Metadata: entry.meta.Clone(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// Run checkpoints every CheckpointInterval, or as soon as garbage makes up
+// most of the log, and flushes the log every SyncInterval with the
+// SyncInterval policy, until ctx is done
+func (s *WALStorage) Run(ctx context.Context) {
+	checkpoints := time.NewTicker(s.config.CheckpointInterval)
+	defer checkpoints.Stop()
+	var syncs <-chan time.Time
+	if s.config.Sync == SyncInterval {
+		ticker := time.NewTicker(s.config.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-syncs:
+			s.syncMu.Lock()
+			if err := s.sync(); err != nil {
+				log.Println("WAL: flush failed:", err)
+			}
+			s.syncMu.Unlock()
+			continue
+		case <-checkpoints.C:
+		case <-s.compact:
+		}
+		if err := s.Checkpoint(); err != nil {
+			log.Println("WAL: checkpoint failed:", err)
+		}
+	}
+}
+
+type walSnapshot struct {
+	ref   objectRef
+	entry walEntry
+}
+
+// Checkpoint writes the live objects to a new checkpoint, then removes the
+// previous checkpoint and the segments it covers. Recovery then starts from
+// the checkpoint and replays only the segments written after it.
+func (s *WALStorage) Checkpoint() error {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	if len(s.segments) == 1 && s.active().size == 0 {
+		// Nothing was written since the last checkpoint
+		s.mu.Unlock()
+		return nil
+	}
+	if err := s.rotate(); err != nil {
+		err = s.fail(err)
+		s.mu.Unlock()
+		return err
+	}
+	first := s.active().id
+	var snapshot []walSnapshot
+	for bucket, objects := range s.index {
+		for key, entry := range objects {
+			snapshot = append(snapshot, walSnapshot{ref: objectRef{bucket, key}, entry: entry})
+		}
+	}
+	s.mu.Unlock()
+
+	// The segments and checkpoint before first are no longer written, they
+	// are read without holding the lock
+	checkpoint, moved, err := s.writeCheckpoint(first, snapshot)
+	if err != nil {
+		return err
+	}
+
+	s.syncMu.Lock()
+	s.mu.Lock()
+	for i, snap := range snapshot {
+		// Objects written meanwhile are more recent than their checkpointed copy
+		if current, ok := s.index[snap.ref.bucket][snap.ref.key]; ok && current.file == snap.entry.file && current.offset == snap.entry.offset {
+			s.set(snap.ref.bucket, snap.ref.key, moved[i])
+		}
+	}
+	obsolete := []*walFile{}
+	if s.checkpoint != nil {
+		obsolete = append(obsolete, s.checkpoint)
+	}
+	for len(s.segments) > 0 && s.segments[0].id < first {
+		obsolete = append(obsolete, s.segments[0])
+		s.segments = s.segments[1:]
+	}
+	s.checkpoint = checkpoint
+	s.mu.Unlock()
+	s.syncMu.Unlock()
+
+	for _, file := range obsolete {
+		file.f.Close()
+		os.Remove(file.path)
+	}
+	walCheckpoints.Inc()
+	return syncDir(s.dir)
+}
+
+// writeCheckpoint writes the snapshot of the objects to a new checkpoint
+// file, atomically renamed once flushed, and returns the entries locating the
+// objects in it
+func (s *WALStorage) writeCheckpoint(first uint64, snapshot []walSnapshot) (*walFile, []walEntry, error) {
+	path := filepath.Join(s.dir, walFileName(first, checkpointExt))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp)
+	checkpoint := &walFile{id: first, path: path}
+	moved := make([]walEntry, len(snapshot))
+	w := bufio.NewWriter(f)
+	for i, snap := range snapshot {
+		data, err := snap.entry.read()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		header := walHeader{Bucket: snap.ref.bucket, Key: snap.ref.key, Metadata: snap.entry.meta, ModTime: snap.entry.modTime}
+		record, dataOffset, err := encodeWALRecord(walOpPut, header, data)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if _, err := w.Write(record); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		moved[i] = snap.entry
+		moved[i].file = checkpoint
+		moved[i].offset = checkpoint.size + dataOffset
+		moved[i].record = int64(len(record))
+		checkpoint.size += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, nil, err
+	}
+	if checkpoint.f, err = os.Open(path); err != nil {
+		return nil, nil, err
+	}
+	return checkpoint, moved, nil
+}
+
+// Close flushes the log and closes its files
+func (s *WALStorage) Close() error {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errors.Is(s.err, errWALClosed) {
+		return nil
+	}
+	err := s.err
+	if err == nil {
+		err = s.active().f.Sync()
+	}
+	s.closeFiles()
+	s.err = errWALClosed
+	return err
+}
+
+func (s *WALStorage) closeFiles() {
+	if s.checkpoint != nil {
+		s.checkpoint.f.Close()
+	}
+	for _, segment := range s.segments {
+		segment.f.Close()
+	}
+}
+
+// syncDir flushes the entries of a directory, making created, renamed and
+// removed files durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
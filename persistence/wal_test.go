@@ -0,0 +1,186 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+func openTestWAL(t *testing.T, dir string, config WALConfig) *WALStorage {
+	t.Helper()
+	s, err := OpenWALStorage(dir, config)
+	if err != nil {
+		t.Fatalf("OpenWALStorage failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestWALStorage_PutGetDeleteAndRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestWAL(t, dir, WALConfig{Sync: SyncAlways})
+
+	created, err := s.PutWithMetadata("photos", "cat.png", []byte("meow"), domain.Metadata{"tags": "pet"})
+	if err != nil || !created {
+		t.Fatalf("Put failed: created %v, err %v", created, err)
+	}
+	if created, _ := s.PutWithMetadata("photos", "cat.png", []byte("meow"), domain.Metadata{"tags": "pet"}); created {
+		t.Errorf("expected an identical put to leave the object unchanged")
+	}
+	s.Put("photos", "dog.png", []byte("woof"))
+	s.Put("photos", "dog.png", []byte("WOOF"))
+	s.Put("docs", "a.txt", []byte("a"))
+	if err := s.Delete("docs", "a.txt"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.Delete("docs", "a.txt"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	s.Close()
+
+	// The index is rebuilt from the log
+	s = openTestWAL(t, dir, WALConfig{Sync: SyncAlways})
+	data, meta, err := s.GetWithMetadata("photos", "cat.png")
+	if err != nil || string(data) != "meow" || meta["tags"] != "pet" {
+		t.Fatalf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+	if data, _ := s.Get("photos", "dog.png"); string(data) != "WOOF" {
+		t.Errorf("expected the last version, got %q", data)
+	}
+	if _, err := s.Get("docs", "a.txt"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	buckets, _ := s.ListBuckets()
+	infos, _ := s.ListObjects("photos", "")
+	if len(buckets) != 1 || len(infos) != 2 || infos[0].ID != "cat.png" || infos[0].Size != 4 {
+		t.Errorf("unexpected listing %v %+v", buckets, infos)
+	}
+}
+
+func TestWALStorage_TornWrites(t *testing.T) {
+	record, _, err := encodeWALRecord(walOpPut, walHeader{Bucket: "b", Key: "torn"}, []byte("never acknowledged"))
+	if err != nil {
+		t.Fatalf("encodeWALRecord failed: %v", err)
+	}
+	damaged := append([]byte(nil), record...)
+	damaged[len(damaged)-1] ^= 0xff
+
+	// A crash may interrupt a write after any of its bytes
+	tails := map[string][]byte{"corrupt": damaged}
+	for cut := 1; cut < len(record); cut++ {
+		tails[fmt.Sprintf("cut at %d", cut)] = record[:cut]
+	}
+	for name, tail := range tails {
+		dir := t.TempDir()
+		s, err := OpenWALStorage(dir, WALConfig{Sync: SyncBatch})
+		if err != nil {
+			t.Fatalf("OpenWALStorage failed: %v", err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := s.Put("b", fmt.Sprint(i), []byte(fmt.Sprint("value ", i))); err != nil {
+					t.Errorf("Put failed: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		// The process dies while appending a record, without closing the log
+		f, _ := os.OpenFile(filepath.Join(dir, walFileName(1, segmentExt)), os.O_WRONLY|os.O_APPEND, 0)
+		f.Write(tail)
+		f.Close()
+
+		s = openTestWAL(t, dir, WALConfig{Sync: SyncBatch})
+		for i := 0; i < 8; i++ {
+			if data, err := s.Get("b", fmt.Sprint(i)); err != nil || string(data) != fmt.Sprint("value ", i) {
+				t.Fatalf("%s: acknowledged write %d lost: %q (err %v)", name, i, data, err)
+			}
+		}
+		if _, err := s.Get("b", "torn"); err != domain.ErrNotFound {
+			t.Fatalf("%s: expected the torn write to be discarded, got %v", name, err)
+		}
+		// The log is writable after the truncated tail
+		s.Put("b", "after", []byte("crash"))
+		s.Close()
+		s = openTestWAL(t, dir, WALConfig{})
+		if data, err := s.Get("b", "after"); err != nil || string(data) != "crash" {
+			t.Fatalf("%s: expected the write after recovery, got %q (err %v)", name, data, err)
+		}
+	}
+}
+
+func TestWALStorage_CheckpointAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	config := WALConfig{Sync: SyncAlways, SegmentSize: 512}
+	s := openTestWAL(t, dir, config)
+	for i := 0; i < 50; i++ {
+		s.Put("b", "counter", []byte(fmt.Sprint(i)))
+	}
+	s.Put("b", "deleted", []byte("gone"))
+	s.Put("b", "kept", []byte("here"))
+	s.Delete("b", "deleted")
+	if len(s.segments) < 5 {
+		t.Fatalf("expected the log to span several segments, got %d", len(s.segments))
+	}
+
+	if err := s.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("expected a checkpoint and an empty segment, got %d files", len(entries))
+	}
+	if data, _ := s.Get("b", "counter"); string(data) != "49" {
+		t.Errorf("expected the last value, got %q", data)
+	}
+
+	// Writes after the checkpoint are replayed on top of it
+	s.Put("b", "counter", []byte("after"))
+	s.Delete("b", "kept")
+	s.Close()
+	s = openTestWAL(t, dir, config)
+	if data, _ := s.Get("b", "counter"); string(data) != "after" {
+		t.Errorf("expected the write after the checkpoint, got %q", data)
+	}
+	for _, key := range []string{"deleted", "kept"} {
+		if _, err := s.Get("b", key); err != domain.ErrNotFound {
+			t.Errorf("expected %s to be deleted, got %v", key, err)
+		}
+	}
+
+	// A checkpoint interrupted before its rename is ignored
+	os.WriteFile(filepath.Join(dir, walFileName(99, checkpointExt)+".tmp"), []byte("partial"), 0o644)
+	s.Close()
+	s = openTestWAL(t, dir, config)
+	if data, _ := s.Get("b", "counter"); string(data) != "after" {
+		t.Errorf("expected the write after the checkpoint, got %q", data)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	if p, err := ParseSyncPolicy(""); err != nil || p != SyncBatch {
+		t.Errorf("expected the batch policy by default, got %q (err %v)", p, err)
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Errorf("expected an unknown policy to be rejected")
+	}
+}
+
+func TestWALStorage_UpdateMetadata(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestWAL(t, dir, WALConfig{Sync: SyncAlways})
+	checkUpdateMetadata(t, s, "cat.png", []byte("meow"))
+	s.Close()
+
+	s = openTestWAL(t, dir, WALConfig{Sync: SyncAlways})
+	data, meta, err := s.GetWithMetadata("photos", "cat.png")
+	if err != nil || string(data) != "meow" || meta["status"] != "done" {
+		t.Errorf("expected the update to survive a restart, got %q %v (err %v)", data, meta, err)
+	}
+}
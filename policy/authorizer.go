@@ -0,0 +1,189 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+// Request is an action a principal attempts on a bucket
+type Request struct {
+	Principal *auth.Principal
+	Action    string
+	Bucket    string
+	// Key is the object key, or the listing prefix for object:List
+	Key      string
+	SourceIP string
+}
+
+// principalNames returns the identifiers statement principals are matched against
+func (r Request) principalNames() []string {
+	p := r.Principal
+	if p == nil {
+		p = auth.Anonymous
+	}
+	names := []string{p.Name}
+	for _, role := range p.Roles {
+		names = append(names, "role:"+role)
+	}
+	if p.Tenant != "" {
+		names = append(names, "tenant:"+p.Tenant)
+	}
+	return names
+}
+
+// resource returns the resource statement resources are matched against.
+// Buckets of a tenant namespace are named relative to the namespace.
+func (r Request) resource() string {
+	_, bucket := domain.SplitTenantBucket(r.Bucket)
+	if strings.HasPrefix(r.Action, "object:") {
+		return bucket + "/" + r.Key
+	}
+	return bucket
+}
+
+// Decision is the outcome of an authorization, with the steps which led to it
+type Decision struct {
+	Allowed   bool     `json:"allowed"`
+	Reason    string   `json:"reason"`
+	Statement string   `json:"statement,omitempty"`
+	Trace     []string `json:"trace,omitempty"`
+}
+
+// Authorizer evaluates requests against the policies and ACLs of buckets.
+//
+// An explicit Deny statement always wins, then an Allow statement or the
+// bucket ACL grant access. Buckets with a policy or ACL deny anything else,
+// buckets without any fall back to the default decision for object actions.
+// Bucket actions, which change who can access a bucket, are never allowed by
+// default: they require the admin role or an explicit grant.
+type Authorizer struct {
+	mu           sync.RWMutex
+	policies     map[string]Policy
+	acls         map[string]ACL
+	defaultAllow bool
+}
+
+// NewAuthorizer creates an authorizer, defaultAllow is the decision for object
+// actions on buckets without policy nor ACL
+func NewAuthorizer(defaultAllow bool) *Authorizer {
+	return &Authorizer{
+		policies:     make(map[string]Policy),
+		acls:         make(map[string]ACL),
+		defaultAllow: defaultAllow,
+	}
+}
+
+// SetPolicy replaces the policy of a bucket
+func (a *Authorizer) SetPolicy(bucket string, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policies[bucket] = p
+	return nil
+}
+
+// Policy returns the policy of a bucket
+func (a *Authorizer) Policy(bucket string) (Policy, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	p, ok := a.policies[bucket]
+	return p, ok
+}
+
+// DeletePolicy removes the policy of a bucket
+func (a *Authorizer) DeletePolicy(bucket string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.policies[bucket]
+	delete(a.policies, bucket)
+	return ok
+}
+
+// SetACL sets the canned ACL of a bucket
+func (a *Authorizer) SetACL(bucket string, acl ACL) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acls[bucket] = acl
+}
+
+// ACL returns the canned ACL of a bucket
+func (a *Authorizer) ACL(bucket string) (ACL, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	acl, ok := a.acls[bucket]
+	return acl, ok
+}
+
+// Authorize decides whether the request is allowed
+func (a *Authorizer) Authorize(req Request) Decision {
+	if req.Principal == nil {
+		req.Principal = auth.Anonymous
+	}
+	var trace []string
+	deny := func(reason, sid string) Decision {
+		return Decision{Allowed: false, Reason: reason, Statement: sid, Trace: append(trace, reason)}
+	}
+	allow := func(reason, sid string) Decision {
+		return Decision{Allowed: true, Reason: reason, Statement: sid, Trace: append(trace, reason)}
+	}
+
+	if req.Principal.HasRole(auth.RoleAdmin) {
+		return allow("principal has the admin role", "")
+	}
+
+	a.mu.RLock()
+	p, hasPolicy := a.policies[req.Bucket]
+	acl, hasACL := a.acls[req.Bucket]
+	a.mu.RUnlock()
+
+	allowedBy := ""
+	for i, st := range p.Statements {
+		sid := statementName(st, i)
+		ok, why := st.matches(req)
+		if !ok {
+			trace = append(trace, fmt.Sprintf("statement %s skipped: %s", sid, why))
+			continue
+		}
+		if st.Effect == Deny {
+			return deny(fmt.Sprintf("explicitly denied by statement %s", sid), sid)
+		}
+		trace = append(trace, fmt.Sprintf("statement %s allows", sid))
+		if allowedBy == "" {
+			allowedBy = sid
+		}
+	}
+	if allowedBy != "" {
+		return allow(fmt.Sprintf("allowed by statement %s", allowedBy), allowedBy)
+	}
+
+	if hasACL {
+		if acl.grants(req.Action) {
+			return allow(fmt.Sprintf("allowed by canned acl %s", acl), "")
+		}
+		trace = append(trace, fmt.Sprintf("canned acl %s does not grant %s", acl, req.Action))
+	}
+
+	if hasPolicy || hasACL {
+		return deny("no statement allows the request", "")
+	}
+	if !strings.HasPrefix(req.Action, "object:") {
+		return deny("bucket actions require the admin role or an explicit grant", "")
+	}
+	if a.defaultAllow {
+		return allow("bucket has no policy nor acl, allowed by default", "")
+	}
+	return deny("bucket has no policy nor acl, denied by default", "")
+}
+
+func statementName(st Statement, i int) string {
+	if st.Sid != "" {
+		return st.Sid
+	}
+	return fmt.Sprintf("#%d", i)
+}
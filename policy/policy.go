@@ -0,0 +1,210 @@
+// Package policy authorizes requests against bucket policies and canned ACLs.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Actions which can be allowed or denied by a policy
+const (
+	ActionGetObject    = "object:Get"
+	ActionPutObject    = "object:Put"
+	ActionDeleteObject = "object:Delete"
+	ActionListObjects  = "object:List"
+	ActionWatchObjects = "object:Watch"
+
+	ActionGetPolicy           = "bucket:GetPolicy"
+	ActionPutPolicy           = "bucket:PutPolicy"
+	ActionDeletePolicy        = "bucket:DeletePolicy"
+	ActionGetACL              = "bucket:GetACL"
+	ActionPutACL              = "bucket:PutACL"
+	ActionGetConfiguration    = "bucket:GetConfiguration"
+	ActionPutConfiguration    = "bucket:PutConfiguration"
+	ActionDeleteConfiguration = "bucket:DeleteConfiguration"
+)
+
+// Effect of a statement
+type Effect string
+
+const (
+	Allow Effect = "Allow"
+	Deny  Effect = "Deny"
+)
+
+// Conditions restrict when a statement applies. Every non empty condition must match.
+type Conditions struct {
+	// SourceIP lists the CIDRs or addresses requests must come from
+	SourceIP []string `json:"sourceIp,omitempty"`
+	// Prefix lists the key prefixes the object (or listing prefix) must start with
+	Prefix []string `json:"prefix,omitempty"`
+}
+
+// Statement allows or denies actions on resources to principals.
+//
+// Principals match the principal name, "role:<role>", "tenant:<tenant>" or "*".
+// Actions match exactly or with wildcards such as "object:*". Resources are
+// "<bucket>/<key>" patterns for objects and "<bucket>" for bucket-wide actions,
+// "*" matches any sequence of characters and "?" any single character.
+type Statement struct {
+	Sid        string     `json:"sid,omitempty"`
+	Effect     Effect     `json:"effect"`
+	Principals []string   `json:"principals"`
+	Actions    []string   `json:"actions"`
+	Resources  []string   `json:"resources"`
+	Conditions Conditions `json:"conditions,omitempty"`
+}
+
+// Policy is the set of statements attached to a bucket
+type Policy struct {
+	Statements []Statement `json:"statements"`
+}
+
+// Validate checks the policy is well formed
+func (p Policy) Validate() error {
+	if len(p.Statements) == 0 {
+		return errors.New("at least one statement is required")
+	}
+	for i, st := range p.Statements {
+		name := st.Sid
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if st.Effect != Allow && st.Effect != Deny {
+			return fmt.Errorf("statement %s: effect must be Allow or Deny", name)
+		}
+		if len(st.Principals) == 0 || len(st.Actions) == 0 || len(st.Resources) == 0 {
+			return fmt.Errorf("statement %s: principals, actions and resources are required", name)
+		}
+		for _, cidr := range st.Conditions.SourceIP {
+			if _, err := parseCIDR(cidr); err != nil {
+				return fmt.Errorf("statement %s: invalid source ip %q", name, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+// ACL is a canned access control list of a bucket
+type ACL string
+
+const (
+	// ACLPrivate grants access only through policies
+	ACLPrivate ACL = "private"
+	// ACLPublicRead additionally lets anyone get and list objects
+	ACLPublicRead ACL = "public-read"
+)
+
+// ParseACL validates a canned ACL name
+func ParseACL(name string) (ACL, error) {
+	switch acl := ACL(name); acl {
+	case ACLPrivate, ACLPublicRead:
+		return acl, nil
+	}
+	return "", fmt.Errorf("unsupported canned acl %q", name)
+}
+
+// grants reports whether the ACL allows an action by itself
+func (a ACL) grants(action string) bool {
+	return a == ACLPublicRead && (action == ActionGetObject || action == ActionListObjects || action == ActionWatchObjects)
+}
+
+// matches reports whether the statement applies to the request, explaining why not
+func (st Statement) matches(req Request) (bool, string) {
+	if !matchAny(st.Principals, req.principalNames()) {
+		return false, "principal does not match"
+	}
+	if !matchAny(st.Actions, []string{req.Action}) {
+		return false, "action does not match"
+	}
+	if !matchAny(st.Resources, []string{req.resource()}) {
+		return false, "resource does not match"
+	}
+	if len(st.Conditions.SourceIP) > 0 && !sourceIPMatches(st.Conditions.SourceIP, req.SourceIP) {
+		return false, "source ip condition not met"
+	}
+	if len(st.Conditions.Prefix) > 0 && !prefixMatches(st.Conditions.Prefix, req.Key) {
+		return false, "prefix condition not met"
+	}
+	return true, ""
+}
+
+// matchAny reports whether any of the patterns matches any of the values
+func matchAny(patterns, values []string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if Match(p, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Match reports whether value matches pattern, where "*" matches any sequence
+// of characters and "?" any single character
+func Match(pattern, value string) bool {
+	p, v := 0, 0
+	star, match := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case p < len(pattern) && pattern[p] == '*':
+			star, match = p, v
+			p++
+		case star >= 0:
+			p = star + 1
+			match++
+			v = match
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func sourceIPMatches(cidrs []string, source string) bool {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if network, err := parseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR parses a CIDR, a plain address is treated as a single host network
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+func prefixMatches(prefixes []string, key string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
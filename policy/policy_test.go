@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"*", "anything", true},
+		{"logs/*", "logs/app/2024.log", true},
+		{"logs/*.log", "logs/app.log", true},
+		{"logs/*.log", "logs/app.txt", false},
+		{"object:*", "object:Get", true},
+		{"object:?et", "object:Get", true},
+		{"logs", "logs/a", false},
+		{"", "", true},
+	}
+	for _, c := range cases {
+		if got := Match(c.pattern, c.value); got != c.want {
+			t.Errorf("Match(%q, %q) = %v; want %v", c.pattern, c.value, got, c.want)
+		}
+	}
+}
+
+func TestAuthorizer_Policy(t *testing.T) {
+	a := NewAuthorizer(true)
+	err := a.SetPolicy("logs", Policy{Statements: []Statement{
+		{Sid: "team-a-read", Effect: Allow, Principals: []string{"tenant:team-a"}, Actions: []string{ActionGetObject, ActionListObjects}, Resources: []string{"logs/*"}},
+		{Sid: "writers", Effect: Allow, Principals: []string{"role:writer"}, Actions: []string{"object:*"}, Resources: []string{"logs/*"},
+			Conditions: Conditions{SourceIP: []string{"10.0.0.0/8"}, Prefix: []string{"app/"}}},
+		{Sid: "no-delete", Effect: Deny, Principals: []string{"*"}, Actions: []string{ActionDeleteObject}, Resources: []string{"logs/audit/*"}},
+	}})
+	if err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+
+	teamA := &auth.Principal{Name: "alice", Tenant: "team-a"}
+	writer := &auth.Principal{Name: "ci", Roles: []string{"writer"}}
+	cases := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{"team a reads", Request{Principal: teamA, Action: ActionGetObject, Bucket: "logs", Key: "x"}, true},
+		{"team a can't delete", Request{Principal: teamA, Action: ActionDeleteObject, Bucket: "logs", Key: "x"}, false},
+		{"anonymous denied", Request{Action: ActionGetObject, Bucket: "logs", Key: "x"}, false},
+		{"writer from network", Request{Principal: writer, Action: ActionPutObject, Bucket: "logs", Key: "app/1", SourceIP: "10.1.2.3"}, true},
+		{"writer outside network", Request{Principal: writer, Action: ActionPutObject, Bucket: "logs", Key: "app/1", SourceIP: "192.168.1.1"}, false},
+		{"writer outside prefix", Request{Principal: writer, Action: ActionPutObject, Bucket: "logs", Key: "db/1", SourceIP: "10.1.2.3"}, false},
+		{"explicit deny wins", Request{Principal: writer, Action: ActionDeleteObject, Bucket: "logs", Key: "audit/1", SourceIP: "10.1.2.3"}, false},
+		{"admin bypasses policy", Request{Principal: &auth.Principal{Name: "root", Roles: []string{auth.RoleAdmin}}, Action: ActionDeleteObject, Bucket: "logs", Key: "audit/1"}, true},
+		{"bucket without policy uses default", Request{Action: ActionDeleteObject, Bucket: "other", Key: "x"}, true},
+		{"bucket actions are never allowed by default", Request{Principal: writer, Action: ActionPutPolicy, Bucket: "other"}, false},
+		{"bucket actions need a grant", Request{Principal: writer, Action: ActionPutACL, Bucket: "logs"}, false},
+	}
+	for _, c := range cases {
+		if got := a.Authorize(c.req); got.Allowed != c.want {
+			t.Errorf("%s: allowed = %v; want %v (%s)", c.name, got.Allowed, c.want, got.Reason)
+		}
+	}
+}
+
+func TestAuthorizer_CannedACL(t *testing.T) {
+	a := NewAuthorizer(false)
+	a.SetACL("public", ACLPublicRead)
+	a.SetACL("private", ACLPrivate)
+
+	if !a.Authorize(Request{Action: ActionGetObject, Bucket: "public", Key: "x"}).Allowed {
+		t.Errorf("expected public-read bucket to be readable")
+	}
+	if a.Authorize(Request{Action: ActionPutObject, Bucket: "public", Key: "x"}).Allowed {
+		t.Errorf("expected public-read bucket not to be writable")
+	}
+	if a.Authorize(Request{Action: ActionGetObject, Bucket: "private", Key: "x"}).Allowed {
+		t.Errorf("expected private bucket not to be readable")
+	}
+	if a.Authorize(Request{Action: ActionGetObject, Bucket: "unconfigured", Key: "x"}).Allowed {
+		t.Errorf("expected default deny")
+	}
+}
+
+func TestAuthorizer_ExplainTrace(t *testing.T) {
+	a := NewAuthorizer(true)
+	a.SetPolicy("logs", Policy{Statements: []Statement{
+		{Sid: "readers", Effect: Allow, Principals: []string{"bob"}, Actions: []string{ActionGetObject}, Resources: []string{"logs/*"}},
+	}})
+
+	d := a.Authorize(Request{Principal: &auth.Principal{Name: "alice"}, Action: ActionGetObject, Bucket: "logs", Key: "x"})
+	if d.Allowed || len(d.Trace) != 2 || d.Trace[0] != "statement readers skipped: principal does not match" {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	invalid := []Policy{
+		{},
+		{Statements: []Statement{{Effect: "Maybe", Principals: []string{"*"}, Actions: []string{"*"}, Resources: []string{"*"}}}},
+		{Statements: []Statement{{Effect: Allow, Actions: []string{"*"}, Resources: []string{"*"}}}},
+		{Statements: []Statement{{Effect: Allow, Principals: []string{"*"}, Actions: []string{"*"}, Resources: []string{"*"},
+			Conditions: Conditions{SourceIP: []string{"not-an-ip"}}}}},
+	}
+	for i, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("policy %d: expected validation error", i)
+		}
+	}
+}
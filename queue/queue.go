@@ -0,0 +1,358 @@
+// Package queue implements a durable FIFO queue of messages kept as files in
+// a directory, with delayed redelivery for retries.
+package queue
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for messages which are not in the queue
+var ErrNotFound = errors.New("message not found")
+
+// fileExt is the extension of message files
+const fileExt = ".msg"
+
+// Message is an entry of the queue
+type Message struct {
+	ID       string          `json:"id"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	// ReadyAt is when the message can be leased again after a failed attempt
+	ReadyAt   time.Time `json:"readyAt"`
+	Enqueued  time.Time `json:"enqueued"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// RetryPolicy controls how consumers retry failed messages. The delay doubles
+// after every failed attempt, from InitialBackoff up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Backoff returns the delay before the attempt following the given number of failed attempts
+func (p RetryPolicy) Backoff(failed int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < failed && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxBackoff)
+}
+
+// Queue is a FIFO of messages persisted one file per message, so that they
+// survive restarts. Messages are leased by consumers and removed once
+// acknowledged, leases are not persisted so unacknowledged messages are
+// delivered again after a restart (at-least-once delivery).
+//
+// A queue opened with an empty directory is kept in memory only.
+type Queue struct {
+	dir string
+
+	mu       sync.Mutex
+	seq      uint64
+	messages map[string]*item
+	// order holds the message IDs in FIFO order. Removed messages are
+	// skipped until there are as many as messages left, then compacted.
+	order   []string
+	removed int
+	ready   readyHeap // messages not leased, by ready time
+	notify  chan struct{}
+	now     func() time.Time
+}
+
+// item is a message of the queue with its position in the ready heap, -1
+// while it is leased
+type item struct {
+	Message
+	index int
+}
+
+// readyHeap orders messages by ready time, then by ID so that messages
+// ready at the same time are delivered in FIFO order
+type readyHeap []*item
+
+func (h readyHeap) Len() int { return len(h) }
+
+func (h readyHeap) Less(i, j int) bool {
+	if !h[i].ReadyAt.Equal(h[j].ReadyAt) {
+		return h[i].ReadyAt.Before(h[j].ReadyAt)
+	}
+	return h[i].ID < h[j].ID
+}
+
+func (h readyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *readyHeap) Push(x any) {
+	it := x.(*item)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *readyHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	it.index = -1
+	return it
+}
+
+// Open loads the queue stored in dir, creating the directory if needed
+func Open(dir string) (*Queue, error) {
+	q := &Queue{
+		dir:      dir,
+		messages: make(map[string]*item),
+		notify:   make(chan struct{}, 1),
+		now:      time.Now,
+	}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("corrupted message %s: %w", name, err)
+		}
+		it := &item{Message: msg, index: len(q.ready)}
+		q.messages[msg.ID] = it
+		q.order = append(q.order, msg.ID)
+		q.ready = append(q.ready, it)
+		if seq, err := strconv.ParseUint(msg.ID, 10, 64); err == nil && seq > q.seq {
+			q.seq = seq
+		}
+	}
+	sort.Strings(q.order)
+	heap.Init(&q.ready)
+	return q, nil
+}
+
+// Enqueue appends a message with the given JSON payload
+func (q *Queue) Enqueue(payload []byte) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	now := q.now().UTC()
+	it := &item{Message: Message{
+		ID:       fmt.Sprintf("%020d", q.seq),
+		Payload:  append(json.RawMessage(nil), payload...),
+		ReadyAt:  now,
+		Enqueued: now,
+	}}
+	if err := q.write(&it.Message); err != nil {
+		return "", err
+	}
+	q.messages[it.ID] = it
+	q.order = append(q.order, it.ID)
+	heap.Push(&q.ready, it)
+	q.signal()
+	return it.ID, nil
+}
+
+// Lease returns the message ready for delivery for the longest time and
+// hides it from other consumers until it is acknowledged or retried
+func (q *Queue) Lease() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.ready) == 0 || q.ready[0].ReadyAt.After(q.now()) {
+		return Message{}, false
+	}
+	it := heap.Pop(&q.ready).(*item)
+	return it.Message, true
+}
+
+// Ack removes a delivered message
+func (q *Queue) Ack(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.remove(id)
+}
+
+// Retry releases a leased message, counting a failed attempt, so that it is
+// delivered again at readyAt
+func (q *Queue) Retry(id string, readyAt time.Time, lastError string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	it, ok := q.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := it.Message
+	updated.Attempts++
+	updated.ReadyAt = readyAt.UTC()
+	updated.LastError = lastError
+	if err := q.write(&updated); err != nil {
+		return err
+	}
+	it.Message = updated
+	if it.index < 0 {
+		heap.Push(&q.ready, it)
+	} else {
+		heap.Fix(&q.ready, it.index)
+	}
+	q.signal()
+	return nil
+}
+
+// Get returns a message
+func (q *Queue) Get(id string) (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it, ok := q.messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return it.Message, true
+}
+
+// List returns every message in FIFO order
+func (q *Queue) List() []Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := make([]Message, 0, len(q.messages))
+	for _, id := range q.order {
+		if it, ok := q.messages[id]; ok {
+			messages = append(messages, it.Message)
+		}
+	}
+	return messages
+}
+
+// Len returns the number of messages in the queue
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// Oldest returns when the oldest message of the queue was enqueued
+func (q *Queue) Oldest() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Removed messages are trimmed from the front of order, so it starts with the oldest message
+	if len(q.order) == 0 {
+		return time.Time{}, false
+	}
+	return q.messages[q.order[0]].Enqueued, true
+}
+
+// NextReady returns when the next message which is not leased becomes ready
+func (q *Queue) NextReady() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.ready) == 0 {
+		return time.Time{}, false
+	}
+	return q.ready[0].ReadyAt, true
+}
+
+// Notify returns a channel signalled when messages are enqueued or retried
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// remove deletes a message, q.mu must be held
+func (q *Queue) remove(id string) error {
+	it, ok := q.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if q.dir != "" {
+		if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(q.messages, id)
+	if it.index >= 0 {
+		heap.Remove(&q.ready, it.index)
+	}
+
+	q.removed++
+	for len(q.order) > 0 && q.messages[q.order[0]] == nil {
+		q.order = q.order[1:]
+		q.removed--
+	}
+	if q.removed > len(q.messages) {
+		order := make([]string, 0, len(q.messages))
+		for _, other := range q.order {
+			if _, ok := q.messages[other]; ok {
+				order = append(order, other)
+			}
+		}
+		q.order, q.removed = order, 0
+	}
+	return nil
+}
+
+// write persists a message atomically, q.mu must be held
+func (q *Queue) write(msg *Message) error {
+	if q.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(q.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path(msg.ID))
+}
+
+func (q *Queue) path(id string) string {
+	return filepath.Join(q.dir, id+fileExt)
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueue_Durable(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, payload := range []string{`"a"`, `"b"`, `"c"`} {
+		if _, err := q.Enqueue([]byte(payload)); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+
+	// Messages are leased in FIFO order and hidden while leased
+	first, ok := q.Lease()
+	if !ok || string(first.Payload) != `"a"` {
+		t.Fatalf("expected first message, got %+v", first)
+	}
+	second, _ := q.Lease()
+	if string(second.Payload) != `"b"` {
+		t.Fatalf("expected second message, got %+v", second)
+	}
+	if err := q.Ack(first.ID); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if err := q.Retry(second.ID, time.Now().Add(time.Hour), "boom"); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+
+	// After a restart, unacknowledged messages are still there with their attempts
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 messages after reopening, got %d", q.Len())
+	}
+	msg, ok := q.Lease()
+	if !ok || string(msg.Payload) != `"c"` {
+		t.Fatalf("expected the delayed message to be skipped, got %+v", msg)
+	}
+	if _, ok := q.Lease(); ok {
+		t.Errorf("expected no message to be ready")
+	}
+	retried, ok := q.Get(second.ID)
+	if !ok || retried.Attempts != 1 || retried.LastError != "boom" {
+		t.Errorf("expected retried message to keep its attempts, got %+v", retried)
+	}
+	if next, ok := q.NextReady(); !ok || !next.Equal(retried.ReadyAt) {
+		t.Errorf("expected next ready time %v, got %v", retried.ReadyAt, next)
+	}
+
+	// New messages never reuse identifiers of existing ones
+	id, _ := q.Enqueue([]byte(`"d"`))
+	if id <= msg.ID {
+		t.Errorf("expected increasing identifiers, got %s after %s", id, msg.ID)
+	}
+	if err := q.Ack("missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestQueue_InMemory(t *testing.T) {
+	q, err := Open("")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	q.Enqueue([]byte(`{}`))
+	select {
+	case <-q.Notify():
+	default:
+		t.Errorf("expected consumers to be notified")
+	}
+	msg, ok := q.Lease()
+	if !ok {
+		t.Fatalf("expected a message")
+	}
+	q.Ack(msg.ID)
+	if q.Len() != 0 {
+		t.Errorf("expected empty queue, got %d", q.Len())
+	}
+}
+
+func TestQueue_ReadyOrder(t *testing.T) {
+	q, _ := Open("")
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	var ids []string
+	for i := 0; i < 100; i++ {
+		id, _ := q.Enqueue([]byte(`{}`))
+		ids = append(ids, id)
+	}
+
+	// A retried message is delivered once ready, after the messages ready before it
+	first, _ := q.Lease()
+	q.Retry(first.ID, now.Add(time.Minute), "boom")
+	if next, ok := q.NextReady(); !ok || !next.Equal(now) {
+		t.Errorf("expected the next message to be ready now, got %v", next)
+	}
+	for _, id := range ids[1:] {
+		msg, ok := q.Lease()
+		if !ok || msg.ID != id {
+			t.Fatalf("expected message %s, got %+v", id, msg)
+		}
+		q.Ack(msg.ID)
+	}
+	if _, ok := q.Lease(); ok {
+		t.Fatalf("expected the retried message to be delayed")
+	}
+	if oldest, ok := q.Oldest(); !ok || !oldest.Equal(now.UTC()) || q.Len() != 1 || len(q.List()) != 1 || len(q.order) > 2 {
+		t.Errorf("expected the retried message to be left, got %v and %d messages", oldest, q.Len())
+	}
+
+	now = now.Add(time.Minute)
+	if msg, ok := q.Lease(); !ok || msg.ID != first.ID || msg.Attempts != 1 {
+		t.Errorf("expected the retried message, got %+v", msg)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for failed, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 50: 10 * time.Second} {
+		if got := p.Backoff(failed); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", failed, got, want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Package quota enforces per-bucket and per-tenant storage quotas and keeps
+// track of their usage incrementally.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrBucketQuotaExceeded is returned when a write would exceed a bucket hard quota
+	ErrBucketQuotaExceeded = errors.New("bucket quota exceeded")
+	// ErrTenantQuotaExceeded is returned when a write would exceed a tenant hard quota
+	ErrTenantQuotaExceeded = errors.New("tenant quota exceeded")
+)
+
+var (
+	usageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quota_usage_bytes",
+		Help: "Bytes currently stored, by scope (bucket or tenant).",
+	}, []string{"scope", "name"})
+	usageObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "quota_usage_objects",
+		Help: "Objects currently stored, by scope (bucket or tenant).",
+	}, []string{"scope", "name"})
+	rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quota_rejected_writes_total",
+		Help: "Writes rejected because of a hard quota, by scope.",
+	}, []string{"scope"})
+	softExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "quota_soft_limit_exceeded_total",
+		Help: "Writes accepted above a soft quota, by scope.",
+	}, []string{"scope"})
+)
+
+const (
+	ScopeBucket = "bucket"
+	ScopeTenant = "tenant"
+)
+
+// Limits are the quotas of a bucket or tenant. Zero means unlimited.
+// Exceeding a soft limit is allowed but reported, hard limits reject the write.
+type Limits struct {
+	HardBytes   int64 `json:"hardBytes,omitempty"`
+	HardObjects int64 `json:"hardObjects,omitempty"`
+	SoftBytes   int64 `json:"softBytes,omitempty"`
+	SoftObjects int64 `json:"softObjects,omitempty"`
+}
+
+// Validate checks the limits are consistent
+func (l Limits) Validate() error {
+	if l.HardBytes < 0 || l.HardObjects < 0 || l.SoftBytes < 0 || l.SoftObjects < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if l.HardBytes > 0 && l.SoftBytes > l.HardBytes {
+		return errors.New("soft byte limit must not exceed the hard limit")
+	}
+	if l.HardObjects > 0 && l.SoftObjects > l.HardObjects {
+		return errors.New("soft object limit must not exceed the hard limit")
+	}
+	return nil
+}
+
+// Usage is the current consumption of a bucket or tenant
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+func (u Usage) add(bytes, objects int64) Usage {
+	return Usage{Bytes: u.Bytes + bytes, Objects: u.Objects + objects}
+}
+
+// hardExceeded reports whether usage is above the hard limits
+func (l Limits) hardExceeded(u Usage) bool {
+	return (l.HardBytes > 0 && u.Bytes > l.HardBytes) || (l.HardObjects > 0 && u.Objects > l.HardObjects)
+}
+
+// softExceeded reports whether usage is above the soft limits
+func (l Limits) softExceeded(u Usage) bool {
+	return (l.SoftBytes > 0 && u.Bytes > l.SoftBytes) || (l.SoftObjects > 0 && u.Objects > l.SoftObjects)
+}
+
+// Report is the usage and limits of a bucket or tenant
+type Report struct {
+	Name         string `json:"name"`
+	Usage        Usage  `json:"usage"`
+	Limits       Limits `json:"limits"`
+	SoftExceeded bool   `json:"softExceeded"`
+	HardExceeded bool   `json:"hardExceeded"`
+}
+
+// Manager holds quota limits and the incrementally maintained usage of every
+// bucket and tenant. Sizes of stored objects are indexed so that overwrites
+// and deletes adjust usage without rescanning the storage.
+type Manager struct {
+	mu sync.Mutex
+
+	sizes        map[string]map[string]int64 // bucket -> objectID -> size
+	bucketUsage  map[string]Usage
+	tenantUsage  map[string]Usage
+	bucketLimits map[string]Limits
+	tenantLimits map[string]Limits
+	owners       map[string]string // bucket -> tenant, for buckets outside a tenant namespace
+}
+
+// NewManager creates a quota manager with no limits
+func NewManager() *Manager {
+	return &Manager{
+		sizes:        make(map[string]map[string]int64),
+		bucketUsage:  make(map[string]Usage),
+		tenantUsage:  make(map[string]Usage),
+		bucketLimits: make(map[string]Limits),
+		tenantLimits: make(map[string]Limits),
+		owners:       make(map[string]string),
+	}
+}
+
+// SetBucketLimits configures the quotas of a bucket
+func (m *Manager) SetBucketLimits(bucket string, limits Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bucketLimits[bucket] = limits
+	return nil
+}
+
+// SetTenantLimits configures the quotas of a tenant
+func (m *Manager) SetTenantLimits(tenant string, limits Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tenantLimits[tenant] = limits
+	return nil
+}
+
+// AssignBucket makes bucket count towards the usage of tenant
+func (m *Manager) AssignBucket(bucket, tenant string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if previous, ok := m.ownerOf(bucket); ok {
+		u := m.bucketUsage[bucket]
+		m.adjustTenant(previous, -u.Bytes, -u.Objects)
+	}
+	m.owners[bucket] = tenant
+	u := m.bucketUsage[bucket]
+	m.adjustTenant(tenant, u.Bytes, u.Objects)
+}
+
+// BucketReport returns the usage and limits of a bucket
+func (m *Manager) BucketReport(bucket string) Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return newReport(bucket, m.bucketUsage[bucket], m.bucketLimits[bucket])
+}
+
+// TenantReport returns the usage and limits of a tenant
+func (m *Manager) TenantReport(tenant string) Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return newReport(tenant, m.tenantUsage[tenant], m.tenantLimits[tenant])
+}
+
+// Reports returns the usage and limits of every known bucket and tenant
+func (m *Manager) Reports() (buckets, tenants []Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, u := range m.bucketUsage {
+		buckets = append(buckets, newReport(name, u, m.bucketLimits[name]))
+	}
+	for name, u := range m.tenantUsage {
+		tenants = append(tenants, newReport(name, u, m.tenantLimits[name]))
+	}
+	return buckets, tenants
+}
+
+func newReport(name string, u Usage, l Limits) Report {
+	return Report{
+		Name:         name,
+		Usage:        u,
+		Limits:       l,
+		SoftExceeded: l.softExceeded(u),
+		HardExceeded: l.hardExceeded(u),
+	}
+}
+
+// Load seeds usage from the current content of a storage, it is meant to be
+// called once at startup
+func (m *Manager) Load(lister domain.Lister) error {
+	buckets, err := lister.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		objects, err := lister.ListObjects(bucket, "")
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		for _, obj := range objects {
+			m.record(bucket, obj.ID, obj.Size)
+		}
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// reserve checks that storing size bytes as bucket/objectID respects the hard
+// quotas and accounts for it, returning the function undoing it when the
+// write fails. The writes of an object must be serialized by the caller.
+func (m *Manager) reserve(bucket, objectID string, size int64) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(bucket, objectID, size); err != nil {
+		return nil, err
+	}
+	previous, existed := m.sizes[bucket][objectID]
+	m.record(bucket, objectID, size)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if existed {
+			m.record(bucket, objectID, previous)
+		} else {
+			m.forget(bucket, objectID)
+		}
+	}, nil
+}
+
+// check checks that storing size bytes as bucket/objectID respects the hard
+// quotas. m.mu must be held.
+func (m *Manager) check(bucket, objectID string, size int64) error {
+	deltaBytes, deltaObjects := m.delta(bucket, objectID, size)
+	if deltaBytes <= 0 && deltaObjects <= 0 {
+		return nil
+	}
+
+	bucketUsage := m.bucketUsage[bucket].add(deltaBytes, deltaObjects)
+	if limits := m.bucketLimits[bucket]; limits.hardExceeded(bucketUsage) {
+		rejected.WithLabelValues(ScopeBucket).Inc()
+		return fmt.Errorf("%w: %s", ErrBucketQuotaExceeded, bucket)
+	} else if limits.softExceeded(bucketUsage) {
+		softExceeded.WithLabelValues(ScopeBucket).Inc()
+	}
+
+	tenant, ok := m.ownerOf(bucket)
+	if !ok {
+		return nil
+	}
+	tenantUsage := m.tenantUsage[tenant].add(deltaBytes, deltaObjects)
+	if limits := m.tenantLimits[tenant]; limits.hardExceeded(tenantUsage) {
+		rejected.WithLabelValues(ScopeTenant).Inc()
+		return fmt.Errorf("%w: %s", ErrTenantQuotaExceeded, tenant)
+	} else if limits.softExceeded(tenantUsage) {
+		softExceeded.WithLabelValues(ScopeTenant).Inc()
+	}
+	return nil
+}
+
+// Forget releases the usage of an object removed from the storage
+func (m *Manager) Forget(bucket, objectID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forget(bucket, objectID)
+}
+
+// SoftExceeded reports whether bucket, or the tenant owning it, is above a soft quota
+func (m *Manager) SoftExceeded(bucket string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.bucketLimits[bucket].softExceeded(m.bucketUsage[bucket]) {
+		return true
+	}
+	tenant, ok := m.ownerOf(bucket)
+	return ok && m.tenantLimits[tenant].softExceeded(m.tenantUsage[tenant])
+}
+
+// delta returns how usage changes when bucket/objectID is stored with size bytes
+func (m *Manager) delta(bucket, objectID string, size int64) (int64, int64) {
+	if previous, ok := m.sizes[bucket][objectID]; ok {
+		return size - previous, 0
+	}
+	return size, 1
+}
+
+// record accounts for bucket/objectID being stored with size bytes. m.mu must be held.
+func (m *Manager) record(bucket, objectID string, size int64) {
+	deltaBytes, deltaObjects := m.delta(bucket, objectID, size)
+	if _, ok := m.sizes[bucket]; !ok {
+		m.sizes[bucket] = make(map[string]int64)
+	}
+	m.sizes[bucket][objectID] = size
+	m.adjust(bucket, deltaBytes, deltaObjects)
+}
+
+// forget accounts for bucket/objectID being deleted. m.mu must be held.
+func (m *Manager) forget(bucket, objectID string) {
+	size, ok := m.sizes[bucket][objectID]
+	if !ok {
+		return
+	}
+	delete(m.sizes[bucket], objectID)
+	m.adjust(bucket, -size, -1)
+}
+
+// ownerOf returns the tenant a bucket counts towards: the tenant it was
+// assigned to, or the tenant of its namespace. m.mu must be held.
+func (m *Manager) ownerOf(bucket string) (string, bool) {
+	if tenant, ok := m.owners[bucket]; ok {
+		return tenant, true
+	}
+	tenant, _ := domain.SplitTenantBucket(bucket)
+	return tenant, tenant != ""
+}
+
+func (m *Manager) adjust(bucket string, bytes, objects int64) {
+	u := m.bucketUsage[bucket].add(bytes, objects)
+	m.bucketUsage[bucket] = u
+	usageBytes.WithLabelValues(ScopeBucket, bucket).Set(float64(u.Bytes))
+	usageObjects.WithLabelValues(ScopeBucket, bucket).Set(float64(u.Objects))
+
+	if tenant, ok := m.ownerOf(bucket); ok {
+		m.adjustTenant(tenant, bytes, objects)
+	}
+}
+
+func (m *Manager) adjustTenant(tenant string, bytes, objects int64) {
+	u := m.tenantUsage[tenant].add(bytes, objects)
+	m.tenantUsage[tenant] = u
+	usageBytes.WithLabelValues(ScopeTenant, tenant).Set(float64(u.Bytes))
+	usageObjects.WithLabelValues(ScopeTenant, tenant).Set(float64(u.Objects))
+}
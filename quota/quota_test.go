@@ -0,0 +1,165 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+)
+
+func TestStorage_BucketHardQuota(t *testing.T) {
+	manager := NewManager()
+	storage := NewStorage(persistence.NewInMemoryStorage(), manager)
+	if err := manager.SetBucketLimits("bucket", Limits{HardBytes: 10, HardObjects: 2}); err != nil {
+		t.Fatalf("SetBucketLimits failed: %v", err)
+	}
+
+	if _, err := storage.Put("bucket", "a", []byte("12345")); err != nil {
+		t.Fatalf("Put within quota failed: %v", err)
+	}
+	if _, err := storage.Put("bucket", "b", []byte("123456")); !errors.Is(err, ErrBucketQuotaExceeded) {
+		t.Fatalf("expected byte quota error, got %v", err)
+	}
+
+	// Overwriting an object only accounts for the size difference
+	if _, err := storage.Put("bucket", "a", []byte("1234567890")); err != nil {
+		t.Fatalf("overwrite within quota failed: %v", err)
+	}
+	if u := manager.BucketReport("bucket").Usage; u.Bytes != 10 || u.Objects != 1 {
+		t.Errorf("unexpected usage after overwrite: %+v", u)
+	}
+
+	// Deleting releases the usage
+	if err := storage.Delete("bucket", "a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	storage.Put("bucket", "x", []byte("1"))
+	storage.Put("bucket", "y", []byte("1"))
+	if _, err := storage.Put("bucket", "z", []byte("1")); !errors.Is(err, ErrBucketQuotaExceeded) {
+		t.Fatalf("expected object count quota error, got %v", err)
+	}
+	if u := manager.BucketReport("bucket").Usage; u.Bytes != 2 || u.Objects != 2 {
+		t.Errorf("unexpected usage: %+v", u)
+	}
+}
+
+func TestStorage_TenantQuota(t *testing.T) {
+	manager := NewManager()
+	storage := NewStorage(persistence.NewInMemoryStorage(), manager)
+	manager.SetTenantLimits("team-a", Limits{HardBytes: 8, SoftBytes: 4})
+	manager.AssignBucket("logs", "team-a")
+	manager.AssignBucket("metrics", "team-a")
+
+	storage.Put("logs", "a", []byte("12345"))
+	if !manager.SoftExceeded("logs") {
+		t.Errorf("expected soft quota to be reported as exceeded")
+	}
+	if _, err := storage.Put("metrics", "b", []byte("12345")); !errors.Is(err, ErrTenantQuotaExceeded) {
+		t.Fatalf("expected tenant quota error, got %v", err)
+	}
+	if u := manager.TenantReport("team-a").Usage; u.Bytes != 5 || u.Objects != 1 {
+		t.Errorf("unexpected tenant usage: %+v", u)
+	}
+}
+
+func TestStorage_ConcurrentPutsRespectQuota(t *testing.T) {
+	manager := NewManager()
+	storage := NewStorage(persistence.NewInMemoryStorage(), manager)
+	manager.SetBucketLimits("bucket", Limits{HardObjects: 10})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storage.Put("bucket", fmt.Sprintf("obj-%d", i), []byte("data"))
+		}(i)
+	}
+	wg.Wait()
+
+	if u := manager.BucketReport("bucket").Usage; u.Objects != 10 {
+		t.Errorf("expected exactly 10 objects stored, got %d", u.Objects)
+	}
+}
+
+// slowStorage blocks the writes of the "slow" object until release is
+// closed and fails those of the "broken" object
+type slowStorage struct {
+	*persistence.InMemoryStorage
+	release chan struct{}
+}
+
+func (s *slowStorage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	switch objectID {
+	case "slow":
+		<-s.release
+	case "broken":
+		return false, errors.New("disk failure")
+	}
+	return s.InMemoryStorage.PutWithMetadata(bucket, objectID, data, meta)
+}
+
+func TestStorage_WritesOutsideTheLock(t *testing.T) {
+	manager := NewManager()
+	inner := &slowStorage{InMemoryStorage: persistence.NewInMemoryStorage(), release: make(chan struct{})}
+	storage := NewStorage(inner, manager)
+	manager.SetBucketLimits("bucket", Limits{HardObjects: 2})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storage.Put("bucket", "slow", []byte("1"))
+	}()
+	// The slow write holds its reservation while other objects are written
+	deadline := time.Now().Add(5 * time.Second)
+	for manager.BucketReport("bucket").Usage.Objects != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the slow write to be reserved")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := storage.Put("bucket", "fast", []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := storage.Put("bucket", "other", []byte("1")); !errors.Is(err, ErrBucketQuotaExceeded) {
+		t.Errorf("expected the reservation to count towards the quota, got %v", err)
+	}
+	close(inner.release)
+	<-done
+
+	// Failed writes release their reservation
+	storage.Delete("bucket", "fast")
+	if _, err := storage.Put("bucket", "broken", []byte("1")); err == nil {
+		t.Fatalf("expected the write to fail")
+	}
+	if u := manager.BucketReport("bucket").Usage; u.Objects != 1 || u.Bytes != 1 {
+		t.Errorf("unexpected usage after a failed write: %+v", u)
+	}
+}
+
+func TestManager_Load(t *testing.T) {
+	inner := persistence.NewInMemoryStorage()
+	inner.Put("bucket", "a", []byte("123"))
+	inner.Put("bucket", "b", []byte("45"))
+
+	manager := NewManager()
+	if err := manager.Load(inner); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if u := manager.BucketReport("bucket").Usage; u.Bytes != 5 || u.Objects != 2 {
+		t.Errorf("unexpected usage after load: %+v", u)
+	}
+}
+
+func TestLimits_Validate(t *testing.T) {
+	if err := (Limits{HardBytes: 10, SoftBytes: 20}).Validate(); err == nil {
+		t.Errorf("expected soft limit above hard limit to be rejected")
+	}
+	if err := (Limits{HardObjects: -1}).Validate(); err == nil {
+		t.Errorf("expected negative limit to be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package quota
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+)
+
+// stripes is the number of locks serializing the writes of an object
+const stripes = 256
+
+// Storage is a domain.Storage decorator enforcing the quotas of a Manager
+type Storage struct {
+	inner   domain.Storage
+	manager *Manager
+	// locks serialize the writes of an object, so that its usage is
+	// accounted in the order they reach the storage
+	locks [stripes]sync.Mutex
+}
+
+// NewStorage wraps inner, rejecting writes which would exceed the hard quotas of manager
+func NewStorage(inner domain.Storage, manager *Manager) *Storage {
+	return &Storage{inner: inner, manager: manager}
+}
+
+func (s *Storage) lock(bucket, objectID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(objectID))
+	return &s.locks[h.Sum32()%stripes]
+}
+
+// Put stores the object if it fits in the bucket and tenant quotas
+func (s *Storage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object with its metadata if it fits in the bucket and tenant quotas.
+// The object is accounted before the write, so that concurrent writes can't
+// exceed the quotas together, and released if the write fails.
+func (s *Storage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	mu := s.lock(bucket, objectID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	undo, err := s.manager.reserve(bucket, objectID, int64(len(data)))
+	if err != nil {
+		return false, err
+	}
+	created, err := domain.PutWithMetadata(s.inner, bucket, objectID, data, meta)
+	if err != nil {
+		undo()
+		return false, err
+	}
+	return created, nil
+}
+
+// Get retrieves the object
+func (s *Storage) Get(bucket, objectID string) ([]byte, error) {
+	return s.inner.Get(bucket, objectID)
+}
+
+// GetWithMetadata retrieves the object and its metadata
+func (s *Storage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	return domain.GetWithMetadata(s.inner, bucket, objectID)
+}
+
+// Exists reports whether the object exists in the underlying storage
+func (s *Storage) Exists(bucket, objectID string) (bool, error) {
+	return domain.Exists(s.inner, bucket, objectID)
+}
+
+// UpdateMetadata forwards the metadata update to the underlying storage
+func (s *Storage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	return domain.UpdateMetadata(s.inner, bucket, objectID, changes)
+}
+
+// Delete removes the object and releases its usage
+func (s *Storage) Delete(bucket, objectID string) error {
+	mu := s.lock(bucket, objectID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := s.inner.Delete(bucket, objectID); err != nil {
+		return err
+	}
+	s.manager.Forget(bucket, objectID)
+	return nil
+}
+
+// ListBuckets lists the buckets of the underlying storage
+func (s *Storage) ListBuckets() ([]string, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListBuckets()
+}
+
+// ListObjects lists the objects of the underlying storage
+func (s *Storage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListObjects(bucket, prefix)
+}
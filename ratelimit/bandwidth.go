@@ -0,0 +1,362 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	transferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bandwidth_transferred_bytes_total",
+		Help: "Bytes of object bodies transferred through the bandwidth throttle, by direction.",
+	}, []string{"direction"})
+	throttleWait = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bandwidth_throttle_wait_seconds_total",
+		Help: "Time transfers spent waiting for bandwidth, by direction.",
+	}, []string{"direction"})
+	activeTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bandwidth_active_transfers",
+		Help: "Transfers currently going through the bandwidth throttle, by direction.",
+	}, []string{"direction"})
+)
+
+// Direction of a transfer
+type Direction string
+
+const (
+	Upload   Direction = "upload"
+	Download Direction = "download"
+)
+
+// maxChunk bounds the bytes a transfer waits for at once, so that concurrent
+// transfers sharing a limit take turns in small slices
+const maxChunk = 32 * 1024
+
+// BandwidthLimits are bytes per second limits of one direction. Zero means unlimited.
+type BandwidthLimits struct {
+	// Global is shared by every transfer
+	Global int64 `json:"global"`
+	// PerKey is shared by the transfers of a principal
+	PerKey int64 `json:"perKey"`
+	// PerConnection applies to each transfer on its own
+	PerConnection int64 `json:"perConnection"`
+}
+
+// BandwidthConfig holds the upload and download limits
+type BandwidthConfig struct {
+	Upload   BandwidthLimits `json:"upload"`
+	Download BandwidthLimits `json:"download"`
+}
+
+// Validate checks the limits are not negative
+func (c BandwidthConfig) Validate() error {
+	for _, l := range []BandwidthLimits{c.Upload, c.Download} {
+		if l.Global < 0 || l.PerKey < 0 || l.PerConnection < 0 {
+			return errors.New("bandwidth limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// ParseBandwidthConfig parses a comma separated list of
+// "<direction>.<scope>=<bytes per second>" entries, where direction is upload
+// or download and scope is global, perKey or perConnection, such as
+// "download.global=104857600,download.perConnection=10485760".
+func ParseBandwidthConfig(config string) (BandwidthConfig, error) {
+	var c BandwidthConfig
+	for _, item := range strings.Split(config, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		target, value, ok := strings.Cut(item, "=")
+		direction, scope, ok2 := strings.Cut(target, ".")
+		if !ok || !ok2 {
+			return c, fmt.Errorf("invalid bandwidth limit %q: expected <direction>.<scope>=<bytes per second>", item)
+		}
+		bytesPerSecond, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return c, fmt.Errorf("invalid bandwidth in %q: %w", item, err)
+		}
+
+		var limits *BandwidthLimits
+		switch Direction(direction) {
+		case Upload:
+			limits = &c.Upload
+		case Download:
+			limits = &c.Download
+		default:
+			return c, fmt.Errorf("unknown bandwidth direction %q", direction)
+		}
+		switch scope {
+		case "global":
+			limits.Global = bytesPerSecond
+		case "perKey":
+			limits.PerKey = bytesPerSecond
+		case "perConnection":
+			limits.PerConnection = bytesPerSecond
+		default:
+			return c, fmt.Errorf("unknown bandwidth scope %q", scope)
+		}
+	}
+	return c, c.Validate()
+}
+
+func (c BandwidthConfig) limits(d Direction) BandwidthLimits {
+	if d == Upload {
+		return c.Upload
+	}
+	return c.Download
+}
+
+// setLimit applies bytes per second to a token bucket. The burst is one
+// second worth of bytes, at most maxChunk.
+func setLimit(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+		l.SetBurst(maxChunk)
+		return
+	}
+	burst := int(min(bytesPerSecond, maxChunk))
+	l.SetLimit(rate.Limit(bytesPerSecond))
+	l.SetBurst(burst)
+}
+
+func newByteLimiter(bytesPerSecond int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, maxChunk)
+	setLimit(l, bytesPerSecond)
+	return l
+}
+
+// keyLimiter is the token bucket of a key, it is kept while the key is idle
+// so that sequential transfers don't each start with a full bucket
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	refs     int
+	lastSeen time.Time
+}
+
+// Bandwidth throttles the bytes per second of object transfers globally, per
+// key and per connection. Transfers wait for their bytes in small chunks in
+// the order they asked for them, so that concurrent transfers share a limit
+// fairly. Limits can be changed at runtime and apply to running transfers.
+type Bandwidth struct {
+	mu        sync.Mutex
+	config    BandwidthConfig
+	global    map[Direction]*rate.Limiter
+	keys      map[Direction]map[string]*keyLimiter
+	transfers map[*Transfer]struct{}
+	lastSweep time.Time
+}
+
+// NewBandwidth creates a bandwidth throttle with the given limits
+func NewBandwidth(config BandwidthConfig) (*Bandwidth, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	b := &Bandwidth{
+		config:    config,
+		global:    make(map[Direction]*rate.Limiter),
+		keys:      make(map[Direction]map[string]*keyLimiter),
+		transfers: make(map[*Transfer]struct{}),
+	}
+	for _, d := range []Direction{Upload, Download} {
+		b.global[d] = newByteLimiter(config.limits(d).Global)
+		b.keys[d] = make(map[string]*keyLimiter)
+	}
+	return b, nil
+}
+
+// Config returns the current limits
+func (b *Bandwidth) Config() BandwidthConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.config
+}
+
+// SetConfig replaces the limits, running transfers are adjusted
+func (b *Bandwidth) SetConfig(config BandwidthConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.config = config
+	for d, l := range b.global {
+		setLimit(l, config.limits(d).Global)
+	}
+	for d, keys := range b.keys {
+		for _, k := range keys {
+			setLimit(k.limiter, config.limits(d).PerKey)
+		}
+	}
+	for t := range b.transfers {
+		setLimit(t.connection, config.limits(t.direction).PerConnection)
+	}
+	return nil
+}
+
+// Start begins a transfer on behalf of key (empty for anonymous clients),
+// Done must be called once it is over
+func (b *Bandwidth) Start(ctx context.Context, key string, d Direction) *Transfer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.sweep(now)
+
+	limits := b.config.limits(d)
+	t := &Transfer{
+		ctx:        ctx,
+		bandwidth:  b,
+		direction:  d,
+		key:        key,
+		connection: newByteLimiter(limits.PerConnection),
+	}
+	t.limiters = []*rate.Limiter{t.connection}
+	if key != "" {
+		k, ok := b.keys[d][key]
+		if !ok {
+			k = &keyLimiter{limiter: newByteLimiter(limits.PerKey)}
+			b.keys[d][key] = k
+		}
+		k.refs++
+		k.lastSeen = now
+		t.limiters = append(t.limiters, k.limiter)
+	}
+	t.limiters = append(t.limiters, b.global[d])
+
+	b.transfers[t] = struct{}{}
+	activeTransfers.WithLabelValues(string(d)).Inc()
+	return t
+}
+
+// sweep forgets the token buckets of keys idle for long, b.mu must be held
+func (b *Bandwidth) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < time.Minute {
+		return
+	}
+	b.lastSweep = now
+	for _, keys := range b.keys {
+		for key, k := range keys {
+			if k.refs == 0 && now.Sub(k.lastSeen) > idleTimeout {
+				delete(keys, key)
+			}
+		}
+	}
+}
+
+// Transfer is a throttled upload or download
+type Transfer struct {
+	ctx        context.Context
+	bandwidth  *Bandwidth
+	direction  Direction
+	key        string
+	connection *rate.Limiter
+	limiters   []*rate.Limiter // connection, key and global
+	done       sync.Once
+}
+
+// Done releases the resources of the transfer
+func (t *Transfer) Done() {
+	t.done.Do(func() {
+		b := t.bandwidth
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.transfers, t)
+		if k, ok := b.keys[t.direction][t.key]; ok {
+			k.refs--
+			k.lastSeen = time.Now()
+		}
+		activeTransfers.WithLabelValues(string(t.direction)).Dec()
+	})
+}
+
+// chunk returns how many bytes can be waited for at once
+func (t *Transfer) chunk() int {
+	n := maxChunk
+	for _, l := range t.limiters {
+		n = min(n, l.Burst())
+	}
+	return max(n, 1)
+}
+
+// wait blocks until n bytes can be transferred
+func (t *Transfer) wait(n int) error {
+	start := time.Now()
+	for _, l := range t.limiters {
+		// The burst may shrink while waiting when the limits are changed
+		for remaining := n; remaining > 0; {
+			k := min(remaining, max(l.Burst(), 1))
+			if err := l.WaitN(t.ctx, k); err != nil {
+				return err
+			}
+			remaining -= k
+		}
+	}
+	throttleWait.WithLabelValues(string(t.direction)).Add(time.Since(start).Seconds())
+	transferredBytes.WithLabelValues(string(t.direction)).Add(float64(n))
+	return nil
+}
+
+// Reader throttles the bytes read from r
+func (t *Transfer) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, t: t}
+}
+
+// Writer throttles the bytes written to w
+func (t *Transfer) Writer(w io.Writer) io.Writer {
+	return &throttledWriter{w: w, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Transfer
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if chunk := tr.t.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if waitErr := tr.t.wait(n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	w io.Writer
+	t *Transfer
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), tw.t.chunk())
+		if err := tw.t.wait(n); err != nil {
+			return written, err
+		}
+		m, err := tw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
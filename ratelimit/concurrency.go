@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrQueueFull is returned when the in-flight limit is reached and the queue is full
+	ErrQueueFull = errors.New("too many requests queued")
+	// ErrQueueTimeout is returned when a queued request waited too long for a slot
+	ErrQueueTimeout = errors.New("timed out waiting for a request slot")
+)
+
+var (
+	inFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "concurrency_in_flight_requests",
+		Help: "Requests currently being served.",
+	})
+	queued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "concurrency_queued_requests",
+		Help: "Requests waiting for a slot.",
+	})
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "concurrency_queue_wait_seconds",
+		Help:    "Time requests waited in the queue before being served.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	concurrencyRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "concurrency_rejected_requests_total",
+		Help: "Requests rejected by the concurrency limiter, by reason (queue_full or timeout).",
+	}, []string{"reason"})
+)
+
+// Concurrency bounds the number of requests served at the same time. Requests
+// above the limit wait in a bounded queue, for at most the queue timeout.
+type Concurrency struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	mu       sync.Mutex
+	queued   int
+	maxQueue int
+}
+
+// NewConcurrency creates a limiter serving at most maxInFlight requests at a
+// time with up to maxQueue requests waiting at most timeout for a slot
+func NewConcurrency(maxInFlight, maxQueue int, timeout time.Duration) *Concurrency {
+	return &Concurrency{
+		slots:    make(chan struct{}, maxInFlight),
+		timeout:  timeout,
+		maxQueue: maxQueue,
+	}
+}
+
+// Acquire waits for a slot, the returned function releases it
+func (c *Concurrency) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case c.slots <- struct{}{}:
+		return c.acquired(), nil
+	default:
+	}
+
+	c.mu.Lock()
+	if c.queued >= c.maxQueue {
+		c.mu.Unlock()
+		concurrencyRejected.WithLabelValues("queue_full").Inc()
+		return nil, ErrQueueFull
+	}
+	c.queued++
+	queued.Inc()
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.queued--
+		queued.Dec()
+		c.mu.Unlock()
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		queueWait.Observe(time.Since(start).Seconds())
+		return c.acquired(), nil
+	case <-timer.C:
+		concurrencyRejected.WithLabelValues("timeout").Inc()
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Concurrency) acquired() func() {
+	inFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlight.Dec()
+			<-c.slots
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// Package ratelimit throttles requests with token buckets per client, API key
+// and bucket, and bounds the number of requests served concurrently.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_throttled_total",
+		Help: "Requests rejected by a rate limit, by dimension and class.",
+	}, []string{"dimension", "class"})
+	trackedLimiters = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ratelimit_tracked_limiters",
+		Help: "Token buckets currently tracked, by dimension.",
+	}, []string{"dimension"})
+)
+
+// Dimension is what requests are grouped by when rate limiting
+type Dimension string
+
+const (
+	DimensionKey    Dimension = "key"
+	DimensionIP     Dimension = "ip"
+	DimensionBucket Dimension = "bucket"
+)
+
+var dimensions = []Dimension{DimensionKey, DimensionIP, DimensionBucket}
+
+// Class separates the limits of reads and writes
+type Class string
+
+const (
+	ClassRead  Class = "read"
+	ClassWrite Class = "write"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second and holding at
+// most Burst tokens. A zero Rate means unlimited.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l Limit) unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Request identifies who a request comes from and what it targets, empty
+// fields are not rate limited
+type Request struct {
+	Key    string
+	IP     string
+	Bucket string
+	Class  Class
+}
+
+func (r Request) name(d Dimension) string {
+	switch d {
+	case DimensionKey:
+		return r.Key
+	case DimensionIP:
+		return r.IP
+	}
+	return r.Bucket
+}
+
+// idleTimeout is how long the token bucket of an inactive client is kept
+const idleTimeout = 10 * time.Minute
+
+type entry struct {
+	limiter  *rate.Limiter
+	limit    Limit
+	lastSeen time.Time
+}
+
+// limitKey identifies a configured limit, an empty name is the default of the dimension
+type limitKey struct {
+	dimension Dimension
+	class     Class
+	name      string
+}
+
+// Limiter applies token bucket rate limits per API key, client IP and bucket,
+// separately for reads and writes. Every dimension has a default limit which
+// can be overridden for specific keys, IPs or buckets.
+type Limiter struct {
+	mu        sync.Mutex
+	limits    map[limitKey]Limit
+	entries   map[limitKey]*entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter creates a limiter without any limit
+func NewLimiter() *Limiter {
+	return &Limiter{
+		limits:  make(map[limitKey]Limit),
+		entries: make(map[limitKey]*entry),
+		now:     time.Now,
+	}
+}
+
+// SetLimit configures the limit of a dimension and class. An empty name sets
+// the default, otherwise the limit applies only to that key, IP or bucket.
+func (l *Limiter) SetLimit(d Dimension, c Class, name string, limit Limit) error {
+	if limit.Rate < 0 || limit.Burst < 0 {
+		return errors.New("rate and burst must not be negative")
+	}
+	if !limit.unlimited() && limit.Burst == 0 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Token buckets are recreated with the new limit on their next use
+	l.limits[limitKey{dimension: d, class: c, name: name}] = limit
+	return nil
+}
+
+// limitFor returns the limit applying to name, l.mu must be held
+func (l *Limiter) limitFor(d Dimension, c Class, name string) Limit {
+	if limit, ok := l.limits[limitKey{dimension: d, class: c, name: name}]; ok {
+		return limit
+	}
+	return l.limits[limitKey{dimension: d, class: c}]
+}
+
+// Allow takes a token from every bucket the request is subject to. When one
+// of them is empty nothing is taken and the time after which the request
+// would be allowed is returned.
+func (l *Limiter) Allow(req Request) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var reservations []*rate.Reservation
+	for _, d := range dimensions {
+		name := req.name(d)
+		if name == "" {
+			continue
+		}
+		limit := l.limitFor(d, req.Class, name)
+		if limit.unlimited() {
+			continue
+		}
+
+		k := limitKey{dimension: d, class: req.Class, name: name}
+		e, ok := l.entries[k]
+		if !ok || e.limit != limit {
+			e = &entry{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst), limit: limit}
+			l.entries[k] = e
+		}
+		e.lastSeen = now
+
+		res := e.limiter.ReserveN(now, 1)
+		if !res.OK() || res.DelayFrom(now) > 0 {
+			retryAfter := res.DelayFrom(now)
+			if !res.OK() {
+				retryAfter = time.Second
+			}
+			res.CancelAt(now)
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+			throttled.WithLabelValues(string(d), string(req.Class)).Inc()
+			return false, retryAfter
+		}
+		reservations = append(reservations, res)
+	}
+	return true, 0
+}
+
+// sweep forgets the token buckets of idle clients, l.mu must be held
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	counts := make(map[Dimension]int)
+	for k, e := range l.entries {
+		if now.Sub(e.lastSeen) > idleTimeout {
+			delete(l.entries, k)
+			continue
+		}
+		counts[k.dimension]++
+	}
+	for _, d := range dimensions {
+		trackedLimiters.WithLabelValues(string(d)).Set(float64(counts[d]))
+	}
+}
+
+// Configure sets limits from a comma separated list of
+// "<dimension>.<class>[.<name>]=<rate>[:<burst>]" entries, such as
+// "ip.read=50:100,ip.write=10,bucket.write.photos=100:200".
+func (l *Limiter) Configure(config string) error {
+	for _, item := range strings.Split(config, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		target, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid rate limit %q: expected <dimension>.<class>[.<name>]=<rate>[:<burst>]", item)
+		}
+
+		parts := strings.SplitN(target, ".", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("invalid rate limit target %q", target)
+		}
+		d, c := Dimension(parts[0]), Class(parts[1])
+		if d != DimensionKey && d != DimensionIP && d != DimensionBucket {
+			return fmt.Errorf("unknown rate limit dimension %q", d)
+		}
+		if c != ClassRead && c != ClassWrite {
+			return fmt.Errorf("unknown rate limit class %q", c)
+		}
+		name := ""
+		if len(parts) == 3 {
+			name = parts[2]
+		}
+
+		var limit Limit
+		rateValue, burstValue, hasBurst := strings.Cut(value, ":")
+		var err error
+		if limit.Rate, err = strconv.ParseFloat(rateValue, 64); err != nil {
+			return fmt.Errorf("invalid rate in %q: %w", item, err)
+		}
+		if hasBurst {
+			if limit.Burst, err = strconv.Atoi(burstValue); err != nil {
+				return fmt.Errorf("invalid burst in %q: %w", item, err)
+			}
+		}
+		if err := l.SetLimit(d, c, name, limit); err != nil {
+			return fmt.Errorf("invalid rate limit %q: %w", item, err)
+		}
+	}
+	return nil
+}
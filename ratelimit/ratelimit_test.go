@@ -0,0 +1,238 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter()
+	l.now = func() time.Time { return now }
+	if err := l.Configure("ip.read=1:2,ip.write=1:1,bucket.read.hot=10:1"); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	read := Request{IP: "10.0.0.1", Bucket: "photos", Class: ClassRead}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow(read); !ok {
+			t.Fatalf("expected read %d within burst to be allowed", i)
+		}
+	}
+	ok, retryAfter := l.Allow(read)
+	if ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("expected read above burst to be throttled with a retry delay, got %v %v", ok, retryAfter)
+	}
+
+	// Writes and other clients have their own token buckets
+	if ok, _ := l.Allow(Request{IP: "10.0.0.1", Class: ClassWrite}); !ok {
+		t.Errorf("expected write to be allowed")
+	}
+	if ok, _ := l.Allow(Request{IP: "10.0.0.2", Class: ClassRead}); !ok {
+		t.Errorf("expected other client to be allowed")
+	}
+
+	// Tokens are refilled over time
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow(read); !ok {
+		t.Errorf("expected read to be allowed after refill")
+	}
+
+	// A bucket override applies on top of the client limit, a request throttled
+	// by the bucket does not consume client tokens
+	hot := Request{IP: "10.0.0.3", Bucket: "hot", Class: ClassRead}
+	if ok, _ := l.Allow(hot); !ok {
+		t.Fatalf("expected first read of hot bucket to be allowed")
+	}
+	if ok, _ := l.Allow(hot); ok {
+		t.Errorf("expected hot bucket burst to be exhausted")
+	}
+	now = now.Add(100 * time.Millisecond)
+	if ok, _ := l.Allow(hot); !ok {
+		t.Errorf("expected client tokens to be left after a throttled request")
+	}
+}
+
+func TestLimiter_Configure(t *testing.T) {
+	for _, config := range []string{"ip.read", "ip=1", "user.read=1", "ip.delete=1", "ip.read=x", "ip.read=1:x", "ip.read=-1"} {
+		if err := NewLimiter().Configure(config); err == nil {
+			t.Errorf("expected %q to be rejected", config)
+		}
+	}
+
+	l := NewLimiter()
+	if err := l.Configure("key.write=2.5, bucket.write.acme/logs=100:500"); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if limit := l.limitFor(DimensionKey, ClassWrite, "ci"); limit != (Limit{Rate: 2.5, Burst: 3}) {
+		t.Errorf("unexpected default limit %+v", limit)
+	}
+	if limit := l.limitFor(DimensionBucket, ClassWrite, "acme/logs"); limit != (Limit{Rate: 100, Burst: 500}) {
+		t.Errorf("unexpected override %+v", limit)
+	}
+	if limit := l.limitFor(DimensionBucket, ClassRead, "acme/logs"); !limit.unlimited() {
+		t.Errorf("expected reads to be unlimited, got %+v", limit)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	c := NewConcurrency(1, 1, 50*time.Millisecond)
+	release, err := c.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// A second request is queued and times out
+	start := time.Now()
+	if _, err := c.Acquire(context.Background()); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("expected queue timeout, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected request to wait in the queue")
+	}
+
+	// A queued request gets the slot once released, further requests find the queue full
+	acquired := make(chan error)
+	go func() {
+		release, err := c.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	for {
+		c.mu.Lock()
+		waiting := c.queued
+		c.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Acquire(context.Background()); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected full queue, got %v", err)
+	}
+	release()
+	release() // releasing twice is harmless
+	if err := <-acquired; err != nil {
+		t.Errorf("expected queued request to be served, got %v", err)
+	}
+}
+
+func TestBandwidth_Throttle(t *testing.T) {
+	b, err := NewBandwidth(BandwidthConfig{Download: BandwidthLimits{PerConnection: 100 * 1024}})
+	if err != nil {
+		t.Fatalf("NewBandwidth failed: %v", err)
+	}
+
+	// The first chunk is the burst, the second one waits for the limit
+	transfer := b.Start(context.Background(), "", Download)
+	var out bytes.Buffer
+	start := time.Now()
+	if n, err := transfer.Writer(&out).Write(make([]byte, 64*1024)); err != nil || n != 64*1024 {
+		t.Fatalf("Write failed: %d %v", n, err)
+	}
+	transfer.Done()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("expected download to be throttled, took %v", elapsed)
+	}
+
+	// Uploads are not limited
+	transfer = b.Start(context.Background(), "", Upload)
+	start = time.Now()
+	if data, err := io.ReadAll(transfer.Reader(bytes.NewReader(make([]byte, 1024*1024)))); err != nil || len(data) != 1024*1024 {
+		t.Fatalf("ReadAll failed: %d %v", len(data), err)
+	}
+	transfer.Done()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected upload not to be throttled, took %v", elapsed)
+	}
+}
+
+func TestBandwidth_SharedAndRuntimeLimits(t *testing.T) {
+	b, err := NewBandwidth(BandwidthConfig{Upload: BandwidthLimits{PerKey: 64 * 1024}})
+	if err != nil {
+		t.Fatalf("NewBandwidth failed: %v", err)
+	}
+
+	// Two transfers of the same key share its limit and progress together
+	var wg sync.WaitGroup
+	finished := make([]time.Duration, 2)
+	start := time.Now()
+	for i := range finished {
+		transfer := b.Start(context.Background(), "acme/ci", Upload)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer transfer.Done()
+			io.Copy(io.Discard, transfer.Reader(bytes.NewReader(make([]byte, 32*1024))))
+			finished[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+	if finished[0] < 250*time.Millisecond && finished[1] < 250*time.Millisecond {
+		t.Errorf("expected the key limit to be shared, finished after %v", finished)
+	}
+
+	// The key bucket is kept between sequential transfers
+	start = time.Now()
+	transfer := b.Start(context.Background(), "acme/ci", Upload)
+	io.Copy(io.Discard, transfer.Reader(bytes.NewReader(make([]byte, 16*1024))))
+	transfer.Done()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the next transfer of the key to wait, took %v", elapsed)
+	}
+
+	// Raising the limit speeds up a running transfer
+	if err := b.SetConfig(BandwidthConfig{Upload: BandwidthLimits{PerConnection: 1024}}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	transfer = b.Start(context.Background(), "", Upload)
+	defer transfer.Done()
+	done := make(chan time.Duration)
+	start = time.Now()
+	go func() {
+		io.Copy(io.Discard, transfer.Reader(bytes.NewReader(make([]byte, 8*1024))))
+		done <- time.Since(start)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := b.SetConfig(BandwidthConfig{}); err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	select {
+	case elapsed := <-done:
+		if elapsed > 3*time.Second {
+			t.Errorf("expected transfer to speed up, took %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transfer did not pick up the new limit")
+	}
+
+	if got := b.Config(); got != (BandwidthConfig{}) {
+		t.Errorf("unexpected config %+v", got)
+	}
+	if err := b.SetConfig(BandwidthConfig{Download: BandwidthLimits{Global: -1}}); err == nil {
+		t.Errorf("expected negative limits to be rejected")
+	}
+}
+
+func TestParseBandwidthConfig(t *testing.T) {
+	c, err := ParseBandwidthConfig("download.global=1000, download.perConnection=100,upload.perKey=10")
+	if err != nil {
+		t.Fatalf("ParseBandwidthConfig failed: %v", err)
+	}
+	want := BandwidthConfig{Download: BandwidthLimits{Global: 1000, PerConnection: 100}, Upload: BandwidthLimits{PerKey: 10}}
+	if c != want {
+		t.Errorf("expected %+v, got %+v", want, c)
+	}
+	for _, config := range []string{"download", "download.global", "sideways.global=1", "download.perBucket=1", "upload.global=x", "upload.global=-1"} {
+		if _, err := ParseBandwidthConfig(config); err == nil {
+			t.Errorf("expected %q to be rejected", config)
+		}
+	}
+}
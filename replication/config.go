@@ -0,0 +1,195 @@
+// Package replication asynchronously copies the objects of a bucket to
+// another instance of the service through its HTTP API.
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Rule replicates the objects of a bucket to a remote instance
+type Rule struct {
+	ID string `json:"id"`
+	// Endpoint is the base URL of the remote instance, such as "https://standby:8080"
+	Endpoint string `json:"endpoint"`
+	// Bucket is the remote bucket, the name of the source bucket by default
+	Bucket string `json:"bucket,omitempty"`
+	// Prefix restricts the rule to the objects whose key starts with it
+	Prefix string `json:"prefix,omitempty"`
+	// APIKey authenticates to the remote instance, it is never returned by the API
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+// Configuration holds the replication rules of a bucket
+type Configuration struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Validate checks the configuration is consistent
+func (c Configuration) Validate() error {
+	if len(c.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+	ids := make(map[string]bool)
+	for _, r := range c.Rules {
+		if r.ID == "" {
+			return errors.New("rule id is required")
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate rule id %q", r.ID)
+		}
+		ids[r.ID] = true
+
+		u, err := url.Parse(r.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rule %q: endpoint must be an absolute http or https url", r.ID)
+		}
+		if strings.Contains(r.Bucket, "/") {
+			return fmt.Errorf("rule %q: invalid bucket %q", r.ID, r.Bucket)
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration without the API keys
+func (c Configuration) Redacted() Configuration {
+	redacted := Configuration{Rules: make([]Rule, len(c.Rules))}
+	for i, r := range c.Rules {
+		r.APIKey = ""
+		redacted.Rules[i] = r
+	}
+	return redacted
+}
+
+// matches reports whether the rule replicates the object
+func (r Rule) matches(key string) bool {
+	return strings.HasPrefix(key, r.Prefix)
+}
+
+// Store keeps the replication configuration of every bucket
+type Store struct {
+	mu      sync.RWMutex
+	buckets map[string]Configuration
+	// path is the file the configurations are saved to, empty when they are
+	// only kept in memory
+	path string
+}
+
+// NewStore creates an empty replication configuration store kept in memory
+func NewStore() *Store {
+	return &Store{buckets: make(map[string]Configuration)}
+}
+
+// OpenStore loads the replication configurations saved at path and saves
+// every change to it, so that the rules of queued operations survive a
+// restart. A missing file is an empty store.
+func OpenStore(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.buckets); err != nil {
+		return nil, fmt.Errorf("corrupted replication configuration %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// save writes the configurations to the file of the store, s.mu must be held
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.buckets)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Set replaces the replication configuration of a bucket
+func (s *Store) Set(bucket string, cfg Configuration) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.buckets[bucket]
+	s.buckets[bucket] = cfg
+	if err := s.save(); err != nil {
+		if existed {
+			s.buckets[bucket] = previous
+		} else {
+			delete(s.buckets, bucket)
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the replication configuration of a bucket
+func (s *Store) Get(bucket string) (Configuration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg, ok := s.buckets[bucket]
+	return cfg, ok
+}
+
+// Delete removes the replication configuration of a bucket and reports
+// whether it existed
+func (s *Store) Delete(bucket string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.buckets[bucket]
+	if !ok {
+		return false, nil
+	}
+	delete(s.buckets, bucket)
+	if err := s.save(); err != nil {
+		s.buckets[bucket] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// rule returns a rule of a bucket
+func (s *Store) rule(bucket, id string) (Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.buckets[bucket].Rules {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
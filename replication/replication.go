@@ -0,0 +1,583 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/lifecycle"
+	"github.com/DanielePalaia/object-storage-service/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// MetadataStatus is the metadata key holding the replication status of an object
+	MetadataStatus = "replication-status"
+	// HeaderStatus carries the replication status of an object. Objects
+	// uploaded with "X-Replication-Status: REPLICA" are copies made by another
+	// instance and are not replicated again.
+	HeaderStatus = "X-Replication-Status"
+)
+
+// Replication statuses of an object
+const (
+	StatusPending   = "PENDING"
+	StatusCompleted = "COMPLETED"
+	StatusFailed    = "FAILED"
+	StatusReplica   = "REPLICA"
+)
+
+// ErrNotConfigured is returned when resyncing a bucket without replication rules
+var ErrNotConfigured = errors.New("bucket has no replication rules")
+
+// DefaultRetryPolicy retries a replication for about two hours
+var DefaultRetryPolicy = queue.RetryPolicy{MaxAttempts: 30, InitialBackoff: time.Second, MaxBackoff: 5 * time.Minute}
+
+var (
+	operations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_operations_total",
+		Help: "Replication operations sent to remote instances, by operation (put or delete) and result.",
+	}, []string{"operation", "result"})
+	replicatedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "replication_bytes_total",
+		Help: "Bytes of objects copied to remote instances.",
+	})
+	pendingOperations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "replication_pending_operations",
+		Help: "Replication operations waiting in the queue.",
+	})
+	lag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "replication_lag_seconds",
+		Help: "Age of the oldest replication operation waiting in the queue.",
+	})
+)
+
+// Task is a queued replication of an object by a rule
+type Task struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Rule   string `json:"rule"`
+}
+
+type objectKey struct {
+	bucket, key string
+}
+
+// objectState tracks an object with replications in flight
+type objectState struct {
+	pending int
+	// failed is set once any replication gave up, replicated once any succeeded
+	failed     bool
+	replicated bool
+}
+
+// outcome is the result of a replication
+type outcome int
+
+const (
+	outcomeReplicated outcome = iota
+	outcomeFailed
+	// dropped replications belong to a rule removed since they were queued
+	outcomeDropped
+)
+
+// stripes is the number of locks serializing the writes of an object with
+// the recording of its replication status
+const stripes = 256
+
+// keyLock serializes the replication of an object
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Storage is a domain.Storage decorator replicating the objects put and
+// deleted in buckets with replication rules. Changes are queued in a durable
+// queue and copied asynchronously, failed operations are retried with
+// exponential backoff.
+//
+// A replication makes the remote object match the local one at the time it
+// is performed: the object is uploaded if it exists and deleted otherwise.
+// Operations are idempotent and those of a same object are serialized, so
+// the replica converges whatever the order in which queued changes are
+// processed.
+//
+// Only the objects with replications in flight are tracked in memory, they
+// are PENDING. Once the last one is done, the outcome is recorded in the
+// metadata of the object as COMPLETED or FAILED, without rewriting its data.
+type Storage struct {
+	inner   domain.Storage
+	store   *Store
+	tasks   *queue.Queue
+	retry   queue.RetryPolicy
+	client  *http.Client
+	workers int
+	now     func() time.Time
+
+	// writes serialize the writes of an object with the recording of its
+	// status, so that a status is never recorded on a newer version
+	writes [stripes]sync.Mutex
+
+	mu      sync.Mutex
+	objects map[objectKey]*objectState
+	locks   map[objectKey]*keyLock
+}
+
+// NewStorage wraps inner, replicating the buckets configured in store with
+// the operations queued in tasks
+func NewStorage(inner domain.Storage, store *Store, tasks *queue.Queue, retry queue.RetryPolicy) *Storage {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+	s := &Storage{
+		inner:   inner,
+		store:   store,
+		tasks:   tasks,
+		retry:   retry,
+		client:  &http.Client{Timeout: time.Minute},
+		workers: 4,
+		now:     time.Now,
+		objects: make(map[objectKey]*objectState),
+		locks:   make(map[objectKey]*keyLock),
+	}
+	// Operations queued before a restart are pending again
+	for _, msg := range tasks.List() {
+		var task Task
+		if json.Unmarshal(msg.Payload, &task) == nil {
+			s.state(objectKey{task.Bucket, task.Key}).pending++
+		}
+	}
+	s.updateLag()
+	return s
+}
+
+// Store returns the replication configurations
+func (s *Storage) Store() *Store {
+	return s.store
+}
+
+// Put stores the object and queues its replication
+func (s *Storage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object with its metadata and queues its
+// replication, unless it is itself a replica
+func (s *Storage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	replica := meta[MetadataStatus] == StatusReplica
+	if _, ok := meta[MetadataStatus]; ok && !replica {
+		// The status of a new version is recorded once it is replicated
+		meta = meta.Clone()
+		delete(meta, MetadataStatus)
+	}
+
+	mu := s.write(objectKey{bucket, objectID})
+	mu.Lock()
+	defer mu.Unlock()
+	created, err := domain.PutWithMetadata(s.inner, bucket, objectID, data, meta)
+	if err != nil {
+		return false, err
+	}
+	if created && !replica {
+		s.enqueue(bucket, objectID)
+	}
+	return created, nil
+}
+
+// Get retrieves the object
+func (s *Storage) Get(bucket, objectID string) ([]byte, error) {
+	return s.inner.Get(bucket, objectID)
+}
+
+// GetWithMetadata retrieves the object and its metadata, including its replication status
+func (s *Storage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	data, meta, err := domain.GetWithMetadata(s.inner, bucket, objectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status := s.StatusOf(bucket, objectID, meta); status != "" {
+		meta[MetadataStatus] = status
+	}
+	return data, meta, nil
+}
+
+// Exists reports whether the object exists in the underlying storage
+func (s *Storage) Exists(bucket, objectID string) (bool, error) {
+	return domain.Exists(s.inner, bucket, objectID)
+}
+
+// UpdateMetadata forwards the metadata update to the underlying storage
+func (s *Storage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	return domain.UpdateMetadata(s.inner, bucket, objectID, changes)
+}
+
+// Delete removes the object and queues the removal of its replicas
+func (s *Storage) Delete(bucket, objectID string) error {
+	mu := s.write(objectKey{bucket, objectID})
+	mu.Lock()
+	defer mu.Unlock()
+	if err := s.inner.Delete(bucket, objectID); err != nil {
+		return err
+	}
+	s.enqueue(bucket, objectID)
+	return nil
+}
+
+// ListBuckets lists the buckets of the underlying storage
+func (s *Storage) ListBuckets() ([]string, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	return lister.ListBuckets()
+}
+
+// ListObjects lists the objects of the underlying storage with their replication status
+func (s *Storage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	lister, ok := s.inner.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	infos, err := lister.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if status := s.StatusOf(bucket, info.ID, info.Metadata); status != "" {
+			if infos[i].Metadata == nil {
+				infos[i].Metadata = domain.Metadata{}
+			}
+			infos[i].Metadata[MetadataStatus] = status
+		}
+	}
+	return infos, nil
+}
+
+// Status returns the replication status of an object, empty when it is not replicated
+func (s *Storage) Status(bucket, objectID string) string {
+	_, meta, err := domain.GetWithMetadata(s.inner, bucket, objectID)
+	if err != nil {
+		return ""
+	}
+	return s.StatusOf(bucket, objectID, meta)
+}
+
+// StatusOf returns the replication status of an object given its stored
+// metadata, empty when it is not replicated
+func (s *Storage) StatusOf(bucket, objectID string, meta domain.Metadata) string {
+	s.mu.Lock()
+	_, pending := s.objects[objectKey{bucket, objectID}]
+	s.mu.Unlock()
+	if pending {
+		return StatusPending
+	}
+	return meta[MetadataStatus]
+}
+
+// Resync queues the replication of every object of a bucket, so that a new
+// or lagging replica catches up. It returns the number of objects queued.
+func (s *Storage) Resync(bucket string) (int, error) {
+	if _, ok := s.store.Get(bucket); !ok {
+		return 0, ErrNotConfigured
+	}
+	infos, err := s.ListObjects(bucket, "")
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, info := range infos {
+		if info.Metadata[MetadataStatus] == StatusReplica {
+			continue
+		}
+		mu := s.write(objectKey{bucket, info.ID})
+		mu.Lock()
+		if s.enqueue(bucket, info.ID) {
+			queued++
+		}
+		mu.Unlock()
+	}
+	return queued, nil
+}
+
+// enqueue queues the replication of an object by every matching rule and
+// reports whether any did, the write lock of the object must be held
+func (s *Storage) enqueue(bucket, objectID string) bool {
+	cfg, ok := s.store.Get(bucket)
+	if !ok {
+		return false
+	}
+	queued := false
+	for _, rule := range cfg.Rules {
+		if !rule.matches(objectID) {
+			continue
+		}
+		payload, err := json.Marshal(Task{Bucket: bucket, Key: objectID, Rule: rule.ID})
+		if err == nil {
+			_, err = s.tasks.Enqueue(payload)
+		}
+		if err != nil {
+			log.Printf("Replication error: queueing %s/%s for rule %s: %v", bucket, objectID, rule.ID, err)
+			continue
+		}
+		s.mu.Lock()
+		s.state(objectKey{bucket, objectID}).pending++
+		s.mu.Unlock()
+		queued = true
+	}
+	s.updateLag()
+	return queued
+}
+
+// state returns the tracked state of an object, s.mu must be held
+func (s *Storage) state(k objectKey) *objectState {
+	state, ok := s.objects[k]
+	if !ok {
+		state = &objectState{}
+		s.objects[k] = state
+	}
+	return state
+}
+
+// finish records the outcome of a replication of an object. Once the last
+// replication in flight is done, the object is FAILED if any replication
+// failed and COMPLETED if any succeeded. Nothing is recorded when every
+// replication was dropped.
+func (s *Storage) finish(k objectKey, result outcome) {
+	mu := s.write(k)
+	mu.Lock()
+	defer mu.Unlock()
+
+	s.mu.Lock()
+	state := s.state(k)
+	state.pending--
+	state.failed = state.failed || result == outcomeFailed
+	state.replicated = state.replicated || result == outcomeReplicated
+	done := state.pending <= 0
+	status := ""
+	switch {
+	case state.failed:
+		status = StatusFailed
+	case state.replicated:
+		status = StatusCompleted
+	}
+	s.mu.Unlock()
+	if !done {
+		return
+	}
+
+	if status != "" {
+		if err := s.record(k, status); err != nil {
+			log.Printf("Replication error: recording the status of %s/%s: %v", k.bucket, k.key, err)
+		}
+	}
+	s.mu.Lock()
+	delete(s.objects, k)
+	s.mu.Unlock()
+}
+
+// record stores the replication status in the metadata of the object,
+// leaving its data and modification time untouched. The write lock of the
+// object must be held.
+func (s *Storage) record(k objectKey, status string) error {
+	err := domain.UpdateMetadata(s.inner, k.bucket, k.key, domain.Metadata{MetadataStatus: status})
+	if errors.Is(err, domain.ErrNotFound) {
+		// Nothing is left to report about an object removed everywhere
+		return nil
+	}
+	return err
+}
+
+// write returns the lock serializing the writes of an object
+func (s *Storage) write(k objectKey) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(k.bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(k.key))
+	return &s.writes[h.Sum32()%stripes]
+}
+
+// lock serializes the replications of an object and returns the unlock function
+func (s *Storage) lock(k objectKey) func() {
+	s.mu.Lock()
+	l, ok := s.locks[k]
+	if !ok {
+		l = &keyLock{}
+		s.locks[k] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, k)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Storage) updateLag() {
+	pendingOperations.Set(float64(s.tasks.Len()))
+	if oldest, ok := s.tasks.Oldest(); ok {
+		lag.Set(s.now().Sub(oldest).Seconds())
+	} else {
+		lag.Set(0)
+	}
+}
+
+// Run replicates queued operations until ctx is done
+func (s *Storage) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Storage) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		s.updateLag()
+		msg, ok := s.tasks.Lease()
+		if ok {
+			s.replicate(ctx, msg)
+			continue
+		}
+
+		wait := time.Second
+		if next, ok := s.tasks.NextReady(); ok {
+			wait = min(wait, max(next.Sub(s.now()), 10*time.Millisecond))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-s.tasks.Notify():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// replicate performs a queued operation and acknowledges or retries it
+func (s *Storage) replicate(ctx context.Context, msg queue.Message) {
+	var task Task
+	if err := json.Unmarshal(msg.Payload, &task); err != nil {
+		log.Printf("Replication error: dropping corrupted task %s: %v", msg.ID, err)
+		s.tasks.Ack(msg.ID)
+		return
+	}
+	k := objectKey{task.Bucket, task.Key}
+	rule, ok := s.store.rule(task.Bucket, task.Rule)
+	if !ok {
+		// The rule was removed since the change was queued
+		s.tasks.Ack(msg.ID)
+		s.finish(k, outcomeDropped)
+		return
+	}
+
+	unlock := s.lock(k)
+	err := s.sync(ctx, rule, task)
+	unlock()
+	if err == nil {
+		s.tasks.Ack(msg.ID)
+		s.finish(k, outcomeReplicated)
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down, the operation is performed again after a restart
+		return
+	}
+
+	attempts := msg.Attempts + 1
+	log.Printf("Replication error: %s/%s to %s failed (attempt %d/%d): %v", task.Bucket, task.Key, rule.Endpoint, attempts, s.retry.MaxAttempts, err)
+	if attempts < s.retry.MaxAttempts {
+		s.tasks.Retry(msg.ID, s.now().Add(s.retry.Backoff(attempts)), err.Error())
+		return
+	}
+	s.tasks.Ack(msg.ID)
+	s.finish(k, outcomeFailed)
+}
+
+// sync makes the remote object match the local one
+func (s *Storage) sync(ctx context.Context, rule Rule, task Task) error {
+	bucket := rule.Bucket
+	if bucket == "" {
+		_, bucket = domain.SplitTenantBucket(task.Bucket)
+	}
+	target := strings.TrimSuffix(rule.Endpoint, "/") + "/objects/" + url.PathEscape(bucket) + "/" + url.PathEscape(task.Key)
+
+	data, meta, err := domain.GetWithMetadata(s.inner, task.Bucket, task.Key)
+	if errors.Is(err, domain.ErrNotFound) {
+		return s.send(ctx, rule, http.MethodDelete, target, nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set(HeaderStatus, StatusReplica)
+	if v, ok := meta[lifecycle.MetadataExpires]; ok {
+		header.Set("X-Expires", v)
+	}
+	if v, ok := meta[lifecycle.MetadataTagging]; ok {
+		header.Set("X-Tagging", v)
+	}
+	if err := s.send(ctx, rule, http.MethodPut, target, header, data); err != nil {
+		return err
+	}
+	replicatedBytes.Add(float64(len(data)))
+	return nil
+}
+
+// send performs a request on the remote instance
+func (s *Storage) send(ctx context.Context, rule Rule, method, target string, header http.Header, body []byte) error {
+	operation := "put"
+	if method == http.MethodDelete {
+		operation = "delete"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if rule.APIKey != "" {
+		req.Header.Set(auth.APIKeyHeader, rule.APIKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		operations.WithLabelValues(operation, "error").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	// Deleting an object the replica doesn't have is a success
+	if resp.StatusCode/100 == 2 || (method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		operations.WithLabelValues(operation, "success").Inc()
+		return nil
+	}
+	operations.WithLabelValues(operation, "error").Inc()
+	return fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
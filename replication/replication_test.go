@@ -0,0 +1,300 @@
+package replication
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/auth"
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+	"github.com/DanielePalaia/object-storage-service/queue"
+)
+
+// remote is a fake instance keeping the objects it receives
+type remote struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	headers  map[string]http.Header
+	failures int
+}
+
+func newRemote() *remote {
+	return &remote{objects: make(map[string]string), headers: make(map[string]http.Header)}
+}
+
+func (rm *remote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.failures > 0 {
+		rm.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get(auth.APIKeyHeader) != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/objects/")
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		rm.objects[path] = string(body)
+		rm.headers[path] = r.Header.Clone()
+	case http.MethodDelete:
+		if _, ok := rm.objects[path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(rm.objects, path)
+	}
+}
+
+func (rm *remote) get(path string) (string, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	v, ok := rm.objects[path]
+	return v, ok
+}
+
+func newStorage(t *testing.T, endpoint string, retry queue.RetryPolicy) *Storage {
+	tasks, err := queue.Open("")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s := NewStorage(persistence.NewInMemoryStorage(), NewStore(), tasks, retry)
+	err = s.Store().Set("acme/photos", Configuration{Rules: []Rule{
+		{ID: "standby", Endpoint: endpoint, Bucket: "backup", Prefix: "2024/", APIKey: "secret"},
+	}})
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStorage_Replicates(t *testing.T) {
+	rm := newRemote()
+	server := httptest.NewServer(rm)
+	defer server.Close()
+	s := newStorage(t, server.URL, DefaultRetryPolicy)
+
+	s.Put("acme/photos", "2024/a.jpg", []byte("v1"))
+	domain.PutWithMetadata(s, "acme/photos", "2024/a.jpg", []byte("v2"), domain.Metadata{"tagging": "team=a"})
+	s.Put("acme/photos", "2024/b.jpg", []byte("b"))
+	s.Put("acme/photos", "2023/old.jpg", []byte("not replicated"))
+	if status := s.Status("acme/photos", "2024/a.jpg"); status != StatusPending {
+		t.Errorf("expected PENDING before replication, got %q", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	waitFor(t, "replication", func() bool {
+		return s.Status("acme/photos", "2024/a.jpg") == StatusCompleted && s.Status("acme/photos", "2024/b.jpg") == StatusCompleted
+	})
+	if v, _ := rm.get("backup/2024/a.jpg"); v != "v2" {
+		t.Errorf("expected the latest version to be replicated, got %q", v)
+	}
+	rm.mu.Lock()
+	header := rm.headers["backup/2024/a.jpg"]
+	rm.mu.Unlock()
+	if header.Get(HeaderStatus) != StatusReplica || header.Get("X-Tagging") != "team=a" {
+		t.Errorf("expected replicas to be marked and keep their tags, got %v", header)
+	}
+	if _, ok := rm.get("backup/2023/old.jpg"); ok {
+		t.Errorf("expected objects outside the prefix not to be replicated")
+	}
+	if s.Status("acme/photos", "2023/old.jpg") != "" {
+		t.Errorf("expected no status for objects outside the rules")
+	}
+	infos, _ := s.ListObjects("acme/photos", "2024/")
+	if len(infos) != 2 || infos[0].Metadata[MetadataStatus] != StatusCompleted {
+		t.Errorf("expected listings to report the status, got %+v", infos)
+	}
+
+	s.Delete("acme/photos", "2024/b.jpg")
+	waitFor(t, "deletion", func() bool {
+		_, ok := rm.get("backup/2024/b.jpg")
+		return !ok
+	})
+
+	// Replicas are not replicated again
+	domain.PutWithMetadata(s, "acme/photos", "2024/copy.jpg", []byte("c"), domain.Metadata{MetadataStatus: StatusReplica})
+	if s.Status("acme/photos", "2024/copy.jpg") != StatusReplica {
+		t.Errorf("expected replicas not to be queued")
+	}
+}
+
+func TestStorage_StatusIsDurable(t *testing.T) {
+	rm := newRemote()
+	server := httptest.NewServer(rm)
+	defer server.Close()
+	s := newStorage(t, server.URL, DefaultRetryPolicy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	s.Put("acme/photos", "2024/a.jpg", []byte("a"))
+	before, _ := s.ListObjects("acme/photos", "2024/a.jpg")
+	waitFor(t, "replication", func() bool { return s.Status("acme/photos", "2024/a.jpg") == StatusCompleted })
+	after, _ := s.ListObjects("acme/photos", "2024/a.jpg")
+	if len(before) != 1 || len(after) != 1 || !after[0].ModTime.Equal(before[0].ModTime) {
+		t.Errorf("expected recording the status to keep the modification time, got %+v then %+v", before, after)
+	}
+	s.mu.Lock()
+	tracked := len(s.objects)
+	s.mu.Unlock()
+	if tracked != 0 {
+		t.Errorf("expected only the objects in flight to be tracked, got %d", tracked)
+	}
+
+	// A restarted instance reads the status from the metadata of the object
+	tasks, _ := queue.Open("")
+	restarted := NewStorage(s.inner, NewStore(), tasks, DefaultRetryPolicy)
+	if status := restarted.Status("acme/photos", "2024/a.jpg"); status != StatusCompleted {
+		t.Errorf("expected the status to survive a restart, got %q", status)
+	}
+	// A new version is pending again, the status of the previous one is not kept
+	domain.PutWithMetadata(s, "acme/photos", "2024/a.jpg", []byte("a2"), domain.Metadata{MetadataStatus: StatusCompleted})
+	if _, meta, _ := domain.GetWithMetadata(s.inner, "acme/photos", "2024/a.jpg"); meta[MetadataStatus] == StatusCompleted {
+		t.Errorf("expected the status not to be stored with a new version, got %v", meta)
+	}
+}
+
+func TestStorage_RetryAndResync(t *testing.T) {
+	rm := newRemote()
+	rm.failures = 3
+	server := httptest.NewServer(rm)
+	defer server.Close()
+	s := newStorage(t, server.URL, queue.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	s.Put("acme/photos", "2024/a.jpg", []byte("a"))
+	waitFor(t, "failure", func() bool { return s.Status("acme/photos", "2024/a.jpg") == StatusFailed })
+
+	s.Put("acme/photos", "2024/b.jpg", []byte("b"))
+	waitFor(t, "retried replication", func() bool { return s.Status("acme/photos", "2024/b.jpg") == StatusCompleted })
+
+	queued, err := s.Resync("acme/photos")
+	if err != nil || queued != 2 {
+		t.Fatalf("expected 2 objects to be resynced, got %d (err %v)", queued, err)
+	}
+	waitFor(t, "resync", func() bool { return s.Status("acme/photos", "2024/a.jpg") == StatusCompleted })
+	if v, _ := rm.get("backup/2024/a.jpg"); v != "a" {
+		t.Errorf("expected the failed object to be replicated by the resync, got %q", v)
+	}
+
+	if _, err := s.Resync("other"); err != ErrNotConfigured {
+		t.Errorf("expected ErrNotConfigured, got %v", err)
+	}
+}
+
+func TestStorage_Outcomes(t *testing.T) {
+	rm := newRemote()
+	server := httptest.NewServer(rm)
+	defer server.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	s := newStorage(t, server.URL, queue.RetryPolicy{MaxAttempts: 1})
+	err := s.Store().Set("acme/photos", Configuration{Rules: []Rule{
+		{ID: "broken", Endpoint: broken.URL, APIKey: "secret"},
+		{ID: "standby", Endpoint: server.URL, Bucket: "backup", APIKey: "secret"},
+	}})
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	s.Put("acme/photos", "a.jpg", []byte("a"))
+
+	// The operations of a removed rule are dropped without reporting a status
+	s.Store().Set("acme/other", Configuration{Rules: []Rule{{ID: "standby", Endpoint: server.URL, APIKey: "secret"}}})
+	s.Put("acme/other", "b.jpg", []byte("b"))
+	s.Store().Delete("acme/other")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	waitFor(t, "replication", func() bool { return s.tasks.Len() == 0 && s.Status("acme/photos", "a.jpg") != StatusPending })
+
+	// A failure is kept whatever the order the replications finish in
+	if status := s.Status("acme/photos", "a.jpg"); status != StatusFailed {
+		t.Errorf("expected FAILED when any rule failed, got %q", status)
+	}
+	waitFor(t, "dropped replication", func() bool { return s.Status("acme/other", "b.jpg") != StatusPending })
+	if status := s.Status("acme/other", "b.jpg"); status != "" {
+		t.Errorf("expected no status once the rule was removed, got %q", status)
+	}
+}
+
+func TestStore_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	cfg := Configuration{Rules: []Rule{{ID: "standby", Endpoint: "https://standby:8080", APIKey: "secret"}}}
+	if err := store.Set("acme/photos", cfg); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	store.Set("acme/other", cfg)
+	if deleted, err := store.Delete("acme/other"); !deleted || err != nil {
+		t.Fatalf("expected the configuration to be deleted, got %v (err %v)", deleted, err)
+	}
+
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	if rule, ok := reopened.rule("acme/photos", "standby"); !ok || rule.APIKey != "secret" {
+		t.Errorf("expected the rules to survive a restart, got %+v", rule)
+	}
+	if _, ok := reopened.Get("acme/other"); ok {
+		t.Errorf("expected deleted configurations to stay deleted")
+	}
+}
+
+func TestConfiguration_Validate(t *testing.T) {
+	valid := Rule{ID: "r", Endpoint: "https://standby:8080"}
+	invalid := []Configuration{
+		{},
+		{Rules: []Rule{valid, valid}},
+		{Rules: []Rule{{ID: "r", Endpoint: "standby:8080"}}},
+		{Rules: []Rule{{Endpoint: "https://standby:8080"}}},
+		{Rules: []Rule{{ID: "r", Endpoint: "https://standby:8080", Bucket: "a/b"}}},
+	}
+	for i, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected configuration %d to be invalid", i)
+		}
+	}
+	if err := (Configuration{Rules: []Rule{valid}}).Validate(); err != nil {
+		t.Errorf("expected valid configuration, got %v", err)
+	}
+	redacted := Configuration{Rules: []Rule{{ID: "r", APIKey: "secret"}}}.Redacted()
+	if redacted.Rules[0].APIKey != "" {
+		t.Errorf("expected the API key to be redacted")
+	}
+}
@@ -0,0 +1,160 @@
+// Package tenant keeps the registry of tenants, each owning an isolated
+// bucket namespace.
+package tenant
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrNotFound is returned for tenants which are not registered
+	ErrNotFound = errors.New("tenant not found")
+	// ErrAlreadyExist is returned when creating a tenant twice
+	ErrAlreadyExist = errors.New("tenant already exists")
+	// ErrSuspended is returned when admitting a request of a suspended tenant
+	ErrSuspended = errors.New("tenant is suspended")
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenant_requests_total",
+		Help: "Requests admitted, by tenant.",
+	}, []string{"tenant"})
+	rejectedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenant_rejected_requests_total",
+		Help: "Requests rejected because the tenant is unknown or suspended, by reason.",
+	}, []string{"reason"})
+	suspended = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenant_suspended",
+		Help: "Whether a tenant is suspended (1) or active (0).",
+	}, []string{"tenant"})
+)
+
+// Status of a tenant
+type Status string
+
+const (
+	StatusActive    Status = "active"
+	StatusSuspended Status = "suspended"
+)
+
+// nameFormat restricts tenant names so that they can prefix bucket names
+var nameFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is an isolated namespace of buckets
+type Tenant struct {
+	Name        string     `json:"name"`
+	Status      Status     `json:"status"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	SuspendedAt *time.Time `json:"suspendedAt,omitempty"`
+}
+
+// Registry holds the known tenants
+type Registry struct {
+	mu      sync.RWMutex
+	tenants map[string]*Tenant
+	now     func() time.Time
+}
+
+// NewRegistry creates an empty tenant registry
+func NewRegistry() *Registry {
+	return &Registry{
+		tenants: make(map[string]*Tenant),
+		now:     time.Now,
+	}
+}
+
+// Create registers a new active tenant
+func (r *Registry) Create(name string) (Tenant, error) {
+	if !nameFormat.MatchString(name) {
+		return Tenant{}, fmt.Errorf("invalid tenant name %q: use lowercase letters, digits and dashes", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tenants[name]; ok {
+		return Tenant{}, fmt.Errorf("%w: %s", ErrAlreadyExist, name)
+	}
+	t := &Tenant{Name: name, Status: StatusActive, CreatedAt: r.now().UTC()}
+	r.tenants[name] = t
+	suspended.WithLabelValues(name).Set(0)
+	return *t, nil
+}
+
+// Get returns a tenant
+func (r *Registry) Get(name string) (Tenant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tenants[name]
+	if !ok {
+		return Tenant{}, false
+	}
+	return *t, true
+}
+
+// List returns every tenant, sorted by name
+func (r *Registry) List() []Tenant {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tenants := make([]Tenant, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		tenants = append(tenants, *t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants
+}
+
+// Suspend rejects the requests of a tenant until it is resumed, its data is kept
+func (r *Registry) Suspend(name string) (Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tenants[name]
+	if !ok {
+		return Tenant{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if t.Status != StatusSuspended {
+		now := r.now().UTC()
+		t.Status, t.SuspendedAt = StatusSuspended, &now
+		suspended.WithLabelValues(name).Set(1)
+	}
+	return *t, nil
+}
+
+// Resume reactivates a suspended tenant
+func (r *Registry) Resume(name string) (Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tenants[name]
+	if !ok {
+		return Tenant{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	t.Status, t.SuspendedAt = StatusActive, nil
+	suspended.WithLabelValues(name).Set(0)
+	return *t, nil
+}
+
+// Admit checks a request on behalf of a tenant may proceed and counts it
+func (r *Registry) Admit(name string) error {
+	t, ok := r.Get(name)
+	switch {
+	case !ok:
+		rejectedRequests.WithLabelValues("unknown").Inc()
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	case t.Status == StatusSuspended:
+		rejectedRequests.WithLabelValues("suspended").Inc()
+		return fmt.Errorf("%w: %s", ErrSuspended, name)
+	}
+	requests.WithLabelValues(name).Inc()
+	return nil
+}
@@ -0,0 +1,45 @@
+package tenant
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.Create("acme"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := r.Create("acme"); !errors.Is(err, ErrAlreadyExist) {
+		t.Errorf("expected duplicate tenant to be rejected, got %v", err)
+	}
+	for _, name := range []string{"", "Acme", "a/b", "-acme"} {
+		if _, err := r.Create(name); err == nil {
+			t.Errorf("expected invalid tenant name %q to be rejected", name)
+		}
+	}
+
+	if err := r.Admit("acme"); err != nil {
+		t.Errorf("expected active tenant to be admitted, got %v", err)
+	}
+	if err := r.Admit("globex"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected unknown tenant to be rejected, got %v", err)
+	}
+
+	tenant, err := r.Suspend("acme")
+	if err != nil || tenant.Status != StatusSuspended || tenant.SuspendedAt == nil {
+		t.Fatalf("expected tenant to be suspended, got %+v (err %v)", tenant, err)
+	}
+	if err := r.Admit("acme"); !errors.Is(err, ErrSuspended) {
+		t.Errorf("expected suspended tenant to be rejected, got %v", err)
+	}
+	if tenant, err := r.Resume("acme"); err != nil || tenant.Status != StatusActive {
+		t.Errorf("expected tenant to be resumed, got %+v (err %v)", tenant, err)
+	}
+	if _, err := r.Suspend("globex"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected suspending an unknown tenant to fail, got %v", err)
+	}
+	if list := r.List(); len(list) != 1 || list[0].Name != "acme" {
+		t.Errorf("unexpected tenants %+v", list)
+	}
+}
@@ -0,0 +1,817 @@
+// Package tiering keeps the hot objects of a durable storage in a faster
+// one. Objects are written to the cold tier before being acknowledged or
+// flushed to it in the background, promoted to the hot tier when read, and
+// demoted from it when the hot tier exceeds its capacity.
+package tiering
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MetadataTier is the metadata key reporting the tier an object was read
+// from, or listed in
+const MetadataTier = "tier"
+
+// Tiers reported in MetadataTier and in the metric labels
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// ErrTierFull is returned when a write would exceed the capacity of the cold tier
+var ErrTierFull = errors.New("storage tier capacity exceeded")
+
+var (
+	reads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiering_reads_total",
+		Help: "Objects read, by tier serving them.",
+	}, []string{"tier"})
+	promotions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tiering_promotions_total",
+		Help: "Objects promoted to the hot tier when read.",
+	})
+	demotions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiering_demotions_total",
+		Help: "Objects demoted from the hot tier, by reason (capacity or age).",
+	}, []string{"reason"})
+	hotObjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tiering_hot_objects",
+		Help: "Objects resident in the hot tier.",
+	})
+	hotBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tiering_hot_bytes",
+		Help: "Bytes resident in the hot tier.",
+	})
+	dirtyObjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tiering_dirty_objects",
+		Help: "Objects of the hot tier not yet flushed to the cold tier.",
+	})
+	coldBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tiering_cold_bytes",
+		Help: "Bytes stored in the cold tier, when it has a capacity.",
+	})
+)
+
+// WriteMode controls when writes reach the cold tier
+type WriteMode string
+
+const (
+	// WriteThrough writes objects to the cold tier before acknowledging them
+	WriteThrough WriteMode = "write-through"
+	// WriteBack acknowledges objects once in the hot tier and flushes them
+	// to the cold tier in the background: objects written since the last
+	// flush are lost if the process crashes
+	WriteBack WriteMode = "write-back"
+)
+
+// ParseWriteMode validates a write mode name
+func ParseWriteMode(name string) (WriteMode, error) {
+	switch m := WriteMode(name); m {
+	case WriteThrough, WriteBack:
+		return m, nil
+	case "":
+		return WriteThrough, nil
+	}
+	return "", fmt.Errorf("unsupported write mode %q", name)
+}
+
+// Policy selects the objects demoted when the hot tier exceeds its capacity
+type Policy string
+
+const (
+	// PolicyLRU demotes the least recently read or written objects
+	PolicyLRU Policy = "lru"
+	// PolicyAge demotes the objects which entered the hot tier first, and
+	// those resident for longer than MaxAge
+	PolicyAge Policy = "age"
+	// PolicySize demotes the largest objects
+	PolicySize Policy = "size"
+)
+
+// ParsePolicy validates a demotion policy name
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyLRU, PolicyAge, PolicySize:
+		return p, nil
+	case "":
+		return PolicyLRU, nil
+	}
+	return "", fmt.Errorf("unsupported demotion policy %q", name)
+}
+
+// Capacity limits the content of a tier, zero values are unlimited
+type Capacity struct {
+	Bytes   int64
+	Objects int
+}
+
+// Config tunes a tiered Storage
+type Config struct {
+	Mode   WriteMode
+	Policy Policy
+	// Hot is the capacity of the hot tier, enforced by demoting objects
+	Hot Capacity
+	// Cold is the capacity of the cold tier, enforced by rejecting writes.
+	// It requires the cold tier to support listing.
+	Cold Capacity
+	// MaxObjectSize is the size of the largest objects kept in the hot tier,
+	// larger ones are only stored in the cold tier. Zero is unlimited.
+	MaxObjectSize int64
+	// MaxAge is the residency of the objects demoted by Run with PolicyAge,
+	// zero keeps objects until the capacity is exceeded
+	MaxAge time.Duration
+	// FlushInterval is the period of Run, 1s by default
+	FlushInterval time.Duration
+}
+
+// objectRef identifies an object
+type objectRef struct {
+	bucket, id string
+}
+
+// entry describes an object resident in the hot tier
+type entry struct {
+	ref      objectRef
+	size     int64
+	modTime  time.Time
+	meta     domain.Metadata
+	dirty    bool
+	admitted time.Time
+	element  *list.Element
+}
+
+// stripes is the number of locks serializing the operations on an object
+const stripes = 256
+
+// Storage is a domain.Storage composing a hot and a cold storage. The hot
+// tier holds copies of the recently used objects, the cold tier every
+// object. The hot tier must be empty when the Storage is created.
+type Storage struct {
+	hot, cold domain.Storage
+	config    Config
+	// locks serialize the operations on an object, so that both tiers see
+	// its writes in the same order
+	locks [stripes]sync.Mutex
+
+	mu      sync.Mutex
+	entries map[objectRef]*entry
+	// order lists the resident objects, the next one to demote at the back
+	order    *list.List
+	hotBytes int64
+	dirty    int
+	// sizes of every object, accounted when the cold tier has a capacity
+	sizes     map[objectRef]int64
+	coldBytes int64
+}
+
+// NewStorage creates a tiered storage keeping the hot objects of cold in hot
+func NewStorage(hot, cold domain.Storage, config Config) (*Storage, error) {
+	if _, err := ParseWriteMode(string(config.Mode)); err != nil {
+		return nil, err
+	}
+	if _, err := ParsePolicy(string(config.Policy)); err != nil {
+		return nil, err
+	}
+	if config.Mode == "" {
+		config.Mode = WriteThrough
+	}
+	if config.Policy == "" {
+		config.Policy = PolicyLRU
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	s := &Storage{hot: hot, cold: cold, config: config, entries: make(map[objectRef]*entry), order: list.New()}
+	if config.Cold.Bytes > 0 || config.Cold.Objects > 0 {
+		if err := s.loadSizes(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loadSizes accounts the objects already stored in the cold tier
+func (s *Storage) loadSizes() error {
+	lister, ok := s.cold.(domain.Lister)
+	if !ok {
+		return fmt.Errorf("cold tier capacity: %w", domain.ErrListNotSupported)
+	}
+	buckets, err := lister.ListBuckets()
+	if err != nil {
+		return err
+	}
+	s.sizes = make(map[objectRef]int64)
+	for _, bucket := range buckets {
+		infos, err := lister.ListObjects(bucket, "")
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			s.sizes[objectRef{bucket, info.ID}] = info.Size
+			s.coldBytes += info.Size
+		}
+	}
+	coldBytes.Set(float64(s.coldBytes))
+	return nil
+}
+
+func (s *Storage) lock(ref objectRef) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(ref.bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(ref.id))
+	return &s.locks[h.Sum32()%stripes]
+}
+
+// Put stores the object if it doesn't already exist in the bucket otherwise it updates it
+func (s *Storage) Put(bucket, objectID string, data []byte) (bool, error) {
+	return s.PutWithMetadata(bucket, objectID, data, nil)
+}
+
+// PutWithMetadata stores the object in the cold tier, directly or through
+// the hot tier depending on the write mode
+func (s *Storage) PutWithMetadata(bucket, objectID string, data []byte, meta domain.Metadata) (bool, error) {
+	ref := objectRef{bucket, objectID}
+	meta = meta.Clone()
+	delete(meta, MetadataTier)
+
+	l := s.lock(ref)
+	l.Lock()
+	created, err := s.put(ref, data, meta)
+	l.Unlock()
+	if err != nil {
+		return false, err
+	}
+	s.evict()
+	return created, nil
+}
+
+func (s *Storage) put(ref objectRef, data []byte, meta domain.Metadata) (bool, error) {
+	undo, err := s.reserve(ref, int64(len(data)))
+	if err != nil {
+		return false, err
+	}
+	admit := s.admits(int64(len(data)))
+
+	if s.config.Mode == WriteBack && admit {
+		created, err := s.admit(ref, data, meta, true)
+		if err != nil {
+			undo()
+			return false, err
+		}
+		return created, nil
+	}
+
+	created, err := domain.PutWithMetadata(s.cold, ref.bucket, ref.id, data, meta)
+	if err != nil {
+		undo()
+		return false, err
+	}
+	if !admit {
+		// The hot tier may hold a previous version
+		if err := s.drop(ref); err != nil {
+			log.Printf("tiering: dropping %s/%s from the hot tier: %v", ref.bucket, ref.id, err)
+		}
+		return created, nil
+	}
+	if _, err := s.admit(ref, data, meta, false); err != nil {
+		// The object is durable, it is served from the cold tier
+		log.Printf("tiering: caching %s/%s in the hot tier: %v", ref.bucket, ref.id, err)
+		s.drop(ref)
+	}
+	return created, nil
+}
+
+// reserve accounts the object in the capacity of the cold tier, returning
+// the function undoing it when the write fails
+func (s *Storage) reserve(ref objectRef, size int64) (func(), error) {
+	if s.sizes == nil {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.sizes[ref]
+	objects := len(s.sizes)
+	if !existed {
+		objects++
+	}
+	if (s.config.Cold.Bytes > 0 && s.coldBytes-old+size > s.config.Cold.Bytes) ||
+		(s.config.Cold.Objects > 0 && objects > s.config.Cold.Objects) {
+		return nil, ErrTierFull
+	}
+	s.sizes[ref] = size
+	s.coldBytes += size - old
+	coldBytes.Set(float64(s.coldBytes))
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if existed {
+			s.sizes[ref] = old
+		} else {
+			delete(s.sizes, ref)
+		}
+		s.coldBytes += old - size
+		coldBytes.Set(float64(s.coldBytes))
+	}, nil
+}
+
+// release removes a deleted object from the capacity of the cold tier
+func (s *Storage) release(ref objectRef) {
+	if s.sizes == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coldBytes -= s.sizes[ref]
+	delete(s.sizes, ref)
+	coldBytes.Set(float64(s.coldBytes))
+}
+
+// admits reports whether objects of size may enter the hot tier
+func (s *Storage) admits(size int64) bool {
+	if s.config.MaxObjectSize > 0 && size > s.config.MaxObjectSize {
+		return false
+	}
+	return s.config.Hot.Bytes == 0 || size <= s.config.Hot.Bytes
+}
+
+// admit stores the object in the hot tier and indexes it. The caller holds
+// the lock of the object.
+func (s *Storage) admit(ref objectRef, data []byte, meta domain.Metadata, dirty bool) (bool, error) {
+	created, err := domain.PutWithMetadata(s.hot, ref.bucket, ref.id, data, meta)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	e, ok := s.entries[ref]
+	if !ok {
+		e = &entry{ref: ref, admitted: now}
+		e.element = s.order.PushFront(e)
+		s.entries[ref] = e
+	} else if s.config.Policy == PolicyLRU {
+		s.order.MoveToFront(e.element)
+	}
+	s.hotBytes += int64(len(data)) - e.size
+	e.size, e.modTime, e.meta = int64(len(data)), now, meta
+	// Rewriting a flushed object with the same data leaves it clean
+	if dirty && created && !e.dirty {
+		e.dirty = true
+		s.dirty++
+	}
+	s.updateGauges()
+	return created, nil
+}
+
+// drop removes the object from the hot tier. The caller holds the lock of
+// the object.
+func (s *Storage) drop(ref objectRef) error {
+	s.mu.Lock()
+	e, ok := s.entries[ref]
+	if ok {
+		s.forget(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := s.hot.Delete(ref.bucket, ref.id); err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// forget removes an entry from the index, the caller holds mu
+func (s *Storage) forget(e *entry) {
+	delete(s.entries, e.ref)
+	s.order.Remove(e.element)
+	s.hotBytes -= e.size
+	if e.dirty {
+		s.dirty--
+	}
+	s.updateGauges()
+}
+
+func (s *Storage) updateGauges() {
+	hotObjects.Set(float64(len(s.entries)))
+	hotBytes.Set(float64(s.hotBytes))
+	dirtyObjects.Set(float64(s.dirty))
+}
+
+// evict demotes objects until the hot tier fits in its capacity. The caller
+// holds no object lock.
+func (s *Storage) evict() {
+	for {
+		ref, ok := s.victim()
+		if !ok {
+			return
+		}
+		if err := s.demote(ref, "capacity"); err != nil {
+			log.Printf("tiering: demoting %s/%s: %v", ref.bucket, ref.id, err)
+			return
+		}
+	}
+}
+
+// victim returns the next object to demote if the hot tier exceeds its capacity
+func (s *Storage) victim() (objectRef, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if (s.config.Hot.Bytes == 0 || s.hotBytes <= s.config.Hot.Bytes) &&
+		(s.config.Hot.Objects == 0 || len(s.entries) <= s.config.Hot.Objects) {
+		return objectRef{}, false
+	}
+	if s.config.Policy != PolicySize {
+		return s.order.Back().Value.(*entry).ref, true
+	}
+	var largest *entry
+	for _, e := range s.entries {
+		if largest == nil || e.size > largest.size {
+			largest = e
+		}
+	}
+	return largest.ref, true
+}
+
+// demote flushes the object to the cold tier if needed and removes it from
+// the hot tier
+func (s *Storage) demote(ref objectRef, reason string) error {
+	l := s.lock(ref)
+	l.Lock()
+	defer l.Unlock()
+	s.mu.Lock()
+	e, ok := s.entries[ref]
+	dirty := ok && e.dirty
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if dirty {
+		if err := s.flush(ref); err != nil {
+			return err
+		}
+	}
+	if err := s.drop(ref); err != nil {
+		return err
+	}
+	demotions.WithLabelValues(reason).Inc()
+	return nil
+}
+
+// flush writes a dirty object to the cold tier. The caller holds the lock
+// of the object.
+func (s *Storage) flush(ref objectRef) error {
+	data, meta, err := domain.GetWithMetadata(s.hot, ref.bucket, ref.id)
+	if err != nil {
+		return err
+	}
+	if _, err := domain.PutWithMetadata(s.cold, ref.bucket, ref.id, data, meta); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[ref]; ok && e.dirty {
+		e.dirty = false
+		s.dirty--
+		s.updateGauges()
+	}
+	return nil
+}
+
+// Flush writes every object of the hot tier not yet flushed to the cold tier
+func (s *Storage) Flush() error {
+	s.mu.Lock()
+	var refs []objectRef
+	for ref, e := range s.entries {
+		if e.dirty {
+			refs = append(refs, ref)
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, ref := range refs {
+		l := s.lock(ref)
+		l.Lock()
+		s.mu.Lock()
+		e, ok := s.entries[ref]
+		dirty := ok && e.dirty
+		s.mu.Unlock()
+		if dirty {
+			if err := s.flush(ref); err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", ref.bucket, ref.id, err))
+			}
+		}
+		l.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// demoteExpired demotes the objects resident for longer than MaxAge
+func (s *Storage) demoteExpired(now time.Time) {
+	s.mu.Lock()
+	var refs []objectRef
+	// The age order lists the objects by admission, the oldest at the back
+	for el := s.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if now.Sub(e.admitted) <= s.config.MaxAge {
+			break
+		}
+		refs = append(refs, e.ref)
+	}
+	s.mu.Unlock()
+	for _, ref := range refs {
+		if err := s.demote(ref, "age"); err != nil {
+			log.Printf("tiering: demoting %s/%s: %v", ref.bucket, ref.id, err)
+		}
+	}
+}
+
+// Run flushes the objects written back and demotes the objects past their
+// age every FlushInterval until ctx is done, flushing a last time then
+func (s *Storage) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(); err != nil {
+				log.Printf("tiering: flushing: %v", err)
+			}
+			return
+		case now := <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("tiering: flushing: %v", err)
+			}
+			if s.config.Policy == PolicyAge && s.config.MaxAge > 0 {
+				s.demoteExpired(now)
+			}
+		}
+	}
+}
+
+// Get retrieves the object data
+func (s *Storage) Get(bucket, objectID string) ([]byte, error) {
+	data, _, err := s.GetWithMetadata(bucket, objectID)
+	return data, err
+}
+
+// GetWithMetadata retrieves the object and its metadata from the hot tier,
+// or from the cold tier promoting it to the hot tier. MetadataTier reports
+// the tier the object was read from.
+func (s *Storage) GetWithMetadata(bucket, objectID string) ([]byte, domain.Metadata, error) {
+	ref := objectRef{bucket, objectID}
+	l := s.lock(ref)
+	l.Lock()
+	data, meta, promoted, err := s.get(ref)
+	l.Unlock()
+	if promoted {
+		s.evict()
+	}
+	return data, meta, err
+}
+
+func (s *Storage) get(ref objectRef) ([]byte, domain.Metadata, bool, error) {
+	s.mu.Lock()
+	e, resident := s.entries[ref]
+	dirty := resident && e.dirty
+	if resident && s.config.Policy == PolicyLRU {
+		s.order.MoveToFront(e.element)
+	}
+	s.mu.Unlock()
+
+	if resident {
+		data, meta, err := domain.GetWithMetadata(s.hot, ref.bucket, ref.id)
+		if err == nil {
+			reads.WithLabelValues(TierHot).Inc()
+			meta = meta.Clone()
+			meta[MetadataTier] = TierHot
+			return data, meta, false, nil
+		}
+		// The only copy of a dirty object is in the hot tier
+		if dirty {
+			return nil, nil, false, err
+		}
+		log.Printf("tiering: reading %s/%s from the hot tier: %v", ref.bucket, ref.id, err)
+		s.drop(ref)
+	}
+
+	data, meta, err := domain.GetWithMetadata(s.cold, ref.bucket, ref.id)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	reads.WithLabelValues(TierCold).Inc()
+	meta = meta.Clone()
+	promoted := false
+	if s.admits(int64(len(data))) {
+		if _, err := s.admit(ref, data, meta, false); err != nil {
+			log.Printf("tiering: promoting %s/%s: %v", ref.bucket, ref.id, err)
+			s.drop(ref)
+		} else {
+			promotions.Inc()
+			promoted = true
+		}
+	}
+	meta = meta.Clone()
+	meta[MetadataTier] = TierCold
+	return data, meta, promoted, nil
+}
+
+// Exists reports whether the object is resident in the hot tier or stored
+// in the cold tier, without promoting it
+func (s *Storage) Exists(bucket, objectID string) (bool, error) {
+	ref := objectRef{bucket, objectID}
+	l := s.lock(ref)
+	l.Lock()
+	defer l.Unlock()
+
+	s.mu.Lock()
+	_, resident := s.entries[ref]
+	s.mu.Unlock()
+	if resident {
+		return true, nil
+	}
+	return domain.Exists(s.cold, bucket, objectID)
+}
+
+// UpdateMetadata sets the keys of changes in the metadata of the object in
+// both tiers. A copy in the hot tier that cannot be updated is dropped, so
+// that the object is read again from the cold tier.
+func (s *Storage) UpdateMetadata(bucket, objectID string, changes domain.Metadata) error {
+	ref := objectRef{bucket, objectID}
+	changes = changes.Clone()
+	delete(changes, MetadataTier)
+	l := s.lock(ref)
+	l.Lock()
+	defer l.Unlock()
+
+	s.mu.Lock()
+	e, resident := s.entries[ref]
+	dirty := resident && e.dirty
+	s.mu.Unlock()
+	if resident {
+		err := domain.UpdateMetadata(s.hot, bucket, objectID, changes)
+		// The only copy of a dirty object is in the hot tier
+		if err != nil && dirty {
+			return err
+		}
+		if err != nil {
+			log.Printf("tiering: updating %s/%s in the hot tier: %v", bucket, objectID, err)
+			if err := s.drop(ref); err != nil {
+				return err
+			}
+		} else {
+			s.mu.Lock()
+			e.meta = e.meta.With(changes)
+			s.mu.Unlock()
+		}
+	}
+	err := domain.UpdateMetadata(s.cold, bucket, objectID, changes)
+	// An object written back may not have reached the cold tier yet
+	if errors.Is(err, domain.ErrNotFound) && dirty {
+		err = nil
+	}
+	return err
+}
+
+// Delete removes the object from both tiers
+func (s *Storage) Delete(bucket, objectID string) error {
+	ref := objectRef{bucket, objectID}
+	l := s.lock(ref)
+	l.Lock()
+	defer l.Unlock()
+
+	s.mu.Lock()
+	e, resident := s.entries[ref]
+	dirty := resident && e.dirty
+	s.mu.Unlock()
+	if err := s.drop(ref); err != nil {
+		return err
+	}
+	err := s.cold.Delete(bucket, objectID)
+	// An object written back may not have reached the cold tier yet
+	if errors.Is(err, domain.ErrNotFound) && dirty {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	s.release(ref)
+	return nil
+}
+
+// Repair repairs the object in the cold tier when it supports it, dropping
+// its copy from the hot tier so that it is read again from the cold tier
+func (s *Storage) Repair(bucket, objectID string) (bool, error) {
+	repairer, ok := s.cold.(interface {
+		Repair(bucket, objectID string) (bool, error)
+	})
+	if !ok {
+		return false, nil
+	}
+	ref := objectRef{bucket, objectID}
+	l := s.lock(ref)
+	l.Lock()
+	defer l.Unlock()
+	s.mu.Lock()
+	e, resident := s.entries[ref]
+	dirty := resident && e.dirty
+	s.mu.Unlock()
+	if resident && !dirty {
+		if err := s.drop(ref); err != nil {
+			return false, err
+		}
+	}
+	return repairer.Repair(bucket, objectID)
+}
+
+// ListBuckets returns the buckets of the cold tier and those of the objects
+// not yet flushed to it
+func (s *Storage) ListBuckets() ([]string, error) {
+	lister, ok := s.cold.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	buckets, err := lister.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(buckets))
+	for _, bucket := range buckets {
+		seen[bucket] = true
+	}
+	s.mu.Lock()
+	for ref, e := range s.entries {
+		if e.dirty && !seen[ref.bucket] {
+			seen[ref.bucket] = true
+			buckets = append(buckets, ref.bucket)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+// ListObjects returns the objects of the cold tier together with those not
+// yet flushed to it. MetadataTier reports whether objects are resident in
+// the hot tier.
+func (s *Storage) ListObjects(bucket, prefix string) ([]domain.ObjectInfo, error) {
+	lister, ok := s.cold.(domain.Lister)
+	if !ok {
+		return nil, domain.ErrListNotSupported
+	}
+	infos, err := lister.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	resident := make(map[string]entry)
+	for ref, e := range s.entries {
+		if ref.bucket == bucket && strings.HasPrefix(ref.id, prefix) {
+			resident[ref.id] = *e
+		}
+	}
+	s.mu.Unlock()
+
+	for i := range infos {
+		tier := TierCold
+		if e, ok := resident[infos[i].ID]; ok {
+			tier = TierHot
+			if e.dirty {
+				infos[i].Size, infos[i].ModTime, infos[i].Metadata = e.size, e.modTime, e.meta
+			}
+			delete(resident, infos[i].ID)
+		}
+		infos[i].Metadata = infos[i].Metadata.Clone()
+		infos[i].Metadata[MetadataTier] = tier
+	}
+	added := false
+	for id, e := range resident {
+		if e.dirty {
+			meta := e.meta.Clone()
+			meta[MetadataTier] = TierHot
+			infos = append(infos, domain.ObjectInfo{Bucket: bucket, ID: id, Size: e.size, ModTime: e.modTime, Metadata: meta})
+			added = true
+		}
+	}
+	if added {
+		sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	}
+	return infos, nil
+}
@@ -0,0 +1,179 @@
+package tiering
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DanielePalaia/object-storage-service/domain"
+	"github.com/DanielePalaia/object-storage-service/persistence"
+)
+
+func newTestStorage(t *testing.T, config Config) (*Storage, *persistence.InMemoryStorage, *persistence.InMemoryStorage) {
+	t.Helper()
+	hot, cold := persistence.NewInMemoryStorage(), persistence.NewInMemoryStorage()
+	s, err := NewStorage(hot, cold, config)
+	if err != nil {
+		t.Fatalf("NewStorage failed: %v", err)
+	}
+	return s, hot, cold
+}
+
+func exists(s domain.Storage, bucket, objectID string) bool {
+	_, err := s.Get(bucket, objectID)
+	return err == nil
+}
+
+func TestStorage_WriteThroughAndLRU(t *testing.T) {
+	s, hot, cold := newTestStorage(t, Config{Hot: Capacity{Objects: 2}})
+
+	for _, key := range []string{"a", "b", "c"} {
+		if created, err := s.Put("bucket", key, []byte(key)); err != nil || !created {
+			t.Fatalf("Put failed: created %v, err %v", created, err)
+		}
+		if !exists(cold, "bucket", key) {
+			t.Fatalf("expected %s to be written through to the cold tier", key)
+		}
+	}
+	if exists(hot, "bucket", "a") || !exists(hot, "bucket", "b") || !exists(hot, "bucket", "c") {
+		t.Fatalf("expected the least recently used object to be demoted")
+	}
+
+	// Reading a demoted object promotes it, demoting the next least recently used
+	data, meta, err := s.GetWithMetadata("bucket", "a")
+	if err != nil || string(data) != "a" || meta[MetadataTier] != TierCold {
+		t.Fatalf("unexpected object %q %v (err %v)", data, meta, err)
+	}
+	if _, meta, _ := s.GetWithMetadata("bucket", "a"); meta[MetadataTier] != TierHot {
+		t.Errorf("expected the promoted object to be read from the hot tier, got %v", meta)
+	}
+	if !exists(hot, "bucket", "a") || exists(hot, "bucket", "b") {
+		t.Errorf("expected b to be demoted")
+	}
+
+	infos, err := s.ListObjects("bucket", "")
+	if err != nil || len(infos) != 3 || infos[0].Metadata[MetadataTier] != TierHot || infos[1].Metadata[MetadataTier] != TierCold {
+		t.Errorf("unexpected listing %+v (err %v)", infos, err)
+	}
+
+	if err := s.Delete("bucket", "a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if exists(hot, "bucket", "a") || exists(cold, "bucket", "a") {
+		t.Errorf("expected the object to be removed from both tiers")
+	}
+	if err := s.Delete("bucket", "a"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStorage_WriteBack(t *testing.T) {
+	s, hot, cold := newTestStorage(t, Config{Mode: WriteBack, Hot: Capacity{Bytes: 10}})
+
+	s.PutWithMetadata("bucket", "a", []byte("12345"), domain.Metadata{"tags": "x"})
+	if exists(cold, "bucket", "a") {
+		t.Fatalf("expected the object to be written back later")
+	}
+	infos, err := s.ListObjects("bucket", "")
+	if err != nil || len(infos) != 1 || infos[0].Size != 5 || infos[0].Metadata["tags"] != "x" {
+		t.Errorf("expected the dirty object to be listed, got %+v (err %v)", infos, err)
+	}
+	if buckets, _ := s.ListBuckets(); len(buckets) != 1 {
+		t.Errorf("expected the bucket of the dirty object to be listed, got %v", buckets)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if _, meta, err := domain.GetWithMetadata(cold, "bucket", "a"); err != nil || meta["tags"] != "x" {
+		t.Fatalf("expected the object to be flushed, got %v (err %v)", meta, err)
+	}
+
+	// Demoting a dirty object flushes it first
+	s.Put("bucket", "b", []byte("12345"))
+	s.Put("bucket", "c", []byte("12345"))
+	s.Put("bucket", "d", []byte("12345"))
+	if exists(hot, "bucket", "a") || exists(hot, "bucket", "b") || !exists(cold, "bucket", "b") || exists(cold, "bucket", "c") {
+		t.Errorf("expected b to be flushed when demoted")
+	}
+	if data, err := s.Get("bucket", "b"); err != nil || string(data) != "12345" {
+		t.Errorf("unexpected demoted object %q (err %v)", data, err)
+	}
+
+	// The metadata of objects not flushed yet is updated in the hot tier
+	if err := s.UpdateMetadata("bucket", "d", domain.Metadata{"status": "done"}); err != nil {
+		t.Fatalf("UpdateMetadata failed: %v", err)
+	}
+	if _, meta, err := domain.GetWithMetadata(hot, "bucket", "d"); err != nil || meta["status"] != "done" || exists(cold, "bucket", "d") {
+		t.Errorf("expected the metadata to be updated in the hot tier only, got %v (err %v)", meta, err)
+	}
+
+	// Objects never flushed are deleted from the hot tier only
+	if err := s.Delete("bucket", "c"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if _, err := s.Get("bucket", "c"); err != domain.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStorage_Policies(t *testing.T) {
+	s, hot, cold := newTestStorage(t, Config{Policy: PolicySize, Hot: Capacity{Bytes: 10}, MaxObjectSize: 8})
+	s.Put("bucket", "large", []byte("123456"))
+	s.Put("bucket", "small", []byte("12"))
+	s.Put("bucket", "medium", []byte("1234"))
+	if exists(hot, "bucket", "large") || !exists(hot, "bucket", "small") || !exists(hot, "bucket", "medium") {
+		t.Errorf("expected the largest object to be demoted")
+	}
+	s.Put("bucket", "huge", []byte("123456789"))
+	if exists(hot, "bucket", "huge") || !exists(cold, "bucket", "huge") {
+		t.Errorf("expected objects above the size threshold to bypass the hot tier")
+	}
+
+	s, hot, _ = newTestStorage(t, Config{Policy: PolicyAge, MaxAge: time.Minute})
+	s.Put("bucket", "old", []byte("1"))
+	s.Put("bucket", "new", []byte("1"))
+	s.mu.Lock()
+	s.entries[objectRef{"bucket", "old"}].admitted = time.Now().Add(-time.Hour)
+	s.mu.Unlock()
+	// Reads leave the age of objects unchanged
+	s.Get("bucket", "old")
+	s.demoteExpired(time.Now())
+	if exists(hot, "bucket", "old") || !exists(hot, "bucket", "new") {
+		t.Errorf("expected the objects past their age to be demoted")
+	}
+}
+
+func TestStorage_ColdCapacity(t *testing.T) {
+	cold := persistence.NewInMemoryStorage()
+	cold.Put("bucket", "existing", []byte("12345"))
+	s, err := NewStorage(persistence.NewInMemoryStorage(), cold, Config{Cold: Capacity{Bytes: 10}})
+	if err != nil {
+		t.Fatalf("NewStorage failed: %v", err)
+	}
+	if _, err := s.Put("bucket", "a", []byte("123456")); !errors.Is(err, ErrTierFull) {
+		t.Fatalf("expected ErrTierFull, got %v", err)
+	}
+	if _, err := s.Put("bucket", "a", []byte("12345")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// Deletes and overwrites free space
+	s.Delete("bucket", "existing")
+	if _, err := s.Put("bucket", "a", []byte("1234567890")); err != nil {
+		t.Errorf("Put failed: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if mode, err := ParseWriteMode(""); err != nil || mode != WriteThrough {
+		t.Errorf("unexpected default mode %q (err %v)", mode, err)
+	}
+	if _, err := ParseWriteMode("write-around"); err == nil {
+		t.Errorf("expected an unsupported mode to be rejected")
+	}
+	if policy, err := ParsePolicy(""); err != nil || policy != PolicyLRU {
+		t.Errorf("unexpected default policy %q (err %v)", policy, err)
+	}
+	if _, err := ParsePolicy("random"); err == nil {
+		t.Errorf("expected an unsupported policy to be rejected")
+	}
+}